@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+
+	"github.com/thecubed/prestowatcher/prestoclient"
+)
+
+/*
+	Acknowledging an alert, so the on-call can say "I've got this" and the query stops generating noise. With
+	--ack-secret and --ack-base-url every partition, resource, queued and full scan alert ends in a link like
+
+		https://prestowatcher.example.com/ack/20230102_101112_00042_abcde?token=...
+
+	The token is the hex HMAC-SHA256 of the query ID with --ack-secret, so only someone who got the alert can
+	make the link. Opening it marks the query acknowledged in its cache entry: no more escalations, resource
+	alerts or completion and failure follow-ups, and /status shows who acknowledged it. A ?by= note is kept as
+	the acknowledger, e.g. ?by=alice+on+it. The ack lives as long as the cache entry, it's gone with
+	--cache-ttl like everything else we remember about the query.
+
+	Slack fetches links in messages to unfurl them, so requests from its link expander are answered without
+	acknowledging anything.
+*/
+
+// The most of a ?by= note we keep
+const ACK_NOTE_MAX_LENGTH = 200
+
+// ackToken is the token in a query's acknowledge link
+func ackToken(queryID string) string {
+	return signBody(cfg.AckSecret, []byte(queryID))
+}
+
+// ackURL is the link acknowledging a query's alerts, empty when acknowledging is off
+func ackURL(queryID string) string {
+	if cfg.AckSecret == "" {
+		return ""
+	}
+	return fmt.Sprintf("%v/ack/%v?token=%v", cfg.AckBaseURL, neturl.PathEscape(queryID), ackToken(queryID))
+}
+
+// ackLine is the Slack line with the acknowledge link, empty when acknowledging is off
+func ackLine(queryID string) string {
+	link := ackURL(queryID)
+	if link == "" {
+		return ""
+	}
+	return fmt.Sprintf("<%v|Acknowledge this alert> to stop escalations and follow-ups on this query.\n", link)
+}
+
+func ackHandler(resp http.ResponseWriter, request *http.Request) {
+	resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if strings.Contains(request.UserAgent(), "Slackbot") {
+		// Unfurling the link must not acknowledge the alert
+		fmt.Fprintln(resp, "Open this link to acknowledge the alert.")
+		return
+	}
+	id := strings.TrimPrefix(request.URL.Path, "/ack/")
+	token := request.URL.Query().Get("token")
+	if id == "" || !hmac.Equal([]byte(token), []byte(ackToken(id))) {
+		http.Error(resp, "This acknowledge link isn't valid, copy the whole link from the alert.", http.StatusForbidden)
+		return
+	}
+	by := strings.TrimSpace(request.URL.Query().Get("by"))
+	if len(by) > ACK_NOTE_MAX_LENGTH {
+		by = by[:ACK_NOTE_MAX_LENGTH]
+	}
+	if by == "" {
+		by = "someone"
+	}
+
+	for _, c := range clusters {
+		entry, found := c.cache.Get(id)
+		if !found {
+			continue
+		}
+		if entry.Acknowledged {
+			fmt.Fprintf(resp, "Query %v was already acknowledged by %v at %v.\n", id, entry.AckedBy, entry.AckedAt.Format(time.RFC1123))
+			return
+		}
+		if detail, err := getQuery(request.Context(), c, id); err == prestoclient.ErrQueryGone {
+			http.Error(resp, fmt.Sprintf("Query %v is gone from Presto, there's nothing left to acknowledge.", id), http.StatusGone)
+			return
+		} else if err == nil && finalStates[detail[0].State] {
+			http.Error(resp, fmt.Sprintf("Query %v has already completed with state %v, there's nothing left to acknowledge.", id, detail[0].State), http.StatusGone)
+			return
+		}
+
+		entry.Acknowledged, entry.AckedBy, entry.AckedAt = true, by, time.Now()
+		entry.AwaitingOutcome = false
+		c.cache.Set(id, entry)
+		completions.forget(c, id)
+		status.acknowledged(id, by)
+		c.metrics.IncrCounter(metricKey("acknowledged_alerts"), 1.0)
+		log.Infof("%vQuery [%v] was acknowledged by [%v] from [%v]", c.prefix(), id, by, request.RemoteAddr)
+		fmt.Fprintf(resp, "Acknowledged query %v for %v. There will be no more escalations or follow-ups on it.\n", id, by)
+		return
+	}
+	http.Error(resp, fmt.Sprintf("Query %v isn't one we remember, its alert may be older than the cache keeps queries for.", id), http.StatusNotFound)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// ackRequest sends a request to ackHandler
+func ackRequest(target string, header http.Header) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("GET", target, nil)
+	for k, v := range header {
+		request.Header[k] = v
+	}
+	resp := httptest.NewRecorder()
+	ackHandler(resp, request)
+	return resp
+}
+
+func TestAckURL(t *testing.T) {
+	defer setupTest()()
+	if got := ackURL("q1"); got != "" {
+		t.Errorf("got ack link %v without --ack-secret", got)
+	}
+	cfg.AckSecret, cfg.AckBaseURL = "Jefe", "https://prestowatcher.example.com"
+	want := "https://prestowatcher.example.com/ack/what%20do%20ya%20want%20for%20nothing%3F?token=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+	if got := ackURL("what do ya want for nothing?"); got != want {
+		t.Errorf("got ack link %v, want %v", got, want)
+	}
+}
+
+func TestAck(t *testing.T) {
+	presto, c, notifier, restore := setupKillTest(testQuery("q1", "alice", "SELECT * FROM events.clicks", 45))
+	defer restore()
+	entry := &cachedQuery{}
+	if err := checkQuery(context.Background(), c, PrestoQuery{QueryID: "q1"}, entry); err != nil {
+		t.Fatal(err)
+	}
+	c.cache.Set("q1", *entry)
+
+	if resp := ackRequest("/ack/q1?token="+ackToken("q2"), nil); resp.Code != http.StatusForbidden {
+		t.Errorf("got %v for another query's token, want 403", resp.Code)
+	}
+	if resp := ackRequest("/ack/q1?token="+ackToken("q1"), http.Header{"User-Agent": {"Slackbot-LinkExpanding 1.0"}}); resp.Code != http.StatusOK {
+		t.Errorf("got %v unfurling the link", resp.Code)
+	}
+	if cached, _ := c.cache.Get("q1"); cached.Acknowledged {
+		t.Fatal("unfurling the link acknowledged the alert")
+	}
+
+	resp := ackRequest("/ack/q1?token="+ackToken("q1")+"&by=alice+on+it", nil)
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "Acknowledged query q1 for alice on it") {
+		t.Fatalf("got %v %q", resp.Code, resp.Body.String())
+	}
+	cached, _ := c.cache.Get("q1")
+	if !cached.Acknowledged || cached.AckedBy != "alice on it" || cached.AckedAt.IsZero() {
+		t.Errorf("unexpected cache entry %+v", cached)
+	}
+	if got := status.report().Flagged; len(got) != 1 || got[0].AcknowledgedBy != "alice on it" {
+		t.Errorf("got /status entries %+v, want the acknowledgement", got)
+	}
+	if resp := ackRequest("/ack/q1?token="+ackToken("q1")+"&by=bob", nil); !strings.Contains(resp.Body.String(), "already acknowledged by alice on it") {
+		t.Errorf("got %q acknowledging again", resp.Body.String())
+	}
+
+	// The query growing tenfold doesn't escalate once it's acknowledged
+	presto.add(testQuery("q1", "alice", "SELECT * FROM events.clicks", 450))
+	if err := checkQuery(context.Background(), c, PrestoQuery{QueryID: "q1"}, &cached); err != nil {
+		t.Fatal(err)
+	}
+	if len(notifier.sent()) != 1 {
+		t.Errorf("got %v alerts, want no escalation after the ack", len(notifier.sent()))
+	}
+}
+
+func TestAckGoneQueries(t *testing.T) {
+	finished := testQuery("finished", "alice", "SELECT * FROM events.clicks", 45)
+	finished.State = "FINISHED"
+	presto, c, _, restore := setupKillTest(finished)
+	defer restore()
+	c.cache.Set("finished", cachedQuery{})
+	c.cache.Set("gone", cachedQuery{})
+
+	for _, tc := range []struct {
+		id   string
+		code int
+		text string
+	}{
+		{"finished", http.StatusGone, "already completed with state FINISHED"},
+		{"gone", http.StatusGone, "gone from Presto"},
+		{"unknown", http.StatusNotFound, "isn't one we remember"},
+	} {
+		resp := ackRequest("/ack/"+tc.id+"?token="+ackToken(tc.id), nil)
+		if resp.Code != tc.code || !strings.Contains(resp.Body.String(), tc.text) {
+			t.Errorf("%v: got %v %q, want %v", tc.id, resp.Code, resp.Body.String(), tc.code)
+		}
+	}
+	if len(presto.killed) != 0 {
+		t.Errorf("acknowledging killed %v", presto.killed)
+	}
+}
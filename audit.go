@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/*
+	The audit log is a durable record of every alert decision for compliance, independent of Slack retention.
+	With --audit-log each decision that sent an alert, or would have if not for a suppression, opt-out or
+	filter, is appended to the file as one JSON object per line. Suppressed decisions are written once per
+	query, alerts every time one goes out.
+
+	Records are handed to a writer goroutine through a buffered channel so a slow disk never holds up a poll.
+	When the buffer is full the record is dropped and counted in presto.watcher.audit_dropped. The file is
+	reopened on SIGHUP and when it's been moved or deleted, so logrotate works with or without copytruncate.
+*/
+
+const (
+	AUDIT_BUFFER         = 1024
+	AUDIT_CHECK_INTERVAL = 10 * time.Second
+
+	AUDIT_ACTION_ALERTED    = "alerted"
+	AUDIT_ACTION_SUPPRESSED = "suppressed"
+	AUDIT_ACTION_DRY_RUN    = "dry-run"
+	AUDIT_ACTION_KILLED     = "killed"
+)
+
+type auditRecord struct {
+	Time          time.Time    `json:"time"`
+	QueryID       string       `json:"query_id"`
+	User          string       `json:"user"`
+	SQLHash       string       `json:"sql_sha256"`
+	QueryType     string       `json:"query_type,omitempty"`
+	Limit         int          `json:"limit,omitempty"`
+	Severity      string       `json:"severity,omitempty"`
+	KillThreshold int          `json:"kill_threshold,omitempty"`
+	Inputs        []auditInput `json:"inputs,omitempty"`
+	Action        string       `json:"action"`
+	Decision      string       `json:"decision"`
+}
+
+type auditInput struct {
+	Table      string `json:"table"`
+	Partitions int    `json:"partitions"`
+	Limit      int    `json:"limit"`
+}
+
+// auditAction maps a decision to what was actually done about it
+func auditAction(decision string) string {
+	switch {
+	case decision == DECISION_OPTOUT || decision == DECISION_IGNORED || decision == DECISION_SUPPRESSED:
+		return AUDIT_ACTION_SUPPRESSED
+	case decision == DECISION_DRY_RUN_KILL || cfg.DryRun:
+		return AUDIT_ACTION_DRY_RUN
+	case decision == DECISION_KILLED:
+		return AUDIT_ACTION_KILLED
+	}
+	return AUDIT_ACTION_ALERTED
+}
+
+func newAuditRecord(query PrestoQuery, d queryDecision, at time.Time) auditRecord {
+	sum := sha256.Sum256([]byte(query.Query))
+	r := auditRecord{
+		Time:          at.UTC(),
+		QueryID:       d.QueryID,
+		User:          d.User,
+		SQLHash:       hex.EncodeToString(sum[:]),
+		QueryType:     d.Type,
+		Limit:         d.Limit,
+		Severity:      d.Severity,
+		KillThreshold: cfg.KillThreshold,
+		Action:        auditAction(d.Decision),
+		Decision:      d.Decision,
+	}
+	for _, i := range d.Inputs {
+		r.Inputs = append(r.Inputs, auditInput{Table: i.Table, Partitions: i.Partitions, Limit: i.Limit})
+	}
+	return r
+}
+
+type auditLog struct {
+	path    string
+	records chan auditRecord
+	dropped int64
+	stop    chan struct{}
+	done    chan struct{}
+	// Only touched by the writer goroutine
+	file *os.File
+}
+
+// nil means disabled
+var audit *auditLog
+
+// startAudit opens --audit-log, if one was given, and starts its writer
+func startAudit() {
+	if cfg.AuditLog == "" {
+		return
+	}
+	a := &auditLog{
+		path:    cfg.AuditLog,
+		records: make(chan auditRecord, AUDIT_BUFFER),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := a.open(); err != nil {
+		log.Fatalf("Unable to open audit log [%v]: %v", a.path, err)
+	}
+	audit = a
+	go a.run()
+	log.Infof("Writing an audit record of every alert to [%v]", a.path)
+}
+
+// record queues a record for the writer, dropping it if the writer is that far behind
+func (a *auditLog) record(r auditRecord) {
+	if a == nil {
+		return
+	}
+	select {
+	case a.records <- r:
+	default:
+		a.drop(r, "the buffer is full")
+	}
+}
+
+func (a *auditLog) drop(r auditRecord, why string) {
+	n := atomic.AddInt64(&a.dropped, 1)
+	metricsSink.IncrCounter(metricKey("audit_dropped"), 1.0)
+	log.Errorf("Dropped audit record for query [%v], because %v ([%v] dropped so far)", r.QueryID, why, n)
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if a.file != nil {
+		a.file.Close()
+	}
+	a.file = f
+	return nil
+}
+
+// reopen switches to a fresh file at the path, keeping the old one on error
+func (a *auditLog) reopen(why string) {
+	if err := a.open(); err != nil {
+		log.Errorf("Unable to reopen audit log [%v] after %v: %v", a.path, why, err)
+		return
+	}
+	log.Infof("Reopened audit log [%v] after %v", a.path, why)
+}
+
+// moved tells whether the open file is no longer the one at the path
+func (a *auditLog) moved() bool {
+	onDisk, err := os.Stat(a.path)
+	if err != nil {
+		return true
+	}
+	open, err := a.file.Stat()
+	if err != nil {
+		return true
+	}
+	return !os.SameFile(onDisk, open)
+}
+
+func (a *auditLog) write(r auditRecord) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		a.drop(r, err.Error())
+		return
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		a.drop(r, err.Error())
+	}
+}
+
+func (a *auditLog) run() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(AUDIT_CHECK_INTERVAL)
+	defer ticker.Stop()
+	defer close(a.done)
+
+	for {
+		select {
+		case r := <-a.records:
+			a.write(r)
+		case <-hup:
+			a.reopen("SIGHUP")
+		case <-ticker.C:
+			if a.moved() {
+				a.reopen("it was moved")
+			}
+		case <-a.stop:
+			// Write out whatever is still buffered
+			for {
+				select {
+				case r := <-a.records:
+					a.write(r)
+				default:
+					a.file.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
+// close writes out the buffered records and closes the file, waiting at most the given time
+func (a *auditLog) close(wait time.Duration) {
+	if a == nil {
+		return
+	}
+	close(a.stop)
+	select {
+	case <-a.done:
+	case <-time.After(wait):
+		log.Warningf("Audit log [%v] still writing after [%v], not waiting for it", a.path, wait)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readAudit parses an audit log back into its records
+func readAudit(t *testing.T, path string) []auditRecord {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("line %q isn't an audit record: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	defer setupTest()()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	cfg.AuditLog = filepath.Join(dir, "audit.jsonl")
+	startAudit()
+	defer func() { audit = nil }()
+
+	optedOut := testQuery("opted-out", "bob", "-- sqlbandit:off\nSELECT * FROM events.clicks", 50)
+	c, _ := testCluster(newFakePresto(testQuery("bad", "alice", "SELECT * FROM events.clicks", 45), optedOut))
+	entries := map[string]*cachedQuery{"bad": {}, "opted-out": {}}
+	for _, id := range []string{"bad", "opted-out", "opted-out"} {
+		if err := checkQuery(context.Background(), c, PrestoQuery{QueryID: id}, entries[id]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	audit.close(time.Second)
+
+	records := readAudit(t, cfg.AuditLog)
+	// The opt-out is only written the first time
+	if len(records) != 2 {
+		t.Fatalf("got %v records, want 2: %+v", len(records), records)
+	}
+	alerted := records[0]
+	if alerted.QueryID != "bad" || alerted.User != "alice" || alerted.Action != AUDIT_ACTION_ALERTED || alerted.Limit != 30 || len(alerted.SQLHash) != 64 {
+		t.Errorf("unexpected alert record %+v", alerted)
+	}
+	if len(alerted.Inputs) != 1 || alerted.Inputs[0] != (auditInput{Table: "hive.events.clicks", Partitions: 45, Limit: 30}) {
+		t.Errorf("got inputs %+v", alerted.Inputs)
+	}
+	if alerted.Time.IsZero() || alerted.Time.Location() != time.UTC {
+		t.Errorf("got time %v", alerted.Time)
+	}
+	if r := records[1]; r.QueryID != "opted-out" || r.Action != AUDIT_ACTION_SUPPRESSED || r.Decision != DECISION_OPTOUT {
+		t.Errorf("unexpected opt-out record %+v", r)
+	}
+}
+
+func TestAuditLogReopen(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	a := &auditLog{path: filepath.Join(dir, "audit.jsonl")}
+	if err := a.open(); err != nil {
+		t.Fatal(err)
+	}
+	a.write(auditRecord{QueryID: "before"})
+	if a.moved() {
+		t.Fatal("a file that wasn't moved counts as moved")
+	}
+
+	// logrotate without copytruncate
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if !a.moved() {
+		t.Fatal("the rotated file wasn't noticed")
+	}
+	a.reopen("it was moved")
+	a.write(auditRecord{QueryID: "after"})
+	a.file.Close()
+
+	if r := readAudit(t, a.path+".1"); len(r) != 1 || r[0].QueryID != "before" {
+		t.Errorf("got %+v in the rotated file", r)
+	}
+	if r := readAudit(t, a.path); len(r) != 1 || r[0].QueryID != "after" {
+		t.Errorf("got %+v in the new file", r)
+	}
+}
+
+func TestAuditLogDropsWhenFull(t *testing.T) {
+	defer setupTest()()
+	// No writer is running, so the buffer fills up
+	a := &auditLog{path: "unused", records: make(chan auditRecord, 2)}
+	for i := 0; i < 5; i++ {
+		a.record(auditRecord{QueryID: "q"})
+	}
+	if a.dropped != 3 || len(a.records) != 2 {
+		t.Errorf("got %v dropped and %v buffered, want 3 and 2", a.dropped, len(a.records))
+	}
+	if got := metricsSink.MetricSink.(*recordingSink).count("audit_dropped"); got != 3 {
+		t.Errorf("got %v audit_dropped, want 3", got)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bluele/gcache"
+)
+
+/*
+	The cache of queries we've already seen, so we don't spam Slack. By default it only lives in memory. With
+	--cache-file it is also written to disk after every poll and on shutdown, and read back on boot, so a
+	restart doesn't re-alert on every long-running query. Restored entries keep the expiry they had, they don't
+	get a fresh --cache-ttl.
+
+	The size, TTL and eviction policy are --cache-size, --cache-ttl and --cache-policy. Evictions, which gcache
+	also reports for expired entries, are counted in cache_evictions, and the lookups of running queries in
+	cache_hits and cache_misses, so an undersized cache shows up as evictions and misses climbing together.
+*/
+
+type queryCacheStore interface {
+	Get(queryID string) (cachedQuery, bool)
+	Set(queryID string, entry cachedQuery)
+	// Save persists the cache, if it's persistent at all
+	Save() error
+	// Len is the number of unexpired entries
+	Len() int
+}
+
+func newGcache() gcache.Cache {
+	return gcache.New(cfg.CacheSize).
+		EvictType(cfg.CachePolicy).
+		Expiration(cfg.CacheTTL).
+		EvictedFunc(func(key, value interface{}) {
+			log.Debugf("Evicted query [%+v] from cache", key)
+			metricsSink.IncrCounter(metricKey("cache_evictions"), 1.0)
+		}).
+		Build()
+}
+
+// memoryQueryCache is the default, in-memory only cache
+type memoryQueryCache struct {
+	c gcache.Cache
+}
+
+func (m *memoryQueryCache) Get(queryID string) (cachedQuery, bool) {
+	t, err := m.c.GetIFPresent(queryID)
+	if err != nil {
+		return cachedQuery{}, false
+	}
+	return t.(cachedQuery), true
+}
+
+func (m *memoryQueryCache) Set(queryID string, entry cachedQuery) {
+	m.c.Set(queryID, entry)
+}
+
+func (m *memoryQueryCache) Len() int {
+	return m.c.Len(true)
+}
+
+func (m *memoryQueryCache) Save() error {
+	return nil
+}
+
+// One entry in the cache file
+type persistedQuery struct {
+	QueryID string      `json:"query_id"`
+	Expires time.Time   `json:"expires"`
+	Entry   cachedQuery `json:"entry"`
+}
+
+// fileQueryCache keeps the in-memory cache and mirrors it to a JSON file
+type fileQueryCache struct {
+	memoryQueryCache
+	path string
+
+	sync.Mutex
+	// gcache doesn't tell us when entries expire, so we keep track
+	expires map[string]time.Time
+}
+
+func newFileQueryCache(path string) (*fileQueryCache, error) {
+	fc := &fileQueryCache{memoryQueryCache: memoryQueryCache{c: newGcache()}, path: path, expires: make(map[string]time.Time)}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return fc, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var persisted []persistedQuery
+	if err := json.NewDecoder(f).Decode(&persisted); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var restored int
+	for _, p := range persisted {
+		left := p.Expires.Sub(now)
+		if left <= 0 {
+			continue
+		}
+		fc.c.SetWithExpire(p.QueryID, p.Entry, left)
+		fc.expires[p.QueryID] = p.Expires
+		restored++
+	}
+	log.Infof("Restored [%v] of [%v] cached queries from [%v]", restored, len(persisted), path)
+	return fc, nil
+}
+
+func (fc *fileQueryCache) Set(queryID string, entry cachedQuery) {
+	fc.memoryQueryCache.Set(queryID, entry)
+	fc.Lock()
+	fc.expires[queryID] = time.Now().Add(cfg.CacheTTL)
+	fc.Unlock()
+}
+
+// Save writes the entries that are still cached to the cache file, replacing it atomically
+func (fc *fileQueryCache) Save() error {
+	fc.Lock()
+	defer fc.Unlock()
+
+	now := time.Now()
+	var persisted []persistedQuery
+	for id, expires := range fc.expires {
+		entry, ok := fc.Get(id)
+		if !ok || !expires.After(now) {
+			// Evicted or expired, forget about it
+			delete(fc.expires, id)
+			continue
+		}
+		persisted = append(persisted, persistedQuery{QueryID: id, Expires: expires, Entry: entry})
+	}
+
+	tmp := fc.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(persisted); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fc.path)
+}
+
+// startQueryCache sets up a query cache, restoring it from path if one was given
+func startQueryCache(path string) queryCacheStore {
+	if path == "" {
+		return &memoryQueryCache{c: newGcache()}
+	}
+	fc, err := newFileQueryCache(path)
+	if err != nil {
+		log.Fatalf("Unable to read query cache file [%v]: %v", path, err)
+	}
+	return fc
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/thecubed/prestowatcher/config"
+)
+
+/*
+	One process can watch several Presto clusters, one per --url given as name=url. Every cluster gets its own
+	polling loop, client, query cache and poll bookkeeping, so a slow or unreachable coordinator doesn't hold up
+	the others. Its metrics carry a cluster label and its Slack alerts start with the cluster name.
+
+	With a single unnamed --url, the default, nothing changes: no label, no prefix and the same cache file.
+	Alert thresholds, filters and notifiers are shared by all clusters.
+*/
+
+type cluster struct {
+	// Empty for the single, unnamed cluster
+	name   string
+	url    string
+	client prestoAPI
+	// FLAVOR_PRESTO or FLAVOR_TRINO, decides what the UI links look like
+	flavor string
+	// Where the cluster's alerts go, every configured notifier
+	notifier Notifier
+	// Queries we've seen before, so we don't spam Slack, and the file they're kept in if any
+	cache     queryCacheStore
+	cacheFile string
+	// Metrics sink that labels everything with the cluster
+	metrics metrics.MetricSink
+
+	// When we last polled the cluster successfully, only accessed atomically
+	lastUpdate int64
+	// Failed polls in a row, reset by a successful one, only accessed atomically
+	consecutiveFailures int64
+	// Queries over a limit in the current poll, only accessed atomically
+	flaggedThisCycle int64
+	// When each user was last alerted on for their combined load, only touched by the cluster's collector
+	userAlertedAt map[string]time.Time
+	// Whether the first poll after startup has gone through, only touched by the cluster's collector
+	warmedUp bool
+}
+
+var clusters []*cluster
+
+// startClusters sets up a client and cache for every --url, alerting through notifier
+func startClusters(notifier Notifier) {
+	for _, cc := range cfg.Clusters {
+		client := newPrestoClient(cc)
+		c := &cluster{
+			name:          cc.Name,
+			url:           cc.URL,
+			client:        client,
+			flavor:        client.Flavor,
+			notifier:      notifier,
+			cacheFile:     clusterCacheFile(cc),
+			userAlertedAt: make(map[string]time.Time),
+		}
+		c.cache = startQueryCache(c.cacheFile)
+		c.metrics = &clusterSink{cluster: c.name}
+		clusters = append(clusters, c)
+		if c.name != "" {
+			log.Infof("Watching cluster [%v] at [%v]", c.name, c.url)
+		}
+	}
+	log.Infof("Caching up to [%v] queries per cluster for [%v] with the [%v] eviction policy", cfg.CacheSize, cfg.CacheTTL, cfg.CachePolicy)
+}
+
+// clusterCacheFile is where a cluster's cache is kept, every named cluster gets its own file next to --cache-file
+func clusterCacheFile(cc config.Cluster) string {
+	if cfg.CacheFile == "" || cc.Name == "" {
+		return cfg.CacheFile
+	}
+	return cfg.CacheFile + "." + cc.Name
+}
+
+// prefix goes in front of the cluster's log lines and Slack alerts, empty for the unnamed cluster
+func (c *cluster) prefix() string {
+	if c == nil || c.name == "" {
+		return ""
+	}
+	return fmt.Sprintf("[%v] ", c.name)
+}
+
+// displayName is the cluster's name, empty for the unnamed cluster
+func (c *cluster) displayName() string {
+	if c == nil {
+		return ""
+	}
+	return c.name
+}
+
+// startCollectors starts polling every cluster. stop stops them all at once, waiting at most grace for the polls in
+// flight, and reports whether they all finished.
+func startCollectors() (stop func(grace time.Duration) bool) {
+	var stops []func(time.Duration) bool
+	for _, c := range clusters {
+		stops = append(stops, startCollector(c))
+	}
+	return func(grace time.Duration) bool {
+		finished := make(chan bool, len(stops))
+		for _, s := range stops {
+			go func(s func(time.Duration) bool) { finished <- s(grace) }(s)
+		}
+		all := true
+		for range stops {
+			all = <-finished && all
+		}
+		return all
+	}
+}
+
+// saveCaches writes every cluster's cache to its file, if it has one
+func saveCaches() {
+	for _, c := range clusters {
+		if err := c.cache.Save(); err != nil {
+			log.Errorf("Unable to save query cache [%v]: %v", c.cacheFile, err)
+		}
+	}
+}
+
+// pollFinished records the outcome of a poll
+func (c *cluster) pollFinished(ok bool) {
+	recordPoll(c, ok)
+	if ok {
+		atomic.StoreInt64(&c.lastUpdate, time.Now().Unix())
+		atomic.StoreInt64(&c.consecutiveFailures, 0)
+	} else {
+		atomic.AddInt64(&c.consecutiveFailures, 1)
+	}
+}
+
+// secondsSinceLastPoll is how long ago the last successful poll finished
+func (c *cluster) secondsSinceLastPoll() int64 {
+	return time.Now().Unix() - atomic.LoadInt64(&c.lastUpdate)
+}
+
+// clusterSink adds the cluster label to every metric on its way to the metrics sink. It looks the sink up on
+// every call, since clusters are set up before startMetrics.
+type clusterSink struct {
+	cluster string
+}
+
+func (s *clusterSink) labels(labels []metrics.Label) []metrics.Label {
+	if s.cluster == "" {
+		return labels
+	}
+	return append(append([]metrics.Label(nil), labels...), metrics.Label{Name: "cluster", Value: s.cluster})
+}
+
+func (s *clusterSink) SetGauge(key []string, val float32) {
+	s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *clusterSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	metricsSink.SetGaugeWithLabels(key, val, s.labels(labels))
+}
+
+func (s *clusterSink) EmitKey(key []string, val float32) {
+	metricsSink.EmitKey(key, val)
+}
+
+func (s *clusterSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *clusterSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	metricsSink.IncrCounterWithLabels(key, val, s.labels(labels))
+}
+
+func (s *clusterSink) AddSample(key []string, val float32) {
+	s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *clusterSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	metricsSink.AddSampleWithLabels(key, val, s.labels(labels))
+}
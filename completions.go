@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/thecubed/prestowatcher/prestoclient"
+)
+
+/*
+	Follow-ups for alerted queries. Every query we alert on is remembered with its alert, and once it no longer
+	shows up as running we fetch it by ID. When it has FINISHED, FAILED or was CANCELED a short follow-up with the
+	final state, elapsed time, bytes and partitions goes out, routed like the original alert, and the query is
+	forgotten so it's only reported once. Queries Presto has already forgotten are dropped without a follow-up.
+
+	With --slack-token the follow-up is a reply in the original alert's thread; incoming webhooks can't reply in a
+	thread, so there it's a normal message naming the query. The list only lives in memory, queries alerted on
+	before a restart get no follow-up.
+*/
+
+var finalStates = map[string]bool{
+	"FINISHED": true,
+	"FAILED":   true,
+	"CANCELED": true,
+}
+
+type completionTracker struct {
+	sync.Mutex
+	// The latest alert sent for each query, by completionKey
+	alerts map[string]Alert
+}
+
+// completionKey tells apart queries on different clusters
+func completionKey(c *cluster, queryID string) string {
+	return c.displayName() + "/" + queryID
+}
+
+var completions = &completionTracker{alerts: make(map[string]Alert)}
+
+// track remembers an alerted query until it completes
+func (c *completionTracker) track(alert Alert) {
+	c.Lock()
+	defer c.Unlock()
+	c.alerts[completionKey(alert.Cluster, alert.Query.QueryID)] = alert
+}
+
+// check looks up the alerted queries on a cluster that aren't running anymore and sends follow-ups for the ones
+// that are done
+func (c *completionTracker) check(ctx context.Context, cl *cluster, running map[string]bool) {
+	c.Lock()
+	var pending []Alert
+	for _, alert := range c.alerts {
+		if alert.Cluster == cl && !running[alert.Query.QueryID] {
+			pending = append(pending, alert)
+		}
+	}
+	c.Unlock()
+
+	for _, alert := range pending {
+		id := alert.Query.QueryID
+		found, err := getQuery(ctx, cl, id)
+		if err == prestoclient.ErrQueryGone {
+			log.Debugf("%vAlerted query [%v] is gone from Presto, no follow-up", cl.prefix(), id)
+			c.forget(cl, id)
+			continue
+		} else if err != nil {
+			log.Errorf("%vUnable to check whether alerted query [%v] has completed: %v", cl.prefix(), id, err)
+			continue
+		}
+		final := found[0]
+		if !finalStates[final.State] {
+			continue
+		}
+		if final.State == "FAILED" && cfg.WatchFailures {
+			// checkOutcomes follows up with why it failed
+			c.forget(cl, id)
+			continue
+		}
+
+		log.Infof("%vAlerted query [%v] by user [%v] has completed with state [%v]", cl.prefix(), id, final.Session.User, final.State)
+		followUp := Alert{Cluster: cl, Query: final, BadInputs: alert.BadInputs, FullScans: alert.FullScans, FinalState: final.State, Thread: alert.Thread}
+		followUp.ScannedBytes, followUp.Runtime = queryResources(final)
+		notify(ctx, followUp)
+		c.forget(cl, id)
+	}
+}
+
+func (c *completionTracker) forget(cl *cluster, queryID string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.alerts, completionKey(cl, queryID))
+}
+
+// finalPartitions is the number of partitions a completed query read on the connectors we check
+func finalPartitions(query PrestoQuery) int {
+	var total int
+	for _, i := range mergeInputs(query.Inputs) {
+		if cfg.Connectors[i.ConnectorID] {
+			total += len(i.ConnectorInfo.PartitionIds)
+		}
+	}
+	return total
+}
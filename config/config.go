@@ -0,0 +1,941 @@
+// Package config turns command line arguments and environment variables into a validated Config.
+//
+// All parsing, precedence resolution (flag > env > file > default), validation and normalization happens in
+// Load, so there is exactly one place that decides what a setting means. Reloading the config file goes through
+// the same parsing with the file as the only source.
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	NOTIFIER_SLACK     = "slack"
+	NOTIFIER_WEBHOOK   = "webhook"
+	NOTIFIER_PAGERDUTY = "pagerduty"
+
+	METRICS_DOGSTATSD  = "dogstatsd"
+	METRICS_STATSD     = "statsd"
+	METRICS_PROMETHEUS = "prometheus"
+	METRICS_NONE       = "none"
+
+	// What the plain StatsD sink does with metric labels
+	STATSD_LABELS_FOLD = "fold"
+	STATSD_LABELS_DROP = "drop"
+
+	LOCK_BACKEND_NONE  = "none"
+	LOCK_BACKEND_REDIS = "redis"
+
+	CACHE_POLICY_LFU = "lfu"
+	CACHE_POLICY_LRU = "lru"
+	CACHE_POLICY_ARC = "arc"
+
+	FLAVOR_PRESTO = "presto"
+	FLAVOR_TRINO  = "trino"
+	FLAVOR_AUTO   = "auto"
+
+	// Where alert decision events are published
+	EVENTS_NONE  = "none"
+	EVENTS_HTTP  = "http"
+	EVENTS_KAFKA = "kafka"
+
+	// Severity tiers of a partition alert, by how far the worst input is over its limit
+	SEVERITY_WARNING   = "warning"
+	SEVERITY_CRITICAL  = "critical"
+	SEVERITY_EMERGENCY = "emergency"
+
+	COMMAND_REPLAY_DECISION = "replay-decision"
+	COMMAND_IMPORT          = "import"
+)
+
+// Options are the raw command line options
+type Options struct {
+	Verbose                  bool          `short:"v" long:"verbose" description:"Enable DEBUG logging"`
+	DoVersion                bool          `short:"V" long:"version" description:"Print version and exit"`
+	DryRun                   bool          `long:"dry-run" description:"Log alerts instead of sending them and never kill queries, for tuning thresholds" env:"DRY_RUN"`
+	SkipSelfTest             bool          `long:"skip-selftest" description:"Don't check that Presto and the notifier URLs work before starting" env:"SKIP_SELFTEST"`
+	SelfTestSlack            bool          `long:"selftest-slack" description:"Post a short startup message to Slack as part of the self-test" env:"SELFTEST_SLACK"`
+	ConfigFile               string        `long:"config" description:"YAML file setting options by their long name, env vars and flags take precedence" default:"" env:"CONFIG_FILE"`
+	PrestoURLs               []string      `short:"u" long:"url" description:"presto URL (including scheme and port), or name=url to watch several clusters. May be given multiple times" env:"PRESTO_URL" env-delim:","`
+	Flavor                   string        `long:"flavor" description:"Coordinator flavor: presto, trino, or auto to ask the coordinator" default:"presto" env:"PRESTO_FLAVOR"`
+	PrestoTimeout            time.Duration `long:"presto-timeout" description:"Timeout for requests to Presto" default:"10s" env:"PRESTO_TIMEOUT"`
+	PrestoUser               string        `long:"presto-user" description:"User sent to Presto in X-Presto-User and for basic auth" default:"" env:"PRESTO_USER"`
+	PrestoPassword           string        `long:"presto-password" description:"Password for basic auth to Presto (prefer the env var)" default:"" env:"PRESTO_PASSWORD"`
+	PrestoToken              string        `long:"presto-token" description:"Bearer token for Presto (prefer the env var)" default:"" env:"PRESTO_TOKEN"`
+	PrestoCACert             string        `long:"presto-ca-cert" description:"PEM file with the CA certificates to trust for Presto" default:"" env:"PRESTO_CA_CERT"`
+	PrestoInsecureSkipVerify bool          `long:"presto-insecure-skip-verify" description:"Don't verify the Presto TLS certificate" env:"PRESTO_INSECURE_SKIP_VERIFY"`
+	PrestoConnector          string        `short:"c" long:"connector" description:"presto connector names for partitioned tables (comma separated)" default:"hive" env:"PRESTO_CONNECTOR"`
+	MaxPartitions            int           `short:"m" long:"maxpart" description:"Alert when Presto queries scan more than X partitions" default:"30" env:"MAX_PARTITIONS"`
+	MaxWritePartitions       int           `long:"maxpart-write" description:"Alert when Presto write queries (INSERT, CTAS) scan more than X partitions" default:"90" env:"MAX_WRITE_PARTITIONS"`
+	UpdateInterval           Interval      `short:"i" long:"interval" description:"How often to poll Presto, e.g. 20s or 1m (a bare number is seconds)" default:"20s" env:"UPDATE_INTERVAL"`
+	UIURLs                   []string      `long:"ui-url" description:"Presto UI base URL for alert links as label=url, may be given multiple times (defaults to the presto URL)" env:"UI_URLS" env-delim:","`
+	UIPreferred              string        `long:"ui-preferred" description:"Label of the --ui-url to use as the main link, others are shown as alternates" default:"" env:"UI_PREFERRED"`
+	DisplayTimezone          string        `long:"display-timezone" description:"Timezone used for hour-of-day reporting" default:"UTC" env:"DISPLAY_TIMEZONE"`
+	HistoryFile              string        `long:"history-file" description:"History file (JSON lines, as written by import) to add every day's hour-of-day histograms to" default:"" env:"HISTORY_FILE"`
+	MaxBytesScanned          string        `long:"max-bytes-scanned" description:"Alert when Presto queries scan more than this much data, e.g. 500GB (empty disables)" default:"" env:"MAX_BYTES_SCANNED"`
+	MaxSplits                int64         `long:"max-splits" description:"Alert when Presto queries process more than X splits (0 disables)" default:"0" env:"MAX_SPLITS"`
+	MaxInputSize             string        `long:"max-input-size" description:"Alert when Presto queries read more than this much physical input, e.g. 500GB (empty disables)" default:"" env:"MAX_INPUT_SIZE"`
+	MaxRuntime               time.Duration `long:"max-runtime" description:"Alert when Presto queries run longer than this, e.g. 2h (0 disables)" default:"0" env:"MAX_RUNTIME"`
+	MaxQueueTime             time.Duration `long:"max-queue-time" description:"Alert when Presto queries have been queued longer than this, e.g. 20m (0 disables)" default:"0" env:"MAX_QUEUE_TIME"`
+	MaxUserPartitions        int           `long:"max-user-partitions" description:"Alert when one user's RUNNING queries scan more than X partitions together (0 disables)" default:"0" env:"MAX_USER_PARTITIONS"`
+	MaxUserQueries           int           `long:"max-user-queries" description:"Alert when one user has more than X queries RUNNING at once (0 disables)" default:"0" env:"MAX_USER_QUERIES"`
+	MaxUserBytesScanned      string        `long:"max-user-bytes-scanned" description:"Alert when one user's RUNNING queries scan more than this much data together, e.g. 2TB (empty disables)" default:"" env:"MAX_USER_BYTES_SCANNED"`
+	UserAlertCooldown        Interval      `long:"user-alert-cooldown" description:"Alert on the same user's combined load at most this often (a bare number is seconds)" default:"30m" env:"USER_ALERT_COOLDOWN"`
+	OptOutTag                string        `long:"optout-tag" description:"Queries containing this tag don't get alerted on" default:"sqlbandit:off" env:"OPTOUT_TAG"`
+	OptOutMaxPartitions      int           `long:"optout-max-partitions" description:"Ignore the opt-out tag for queries over X partitions (0 never ignores it)" default:"0" env:"OPTOUT_MAX_PARTITIONS"`
+	KillThreshold            int           `long:"kill-threshold" description:"Kill Presto queries that scan more than X partitions (0 disables killing)" default:"0" env:"KILL_THRESHOLD"`
+	NoKillTag                string        `long:"nokill-tag" description:"Queries containing this tag aren't killed by --kill-threshold" default:"sqlbandit:nokill" env:"NOKILL_TAG"`
+	RulesFile                string        `long:"rules-file" description:"YAML or JSON file with per-table partition limits" default:"" env:"RULES_FILE"`
+	PartitionedTablesFile    string        `long:"partitioned-tables-file" description:"File listing partitioned tables as schema.table, one per line, to alert on queries that don't filter their partitions at all" default:"" env:"PARTITIONED_TABLES_FILE"`
+	UserMapFile              string        `long:"user-map-file" description:"YAML or JSON file mapping Presto and Mode users to Slack users to @mention" default:"" env:"USER_MAP_FILE"`
+	RulesReloadInterval      Interval      `long:"rules-reload-interval" description:"How often to check the rules and user map files for changes (a bare number is seconds)" default:"1m" env:"RULES_RELOAD_INTERVAL"`
+	StartupGrace             Interval      `long:"startup-grace" description:"On the first poll after startup, remember running queries older than this without checking them, the previous instance already did (0 checks them all)" default:"0" env:"STARTUP_GRACE"`
+	RecheckInterval          Interval      `long:"recheck-interval" description:"Re-check still running queries after this long (a bare number is seconds)" default:"1m" env:"RECHECK_INTERVAL"`
+	WatchFailures            bool          `long:"watch-failures" description:"Also poll recently failed queries and follow up on the flagged ones with why they failed" env:"WATCH_FAILURES"`
+	FailureWatchTimeout      Interval      `long:"failure-watch-timeout" description:"Stop waiting for the outcome of a flagged query after this long (a bare number is seconds)" default:"6h" env:"FAILURE_WATCH_TIMEOUT"`
+	Notifiers                []string      `long:"notifier" description:"Where to send alerts: slack, webhook or pagerduty. May be given multiple times" default:"slack" env:"NOTIFIERS" env-delim:","`
+	SlackURL                 string        `short:"s" long:"slack" description:"Slack Webhook URL" default:"" env:"SLACK_URL"`
+	SlackToken               string        `long:"slack-token" description:"Slack bot token, posts with chat.postMessage to --slack-channel instead of the webhook and threads follow-ups (prefer the env var)" default:"" env:"SLACK_TOKEN"`
+	DigestInterval           Interval      `long:"digest-interval" description:"Batch Slack alerts into one summary message this often, e.g. 5m (0 sends them right away)" default:"0" env:"DIGEST_INTERVAL"`
+	SlackTemplate            string        `long:"slack-template" description:"Go text/template for the Slack alert text, replaces the built-in message" default:"" env:"SLACK_TEMPLATE"`
+	SlackTemplateFile        string        `long:"slack-template-file" description:"File with a Go text/template for the Slack alert text" default:"" env:"SLACK_TEMPLATE_FILE"`
+	SlackUsername            string        `long:"slack-username" description:"Name the Slack alerts are posted as" default:"SQLBandit" env:"SLACK_USERNAME"`
+	SlackIconEmoji           string        `long:"slack-icon-emoji" description:"Icon emoji for the Slack alerts, e.g. :rotating_light:" default:"" env:"SLACK_ICON_EMOJI"`
+	SlackRoutesFile          string        `long:"slack-routes-file" description:"YAML or JSON file routing Slack alerts to webhooks or channels by schema or schema.table" default:"" env:"SLACK_ROUTES_FILE"`
+	SlackChannel             string        `long:"slack-channel" description:"Post Slack alerts to this channel instead of the webhook's default" default:"" env:"SLACK_CHANNEL"`
+	SlackMaxTables           int           `long:"slack-max-tables" description:"Show at most this many tables in a Slack alert, worst first, and sum up the rest" default:"10" env:"SLACK_MAX_TABLES"`
+	QueryTextLength          int           `long:"query-text-length" description:"Show at most this many characters of the query's SQL in Slack alerts" default:"500" env:"QUERY_TEXT_LENGTH"`
+	QueryTextCompact         bool          `long:"query-text-compact" description:"Drop comment lines and collapse whitespace in the SQL shown in Slack alerts" env:"QUERY_TEXT_COMPACT"`
+	NoQueryText              bool          `long:"no-query-text" description:"Don't show the query's SQL in Slack alerts, e.g. when it can hold sensitive literals" env:"NO_QUERY_TEXT"`
+	RepeatOffenderCount      int           `long:"repeat-offender-count" description:"Mark alerts as repeat offenders from the Xth alert for the same user and query within the window (0 disables)" default:"0" env:"REPEAT_OFFENDER_COUNT"`
+	RepeatOffenderWindow     Interval      `long:"repeat-offender-window" description:"Window repeat offender alerts are counted in" default:"336h" env:"REPEAT_OFFENDER_WINDOW"`
+	RepeatOffenderWebhook    string        `long:"repeat-offender-webhook" description:"Slack webhook to send repeat offender alerts to instead of the usual channels" default:"" env:"REPEAT_OFFENDER_WEBHOOK"`
+	CriticalMultiplier       float64       `long:"critical-multiplier" description:"Partition alerts are critical from this many times the limit (the rules file can override it)" default:"5" env:"CRITICAL_MULTIPLIER"`
+	EmergencyMultiplier      float64       `long:"emergency-multiplier" description:"Partition alerts are emergencies from this many times the limit (the rules file can override it)" default:"20" env:"EMERGENCY_MULTIPLIER"`
+	MentionSeverity          string        `long:"mention-severity" description:"Only @mention the user on alerts of this severity or worse: warning, critical or emergency" default:"warning" env:"MENTION_SEVERITY"`
+	CriticalWebhook          string        `long:"critical-webhook" description:"Slack webhook to send critical alerts to instead of the usual channels" default:"" env:"CRITICAL_WEBHOOK"`
+	EmergencyWebhook         string        `long:"emergency-webhook" description:"Slack webhook to send emergency alerts to instead of the usual channels" default:"" env:"EMERGENCY_WEBHOOK"`
+	RepeatOffenderFile       string        `long:"repeat-offender-file" description:"File to keep the repeat offender counts in across restarts" default:"" env:"REPEAT_OFFENDER_FILE"`
+	WebhookURL               string        `long:"webhook-url" description:"URL the webhook notifier POSTs alerts to as JSON" default:"" env:"WEBHOOK_URL"`
+	PagerDutyRoutingKey      string        `long:"pagerduty-routing-key" description:"PagerDuty Events v2 routing key for the pagerduty notifier" default:"" env:"PAGERDUTY_ROUTING_KEY"`
+	PagerDutyURL             string        `long:"pagerduty-url" description:"PagerDuty Events v2 API URL" default:"https://events.pagerduty.com/v2/enqueue" env:"PAGERDUTY_URL"`
+	NotifyHeaders            []string      `long:"notify-header" description:"Header to add to alert requests to the Slack and alert webhook URLs, as \"Name: Value\". May be given multiple times" env:"NOTIFY_HEADERS" env-delim:"\n"`
+	NotifyHMACSecret         string        `long:"notify-hmac-secret" description:"Sign every outgoing alert request body with HMAC-SHA256 in the X-Prestowatcher-Signature header (prefer the env var)" default:"" env:"NOTIFY_HMAC_SECRET"`
+	PagerDutyMinPartitions   int           `long:"pagerduty-min-partitions" description:"Only page for alerts of at least X partitions in total" default:"0" env:"PAGERDUTY_MIN_PARTITIONS"`
+	Concurrency              int           `long:"concurrency" description:"Number of running queries to check in parallel" default:"5" env:"CONCURRENCY"`
+	RetryAttempts            int           `long:"retry-attempts" description:"Tries for each Presto request and Slack message, retrying network errors, 429s and 5xxs with backoff" default:"3" env:"RETRY_ATTEMPTS"`
+	ReadyMaxFailures         int           `long:"ready-max-failures" description:"Report not ready on /readyz after this many failed polls in a row" default:"3" env:"READY_MAX_FAILURES"`
+	MaxStaleClusters         int           `long:"max-stale-clusters" description:"With several --url, only report unhealthy when more than X clusters are stale" default:"0" env:"MAX_STALE_CLUSTERS"`
+	StatusSize               int           `long:"status-size" description:"Number of recently flagged queries to show on /status" default:"50" env:"STATUS_SIZE"`
+	LockBackend              string        `long:"lock-backend" description:"Leader election backend for running several replicas: none or redis" default:"none" env:"LOCK_BACKEND"`
+	LockRedisAddr            string        `long:"lock-redis-addr" description:"Redis ( host:port ) for --lock-backend=redis" default:"127.0.0.1:6379" env:"LOCK_REDIS_ADDR"`
+	LockRedisPassword        string        `long:"lock-redis-password" description:"Redis password (prefer the env var)" default:"" env:"LOCK_REDIS_PASSWORD"`
+	LockKey                  string        `long:"lock-key" description:"Redis key of the leader lock" default:"prestowatcher-leader" env:"LOCK_KEY"`
+	LockTTL                  time.Duration `long:"lock-ttl" description:"How long the leader lock lasts without being renewed, must be longer than --interval" default:"1m" env:"LOCK_TTL"`
+	ShutdownGrace            time.Duration `long:"shutdown-grace" description:"How long to wait for an in-flight poll and HTTP requests on SIGTERM" default:"20s" env:"SHUTDOWN_GRACE"`
+	DebugHTTP                bool          `long:"debug-http" description:"Serve pprof at /debug/pprof/ and internal counters at /debug/vars on the health check port" env:"DEBUG_HTTP"`
+	AckSecret                string        `long:"ack-secret" description:"Secret the acknowledge links in alerts are signed with, the links are off when unset (prefer the env var)" default:"" env:"ACK_SECRET"`
+	AckBaseURL               string        `long:"ack-base-url" description:"Base URL of the health check server as Slack users reach it, for acknowledge links, e.g. https://prestowatcher.example.com" default:"" env:"ACK_BASE_URL"`
+	KillLinks                bool          `long:"kill-links" description:"Add a link killing the query to partition alerts, signed with --ack-secret. Protected queries are still never killed" env:"KILL_LINKS"`
+	AdminSecret              string        `long:"admin-secret" description:"Shared secret for the admin API (X-Admin-Secret header), the API is off when unset" default:"" env:"ADMIN_SECRET"`
+	HealthHTTPPort           int           `short:"p" long:"port" description:"Health check HTTP server port" default:"8080" env:"PORT"`
+	Metrics                  string        `long:"metrics" description:"Where to send metrics: dogstatsd, statsd, prometheus (served at /metrics) or none" default:"dogstatsd" env:"METRICS"`
+	MetricsPrefix            string        `long:"metrics-prefix" description:"Dot separated prefix of every metric name" default:"presto.watcher" env:"METRICS_PREFIX"`
+	StatsdLabels             string        `long:"statsd-labels" description:"With --metrics=statsd, fold metric labels into the name or drop them: fold or drop" default:"fold" env:"STATSD_LABELS"`
+	NoMetrics                bool          `long:"no-metrics" description:"Disable metrics, same as --metrics=none" env:"NO_METRICS"`
+	PartitionMetrics         bool          `long:"partition-metrics" description:"Also count a sample of the scanned partitions by name, one metric per partition" env:"PARTITION_METRICS"`
+	PartitionMetricsSample   int           `long:"partition-metrics-sample" description:"With --partition-metrics, how many partitions per table to count by name (0 for all)" default:"20" env:"PARTITION_METRICS_SAMPLE"`
+	ClusterMetrics           bool          `long:"cluster-metrics" description:"Publish gauges of running, queued and flagged queries and the poll duration every poll" env:"CLUSTER_METRICS"`
+	StatsdHost               string        `long:"statsd" description:"StatsD ( host:port )" default:"127.0.0.1" env:"STATSD_HOST"`
+	IgnoreUsers              string        `long:"ignore-users" description:"Never alert on queries from these users (comma separated globs)" default:"" env:"IGNORE_USERS"`
+	IgnoreSources            string        `long:"ignore-sources" description:"Never alert on queries from these client sources, e.g. airflow-dag-* (comma separated globs)" default:"" env:"IGNORE_SOURCES"`
+	IgnoreSchemas            string        `long:"ignore-schemas" description:"Never alert on inputs in these schemas (comma separated globs, e.g. tmp_*)" default:"" env:"IGNORE_SCHEMAS"`
+	OnlyUsers                string        `long:"only-users" description:"Only alert on queries from these users (comma separated globs)" default:"" env:"ONLY_USERS"`
+	OnlySchemas              string        `long:"only-schemas" description:"Only alert on inputs in these schemas (comma separated globs)" default:"" env:"ONLY_SCHEMAS"`
+	ProtectedUsers           string        `long:"protected-users" description:"Never kill queries from these users (comma separated)" default:"" env:"PROTECTED_USERS"`
+	ProtectedResourceGroups  string        `long:"protected-resource-groups" description:"Never kill queries in these resource groups or their children (comma separated, e.g. global.etl)" default:"" env:"PROTECTED_RESOURCE_GROUPS"`
+	ProtectedSources         string        `long:"protected-sources" description:"Never kill queries from these client sources (comma separated)" default:"" env:"PROTECTED_SOURCES"`
+	ProtectedTags            string        `long:"protected-tags" description:"Never kill queries whose text contains one of these tags (comma separated)" default:"critical-pipeline" env:"PROTECTED_TAGS"`
+	CacheSize                int           `long:"cache-size" description:"How many queries the cache of already checked queries holds" default:"100" env:"CACHE_SIZE"`
+	CacheTTL                 time.Duration `long:"cache-ttl" description:"How long a checked query stays cached, a query running longer gets alerted on again" default:"1h" env:"CACHE_TTL"`
+	CachePolicy              string        `long:"cache-policy" description:"Which queries to evict when the cache is full: lfu, lru or arc" default:"lfu" env:"CACHE_POLICY"`
+	CacheFile                string        `long:"cache-file" description:"Keep the cache of already alerted queries in this file so restarts don't re-alert" default:"" env:"CACHE_FILE"`
+	DecisionLog              string        `long:"decision-log" description:"Record every poll cycle's decisions to this file for replay-decision" default:"" env:"DECISION_LOG"`
+	DecisionRetention        time.Duration `long:"decision-retention" description:"How long to keep recorded decisions" default:"168h" env:"DECISION_RETENTION"`
+	DecisionLogMaxBytes      int64         `long:"decision-log-max-bytes" description:"Maximum size of the decision journal before the oldest cycles are evicted" default:"52428800" env:"DECISION_LOG_MAX_BYTES"`
+	Events                   string        `long:"events" description:"Publish every alert decision as a JSON event: none, http (to --events-url) or kafka (to --kafka-topic on --kafka-brokers)" default:"none" env:"EVENTS"`
+	EventsURL                string        `long:"events-url" description:"URL the http event publisher POSTs every alert decision to" default:"" env:"EVENTS_URL"`
+	KafkaBrokers             string        `long:"kafka-brokers" description:"Kafka brokers the kafka event publisher bootstraps from (comma separated host:port, the port defaults to 9092)" default:"" env:"KAFKA_BROKERS"`
+	KafkaTopic               string        `long:"kafka-topic" description:"Kafka topic the kafka event publisher produces to" default:"" env:"KAFKA_TOPIC"`
+	AuditLog                 string        `long:"audit-log" description:"Append a JSON line for every alert decision to this file, reopened on SIGHUP or when moved" default:"" env:"AUDIT_LOG"`
+	OtlpEndpoint             string        `long:"otlp-endpoint" description:"OTLP/HTTP collector to send a trace of every poll to, e.g. http://otel-collector:4318 (no tracing when empty)" default:"" env:"OTLP_ENDPOINT"`
+	TraceSampleRatio         float64       `long:"trace-sample-ratio" description:"Fraction of polls to trace with --otlp-endpoint, from 0 to 1" default:"1" env:"TRACE_SAMPLE_RATIO"`
+}
+
+// Options of the replay-decision command
+type ReplayDecisionOptions struct {
+	At      string `long:"at" description:"Point in time to reconstruct (RFC3339)" required:"true"`
+	QueryID string `long:"query-id" description:"Presto query ID to reconstruct the decision for" required:"true"`
+	Cluster string `long:"cluster" description:"Name of the cluster the query ran on, as in --url name=url (empty for a single unnamed --url)" default:""`
+}
+
+// Options of the import command
+type ImportOptions struct {
+	Dir     string `long:"dir" description:"Directory of archived query JSON files, plain or gzipped" required:"true"`
+	History string `long:"history" description:"History file (JSON lines) to add the imported queries to" required:"true"`
+}
+
+// A labelled Presto UI base URL
+type UILink struct {
+	Label string
+	Base  string
+}
+
+// An HTTP header added to outgoing alert requests
+type Header struct {
+	Name  string
+	Value string
+}
+
+// A Presto cluster to watch. Name is empty when there's only the one, unnamed cluster.
+type Cluster struct {
+	Name string
+	URL  string
+}
+
+// Config is the validated configuration. The raw options are embedded, everything else is derived from them.
+type Config struct {
+	Options
+
+	// Clusters to watch, from --url
+	Clusters []Cluster
+	// Set of connectors whose inputs are checked
+	Connectors map[string]bool
+	// UI base URLs, preferred one first. Empty means link to the Presto URL.
+	UILinks []UILink
+	// Parsed --notify-header values
+	NotifyHeaderList []Header
+	// Location for hour-of-day reporting
+	DisplayLocation *time.Location
+	// Normalized, deduplicated notifier names
+	NotifierNames []string
+	// --max-bytes-scanned in bytes, 0 when disabled
+	MaxBytes int64
+	// --max-user-bytes-scanned in bytes, 0 when disabled
+	MaxUserBytes int64
+	// --max-input-size in bytes, 0 when disabled
+	MaxInputBytes int64
+	// --metrics-prefix split into key segments, empty for no prefix
+	MetricsPrefixKey []string
+	// Parsed --slack-template(-file), nil for the built-in message
+	SlackMessageTemplate *template.Template
+
+	// Things worth logging once logging is set up, e.g. unknown keys in the config file
+	Warnings []string
+
+	// Subcommand to run instead of the watcher, empty for the watcher itself
+	Command        string
+	ReplayDecision ReplayDecisionOptions
+	Import         ImportOptions
+}
+
+// UsageError means the command line couldn't be parsed. Help is set when the user asked for help, in which
+// case the message is the help text.
+type UsageError struct {
+	Message string
+	Help    bool
+}
+
+func (e *UsageError) Error() string { return e.Message }
+
+// ValidationError means the options parsed but don't make sense
+type ValidationError struct {
+	Option  string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid --%v: %v", e.Option, e.Message)
+}
+
+// Load parses the arguments (without the program name) and environment, and validates the result
+func Load(args []string, env func(string) string) (Config, error) {
+	cfg, err := parse(args, env)
+	if err != nil {
+		return cfg, err
+	}
+	// Nothing else matters if we're only printing the version
+	if cfg.DoVersion {
+		return cfg, nil
+	}
+	return cfg, cfg.validate()
+}
+
+// parse resolves the options from the arguments, environment and config file, without validating them
+func parse(args []string, env func(string) string) (Config, error) {
+	var cfg Config
+	parser := flags.NewParser(&cfg.Options, flags.HelpFlag|flags.PassDoubleDash)
+	parser.SubcommandsOptional = true
+	parser.AddCommand(COMMAND_REPLAY_DECISION, "Reconstruct a past decision", "Reconstruct and print the decision made for a query at a past moment, from the decision journal", &cfg.ReplayDecision)
+	parser.AddCommand(COMMAND_IMPORT, "Import archived queries", "Evaluate archived Presto query JSON against the thresholds and add the results to a history file", &cfg.Import)
+
+	// The config file goes in as defaults first, so env vars and then flags override it
+	if path := configFilePath(args, env); path != "" {
+		unknown, err := applyFile(parser, path)
+		if err != nil {
+			return cfg, invalid("config", "unable to load '%s': %v", path, err)
+		}
+		if len(unknown) > 0 {
+			cfg.Warnings = append(cfg.Warnings, fmt.Sprintf("Ignoring unknown options in config file [%v]: %v", path, strings.Join(unknown, ", ")))
+		}
+	}
+
+	// go-flags reads the process environment itself, so hand it ours as defaults instead. Flags still win.
+	envKeys := applyEnv(parser, env)
+
+	if _, err := parser.ParseArgs(args); err != nil {
+		if ferr, ok := err.(*flags.Error); ok && ferr.Type == flags.ErrHelp {
+			// Put the env names back so they show up in the help
+			for opt, key := range envKeys {
+				opt.EnvDefaultKey = key
+			}
+			var help bytes.Buffer
+			parser.WriteHelp(&help)
+			return cfg, &UsageError{Message: help.String(), Help: true}
+		}
+		return cfg, &UsageError{Message: err.Error()}
+	}
+	if parser.Active != nil {
+		cfg.Command = parser.Active.Name
+	}
+	return cfg, nil
+}
+
+// Options a reload of the config file may change, by long name. Everything else needs a restart.
+var Reloadable = []string{
+	"maxpart", "maxpart-write", "max-splits", "max-runtime", "max-queue-time", "max-user-partitions",
+	"max-user-queries", "optout-max-partitions", "kill-threshold", "critical-multiplier", "emergency-multiplier",
+}
+
+// LoadFile parses a config file the way Load does at startup, but with the file as the only source: no flags,
+// no env vars and no validation, since the file alone needn't be a complete configuration
+func LoadFile(path string) (Config, error) {
+	cfg, err := parse([]string{"--config", path}, func(string) string { return "" })
+	if err != nil {
+		return cfg, invalid("config", "unable to load '%s': %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Reload applies the Reloadable options that changed in the config file to a running configuration. before and
+// after are what LoadFile gave for the file then and now. An option a flag or env var overrode at startup
+// doesn't have the file's value in running, and keeps its own. The result is validated like at startup, and
+// running is only changed when it's valid. Reload returns the names of the options it changed.
+func Reload(running *Config, before Config, after Config) ([]string, error) {
+	reloaded := *running
+	var changed []string
+	for _, name := range Reloadable {
+		r, b, a := optionField(&reloaded, name), optionField(&before, name), optionField(&after, name)
+		if reflect.DeepEqual(b.Interface(), a.Interface()) || !reflect.DeepEqual(r.Interface(), b.Interface()) {
+			continue
+		}
+		r.Set(a)
+		changed = append(changed, name)
+	}
+	if len(changed) == 0 {
+		return nil, nil
+	}
+	if err := reloaded.validate(); err != nil {
+		return nil, err
+	}
+	for _, name := range changed {
+		optionField(running, name).Set(optionField(&reloaded, name))
+	}
+	return changed, nil
+}
+
+// optionField is the field of an option, by long name
+func optionField(cfg *Config, name string) reflect.Value {
+	v := reflect.ValueOf(&cfg.Options).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("long") == name {
+			return v.Field(i)
+		}
+	}
+	panic("no option --" + name)
+}
+
+// configFilePath finds the config file in the arguments or the environment, before they're parsed
+func configFilePath(args []string, env func(string) string) string {
+	for i, a := range args {
+		if a == "--" {
+			break
+		}
+		if a == "--config" && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(a, "--config=") {
+			return strings.TrimPrefix(a, "--config=")
+		}
+	}
+	return env("CONFIG_FILE")
+}
+
+// applyFile turns the options set in a YAML config file into option defaults. Keys are long option names,
+// lists set options that can be given multiple times. It returns the keys that aren't options.
+func applyFile(parser *flags.Parser, path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+
+	var unknown []string
+	for key, value := range values {
+		opt := parser.FindOptionByLongName(strings.Replace(key, "_", "-", -1))
+		if opt == nil || opt.LongName == "config" {
+			unknown = append(unknown, key)
+			continue
+		}
+		switch v := value.(type) {
+		case nil:
+		case []interface{}:
+			var list []string
+			for _, item := range v {
+				list = append(list, fmt.Sprint(item))
+			}
+			opt.Default = list
+		case map[interface{}]interface{}:
+			return nil, fmt.Errorf("option '%s' must be a value or a list", key)
+		default:
+			opt.Default = []string{fmt.Sprint(v)}
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+// applyEnv turns environment variables into option defaults and stops go-flags from looking them up itself.
+// It returns the env keys it took over.
+func applyEnv(parser *flags.Parser, env func(string) string) map[*flags.Option]string {
+	keys := make(map[*flags.Option]string)
+	var walk func(g *flags.Group)
+	walk = func(g *flags.Group) {
+		for _, opt := range g.Options() {
+			if opt.EnvDefaultKey == "" {
+				continue
+			}
+			if v := env(opt.EnvDefaultKey); v != "" {
+				if opt.EnvDefaultDelim != "" {
+					opt.Default = strings.Split(v, opt.EnvDefaultDelim)
+				} else {
+					opt.Default = []string{v}
+				}
+			}
+			keys[opt] = opt.EnvDefaultKey
+			opt.EnvDefaultKey = ""
+		}
+		for _, sub := range g.Groups() {
+			walk(sub)
+		}
+	}
+	walk(parser.Command.Group)
+	for _, cmd := range parser.Commands() {
+		walk(cmd.Group)
+	}
+	return keys
+}
+
+var dataSizePattern = regexp.MustCompile(`^\s*([0-9.]+)\s*([a-zA-Z]*)\s*$`)
+
+var dataSizeUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"kb":  1 << 10,
+	"kib": 1 << 10,
+	"mb":  1 << 20,
+	"mib": 1 << 20,
+	"gb":  1 << 30,
+	"gib": 1 << 30,
+	"tb":  1 << 40,
+	"tib": 1 << 40,
+	"pb":  1 << 50,
+	"pib": 1 << 50,
+}
+
+// ParseDataSize parses sizes like "500GB" or Presto's "1.25kB" into bytes. Like Presto, units are powers of 1024.
+func ParseDataSize(s string) (int64, error) {
+	m := dataSizePattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid data size '%s'", s)
+	}
+	unit, ok := dataSizeUnits[strings.ToLower(m[2])]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit in data size '%s'", s)
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid data size '%s'", s)
+	}
+	return int64(v * unit), nil
+}
+
+// Interval is a duration option like "20s" or "2m30s". A bare number is taken as seconds, which is what the
+// interval options used to be.
+type Interval struct {
+	time.Duration
+}
+
+// UnmarshalFlag is called by go-flags for the flag, its env var and its default
+func (i *Interval) UnmarshalFlag(value string) error {
+	if secs, err := strconv.ParseFloat(value, 64); err == nil {
+		i.Duration = time.Duration(secs * float64(time.Second))
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration '%s', expected e.g. 20s, 2m30s or a number of seconds", value)
+	}
+	i.Duration = d
+	return nil
+}
+
+// SplitList splits a comma separated option into its trimmed, non-empty values
+func SplitList(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// ParseUILinks parses label=url pairs and moves the preferred label to the front
+func ParseUILinks(values []string, preferred string) ([]UILink, error) {
+	var links []UILink
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("'%s' is not in label=url form", v)
+		}
+		links = append(links, UILink{Label: parts[0], Base: strings.TrimRight(parts[1], "/")})
+	}
+	if preferred == "" {
+		return links, nil
+	}
+	for i, l := range links {
+		if l.Label == preferred {
+			return append([]UILink{l}, append(links[:i:i], links[i+1:]...)...), nil
+		}
+	}
+	return nil, fmt.Errorf("'%s' is not one of the --ui-url labels", preferred)
+}
+
+// CheckSeverityMultipliers checks that the critical tier starts above the limit and the emergency tier no lower
+func CheckSeverityMultipliers(critical float64, emergency float64) error {
+	if critical <= 1 {
+		return fmt.Errorf("the critical multiplier must be more than 1, got %v", critical)
+	}
+	if emergency < critical {
+		return fmt.Errorf("the emergency multiplier %v is below the critical multiplier %v", emergency, critical)
+	}
+	return nil
+}
+
+// ParseHeaders parses "Name: Value" headers
+func ParseHeaders(values []string) ([]Header, error) {
+	var headers []Header
+	for _, v := range values {
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("'%s' is not in \"Name: Value\" form", v)
+		}
+		name := strings.TrimSpace(parts[0])
+		if name == "" || strings.ContainsAny(name, " \t\r\n") {
+			return nil, fmt.Errorf("'%s' is not a valid header name", parts[0])
+		}
+		value := strings.TrimSpace(parts[1])
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("the value of header '%s' has a line break", name)
+		}
+		headers = append(headers, Header{Name: name, Value: value})
+	}
+	return headers, nil
+}
+
+// ParseClusters parses the --url values, each a URL or name=url. A single URL can go without a name, with
+// several the unnamed ones are named after their host.
+func ParseClusters(values []string) ([]Cluster, error) {
+	var clusters []Cluster
+	seen := make(map[string]bool)
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		c := Cluster{URL: v}
+		if eq := strings.Index(v, "="); eq >= 0 && (!strings.Contains(v, "://") || eq < strings.Index(v, "://")) {
+			c.Name, c.URL = v[:eq], v[eq+1:]
+			if c.Name == "" {
+				return nil, fmt.Errorf("'%s' has an empty cluster name", v)
+			}
+		}
+		c.URL = strings.TrimRight(c.URL, "/")
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("'%s' is not a URL like http://coordinator:8080", c.URL)
+		}
+		if c.Name == "" && len(values) > 1 {
+			c.Name = u.Hostname()
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("cluster '%s' is given more than once", c.Name)
+		}
+		seen[c.Name] = true
+		clusters = append(clusters, c)
+	}
+	return clusters, nil
+}
+
+func invalid(option string, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{Option: option, Message: fmt.Sprintf(format, args...)}
+}
+
+// validate checks the options and fills in the derived fields
+func (cfg *Config) validate() error {
+	// The subcommands work offline, only the watcher needs to reach Presto
+	if cfg.Command == "" && len(cfg.PrestoURLs) == 0 {
+		return invalid("url", "a Presto URL is required")
+	}
+	clusters, err := ParseClusters(cfg.PrestoURLs)
+	if err != nil {
+		return invalid("url", "%v", err)
+	}
+	cfg.Clusters = clusters
+	if len(cfg.Clusters) > 1 && len(cfg.UIURLs) > 0 {
+		return invalid("ui-url", "can't be combined with several --url, alerts link to each cluster's own URL")
+	}
+	if cfg.MaxStaleClusters < 0 {
+		return invalid("max-stale-clusters", "must not be negative")
+	}
+
+	cfg.Connectors = make(map[string]bool)
+	for _, c := range SplitList(cfg.PrestoConnector) {
+		cfg.Connectors[c] = true
+	}
+	cfg.Flavor = strings.ToLower(strings.TrimSpace(cfg.Flavor))
+	switch cfg.Flavor {
+	case FLAVOR_PRESTO, FLAVOR_TRINO, FLAVOR_AUTO:
+	default:
+		return invalid("flavor", "unknown flavor '%s'", cfg.Flavor)
+	}
+
+	if cfg.PrestoPassword != "" && cfg.PrestoToken != "" {
+		return invalid("presto-token", "can't be combined with --presto-password")
+	}
+	if cfg.PrestoPassword != "" && cfg.PrestoUser == "" {
+		return invalid("presto-user", "is required with --presto-password")
+	}
+	if len(cfg.Connectors) == 0 {
+		return invalid("connector", "no connectors given in '%s'", cfg.PrestoConnector)
+	}
+
+	positive := []struct {
+		option string
+		value  int64
+	}{
+		{"maxpart", int64(cfg.MaxPartitions)},
+		{"maxpart-write", int64(cfg.MaxWritePartitions)},
+		{"interval", int64(cfg.UpdateInterval.Duration)},
+		{"presto-timeout", int64(cfg.PrestoTimeout)},
+		{"shutdown-grace", int64(cfg.ShutdownGrace)},
+		{"status-size", int64(cfg.StatusSize)},
+		{"ready-max-failures", int64(cfg.ReadyMaxFailures)},
+		{"retry-attempts", int64(cfg.RetryAttempts)},
+		{"concurrency", int64(cfg.Concurrency)},
+		{"recheck-interval", int64(cfg.RecheckInterval.Duration)},
+		{"rules-reload-interval", int64(cfg.RulesReloadInterval.Duration)},
+		{"decision-retention", int64(cfg.DecisionRetention)},
+		{"decision-log-max-bytes", cfg.DecisionLogMaxBytes},
+		{"cache-size", int64(cfg.CacheSize)},
+		{"cache-ttl", int64(cfg.CacheTTL)},
+		{"query-text-length", int64(cfg.QueryTextLength)},
+		{"slack-max-tables", int64(cfg.SlackMaxTables)},
+		{"failure-watch-timeout", int64(cfg.FailureWatchTimeout.Duration)},
+	}
+	for _, p := range positive {
+		if p.value <= 0 {
+			return invalid(p.option, "must be greater than zero")
+		}
+	}
+	globs := []struct {
+		option   string
+		patterns string
+	}{
+		{"ignore-users", cfg.IgnoreUsers},
+		{"ignore-sources", cfg.IgnoreSources},
+		{"ignore-schemas", cfg.IgnoreSchemas},
+		{"only-users", cfg.OnlyUsers},
+		{"only-schemas", cfg.OnlySchemas},
+	}
+	for _, g := range globs {
+		for _, p := range SplitList(g.patterns) {
+			if _, err := path.Match(p, ""); err != nil {
+				return invalid(g.option, "bad pattern '%s': %v", p, err)
+			}
+		}
+	}
+
+	if cfg.MaxBytesScanned != "" {
+		b, err := ParseDataSize(cfg.MaxBytesScanned)
+		if err != nil || b <= 0 {
+			return invalid("max-bytes-scanned", "'%s' is not a positive data size like 500GB", cfg.MaxBytesScanned)
+		}
+		cfg.MaxBytes = b
+	}
+	if cfg.MaxSplits < 0 {
+		return invalid("max-splits", "must not be negative")
+	}
+	if cfg.MaxInputSize != "" {
+		b, err := ParseDataSize(cfg.MaxInputSize)
+		if err != nil || b <= 0 {
+			return invalid("max-input-size", "'%s' is not a positive data size like 500GB", cfg.MaxInputSize)
+		}
+		cfg.MaxInputBytes = b
+	}
+	if cfg.MaxQueueTime < 0 {
+		return invalid("max-queue-time", "must not be negative")
+	}
+	if cfg.MaxUserPartitions < 0 {
+		return invalid("max-user-partitions", "must not be negative")
+	}
+	if cfg.MaxUserQueries < 0 {
+		return invalid("max-user-queries", "must not be negative")
+	}
+	if cfg.MaxUserBytesScanned != "" {
+		b, err := ParseDataSize(cfg.MaxUserBytesScanned)
+		if err != nil || b <= 0 {
+			return invalid("max-user-bytes-scanned", "'%s' is not a positive data size like 2TB", cfg.MaxUserBytesScanned)
+		}
+		cfg.MaxUserBytes = b
+	}
+	if cfg.UserAlertCooldown.Duration < 0 {
+		return invalid("user-alert-cooldown", "must not be negative")
+	}
+	if cfg.MaxRuntime < 0 {
+		return invalid("max-runtime", "must not be negative")
+	}
+
+	if cfg.SlackTemplate != "" && cfg.SlackTemplateFile != "" {
+		return invalid("slack-template-file", "can't be combined with --slack-template")
+	}
+	source, option := cfg.SlackTemplate, "slack-template"
+	if cfg.SlackTemplateFile != "" {
+		b, err := ioutil.ReadFile(cfg.SlackTemplateFile)
+		if err != nil {
+			return invalid("slack-template-file", "%v", err)
+		}
+		source, option = string(b), "slack-template-file"
+	}
+	if source != "" {
+		t, err := template.New("slack").Parse(source)
+		if err != nil {
+			return invalid(option, "%v", err)
+		}
+		cfg.SlackMessageTemplate = t
+	}
+
+	if cfg.RepeatOffenderCount < 0 {
+		return invalid("repeat-offender-count", "must not be negative")
+	}
+	if cfg.RepeatOffenderCount > 0 && cfg.RepeatOffenderWindow.Duration <= 0 {
+		return invalid("repeat-offender-window", "must be greater than zero")
+	}
+
+	if cfg.PartitionMetricsSample < 0 {
+		return invalid("partition-metrics-sample", "must not be negative")
+	}
+
+	if cfg.DigestInterval.Duration < 0 {
+		return invalid("digest-interval", "must not be negative")
+	}
+
+	if strings.TrimSpace(cfg.OptOutTag) == "" {
+		return invalid("optout-tag", "must not be empty")
+	}
+	if cfg.OptOutMaxPartitions < 0 {
+		return invalid("optout-max-partitions", "must not be negative")
+	}
+	if cfg.KillThreshold < 0 {
+		return invalid("kill-threshold", "must not be negative")
+	}
+	if strings.TrimSpace(cfg.NoKillTag) == "" {
+		return invalid("nokill-tag", "must not be empty")
+	}
+	if cfg.PagerDutyMinPartitions < 0 {
+		return invalid("pagerduty-min-partitions", "must not be negative")
+	}
+	if cfg.HealthHTTPPort <= 0 || cfg.HealthHTTPPort > 65535 {
+		return invalid("port", "%v is not a valid port", cfg.HealthHTTPPort)
+	}
+
+	links, err := ParseUILinks(cfg.UIURLs, cfg.UIPreferred)
+	if err != nil {
+		return invalid("ui-url", "%v", err)
+	}
+	cfg.UILinks = links
+
+	if err := CheckSeverityMultipliers(cfg.CriticalMultiplier, cfg.EmergencyMultiplier); err != nil {
+		return invalid("critical-multiplier", "%v", err)
+	}
+	cfg.MentionSeverity = strings.ToLower(strings.TrimSpace(cfg.MentionSeverity))
+	switch cfg.MentionSeverity {
+	case SEVERITY_WARNING, SEVERITY_CRITICAL, SEVERITY_EMERGENCY:
+	default:
+		return invalid("mention-severity", "unknown severity '%s'", cfg.MentionSeverity)
+	}
+
+	if cfg.AckSecret != "" {
+		cfg.AckBaseURL = strings.TrimRight(cfg.AckBaseURL, "/")
+		if u, err := url.Parse(cfg.AckBaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return invalid("ack-base-url", "is needed with --ack-secret, as an absolute http(s) URL")
+		}
+	}
+	if cfg.KillLinks && cfg.AckSecret == "" {
+		return invalid("kill-links", "needs --ack-secret to sign the links")
+	}
+
+	if cfg.NotifyHeaderList, err = ParseHeaders(cfg.NotifyHeaders); err != nil {
+		return invalid("notify-header", "%v", err)
+	}
+
+	if cfg.DisplayLocation, err = time.LoadLocation(cfg.DisplayTimezone); err != nil {
+		return invalid("display-timezone", "%v", err)
+	}
+
+	cfg.Metrics = strings.ToLower(strings.TrimSpace(cfg.Metrics))
+	if cfg.NoMetrics {
+		cfg.Metrics = METRICS_NONE
+	}
+	switch cfg.Metrics {
+	case METRICS_DOGSTATSD, METRICS_STATSD, METRICS_PROMETHEUS, METRICS_NONE:
+	default:
+		return invalid("metrics", "unknown metrics backend '%s'", cfg.Metrics)
+	}
+	cfg.Events = strings.ToLower(strings.TrimSpace(cfg.Events))
+	switch cfg.Events {
+	case EVENTS_NONE:
+	case EVENTS_HTTP:
+		if cfg.EventsURL == "" {
+			return invalid("events-url", "the http event publisher needs a URL")
+		}
+	case EVENTS_KAFKA:
+		if len(SplitList(cfg.KafkaBrokers)) == 0 {
+			return invalid("kafka-brokers", "the kafka event publisher needs at least one broker")
+		}
+		if strings.TrimSpace(cfg.KafkaTopic) == "" {
+			return invalid("kafka-topic", "the kafka event publisher needs a topic")
+		}
+	default:
+		return invalid("events", "unknown event publisher '%s'", cfg.Events)
+	}
+	if cfg.OtlpEndpoint != "" {
+		cfg.OtlpEndpoint = strings.TrimRight(strings.TrimSpace(cfg.OtlpEndpoint), "/")
+		if u, err := url.Parse(cfg.OtlpEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return invalid("otlp-endpoint", "'%s' isn't an absolute http(s) URL", cfg.OtlpEndpoint)
+		}
+	}
+	if cfg.TraceSampleRatio < 0 || cfg.TraceSampleRatio > 1 {
+		return invalid("trace-sample-ratio", "%v isn't between 0 and 1", cfg.TraceSampleRatio)
+	}
+
+	cfg.StatsdLabels = strings.ToLower(strings.TrimSpace(cfg.StatsdLabels))
+	switch cfg.StatsdLabels {
+	case STATSD_LABELS_FOLD, STATSD_LABELS_DROP:
+	default:
+		return invalid("statsd-labels", "unknown label handling '%s', expected fold or drop", cfg.StatsdLabels)
+	}
+	cfg.MetricsPrefixKey = nil
+	if prefix := strings.Trim(strings.TrimSpace(cfg.MetricsPrefix), "."); prefix != "" {
+		for _, segment := range strings.Split(prefix, ".") {
+			if segment == "" {
+				return invalid("metrics-prefix", "'%s' has an empty segment", cfg.MetricsPrefix)
+			}
+			cfg.MetricsPrefixKey = append(cfg.MetricsPrefixKey, segment)
+		}
+	}
+
+	cfg.CachePolicy = strings.ToLower(strings.TrimSpace(cfg.CachePolicy))
+	switch cfg.CachePolicy {
+	case CACHE_POLICY_LFU, CACHE_POLICY_LRU, CACHE_POLICY_ARC:
+	default:
+		return invalid("cache-policy", "unknown cache policy '%s', expected lfu, lru or arc", cfg.CachePolicy)
+	}
+
+	cfg.LockBackend = strings.ToLower(strings.TrimSpace(cfg.LockBackend))
+	switch cfg.LockBackend {
+	case LOCK_BACKEND_NONE:
+	case LOCK_BACKEND_REDIS:
+		if cfg.LockKey == "" {
+			return invalid("lock-key", "must not be empty")
+		}
+		if cfg.LockTTL <= cfg.UpdateInterval.Duration {
+			return invalid("lock-ttl", "must be longer than --interval (%v)", cfg.UpdateInterval)
+		}
+	default:
+		return invalid("lock-backend", "unknown lock backend '%s'", cfg.LockBackend)
+	}
+
+	seen := make(map[string]bool)
+	cfg.NotifierNames = nil
+	for _, name := range cfg.Notifiers {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		switch name {
+		case NOTIFIER_SLACK:
+			if cfg.SlackURL == "" && cfg.SlackToken == "" && cfg.Command == "" {
+				return invalid("slack", "the slack notifier needs a Slack webhook URL or --slack-token")
+			}
+			if cfg.SlackToken != "" && cfg.SlackChannel == "" {
+				return invalid("slack-channel", "is needed to post with --slack-token")
+			}
+		case NOTIFIER_WEBHOOK:
+			if cfg.WebhookURL == "" && cfg.Command == "" {
+				return invalid("webhook-url", "the webhook notifier needs a URL")
+			}
+		case NOTIFIER_PAGERDUTY:
+			if cfg.PagerDutyRoutingKey == "" && cfg.Command == "" {
+				return invalid("pagerduty-routing-key", "the pagerduty notifier needs a routing key")
+			}
+		default:
+			return invalid("notifier", "unknown notifier '%s'", name)
+		}
+		cfg.NotifierNames = append(cfg.NotifierNames, name)
+	}
+	if cfg.SelfTestSlack && !seen[NOTIFIER_SLACK] {
+		return invalid("selftest-slack", "needs the slack notifier")
+	}
+	if len(cfg.NotifierNames) == 0 {
+		return invalid("notifier", "no notifiers configured")
+	}
+	return nil
+}
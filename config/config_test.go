@@ -0,0 +1,320 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig is the configuration the option defaults give, plus the Presto and Slack URLs every watcher needs
+func validConfig(t *testing.T) Config {
+	var cfg Config
+	v := reflect.ValueOf(&cfg.Options).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		def, ok := v.Type().Field(i).Tag.Lookup("default")
+		if !ok {
+			continue
+		}
+		var err error
+		switch field := v.Field(i).Addr().Interface().(type) {
+		case *string:
+			*field = def
+		case *int:
+			*field, err = strconv.Atoi(def)
+		case *int64:
+			*field, err = strconv.ParseInt(def, 10, 64)
+		case *float64:
+			*field, err = strconv.ParseFloat(def, 64)
+		case *bool:
+			*field, err = strconv.ParseBool(def)
+		case *time.Duration:
+			*field, err = time.ParseDuration(def)
+		case *Interval:
+			err = field.UnmarshalFlag(def)
+		case *[]string:
+			*field = []string{def}
+		default:
+			t.Fatalf("no default handling for option --%v", v.Type().Field(i).Tag.Get("long"))
+		}
+		if err != nil {
+			t.Fatalf("option --%v: bad default %q: %v", v.Type().Field(i).Tag.Get("long"), def, err)
+		}
+	}
+	cfg.PrestoURLs = []string{"http://presto.example.com:8080"}
+	cfg.SlackURL = "https://hooks.slack.com/services/T000/B000/XXXX"
+	return cfg
+}
+
+func TestValidConfig(t *testing.T) {
+	cfg := validConfig(t)
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Clusters) != 1 || !cfg.Connectors["hive"] || len(cfg.NotifierNames) != 1 || cfg.DisplayLocation == nil {
+		t.Errorf("derived fields weren't filled in: %+v", cfg)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	missing := filepath.Join(os.TempDir(), "prestowatcher-no-such-template")
+	for _, tc := range []struct {
+		option string
+		change func(cfg *Config)
+	}{
+		{"url", func(cfg *Config) { cfg.PrestoURLs = nil }},
+		{"url", func(cfg *Config) { cfg.PrestoURLs = []string{"not a url"} }},
+		{"ui-url", func(cfg *Config) {
+			cfg.PrestoURLs = []string{"a=http://a.example.com:8080", "b=http://b.example.com:8080"}
+			cfg.UIURLs = []string{"ui=https://ui.example.com"}
+		}},
+		{"ui-url", func(cfg *Config) { cfg.UIURLs = []string{"=https://ui.example.com"} }},
+		{"max-stale-clusters", func(cfg *Config) { cfg.MaxStaleClusters = -1 }},
+		{"flavor", func(cfg *Config) { cfg.Flavor = "hive" }},
+		{"presto-token", func(cfg *Config) { cfg.PrestoUser, cfg.PrestoPassword, cfg.PrestoToken = "watcher", "secret", "tok" }},
+		{"presto-user", func(cfg *Config) { cfg.PrestoPassword = "secret" }},
+		{"connector", func(cfg *Config) { cfg.PrestoConnector = " , " }},
+		{"maxpart", func(cfg *Config) { cfg.MaxPartitions = 0 }},
+		{"maxpart-write", func(cfg *Config) { cfg.MaxWritePartitions = 0 }},
+		{"interval", func(cfg *Config) { cfg.UpdateInterval.Duration = 0 }},
+		{"presto-timeout", func(cfg *Config) { cfg.PrestoTimeout = 0 }},
+		{"shutdown-grace", func(cfg *Config) { cfg.ShutdownGrace = 0 }},
+		{"status-size", func(cfg *Config) { cfg.StatusSize = 0 }},
+		{"ready-max-failures", func(cfg *Config) { cfg.ReadyMaxFailures = 0 }},
+		{"retry-attempts", func(cfg *Config) { cfg.RetryAttempts = 0 }},
+		{"concurrency", func(cfg *Config) { cfg.Concurrency = 0 }},
+		{"recheck-interval", func(cfg *Config) { cfg.RecheckInterval.Duration = 0 }},
+		{"rules-reload-interval", func(cfg *Config) { cfg.RulesReloadInterval.Duration = 0 }},
+		{"decision-retention", func(cfg *Config) { cfg.DecisionRetention = 0 }},
+		{"decision-log-max-bytes", func(cfg *Config) { cfg.DecisionLogMaxBytes = 0 }},
+		{"cache-size", func(cfg *Config) { cfg.CacheSize = 0 }},
+		{"cache-ttl", func(cfg *Config) { cfg.CacheTTL = 0 }},
+		{"query-text-length", func(cfg *Config) { cfg.QueryTextLength = 0 }},
+		{"slack-max-tables", func(cfg *Config) { cfg.SlackMaxTables = 0 }},
+		{"failure-watch-timeout", func(cfg *Config) { cfg.FailureWatchTimeout.Duration = 0 }},
+		{"ignore-users", func(cfg *Config) { cfg.IgnoreUsers = "etl,[" }},
+		{"ignore-sources", func(cfg *Config) { cfg.IgnoreSources = "[" }},
+		{"ignore-schemas", func(cfg *Config) { cfg.IgnoreSchemas = "[" }},
+		{"only-users", func(cfg *Config) { cfg.OnlyUsers = "[" }},
+		{"only-schemas", func(cfg *Config) { cfg.OnlySchemas = "[" }},
+		{"max-bytes-scanned", func(cfg *Config) { cfg.MaxBytesScanned = "abc" }},
+		{"max-bytes-scanned", func(cfg *Config) { cfg.MaxBytesScanned = "0GB" }},
+		{"max-splits", func(cfg *Config) { cfg.MaxSplits = -1 }},
+		{"max-input-size", func(cfg *Config) { cfg.MaxInputSize = "lots" }},
+		{"max-queue-time", func(cfg *Config) { cfg.MaxQueueTime = -time.Second }},
+		{"max-user-partitions", func(cfg *Config) { cfg.MaxUserPartitions = -1 }},
+		{"max-user-queries", func(cfg *Config) { cfg.MaxUserQueries = -1 }},
+		{"max-user-bytes-scanned", func(cfg *Config) { cfg.MaxUserBytesScanned = "2XB" }},
+		{"user-alert-cooldown", func(cfg *Config) { cfg.UserAlertCooldown.Duration = -time.Second }},
+		{"max-runtime", func(cfg *Config) { cfg.MaxRuntime = -time.Second }},
+		{"slack-template-file", func(cfg *Config) { cfg.SlackTemplate, cfg.SlackTemplateFile = "{{.User}}", missing }},
+		{"slack-template-file", func(cfg *Config) { cfg.SlackTemplateFile = missing }},
+		{"slack-template", func(cfg *Config) { cfg.SlackTemplate = "{{" }},
+		{"repeat-offender-count", func(cfg *Config) { cfg.RepeatOffenderCount = -1 }},
+		{"repeat-offender-window", func(cfg *Config) { cfg.RepeatOffenderCount, cfg.RepeatOffenderWindow.Duration = 3, 0 }},
+		{"partition-metrics-sample", func(cfg *Config) { cfg.PartitionMetricsSample = -1 }},
+		{"digest-interval", func(cfg *Config) { cfg.DigestInterval.Duration = -time.Second }},
+		{"optout-tag", func(cfg *Config) { cfg.OptOutTag = " " }},
+		{"optout-max-partitions", func(cfg *Config) { cfg.OptOutMaxPartitions = -1 }},
+		{"kill-threshold", func(cfg *Config) { cfg.KillThreshold = -1 }},
+		{"nokill-tag", func(cfg *Config) { cfg.NoKillTag = "" }},
+		{"pagerduty-min-partitions", func(cfg *Config) { cfg.PagerDutyMinPartitions = -1 }},
+		{"port", func(cfg *Config) { cfg.HealthHTTPPort = 0 }},
+		{"port", func(cfg *Config) { cfg.HealthHTTPPort = 65536 }},
+		{"critical-multiplier", func(cfg *Config) { cfg.CriticalMultiplier = 1 }},
+		{"critical-multiplier", func(cfg *Config) { cfg.CriticalMultiplier, cfg.EmergencyMultiplier = 10, 5 }},
+		{"mention-severity", func(cfg *Config) { cfg.MentionSeverity = "loud" }},
+		{"ack-base-url", func(cfg *Config) { cfg.AckSecret = "ack-secret" }},
+		{"ack-base-url", func(cfg *Config) { cfg.AckSecret, cfg.AckBaseURL = "ack-secret", "prestowatcher.example.com" }},
+		{"kill-links", func(cfg *Config) { cfg.KillLinks = true }},
+		{"notify-header", func(cfg *Config) { cfg.NotifyHeaders = []string{"bad"} }},
+		{"display-timezone", func(cfg *Config) { cfg.DisplayTimezone = "Nowhere/City" }},
+		{"metrics", func(cfg *Config) { cfg.Metrics = "graphite" }},
+		{"events-url", func(cfg *Config) { cfg.Events = EVENTS_HTTP }},
+		{"kafka-brokers", func(cfg *Config) { cfg.Events, cfg.KafkaBrokers = EVENTS_KAFKA, " , " }},
+		{"kafka-topic", func(cfg *Config) { cfg.Events, cfg.KafkaBrokers = EVENTS_KAFKA, "kafka-1:9092,kafka-2" }},
+		{"events", func(cfg *Config) { cfg.Events = "sns" }},
+		{"otlp-endpoint", func(cfg *Config) { cfg.OtlpEndpoint = "otel-collector:4318" }},
+		{"trace-sample-ratio", func(cfg *Config) { cfg.TraceSampleRatio = 1.5 }},
+		{"trace-sample-ratio", func(cfg *Config) { cfg.TraceSampleRatio = -0.1 }},
+		{"statsd-labels", func(cfg *Config) { cfg.StatsdLabels = "keep" }},
+		{"metrics-prefix", func(cfg *Config) { cfg.MetricsPrefix = "a..b" }},
+		{"cache-policy", func(cfg *Config) { cfg.CachePolicy = "fifo" }},
+		{"lock-key", func(cfg *Config) { cfg.LockBackend, cfg.LockKey = LOCK_BACKEND_REDIS, "" }},
+		{"lock-ttl", func(cfg *Config) { cfg.LockBackend, cfg.LockTTL = LOCK_BACKEND_REDIS, 20*time.Second }},
+		{"lock-backend", func(cfg *Config) { cfg.LockBackend = "etcd" }},
+		{"slack", func(cfg *Config) { cfg.SlackURL = "" }},
+		{"slack-channel", func(cfg *Config) { cfg.SlackURL, cfg.SlackToken = "", "xoxb-token" }},
+		{"webhook-url", func(cfg *Config) { cfg.Notifiers = []string{NOTIFIER_WEBHOOK} }},
+		{"pagerduty-routing-key", func(cfg *Config) { cfg.Notifiers = []string{NOTIFIER_PAGERDUTY} }},
+		{"notifier", func(cfg *Config) { cfg.Notifiers = []string{"sms"} }},
+		{"selftest-slack", func(cfg *Config) {
+			cfg.Notifiers, cfg.WebhookURL, cfg.SelfTestSlack = []string{NOTIFIER_WEBHOOK}, "https://alerts.example.com/hook", true
+		}},
+		{"notifier", func(cfg *Config) { cfg.Notifiers = []string{" ", ""} }},
+	} {
+		cfg := validConfig(t)
+		tc.change(&cfg)
+		err := cfg.validate()
+		if verr, ok := err.(*ValidationError); !ok || verr.Option != tc.option {
+			t.Errorf("want an invalid --%v, got %v", tc.option, err)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	file := validConfig(t).Options
+	before := Config{Options: file}
+	running := validConfig(t)
+	// Started with --max-splits on the command line
+	running.MaxSplits = 5000
+	if err := running.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	after := Config{Options: file}
+	after.MaxPartitions = 60
+	after.MaxSplits = 10000
+	after.CacheSize = 5
+	changed, err := Reload(&running, before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changed, []string{"maxpart"}) {
+		t.Errorf("got changed options %v, want [maxpart]", changed)
+	}
+	if running.MaxPartitions != 60 {
+		t.Errorf("got --maxpart %v, want the file's 60", running.MaxPartitions)
+	}
+	if running.MaxSplits != 5000 {
+		t.Errorf("got --max-splits %v, want the flag's 5000", running.MaxSplits)
+	}
+	if running.CacheSize != 100 {
+		t.Errorf("got --cache-size %v, it needs a restart to change", running.CacheSize)
+	}
+
+	// An invalid change leaves everything as it was
+	before = after
+	after.MaxPartitions = 90
+	after.CriticalMultiplier = 1
+	changed, err = Reload(&running, before, after)
+	if verr, ok := err.(*ValidationError); !ok || verr.Option != "critical-multiplier" {
+		t.Errorf("want an invalid --critical-multiplier, got %v", err)
+	}
+	if changed != nil || running.MaxPartitions != 60 || running.CriticalMultiplier != 5 {
+		t.Errorf("a rejected reload changed %v: --maxpart %v, --critical-multiplier %v", changed, running.MaxPartitions, running.CriticalMultiplier)
+	}
+
+	if changed, err := Reload(&running, before, before); changed != nil || err != nil {
+		t.Errorf("got %v, %v reloading an unchanged file", changed, err)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prestowatcher-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte("maxpart: 45\nkill_threshold: 500\nnotifier: [slack, webhook]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Variables in the environment don't leak into the file's values
+	os.Setenv("MAX_PARTITIONS", "10")
+	defer os.Unsetenv("MAX_PARTITIONS")
+
+	cfg, err := LoadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxPartitions != 45 || cfg.KillThreshold != 500 || !reflect.DeepEqual(cfg.Notifiers, []string{"slack", "webhook"}) {
+		t.Errorf("got --maxpart %v, --kill-threshold %v, --notifier %v from the file", cfg.MaxPartitions, cfg.KillThreshold, cfg.Notifiers)
+	}
+	if cfg.MaxWritePartitions != 90 {
+		t.Errorf("got --maxpart-write %v, want the default 90", cfg.MaxWritePartitions)
+	}
+
+	if _, err := LoadFile(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("loading a missing file succeeded")
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prestowatcher-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	file := "maxpart: 40\nmaxpart_write: 120\nmax-splits: 5000\nslack: https://hooks.slack.com/services/T000/B000/FILE\nbogus: 1\n"
+	if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"CONFIG_FILE":          path,
+		"MAX_PARTITIONS":       "50",
+		"MAX_WRITE_PARTITIONS": "150",
+	}
+
+	cfg, err := Load([]string{"--url", "http://presto.example.com:8080", "--maxpart", "60"}, func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		option string
+		got    int
+		want   int
+	}{
+		// flag > env > file > default
+		{"maxpart", cfg.MaxPartitions, 60},
+		{"maxpart-write", cfg.MaxWritePartitions, 150},
+		{"max-splits", int(cfg.MaxSplits), 5000},
+		{"slack-max-tables", cfg.SlackMaxTables, 10},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("got --%v %v, want %v", tc.option, tc.got, tc.want)
+		}
+	}
+	if cfg.SlackURL != "https://hooks.slack.com/services/T000/B000/FILE" {
+		t.Errorf("got --slack %q, want the file's", cfg.SlackURL)
+	}
+	if len(cfg.Warnings) != 1 || !strings.Contains(cfg.Warnings[0], "bogus") {
+		t.Errorf("got warnings %v, want the unknown key", cfg.Warnings)
+	}
+}
+
+func TestParseDataSize(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want int64
+	}{
+		// As Presto formats them
+		{"1.2TB", 1319413953331},
+		{"500GB", 500 << 30},
+		{"3.20GB", 3435973836},
+		{"12.50kB", 12800},
+		{"0B", 0},
+		// Raw bytes
+		{"1024", 1024},
+		{"123456789", 123456789},
+		{"1024B", 1024},
+		// As people type them
+		{" 2 GiB ", 2 << 30},
+		{"1.5pb", 3 << 49},
+	} {
+		got, err := ParseDataSize(tc.s)
+		if err != nil || got != tc.want {
+			t.Errorf("ParseDataSize(%q) = %v, %v, want %v", tc.s, got, err, tc.want)
+		}
+	}
+	for _, s := range []string{"", "abc", "5XB", "-1GB", "1.2.3GB", "GB"} {
+		if got, err := ParseDataSize(s); err == nil {
+			t.Errorf("ParseDataSize(%q) = %v, want an error", s, got)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+	Info-style gauges describing how this watcher is configured, so drift between instances can be alerted on.
+	They always have the value 1 and are re-emitted by every cluster's poll cycle, which also picks up rules
+	file reloads.
+
+	presto.watcher.config_info labels, one series per cluster, in this order:
+		version               APP_VERSION
+		cluster               the cluster's --url name, "" for the single unnamed one
+		engine                the cluster's flavor, presto or trino
+		connectors            sorted, comma separated --connector values
+		max_partitions        --maxpart
+		max_write_partitions  --maxpart-write
+		interval              --interval, in seconds
+		recheck_interval      --recheck-interval, in seconds
+		kill_threshold        --kill-threshold, "0" when disabled
+		rules_fingerprint     fingerprint of the rules file contents, "" without one
+
+	presto.watcher.rule_info labels, one series per rule for the first MAX_RULE_INFO rules:
+		table                 the rule's table pattern
+		query_type            the rule's query type, "any" when unset
+		max_partitions        the rule's limit
+
+	Nothing that can hold a secret (URLs, tokens, passwords) may be added here.
+*/
+
+const MAX_RULE_INFO = 50
+
+func configInfoLabels(c *cluster) []metrics.Label {
+	var conns []string
+	for c := range cfg.Connectors {
+		conns = append(conns, c)
+	}
+	sort.Strings(conns)
+
+	return []metrics.Label{
+		{Name: "version", Value: APP_VERSION},
+		{Name: "cluster", Value: c.displayName()},
+		{Name: "engine", Value: c.flavor},
+		{Name: "connectors", Value: strings.Join(conns, ",")},
+		{Name: "max_partitions", Value: strconv.Itoa(cfg.MaxPartitions)},
+		{Name: "max_write_partitions", Value: strconv.Itoa(cfg.MaxWritePartitions)},
+		{Name: "interval", Value: strconv.FormatFloat(cfg.UpdateInterval.Seconds(), 'f', -1, 64)},
+		{Name: "recheck_interval", Value: strconv.FormatFloat(cfg.RecheckInterval.Seconds(), 'f', -1, 64)},
+		{Name: "kill_threshold", Value: strconv.Itoa(cfg.KillThreshold)},
+		{Name: "rules_fingerprint", Value: rules.Fingerprint()},
+	}
+}
+
+// emitConfigInfo publishes the config info gauge of a cluster and the rule info gauges
+func emitConfigInfo(c *cluster) {
+	metricsSink.SetGaugeWithLabels(metricKey("config_info"), 1, configInfoLabels(c))
+
+	rules.RLock()
+	defer rules.RUnlock()
+	for i, r := range rules.rules {
+		if i >= MAX_RULE_INFO {
+			break
+		}
+		qType := r.QueryType
+		if qType == "" {
+			qType = "any"
+		}
+		metricsSink.SetGaugeWithLabels(
+			metricKey("rule_info"),
+			1,
+			[]metrics.Label{
+				{Name: "table", Value: r.Table},
+				{Name: "query_type", Value: qType},
+				{Name: "max_partitions", Value: strconv.Itoa(r.MaxPartitions)},
+			},
+		)
+	}
+}
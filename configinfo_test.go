@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/thecubed/prestowatcher/prestoclient"
+)
+
+func TestEmitConfigInfo(t *testing.T) {
+	defer setupTest()()
+	cfg.Connectors = map[string]bool{"hive": true, "iceberg": true}
+	cfg.UpdateInterval.Duration = 20 * time.Second
+	cfg.RecheckInterval.Duration = 90 * time.Second
+	cfg.KillThreshold = 500
+	cfg.AdminSecret = "admin-secret"
+	cfg.AckSecret = "ack-secret"
+	cfg.PrestoPassword = "presto-secret"
+	cfg.SlackToken = "xoxb-secret"
+	rules = &ruleSet{rules: []Rule{
+		{Table: "hive.events.*", MaxPartitions: 90},
+		{Table: "hive.*.*", QueryType: "write", MaxPartitions: 200},
+	}, fingerprint: "0123456789ab"}
+
+	emitConfigInfo(&cluster{name: "adhoc", flavor: prestoclient.FLAVOR_TRINO})
+	sink := metricsSink.MetricSink.(*recordingSink)
+
+	info := sink.gauge("config_info")
+	if len(info) != 1 || info[0].Value != 1 {
+		t.Fatalf("got config_info %+v, want one series set to 1", info)
+	}
+	want := []metrics.Label{
+		{Name: "version", Value: APP_VERSION},
+		{Name: "cluster", Value: "adhoc"},
+		{Name: "engine", Value: "trino"},
+		{Name: "connectors", Value: "hive,iceberg"},
+		{Name: "max_partitions", Value: "30"},
+		{Name: "max_write_partitions", Value: "90"},
+		{Name: "interval", Value: "20"},
+		{Name: "recheck_interval", Value: "90"},
+		{Name: "kill_threshold", Value: "500"},
+		{Name: "rules_fingerprint", Value: "0123456789ab"},
+	}
+	if fmt.Sprint(info[0].Labels) != fmt.Sprint(want) {
+		t.Errorf("got config_info labels\n%v\nwant\n%v", info[0].Labels, want)
+	}
+
+	ruleInfo := sink.gauge("rule_info")
+	wantRules := [][]metrics.Label{
+		{{Name: "table", Value: "hive.events.*"}, {Name: "query_type", Value: "any"}, {Name: "max_partitions", Value: "90"}},
+		{{Name: "table", Value: "hive.*.*"}, {Name: "query_type", Value: "write"}, {Name: "max_partitions", Value: "200"}},
+	}
+	if len(ruleInfo) != len(wantRules) {
+		t.Fatalf("got rule_info %+v, want a series per rule", ruleInfo)
+	}
+	for i, r := range ruleInfo {
+		if r.Value != 1 || fmt.Sprint(r.Labels) != fmt.Sprint(wantRules[i]) {
+			t.Errorf("got rule_info %v = %v, want %v = 1", r.Labels, r.Value, wantRules[i])
+		}
+	}
+
+	for _, g := range sink.gauges {
+		if strings.Contains(fmt.Sprint(g.Labels), "secret") {
+			t.Errorf("%v carries a secret: %v", g.Key, g.Labels)
+		}
+	}
+}
+
+func TestRuleInfoIsBounded(t *testing.T) {
+	defer setupTest()()
+	for i := 0; i < MAX_RULE_INFO+10; i++ {
+		rules.rules = append(rules.rules, Rule{Table: fmt.Sprintf("hive.t%v.*", i), MaxPartitions: 10})
+	}
+
+	emitConfigInfo(&cluster{flavor: prestoclient.FLAVOR_PRESTO})
+	if got := len(metricsSink.MetricSink.(*recordingSink).gauge("rule_info")); got != MAX_RULE_INFO {
+		t.Errorf("got %v rule_info series, want %v", got, MAX_RULE_INFO)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync/atomic"
+)
+
+/*
+	--debug-http serves the pprof profiles at /debug/pprof/ and a few internal counters as JSON at /debug/vars,
+	on the health check port. The counters are kept with atomics whether or not the endpoints are on, so the
+	collect path never waits on a lock for them.
+
+	/debug/pprof/cmdline and the standard expvar handler are left out on purpose, both show the command line,
+	which can hold passwords and webhook URLs.
+*/
+
+var (
+	// Queries whose detail was fetched and checked, since startup
+	queriesCheckedTotal int64
+	// Alerts handed to the notifiers, since startup
+	alertsSentTotal int64
+	// How long the last successful poll took
+	lastPollMillis int64
+)
+
+type debugVars struct {
+	CacheSize      int              `json:"cache_size"`
+	QueriesChecked int64            `json:"queries_checked_total"`
+	AlertsSent     int64            `json:"alerts_sent_total"`
+	LastPollMillis int64            `json:"last_poll_ms"`
+	Goroutines     int              `json:"goroutines"`
+	MemStats       runtime.MemStats `json:"memstats"`
+}
+
+func debugVarsHandler(resp http.ResponseWriter, request *http.Request) {
+	vars := debugVars{
+		QueriesChecked: atomic.LoadInt64(&queriesCheckedTotal),
+		AlertsSent:     atomic.LoadInt64(&alertsSentTotal),
+		LastPollMillis: atomic.LoadInt64(&lastPollMillis),
+		Goroutines:     runtime.NumGoroutine(),
+	}
+	for _, c := range clusters {
+		vars.CacheSize += c.cache.Len()
+	}
+	runtime.ReadMemStats(&vars.MemStats)
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(vars)
+}
+
+// startDebugHTTP registers the debug endpoints on mux when --debug-http is set
+func startDebugHTTP(mux *http.ServeMux) {
+	if !cfg.DebugHTTP {
+		return
+	}
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/vars", debugVarsHandler)
+	log.Warningf("Serving debug endpoints at /debug/pprof/ and /debug/vars on port [%v]", cfg.HealthHTTPPort)
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thecubed/prestowatcher/config"
+)
+
+/*
+	The decision journal records what the watcher saw and decided on every poll cycle, so that post-incident
+	reviews can reconstruct why a query was (or wasn't) alerted on. Entries are JSON lines with short keys to
+	keep the file small, and the file is compacted oldest-first once it grows past the configured size or the
+	oldest entry falls out of the retention window.
+
+	Every cluster is polled on its own, so decisions are kept per cluster and each cluster's poll writes its own
+	cycle entry, tagged with the cluster's name. replay-decision --cluster picks the cluster to look at.
+
+	Suppressions only live in memory, so the ones active when a cycle ends are written into its entry for a
+	replay to show what was silenced at the time.
+*/
+
+const (
+	JOURNAL_CYCLE   = "cycle"
+	JOURNAL_CONFIG  = "config"
+	JOURNAL_EVICTED = "evicted"
+
+	DECISION_ALERTED         = "alerted"
+	DECISION_ESCALATED       = "escalated"
+	DECISION_KILLED          = "killed"
+	DECISION_DRY_RUN_KILL    = "dry-run-kill"
+	DECISION_ALREADY_ALERTED = "already-alerted"
+	DECISION_OK              = "ok"
+	DECISION_OPTOUT          = "optout"
+	DECISION_IGNORED         = "ignored"
+	DECISION_SUPPRESSED      = "suppressed"
+	DECISION_CACHED          = "cached"
+	DECISION_ERROR           = "error"
+)
+
+type journalEntry struct {
+	Kind        string            `json:"k"`
+	Time        int64             `json:"t"`
+	Fingerprint string            `json:"f,omitempty"`
+	Cluster     string            `json:"cl,omitempty"`
+	Config      map[string]string `json:"c,omitempty"`
+	Queries     []queryDecision   `json:"q,omitempty"`
+	// Suppressions active at the end of the cycle
+	Suppressions []suppression `json:"s,omitempty"`
+}
+
+type queryDecision struct {
+	QueryID  string          `json:"id"`
+	User     string          `json:"u,omitempty"`
+	Type     string          `json:"ty,omitempty"`
+	Limit    int             `json:"l,omitempty"`
+	Severity string          `json:"sv,omitempty"`
+	Inputs   []inputDecision `json:"in,omitempty"`
+	Decision string          `json:"d"`
+}
+
+type inputDecision struct {
+	Table      string `json:"t"`
+	Partitions int    `json:"p"`
+	Limit      int    `json:"l,omitempty"`
+}
+
+type decisionJournal struct {
+	path        string
+	retention   time.Duration
+	maxBytes    int64
+	oldest      int64
+	fingerprint string
+
+	// Decisions are recorded from the check workers, flushes happen on the collector goroutines, each cluster's
+	// waiting for its own poll to end
+	sync.Mutex
+	pending map[*cluster][]queryDecision
+}
+
+// nil means disabled
+var journal *decisionJournal
+
+// Options that must never be written to disk
+func isSecretOption(name string) bool {
+	for _, s := range []string{"slack", "webhook", "password", "token", "secret", "key", "header"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// configSnapshot returns the effective command line options, keyed by long flag name, with secrets redacted
+func configSnapshot() map[string]string {
+	snap := make(map[string]string)
+	v := reflect.ValueOf(cfg.Options)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("long")
+		if name == "" {
+			continue
+		}
+		val := fmt.Sprintf("%v", v.Field(i).Interface())
+		if isSecretOption(name) && val != "" {
+			val = "<redacted>"
+		}
+		snap[name] = val
+	}
+	if fp := rules.Fingerprint(); fp != "" {
+		snap["rules-fingerprint"] = fp
+	}
+	return snap
+}
+
+func configFingerprint(snap map[string]string) string {
+	b, _ := json.Marshal(snap) // map keys are marshalled in sorted order
+	sum := sha1.Sum(b)
+	return hex.EncodeToString(sum[:6])
+}
+
+func newDecisionJournal(path string, retention time.Duration, maxBytes int64) (*decisionJournal, error) {
+	j := &decisionJournal{path: path, retention: retention, maxBytes: maxBytes, pending: make(map[*cluster][]queryDecision)}
+	entries, err := readJournal(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Kind == JOURNAL_CYCLE {
+			j.oldest = e.Time
+			break
+		}
+	}
+	return j, nil
+}
+
+func readJournal(path string) ([]journalEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []journalEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Warningf("Skipping unreadable decision journal line: %v", err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// record queues a decision for the cycle currently being collected on a cluster
+func (j *decisionJournal) record(c *cluster, d queryDecision) {
+	if j == nil {
+		return
+	}
+	j.Lock()
+	defer j.Unlock()
+	j.pending[c] = append(j.pending[c], d)
+}
+
+// flushCycle appends a cluster's current cycle (and the config in effect, if it changed) to the journal
+func (j *decisionJournal) flushCycle(c *cluster, now time.Time) {
+	if j == nil {
+		return
+	}
+	j.Lock()
+	defer j.Unlock()
+	pending := j.pending[c]
+	delete(j.pending, c)
+
+	snap := configSnapshot()
+	fp := configFingerprint(snap)
+
+	var lines []journalEntry
+	if fp != j.fingerprint {
+		lines = append(lines, journalEntry{Kind: JOURNAL_CONFIG, Time: now.Unix(), Fingerprint: fp, Config: snap})
+	}
+	lines = append(lines, journalEntry{Kind: JOURNAL_CYCLE, Time: now.Unix(), Fingerprint: fp, Cluster: c.displayName(), Queries: pending, Suppressions: suppressions.active()})
+
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Errorf("Unable to open decision journal [%v]: %v", j.path, err)
+		return
+	}
+	enc := json.NewEncoder(f)
+	for _, l := range lines {
+		if err := enc.Encode(l); err != nil {
+			log.Errorf("Unable to write decision journal [%v]: %v", j.path, err)
+			f.Close()
+			return
+		}
+	}
+	stat, err := f.Stat()
+	f.Close()
+	if err != nil {
+		return
+	}
+
+	j.fingerprint = fp
+	if j.oldest == 0 {
+		j.oldest = now.Unix()
+	}
+	if stat.Size() > j.maxBytes || j.oldest < now.Add(-j.retention).Unix() {
+		j.compact(now)
+	}
+}
+
+// compact drops cycles oldest-first until the journal is inside both the retention window and 3/4 of the size
+// limit, leaving a marker so replays can tell evicted data apart from times the watcher wasn't running.
+func (j *decisionJournal) compact(now time.Time) {
+	entries, err := readJournal(j.path)
+	if err != nil {
+		log.Errorf("Unable to read decision journal [%v] for compaction: %v", j.path, err)
+		return
+	}
+
+	var cycles []journalEntry
+	configs := make(map[string]journalEntry)
+	var evictedBefore int64
+	sizes := make(map[int]int)
+	var total int
+	for _, e := range entries {
+		switch e.Kind {
+		case JOURNAL_CYCLE:
+			b, _ := json.Marshal(e)
+			sizes[len(cycles)] = len(b) + 1
+			total += len(b) + 1
+			cycles = append(cycles, e)
+		case JOURNAL_CONFIG:
+			configs[e.Fingerprint] = e
+		case JOURNAL_EVICTED:
+			evictedBefore = e.Time
+		}
+	}
+
+	cutoff := now.Add(-j.retention).Unix()
+	target := int(j.maxBytes * 3 / 4)
+	drop := 0
+	for drop < len(cycles) && (cycles[drop].Time < cutoff || total > target) {
+		total -= sizes[drop]
+		evictedBefore = cycles[drop].Time + 1
+		drop++
+	}
+	cycles = cycles[drop:]
+
+	tmp := j.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		log.Errorf("Unable to compact decision journal [%v]: %v", j.path, err)
+		return
+	}
+	enc := json.NewEncoder(f)
+	if evictedBefore > 0 {
+		enc.Encode(journalEntry{Kind: JOURNAL_EVICTED, Time: evictedBefore})
+	}
+	written := make(map[string]bool)
+	for _, c := range cycles {
+		if conf, ok := configs[c.Fingerprint]; ok && !written[c.Fingerprint] {
+			enc.Encode(conf)
+			written[c.Fingerprint] = true
+		}
+		enc.Encode(c)
+	}
+	if err := f.Close(); err != nil {
+		log.Errorf("Unable to compact decision journal [%v]: %v", j.path, err)
+		return
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		log.Errorf("Unable to compact decision journal [%v]: %v", j.path, err)
+		return
+	}
+
+	j.oldest = 0
+	if len(cycles) > 0 {
+		j.oldest = cycles[0].Time
+	}
+	log.Infof("Compacted decision journal [%v], evicted [%v] cycles", j.path, drop)
+}
+
+// startJournal sets up the decision journal if one was configured
+func startJournal() {
+	if cfg.DecisionLog == "" {
+		return
+	}
+	var err error
+	retention, maxBytes := cfg.DecisionRetention, cfg.DecisionLogMaxBytes
+	journal, err = newDecisionJournal(cfg.DecisionLog, retention, maxBytes)
+	if err != nil {
+		log.Fatalf("Unable to open decision journal [%v]: %v", cfg.DecisionLog, err)
+	}
+	log.Infof("Recording decisions to [%v], retention [%v], max size [%v] bytes", cfg.DecisionLog, retention, maxBytes)
+}
+
+// replayDecision prints the decision the watcher made for a query in the last cycle of the cluster at or before
+// the given time
+func replayDecision(cmd config.ReplayDecisionOptions, out io.Writer) int {
+	if cfg.DecisionLog == "" {
+		fmt.Fprintln(out, "No decision journal configured, pass --decision-log")
+		return 1
+	}
+	at, err := time.Parse(time.RFC3339, cmd.At)
+	if err != nil {
+		fmt.Fprintf(out, "Unable to parse time '%s': %v\n", cmd.At, err)
+		return 1
+	}
+	entries, err := readJournal(cfg.DecisionLog)
+	if err != nil {
+		fmt.Fprintf(out, "Unable to read decision journal [%v]: %v\n", cfg.DecisionLog, err)
+		return 1
+	}
+
+	var evictedBefore int64
+	configs := make(map[string]journalEntry)
+	var cycle *journalEntry
+	others := make(map[string]bool)
+	for i, e := range entries {
+		switch e.Kind {
+		case JOURNAL_EVICTED:
+			evictedBefore = e.Time
+		case JOURNAL_CONFIG:
+			configs[e.Fingerprint] = e
+		case JOURNAL_CYCLE:
+			if e.Cluster != cmd.Cluster {
+				others[e.Cluster] = true
+			} else if e.Time <= at.Unix() {
+				cycle = &entries[i]
+			}
+		}
+	}
+
+	if at.Unix() < evictedBefore {
+		fmt.Fprintf(out, "Data for %v has been EVICTED from the decision journal. The oldest retained data starts at %v.\n",
+			at.UTC().Format(time.RFC3339), time.Unix(evictedBefore, 0).UTC().Format(time.RFC3339))
+		return 2
+	}
+	if cycle == nil {
+		fmt.Fprintf(out, "No poll cycle%v was recorded at or before %v.\n", clusterText(cmd.Cluster), at.UTC().Format(time.RFC3339))
+		if len(others) > 0 {
+			var names []string
+			for name := range others {
+				names = append(names, fmt.Sprintf("%q", name))
+			}
+			sort.Strings(names)
+			fmt.Fprintf(out, "The journal has cycles of the clusters %v, pick one with --cluster.\n", strings.Join(names, ", "))
+		}
+		return 2
+	}
+
+	fmt.Fprintf(out, "Reconstructing decision for query [%v]%v at %v\n", cmd.QueryID, clusterText(cmd.Cluster), at.UTC().Format(time.RFC3339))
+	fmt.Fprintf(out, "Closest poll cycle ran at %v (%v before the requested time)\n\n",
+		time.Unix(cycle.Time, 0).UTC().Format(time.RFC3339), at.Sub(time.Unix(cycle.Time, 0)))
+
+	fmt.Fprintf(out, "Config in effect (fingerprint %v):\n", cycle.Fingerprint)
+	if conf, ok := configs[cycle.Fingerprint]; ok {
+		var keys []string
+		for k := range conf.Config {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(out, "  %v = %v\n", k, conf.Config[k])
+		}
+	} else {
+		fmt.Fprintln(out, "  (not recorded)")
+	}
+	fmt.Fprintln(out)
+
+	for _, q := range cycle.Queries {
+		if q.QueryID != cmd.QueryID {
+			continue
+		}
+		fmt.Fprintf(out, "Query:     %v\n", q.QueryID)
+		fmt.Fprintf(out, "User:      %v\n", q.User)
+		fmt.Fprintf(out, "Type:      %v\n", q.Type)
+		fmt.Fprintf(out, "Default limit: %v partitions\n", q.Limit)
+		fmt.Fprintf(out, "Decision:  %v\n", q.Decision)
+		for _, in := range q.Inputs {
+			fmt.Fprintf(out, "  Input %v: %v partitions (limit %v)\n", in.Table, in.Partitions, in.Limit)
+		}
+		printSuppressions(out, cycle.Suppressions, q)
+		return 0
+	}
+	fmt.Fprintf(out, "Query [%v] was not among the RUNNING queries seen in that cycle (%v queries seen).\n", cmd.QueryID, len(cycle.Queries))
+	return 3
+}
+
+// printSuppressions lists the suppressions active in a cycle, pointing out the ones covering the query
+func printSuppressions(out io.Writer, active []suppression, q queryDecision) {
+	fmt.Fprintln(out)
+	if len(active) == 0 {
+		fmt.Fprintln(out, "Suppressions active: none")
+		return
+	}
+	fmt.Fprintln(out, "Suppressions active:")
+	for _, s := range active {
+		var covered []string
+		for _, in := range q.Inputs {
+			if s.covers(q.User, in.Table) {
+				covered = append(covered, in.Table)
+			}
+		}
+		line := fmt.Sprintf("  [%v] user [%v] table [%v] until %v", s.ID, s.User, s.Table, s.Expires.UTC().Format(time.RFC3339))
+		if len(covered) > 0 {
+			line += fmt.Sprintf(", covers %v", strings.Join(covered, ", "))
+		}
+		fmt.Fprintln(out, line)
+	}
+}
+
+// clusterText is " of cluster [name]" for a named cluster, empty for the unnamed one
+func clusterText(name string) string {
+	if name == "" {
+		return ""
+	}
+	return fmt.Sprintf(" of cluster [%v]", name)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thecubed/prestowatcher/config"
+)
+
+// tempJournal is a decision journal in a fresh temp directory, removed by the returned func
+func tempJournal(t *testing.T) (*decisionJournal, func()) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.DecisionLog = filepath.Join(dir, "decisions.jsonl")
+	j, err := newDecisionJournal(cfg.DecisionLog, 24*time.Hour, 1<<20)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return j, func() { os.RemoveAll(dir) }
+}
+
+func TestJournalPerCluster(t *testing.T) {
+	defer setupTest()()
+	j, cleanup := tempJournal(t)
+	defer cleanup()
+
+	adhoc, etl := &cluster{name: "adhoc"}, &cluster{name: "etl"}
+	polled := time.Date(2023, 1, 2, 10, 0, 0, 0, time.UTC)
+	// Both clusters run a query with the same ID, the adhoc poll ends while the etl one is still going
+	j.record(adhoc, queryDecision{QueryID: "q1", User: "alice", Decision: DECISION_ALERTED})
+	j.record(etl, queryDecision{QueryID: "q1", User: "etl", Decision: DECISION_OK})
+	j.record(etl, queryDecision{QueryID: "q2", User: "etl", Decision: DECISION_OK})
+	j.flushCycle(adhoc, polled)
+	j.record(adhoc, queryDecision{QueryID: "q3", User: "bob", Decision: DECISION_OK})
+	j.flushCycle(etl, polled.Add(time.Second))
+
+	entries, err := readJournal(cfg.DecisionLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]int)
+	for _, e := range entries {
+		if e.Kind == JOURNAL_CYCLE {
+			seen[e.Cluster] = len(e.Queries)
+		}
+	}
+	if len(seen) != 2 || seen["adhoc"] != 1 || seen["etl"] != 2 {
+		t.Errorf("got cycles %v, want one of adhoc with 1 query and one of etl with 2", seen)
+	}
+
+	for _, tc := range []struct {
+		cluster  string
+		code     int
+		contains string
+	}{
+		{"adhoc", 0, "Decision:  " + DECISION_ALERTED},
+		{"etl", 0, "Decision:  " + DECISION_OK},
+		{"", 2, `cycles of the clusters "adhoc", "etl"`},
+	} {
+		var out bytes.Buffer
+		code := replayDecision(config.ReplayDecisionOptions{At: "2023-01-02T10:05:00Z", QueryID: "q1", Cluster: tc.cluster}, &out)
+		if code != tc.code || !strings.Contains(out.String(), tc.contains) {
+			t.Errorf("--cluster %q: got %v and\n%v\nwant %v and %q", tc.cluster, code, out.String(), tc.code, tc.contains)
+		}
+	}
+}
+
+func TestJournalSuppressions(t *testing.T) {
+	defer setupTest()()
+	j, cleanup := tempJournal(t)
+	defer cleanup()
+
+	c := &cluster{}
+	polled := time.Now().Truncate(time.Second)
+	suppressions.add("mode", "", time.Hour)
+	suppressions.add("", "hive.events.*", 2*time.Hour)
+	j.record(c, queryDecision{QueryID: "q1", User: "alice", Inputs: []inputDecision{{Table: "hive.events.clicks", Partitions: 90, Limit: 30}}, Decision: DECISION_SUPPRESSED})
+	j.flushCycle(c, polled)
+	// Suppressions lifted after the cycle stay in its entry
+	for _, s := range suppressions.active() {
+		suppressions.remove(s.ID)
+	}
+
+	var out bytes.Buffer
+	if code := replayDecision(config.ReplayDecisionOptions{At: polled.UTC().Format(time.RFC3339), QueryID: "q1"}, &out); code != 0 {
+		t.Fatalf("got %v:\n%v", code, out.String())
+	}
+	var listed []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, "  [") {
+			listed = append(listed, line)
+		}
+	}
+	if len(listed) != 2 || strings.Contains(listed[0], "covers") || !strings.HasSuffix(listed[1], ", covers hive.events.clicks") {
+		t.Errorf("got suppressions %q, want the table one covering the query:\n%v", listed, out.String())
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/ashwanthkumar/slack-go-webhook"
+	"github.com/thecubed/prestowatcher/config"
+)
+
+/*
+	Digest mode batches Slack alerts into one summary message every --digest-interval, so a bad afternoon
+	doesn't get the webhook rate-limited and the channel muted. Kills, queue and full scan alerts and follow-ups
+	still go out right away. Other notifiers are not affected.
+*/
+
+// digestNotifier stands in for the Slack notifier when digest mode is on
+type digestNotifier struct {
+	slack *slackNotifier
+
+	sync.Mutex
+	pending []Alert
+}
+
+var digest *digestNotifier
+
+func (d *digestNotifier) Name() string { return config.NOTIFIER_SLACK }
+
+func (d *digestNotifier) Notify(alert Alert) error {
+	// Kills already happened and queue alerts are about the cluster right now, neither can wait. Full scans,
+	// follow-ups and user load alerts don't fit the summary's partition counts.
+	if alert.KillReason != "" || alert.QueuedFor > 0 || len(alert.FullScans) > 0 || alert.FinalState != "" || len(alert.UserQueries) > 0 {
+		return d.slack.Notify(alert)
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.pending = append(d.pending, alert)
+	return nil
+}
+
+// flush posts the summary of everything alerted since the last flush, if anything was
+func (d *digestNotifier) flush() error {
+	d.Lock()
+	alerts := d.pending
+	d.pending = nil
+	d.Unlock()
+	if len(alerts) == 0 {
+		return nil
+	}
+
+	if err := d.slack.send(d.slack.url, digestPayload(alerts)); err != nil {
+		return err
+	}
+	log.Infof("Sent Slack digest of [%v] alerts", len(alerts))
+	return nil
+}
+
+// digestPayload summarizes alerts in one message, an attachment per query
+func digestPayload(alerts []Alert) slack.Payload {
+	var total int
+	// Queries and partitions by query type
+	queries := make(map[string]int)
+	partitions := make(map[string]int)
+	var attachments []slack.Attachment
+	for _, a := range alerts {
+		total += a.TotalPartitions
+		qType := queryType(a.Query)
+		queries[qType]++
+		partitions[qType] += a.TotalPartitions
+		var tables []string
+		for _, i := range a.BadInputs {
+			tables = append(tables, fmt.Sprintf("%v (%v)", tableName(i), partitionCountText(i)))
+		}
+		sort.Strings(tables)
+
+		color := "warning"
+		title := a.Cluster.prefix() + a.Query.QueryID
+		link := primaryQueryURL(a.Cluster, a.Query.QueryID)
+		attachment := slack.Attachment{Color: &color, Title: &title, TitleLink: &link}
+		if alternate := slackAlternateLinks(a.Cluster, a.Query.QueryID); alternate != "" {
+			text := strings.TrimSuffix(alternate, "\n")
+			attachment.Text = &text
+		}
+		attachment.AddField(slack.Field{Title: "User", Value: a.Query.Session.User, Short: true})
+		attachment.AddField(slack.Field{Title: "Partitions", Value: fmt.Sprintf("%v", a.TotalPartitions), Short: true})
+		attachment.AddField(slack.Field{Title: "Query Type", Value: qType, Short: true})
+		attachment.AddField(slack.Field{Title: "Tables", Value: strings.Join(tables, "\n")})
+		if len(a.Breaches) > 0 {
+			attachment.AddField(slack.Field{Title: "Limits", Value: breachText(a.Breaches)})
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	return slack.Payload{
+		Text: fmt.Sprintf(":bomb: *%v* Presto queries went over their limits in the last %v, searching through *%v* partitions in total. :sql_bandit:\n"+
+			"Reads: *%v* queries, *%v* partitions. Writes: *%v* queries, *%v* partitions.\n"+
+			peakHourText()+
+			"Make sure your queries filter on the partition columns of the tables they read!\n\n"+
+			"*If you want to disable these alerts for a query*, add `-- %v` somewhere in it.",
+			len(alerts), cfg.DigestInterval, total,
+			queries[QUERY_TYPE_READ], partitions[QUERY_TYPE_READ], queries[QUERY_TYPE_WRITE], partitions[QUERY_TYPE_WRITE],
+			cfg.OptOutTag),
+		Attachments: attachments,
+	}
+}
+
+// peakHourText is the line with the hour most alerts happen at, empty while nothing was seen
+func peakHourText() string {
+	peak := hourly.peakHour()
+	if peak < 0 {
+		return ""
+	}
+	return fmt.Sprintf("Peak abuse hour since startup: *%02d:00* %v.\n", peak, cfg.DisplayLocation)
+}
+
+// startDigest posts the digest every --digest-interval
+func startDigest() {
+	if digest == nil {
+		return
+	}
+	ticker := time.NewTicker(cfg.DigestInterval.Duration)
+	go func() {
+		for range ticker.C {
+			flushDigest()
+		}
+	}()
+}
+
+// flushDigest sends the pending digest now, e.g. on shutdown
+func flushDigest() {
+	if digest == nil {
+		return
+	}
+	if err := digest.flush(); err != nil {
+		log.Errorf("Error sending Slack digest: %v", err)
+		metricsSink.IncrCounterWithLabels(
+			metricKey("notify_errors"),
+			1.0,
+			[]metrics.Label{
+				{
+					Name:  "backend",
+					Value: config.NOTIFIER_SLACK,
+				},
+			},
+		)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thecubed/prestowatcher/config"
+)
+
+func TestDigestReadWriteBreakdown(t *testing.T) {
+	defer setupTest()()
+	cfg.DigestInterval.Duration = 5 * time.Minute
+
+	read := testQuery("read", "alice", "SELECT * FROM events.clicks", 45)
+	otherRead := testQuery("other-read", "bob", "SELECT * FROM events.clicks", 40)
+	write := testQuery("write", "etl", "INSERT INTO events.daily SELECT * FROM events.clicks", 120)
+	var alerts []Alert
+	for _, q := range []PrestoQuery{read, otherRead, write} {
+		alerts = append(alerts, Alert{Query: q, BadInputs: q.Inputs, TotalPartitions: len(q.Inputs[0].ConnectorInfo.PartitionIds), Severity: config.SEVERITY_WARNING})
+	}
+
+	payload := digestPayload(alerts)
+	if want := "Reads: *2* queries, *85* partitions. Writes: *1* queries, *120* partitions."; !strings.Contains(payload.Text, want) {
+		t.Errorf("the digest doesn't break the alerts down by type, want %q in\n%v", want, payload.Text)
+	}
+	for i, want := range []string{QUERY_TYPE_READ, QUERY_TYPE_READ, QUERY_TYPE_WRITE} {
+		var got string
+		for _, f := range payload.Attachments[i].Fields {
+			if f.Title == "Query Type" {
+				got = f.Value
+			}
+		}
+		if got != want {
+			t.Errorf("%v: got query type %q, want %q", alerts[i].Query.QueryID, got, want)
+		}
+	}
+}
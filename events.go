@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/thecubed/prestowatcher/config"
+)
+
+/*
+	Alert decision events for downstream automation, like a coaching bot or cost attribution, that shouldn't
+	have to scrape Slack. With --events every decision that goes into the audit log is also published as a JSON
+	event: the audit record plus the cluster and EVENT_SCHEMA_VERSION, which is bumped whenever a field changes
+	meaning or goes away so consumers can tell. Adding fields doesn't bump it.
+
+	--events=http POSTs each event to --events-url. --events=kafka produces it to --kafka-topic on the brokers in
+	--kafka-brokers, keyed by query ID so a query's events stay in order, see kafka.go.
+
+	Like the audit log, events are handed to a publisher goroutine through a buffered channel so a slow endpoint
+	never holds up a poll. Events that don't fit in the buffer are dropped and counted in
+	presto.watcher.events_dropped, delivery failures are logged and counted in presto.watcher.events_failed.
+	In a dry run events are only logged.
+*/
+
+const (
+	EVENT_SCHEMA_VERSION = 1
+	EVENTS_BUFFER        = 1024
+)
+
+type alertEvent struct {
+	SchemaVersion int    `json:"schema_version"`
+	Cluster       string `json:"cluster,omitempty"`
+	auditRecord
+}
+
+type eventPublisher struct {
+	// Where events are POSTed by the http publisher
+	url string
+	// Producer of the kafka publisher, nil for http
+	kafka   *kafkaProducer
+	events  chan alertEvent
+	dropped int64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// nil means disabled
+var events *eventPublisher
+
+// startEvents starts the --events publisher, if one was chosen
+func startEvents() {
+	p := &eventPublisher{
+		events: make(chan alertEvent, EVENTS_BUFFER),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	switch cfg.Events {
+	case config.EVENTS_HTTP:
+		p.url = cfg.EventsURL
+	case config.EVENTS_KAFKA:
+		p.kafka = newKafkaEventProducer()
+	default:
+		return
+	}
+	events = p
+	go p.run()
+	log.Infof("Publishing alert decision events with the [%v] publisher", cfg.Events)
+}
+
+// publish queues an event for the publisher, dropping it if the publisher is that far behind
+func (p *eventPublisher) publish(c *cluster, r auditRecord) {
+	if p == nil {
+		return
+	}
+	e := alertEvent{SchemaVersion: EVENT_SCHEMA_VERSION, Cluster: c.displayName(), auditRecord: r}
+	select {
+	case p.events <- e:
+	default:
+		n := atomic.AddInt64(&p.dropped, 1)
+		metricsSink.IncrCounter(metricKey("events_dropped"), 1.0)
+		log.Errorf("Dropped the event for query [%v], the buffer is full ([%v] dropped so far)", r.QueryID, n)
+	}
+}
+
+// send delivers one event
+func (p *eventPublisher) send(e alertEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if cfg.DryRun {
+		log.Infof("Dry run, not publishing event: %s", b)
+		return nil
+	}
+	if p.kafka != nil {
+		return p.kafka.produce([]byte(e.QueryID), b)
+	}
+	req, err := http.NewRequest("POST", p.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%v: %s", resp.Status, snippet)
+	}
+	return nil
+}
+
+func (p *eventPublisher) deliver(e alertEvent) {
+	if err := p.send(e); err != nil {
+		metricsSink.IncrCounter(metricKey("events_failed"), 1.0)
+		log.Errorf("Unable to publish the event for query [%v]: %v", e.QueryID, err)
+		return
+	}
+	metricsSink.IncrCounter(metricKey("events_published"), 1.0)
+}
+
+func (p *eventPublisher) run() {
+	defer close(p.done)
+	if p.kafka != nil {
+		defer p.kafka.disconnect()
+	}
+	for {
+		select {
+		case e := <-p.events:
+			p.deliver(e)
+		case <-p.stop:
+			// Deliver whatever is still buffered
+			for {
+				select {
+				case e := <-p.events:
+					p.deliver(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// close delivers the buffered events, waiting at most the given time
+func (p *eventPublisher) close(wait time.Duration) {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	select {
+	case <-p.done:
+	case <-time.After(wait):
+		log.Warningf("Event publisher still delivering after [%v], not waiting for it", wait)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thecubed/prestowatcher/config"
+)
+
+// startTestEvents starts the --events publisher, the returned func flushes it and turns it off again
+func startTestEvents() (stop func()) {
+	startEvents()
+	return func() {
+		events.close(5 * time.Second)
+		events = nil
+	}
+}
+
+func TestEventsHTTP(t *testing.T) {
+	defer setupTest()()
+	var lock sync.Mutex
+	var bodies []alertEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e alertEvent
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &e); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %v %s", r.Header, body)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		bodies = append(bodies, e)
+	}))
+	defer server.Close()
+	cfg.Events, cfg.EventsURL = config.EVENTS_HTTP, server.URL
+	stop := startTestEvents()
+
+	c, _ := testCluster(newFakePresto(testQuery("q1", "alice", "SELECT * FROM events.clicks", 45)))
+	c.name = "etl"
+	if err := checkQuery(context.Background(), c, PrestoQuery{QueryID: "q1"}, &cachedQuery{}); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+
+	if len(bodies) != 1 {
+		t.Fatalf("got events %+v, want one", bodies)
+	}
+	e := bodies[0]
+	if e.SchemaVersion != EVENT_SCHEMA_VERSION || e.Cluster != "etl" || e.QueryID != "q1" || e.User != "alice" || e.Decision != DECISION_ALERTED {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if len(e.Inputs) != 1 || e.Inputs[0].Table != "hive.events.clicks" || e.Inputs[0].Partitions != 45 {
+		t.Errorf("got inputs %+v", e.Inputs)
+	}
+	if got := metricsSink.MetricSink.(*recordingSink).count("events_published"); got != 1 {
+		t.Errorf("got %v events_published", got)
+	}
+}
+
+func TestEventsKafka(t *testing.T) {
+	defer setupTest()()
+	kafka := newFakeKafka(t, 1, "prestowatcher.alerts", 0)
+	defer kafka.close()
+	cfg.Events, cfg.KafkaBrokers, cfg.KafkaTopic = config.EVENTS_KAFKA, kafka.addr(0), "prestowatcher.alerts"
+	stop := startTestEvents()
+	events.publish(nil, auditRecord{QueryID: "q1", User: "alice", Decision: DECISION_ALERTED})
+	stop()
+
+	records := kafka.produced(0)
+	if len(records) != 1 || records[0].key != "q1" {
+		t.Fatalf("got records %+v, want one keyed by the query ID", records)
+	}
+	var e alertEvent
+	if err := json.Unmarshal([]byte(records[0].value), &e); err != nil || e.SchemaVersion != EVENT_SCHEMA_VERSION || e.User != "alice" {
+		t.Errorf("got event %v, %v", records[0].value, err)
+	}
+}
+
+func TestEventsFailed(t *testing.T) {
+	defer setupTest()()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	cfg.Events, cfg.EventsURL = config.EVENTS_HTTP, server.URL
+	stop := startTestEvents()
+	events.publish(nil, auditRecord{QueryID: "q1"})
+	events.publish(nil, auditRecord{QueryID: "q2"})
+	stop()
+
+	sink := metricsSink.MetricSink.(*recordingSink)
+	if sink.count("events_failed") != 2 || sink.count("events_published") != 0 {
+		t.Errorf("got %v events_failed and %v events_published", sink.count("events_failed"), sink.count("events_published"))
+	}
+}
+
+func TestEventsQueueFull(t *testing.T) {
+	defer setupTest()()
+	// Nothing is delivering, like a publisher stuck on a slow endpoint
+	p := &eventPublisher{events: make(chan alertEvent, 2)}
+	for _, id := range []string{"q1", "q2", "q3", "q4"} {
+		p.publish(nil, auditRecord{QueryID: id})
+	}
+	if len(p.events) != 2 || p.dropped != 2 {
+		t.Errorf("got %v queued and %v dropped, want 2 of each", len(p.events), p.dropped)
+	}
+	if got := metricsSink.MetricSink.(*recordingSink).count("events_dropped"); got != 2 {
+		t.Errorf("got %v events_dropped", got)
+	}
+	// Without a publisher nothing happens
+	events.publish(nil, auditRecord{QueryID: "q1"})
+}
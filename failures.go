@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+/*
+	With --watch-failures, flagged queries that go on to fail get a follow-up saying why, e.g. that they exceeded
+	the memory limit, which is the context the user needs. Every query we alert on is marked as awaiting its
+	outcome in the query cache, so the marker survives restarts with --cache-file. Every poll also lists the
+	recently FAILED and FINISHED queries. A marked query that failed is fetched for its errorCode, errorType and
+	failureInfo.message and followed up on; one that finished just loses its marker.
+
+	A query that shows up more than --failure-watch-timeout after it was flagged loses its marker without a
+	follow-up, and markers on queries that never show up go with their cache entry. Queries we never flagged
+	never get a failure message. The completion follow-up for a FAILED query is left to this one, so the user
+	gets one message with the reason instead of two.
+*/
+
+// awaitOutcome marks an alerted query as awaiting its outcome, the first time it's alerted on
+func awaitOutcome(entry *cachedQuery, now time.Time) {
+	if !cfg.WatchFailures || !entry.FlaggedAt.IsZero() {
+		return
+	}
+	entry.AwaitingOutcome = true
+	entry.FlaggedAt = now
+}
+
+// checkOutcomes follows up on the flagged queries that have failed since the last poll
+func checkOutcomes(ctx context.Context, c *cluster, now time.Time) {
+	finished, err := getQueriesInState(ctx, c, "finished")
+	if err != nil {
+		log.Errorf("%vGot error while collecting finished queries: %v", c.prefix(), err)
+		c.metrics.IncrCounter(metricKey("check_errors"), 1.0)
+	}
+	for _, query := range finished {
+		if entry, found := c.cache.Get(query.QueryID); found && entry.AwaitingOutcome {
+			entry.AwaitingOutcome = false
+			c.cache.Set(query.QueryID, entry)
+		}
+	}
+
+	failed, err := getQueriesInState(ctx, c, "failed")
+	if err != nil {
+		log.Errorf("%vGot error while collecting failed queries: %v", c.prefix(), err)
+		c.metrics.IncrCounter(metricKey("check_errors"), 1.0)
+		return
+	}
+	for _, query := range failed {
+		entry, found := c.cache.Get(query.QueryID)
+		if !found || !entry.AwaitingOutcome {
+			continue
+		}
+		entry.AwaitingOutcome = false
+		c.cache.Set(query.QueryID, entry)
+		if waited := now.Sub(entry.FlaggedAt); waited > cfg.FailureWatchTimeout.Duration {
+			log.Debugf("%vFlagged query [%v] failed [%v] after we alerted on it, too late for a follow-up", c.prefix(), query.QueryID, formatDuration(waited))
+			continue
+		}
+
+		// The overview has no failureInfo, the detail does
+		detail := query
+		if found, err := getQuery(ctx, c, query.QueryID); err == nil {
+			detail = found[0]
+		} else {
+			log.Warningf("%vUnable to get the detail of failed query [%v], following up without it: %v", c.prefix(), query.QueryID, err)
+		}
+
+		reason := failureReason(detail)
+		log.Infof("%vFlagged query [%v] by user [%v] has failed: %v", c.prefix(), query.QueryID, detail.Session.User, reason)
+		c.metrics.IncrCounter(metricKey("failure_follow_ups"), 1.0)
+		ev := evaluateQuery(detail)
+		thread := entry.SlackThread
+		followUp := Alert{Cluster: c, Query: detail, BadInputs: ev.BadInputs, FullScans: ev.FullScans, FinalState: "FAILED", FailureReason: reason, Thread: &thread}
+		followUp.ScannedBytes, followUp.Runtime = queryResources(detail)
+		notify(ctx, followUp)
+	}
+}
+
+// failureReason sums up why a query failed, e.g. "EXCEEDED_LOCAL_MEMORY_LIMIT (INSUFFICIENT_RESOURCES): Query
+// exceeded per-node user memory limit of 10GB"
+func failureReason(query PrestoQuery) string {
+	name, kind := query.ErrorCode.Name, query.ErrorCode.Type
+	if kind == "" {
+		kind = query.ErrorType
+	}
+	reason := name
+	switch {
+	case name == "" && kind == "":
+		reason = "unknown error"
+	case name == "":
+		reason = kind
+	case kind != "":
+		reason = fmt.Sprintf("%v (%v)", name, kind)
+	}
+	if query.FailureInfo.Message != "" {
+		reason += ": " + query.FailureInfo.Message
+	}
+	return reason
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"path"
+	"strings"
+
+	"github.com/thecubed/prestowatcher/config"
+)
+
+/*
+	User, source and schema filters for alerting. --ignore-users / --ignore-sources / --ignore-schemas drop
+	matches from alerting, --only-users / --only-schemas restrict alerting to matches. Patterns are case-insensitive globs such as
+	tmp_*. Filtered queries are still measured and emitted as metrics, and can still be killed.
+*/
+
+// matchesAny tells whether value matches one of the comma separated glob patterns
+func matchesAny(patterns string, value string) bool {
+	value = strings.ToLower(value)
+	for _, p := range config.SplitList(patterns) {
+		if ok, _ := path.Match(strings.ToLower(p), value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// userAlertable tells whether queries from user should be alerted on at all
+func userAlertable(user string) bool {
+	if matchesAny(cfg.IgnoreUsers, user) {
+		return false
+	}
+	return cfg.OnlyUsers == "" || matchesAny(cfg.OnlyUsers, user)
+}
+
+// sourceAlertable tells whether queries from a client source, e.g. an Airflow DAG, should be alerted on at all
+func sourceAlertable(source string) bool {
+	return source == "" || !matchesAny(cfg.IgnoreSources, source)
+}
+
+// alertableInputs drops the inputs on schemas we don't alert for
+func alertableInputs(inputs []PrestoInput) []PrestoInput {
+	var kept []PrestoInput
+	for _, i := range inputs {
+		if matchesAny(cfg.IgnoreSchemas, i.Schema) {
+			continue
+		}
+		if cfg.OnlySchemas != "" && !matchesAny(cfg.OnlySchemas, i.Schema) {
+			continue
+		}
+		kept = append(kept, i)
+	}
+	return kept
+}
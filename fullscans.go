@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+/*
+	Queries that don't filter on partitions at all, like a SELECT * without a date predicate. Presto lists no
+	partitions for such an input, which looks the same as a table that isn't partitioned, so full scans are only
+	detected on the tables in --partitioned-tables-file. It lists one schema.table per line:
+
+		# Comments and blank lines are ignored
+		events.pageviews
+		events.clicks
+
+	A full scan gets its own "no partition filter detected" alert, once per query. The file is read at startup.
+*/
+
+// Lower case schema.table names of the tables known to be partitioned, read-only after startup
+var partitionedTables map[string]bool
+
+func parsePartitionedTables(data []byte) (map[string]bool, error) {
+	tables := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ".")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("line %v: expected schema.table, got '%v'", n, line)
+		}
+		tables[strings.ToLower(line)] = true
+	}
+	return tables, scanner.Err()
+}
+
+// startPartitionedTables reads --partitioned-tables-file, if one was given
+func startPartitionedTables() {
+	if cfg.PartitionedTablesFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(cfg.PartitionedTablesFile)
+	if err != nil {
+		log.Fatalf("Unable to read partitioned tables file [%v]: %v", cfg.PartitionedTablesFile, err)
+	}
+	partitionedTables, err = parsePartitionedTables(data)
+	if err != nil {
+		log.Fatalf("Unable to parse partitioned tables file [%v]: %v", cfg.PartitionedTablesFile, err)
+	}
+	log.Infof("Watching [%v] partitioned tables for full scans", len(partitionedTables))
+}
+
+// fullScan tells whether an input reads a partitioned table without any partition pruning
+func fullScan(input PrestoInput) bool {
+	if len(input.ConnectorInfo.PartitionIds) > 0 || input.ConnectorInfo.Truncated {
+		return false
+	}
+	return partitionedTables[strings.ToLower(input.Schema+"."+input.Table)]
+}
+
+// tableNames lists the names of inputs for messages
+func tableNames(inputs []PrestoInput) string {
+	var names []string
+	for _, i := range inputs {
+		names = append(names, tableName(i))
+	}
+	return strings.Join(names, ", ")
+}
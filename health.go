@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Liveness and readiness for Kubernetes. /healthz answers as long as the process is serving HTTP. /readyz
+	fails when the last successful poll is older than 3 intervals or the last --ready-max-failures polls all
+	failed, so "Presto is down" can be told apart from "the watcher is wedged". The poll bookkeeping is
+	written by the collectors and read by the handlers, so it's only accessed atomically.
+
+	With several clusters each one is judged on its own, and the watcher is only unready once more than
+	--max-stale-clusters of them are.
+*/
+
+// pollOverdue is true when the last successful poll is more than 3 intervals ago
+func pollOverdue(secondsSince int64) bool {
+	return time.Duration(secondsSince)*time.Second > 3*cfg.UpdateInterval.Duration
+}
+
+type readiness struct {
+	Ready bool `json:"ready"`
+	// The worst of the clusters
+	SecondsSinceLastPoll int64   `json:"seconds_since_last_poll"`
+	ConsecutiveFailures  int64   `json:"consecutive_failures"`
+	IntervalSeconds      float64 `json:"interval_seconds"`
+	// Another replica holds the leader lock and does the polling
+	Standby bool `json:"standby,omitempty"`
+	// Every cluster, when they're named
+	Clusters []clusterReadiness `json:"clusters,omitempty"`
+}
+
+type clusterReadiness struct {
+	Name                 string `json:"name"`
+	Ready                bool   `json:"ready"`
+	SecondsSinceLastPoll int64  `json:"seconds_since_last_poll"`
+	ConsecutiveFailures  int64  `json:"consecutive_failures"`
+}
+
+// clusterHealth reports on every cluster and tells whether few enough of them are stale
+func clusterHealth() (r readiness) {
+	stale := 0
+	for _, c := range clusters {
+		cr := clusterReadiness{
+			Name:                 c.name,
+			SecondsSinceLastPoll: c.secondsSinceLastPoll(),
+			ConsecutiveFailures:  atomic.LoadInt64(&c.consecutiveFailures),
+		}
+		cr.Ready = !pollOverdue(cr.SecondsSinceLastPoll) && cr.ConsecutiveFailures < int64(cfg.ReadyMaxFailures)
+		if !cr.Ready {
+			stale++
+		}
+		if cr.SecondsSinceLastPoll > r.SecondsSinceLastPoll {
+			r.SecondsSinceLastPoll = cr.SecondsSinceLastPoll
+		}
+		if cr.ConsecutiveFailures > r.ConsecutiveFailures {
+			r.ConsecutiveFailures = cr.ConsecutiveFailures
+		}
+		if c.name != "" {
+			r.Clusters = append(r.Clusters, cr)
+		}
+	}
+	r.Ready = stale <= cfg.MaxStaleClusters
+	r.IntervalSeconds = cfg.UpdateInterval.Seconds()
+	return r
+}
+
+func healthzHandler(resp http.ResponseWriter, request *http.Request) {
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(map[string]bool{"alive": true})
+}
+
+func readyzHandler(resp http.ResponseWriter, request *http.Request) {
+	r := clusterHealth()
+	// A standby has nothing to be behind on, and has to count as ready for rollouts to finish
+	if onStandby() {
+		r.Standby, r.Ready = true, true
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	if !r.Ready {
+		resp.WriteHeader(500)
+	}
+	json.NewEncoder(resp).Encode(r)
+}
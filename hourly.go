@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+	Hour-of-day histograms of partitions scanned and violations, so capacity planning can see when the abusive
+	scanning happens. Buckets are the local hour in the display timezone, which keeps them right across DST
+	changes: the repeated hour in autumn lands in the same bucket twice and the skipped hour in spring simply
+	gets nothing. Memory is bounded by tracking at most HOURLY_MAX_TABLES tables.
+
+	Next to the totals since startup, the histograms of the current local day are kept, and with
+	--history-file every day that ended is appended to the history file as one "hourly" record with its top
+	HOURLY_HISTORY_TABLES tables. Days are cut on the local date, so the DST days have 23 and 25 hours. The
+	day in progress isn't written when the watcher stops.
+
+	/dashboard draws the histograms since startup as heat strips, one row per table.
+*/
+
+const (
+	HOURLY_MAX_TABLES = 500
+	// Tables written to the history file per day
+	HOURLY_HISTORY_TABLES = 20
+	// How often we check for a day having ended
+	HOURLY_HISTORY_CHECK = 10 * time.Minute
+
+	HISTORY_KIND_HOURLY = "hourly"
+)
+
+type hourCounts struct {
+	Partitions [24]int64 `json:"partitions"`
+	Violations [24]int64 `json:"violations"`
+}
+
+func (h *hourCounts) total() int64 {
+	var t int64
+	for _, p := range h.Partitions {
+		t += p
+	}
+	return t
+}
+
+type hourlyStats struct {
+	sync.Mutex
+	loc    *time.Location
+	all    hourCounts
+	tables map[string]*hourCounts
+
+	// The local date being counted for the history file and its histograms
+	day       string
+	dayAll    hourCounts
+	dayTables map[string]*hourCounts
+	// Days that ended since the history file was last written
+	ended []hourlyDay
+}
+
+// One day of histograms in the history file
+type hourlyDay struct {
+	Kind      string        `json:"kind"`
+	Date      string        `json:"date"`
+	Timezone  string        `json:"timezone"`
+	PeakHour  int           `json:"peak_abuse_hour"`
+	Overall   hourCounts    `json:"overall"`
+	TopTables []hourlyTable `json:"top_tables"`
+}
+
+var hourly *hourlyStats
+
+func newHourlyStats(loc *time.Location) *hourlyStats {
+	return &hourlyStats{loc: loc, tables: make(map[string]*hourCounts), dayTables: make(map[string]*hourCounts)}
+}
+
+// observe adds newly scanned partitions (and possibly a violation) for a table at the given time
+func (h *hourlyStats) observe(now time.Time, table string, partitions int, violation bool) {
+	if partitions <= 0 && !violation {
+		return
+	}
+	local := now.In(h.loc)
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.rollOver(local)
+	countHour(&h.all, h.tables, local.Hour(), table, partitions, violation)
+	countHour(&h.dayAll, h.dayTables, local.Hour(), table, partitions, violation)
+}
+
+// countHour adds to the overall and a table's histogram, making room for the table if needed
+func countHour(all *hourCounts, tables map[string]*hourCounts, hour int, table string, partitions int, violation bool) {
+	t, ok := tables[table]
+	if !ok {
+		if len(tables) >= HOURLY_MAX_TABLES {
+			evictSmallest(tables)
+		}
+		t = &hourCounts{}
+		tables[table] = t
+	}
+	for _, c := range []*hourCounts{all, t} {
+		c.Partitions[hour] += int64(partitions)
+		if violation {
+			c.Violations[hour]++
+		}
+	}
+}
+
+// evictSmallest drops the table with the fewest partitions scanned to make room for a new one
+func evictSmallest(tables map[string]*hourCounts) {
+	var victim string
+	var smallest int64 = -1
+	for name, c := range tables {
+		if t := c.total(); smallest < 0 || t < smallest {
+			victim, smallest = name, t
+		}
+	}
+	delete(tables, victim)
+}
+
+// rollOver starts counting a new day once the local date changes, keeping the one that ended if anything was
+// seen on it
+func (h *hourlyStats) rollOver(local time.Time) {
+	date := local.Format("2006-01-02")
+	if date == h.day {
+		return
+	}
+	if h.day != "" && h.dayAll.peakHour() >= 0 {
+		h.ended = append(h.ended, hourlyDay{
+			Kind:      HISTORY_KIND_HOURLY,
+			Date:      h.day,
+			Timezone:  h.loc.String(),
+			PeakHour:  h.dayAll.peakHour(),
+			Overall:   h.dayAll,
+			TopTables: topTables(h.dayTables, HOURLY_HISTORY_TABLES),
+		})
+	}
+	h.day = date
+	h.dayAll = hourCounts{}
+	h.dayTables = make(map[string]*hourCounts)
+}
+
+// endedDays returns the days that ended by now and haven't been returned yet
+func (h *hourlyStats) endedDays(now time.Time) []hourlyDay {
+	h.Lock()
+	defer h.Unlock()
+	h.rollOver(now.In(h.loc))
+	ended := h.ended
+	h.ended = nil
+	return ended
+}
+
+// peakHour is the peak abuse hour since startup, -1 if nothing was seen
+func (h *hourlyStats) peakHour() int {
+	h.Lock()
+	defer h.Unlock()
+	return h.all.peakHour()
+}
+
+// writeHourlyHistory appends days of histograms to the history file
+func writeHourlyHistory(path string, days []hourlyDay) error {
+	if len(days) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, d := range days {
+		if err := enc.Encode(d); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// startHourlyHistory writes every day that ends to --history-file
+func startHourlyHistory() {
+	if cfg.HistoryFile == "" {
+		return
+	}
+	// Start counting the current day now, so a quiet first day still gets cut at midnight
+	hourly.endedDays(time.Now())
+	ticker := time.NewTicker(HOURLY_HISTORY_CHECK)
+	go func() {
+		for now := range ticker.C {
+			days := hourly.endedDays(now)
+			if err := writeHourlyHistory(cfg.HistoryFile, days); err != nil {
+				log.Errorf("Unable to write the hour-of-day histograms to history file [%v]: %v", cfg.HistoryFile, err)
+				continue
+			}
+			for _, d := range days {
+				log.Infof("Wrote the hour-of-day histograms of [%v] to history file [%v]", d.Date, cfg.HistoryFile)
+			}
+		}
+	}()
+}
+
+// peakHour returns the hour with the most violations, breaking ties on partitions scanned. -1 if nothing was seen.
+func (c *hourCounts) peakHour() int {
+	peak := -1
+	for hour := 0; hour < 24; hour++ {
+		if c.Violations[hour] == 0 && c.Partitions[hour] == 0 {
+			continue
+		}
+		if peak < 0 || c.Violations[hour] > c.Violations[peak] ||
+			(c.Violations[hour] == c.Violations[peak] && c.Partitions[hour] > c.Partitions[peak]) {
+			peak = hour
+		}
+	}
+	return peak
+}
+
+type hourlyTable struct {
+	Table string `json:"table"`
+	hourCounts
+}
+
+type hourlyReport struct {
+	Timezone  string        `json:"timezone"`
+	PeakHour  int           `json:"peak_abuse_hour"`
+	Overall   hourCounts    `json:"overall"`
+	TopTables []hourlyTable `json:"top_tables"`
+}
+
+// report returns the overall histogram and the top k tables by partitions scanned
+func (h *hourlyStats) report(k int) hourlyReport {
+	h.Lock()
+	defer h.Unlock()
+
+	return hourlyReport{Timezone: h.loc.String(), PeakHour: h.all.peakHour(), Overall: h.all, TopTables: topTables(h.tables, k)}
+}
+
+// topTables returns the k tables with the most partitions scanned, largest first
+func topTables(tables map[string]*hourCounts, k int) []hourlyTable {
+	var top []hourlyTable
+	for name, c := range tables {
+		top = append(top, hourlyTable{Table: name, hourCounts: *c})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].total() != top[j].total() {
+			return top[i].total() > top[j].total()
+		}
+		return top[i].Table < top[j].Table
+	})
+	if len(top) > k {
+		top = top[:k]
+	}
+	return top
+}
+
+func hourlyHandler(resp http.ResponseWriter, request *http.Request) {
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(hourly.report(10))
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>prestowatcher</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td { width: 2em; height: 1.5em; text-align: center; font-size: small; border: 1px solid #eee; }
+td.name { width: auto; text-align: left; padding-right: 1em; border: none; }
+</style>
+</head>
+<body>
+<h1>Partitions scanned by hour of day</h1>
+<p>{{.Timezone}}, since startup. Darker hours scanned more partitions, the numbers are alerts.{{if ge .PeakHour 0}} Peak abuse hour: {{printf "%02d:00" .PeakHour}}.{{end}}</p>
+<table>
+<tr><td class="name"></td>{{range .Hours}}<td>{{printf "%02d" .}}</td>{{end}}</tr>
+{{range .Rows}}<tr><td class="name">{{.Name}}</td>{{range .Cells}}<td style="{{.Style}}" title="{{.Partitions}} partitions, {{.Violations}} alerts">{{if .Violations}}{{.Violations}}{{end}}</td>{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type heatCell struct {
+	Partitions int64
+	Violations int64
+	Style      template.CSS
+}
+
+type heatRow struct {
+	Name  string
+	Cells []heatCell
+}
+
+// heatStrip shades every hour by its share of the busiest hour's partitions
+func heatStrip(name string, c hourCounts) heatRow {
+	var most int64
+	for _, p := range c.Partitions {
+		if p > most {
+			most = p
+		}
+	}
+	row := heatRow{Name: name}
+	for hour := 0; hour < 24; hour++ {
+		var shade float64
+		if most > 0 {
+			shade = float64(c.Partitions[hour]) / float64(most)
+		}
+		row.Cells = append(row.Cells, heatCell{
+			Partitions: c.Partitions[hour],
+			Violations: c.Violations[hour],
+			Style:      template.CSS(fmt.Sprintf("background-color: rgba(204, 0, 0, %.2f)", shade)),
+		})
+	}
+	return row
+}
+
+// dashboardHandler draws the hour-of-day histograms as heat strips
+func dashboardHandler(resp http.ResponseWriter, request *http.Request) {
+	r := hourly.report(10)
+	data := struct {
+		Timezone string
+		PeakHour int
+		Hours    []int
+		Rows     []heatRow
+	}{Timezone: r.Timezone, PeakHour: r.PeakHour, Rows: []heatRow{heatStrip("All tables", r.Overall)}}
+	for hour := 0; hour < 24; hour++ {
+		data.Hours = append(data.Hours, hour)
+	}
+	for _, t := range r.TopTables {
+		data.Rows = append(data.Rows, heatStrip(t.Table, t.hourCounts))
+	}
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(resp, data); err != nil {
+		log.Errorf("Unable to render the dashboard: %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// observeEvery observes one partition of table every step from start until end, like a poll would
+func observeEvery(h *hourlyStats, start time.Time, end time.Time, step time.Duration) {
+	for now := start; now.Before(end); now = now.Add(step) {
+		h.observe(now, "hive.events.clicks", 1, false)
+	}
+}
+
+func TestHourlyAcrossFallBack(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	h := newHourlyStats(ny)
+	// Clocks go back from 02:00 to 01:00 on 2023-11-05, a poll every 15 minutes from midnight to midnight
+	start := time.Date(2023, 11, 5, 0, 0, 0, 0, ny)
+	observeEvery(h, start, time.Date(2023, 11, 6, 0, 0, 0, 0, ny), 15*time.Minute)
+	h.observe(time.Date(2023, 11, 6, 0, 30, 0, 0, ny), "hive.events.clicks", 1, true)
+
+	r := h.report(10)
+	for hour, got := range r.Overall.Partitions {
+		want := int64(4)
+		switch hour {
+		case 1:
+			// 01:00-02:00 happened twice
+			want = 8
+		case 0:
+			// The next day's poll after midnight too
+			want = 5
+		}
+		if got != want {
+			t.Errorf("hour %v: got %v partitions, want %v", hour, got, want)
+		}
+	}
+
+	days := h.endedDays(time.Date(2023, 11, 6, 1, 0, 0, 0, ny))
+	if len(days) != 1 || days[0].Date != "2023-11-05" || days[0].Timezone != "America/New_York" {
+		t.Fatalf("got ended days %+v, want 2023-11-05", days)
+	}
+	if total := days[0].Overall.total(); total != 25*4 {
+		t.Errorf("got %v partitions on the 25 hour day, want %v", total, 25*4)
+	}
+	if days[0].Overall.Partitions[1] != 8 || len(days[0].TopTables) != 1 {
+		t.Errorf("unexpected day %+v", days[0])
+	}
+	// The next day has only started
+	if days := h.endedDays(time.Date(2023, 11, 6, 23, 0, 0, 0, ny)); len(days) != 0 {
+		t.Errorf("got ended days %+v before midnight", days)
+	}
+	if days := h.endedDays(time.Date(2023, 11, 7, 0, 0, 0, 0, ny)); len(days) != 1 || days[0].Date != "2023-11-06" || days[0].PeakHour != 0 {
+		t.Errorf("got ended days %+v, want 2023-11-06 peaking at midnight", days)
+	}
+}
+
+func TestHourlyAcrossSpringForward(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	h := newHourlyStats(ny)
+	// Clocks go from 02:00 to 03:00 on 2023-03-12
+	observeEvery(h, time.Date(2023, 3, 12, 0, 0, 0, 0, ny), time.Date(2023, 3, 13, 0, 0, 0, 0, ny), 15*time.Minute)
+
+	r := h.report(10)
+	if r.Overall.Partitions[2] != 0 || r.Overall.Partitions[1] != 4 || r.Overall.Partitions[3] != 4 {
+		t.Errorf("got %v, want nothing at 02:00 and 4 partitions around it", r.Overall.Partitions)
+	}
+	days := h.endedDays(time.Date(2023, 3, 13, 0, 0, 0, 0, ny))
+	if len(days) != 1 || days[0].Overall.total() != 23*4 {
+		t.Errorf("got ended days %+v, want a 23 hour day", days)
+	}
+}
+
+func TestHourlyHistoryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.jsonl")
+
+	h := newHourlyStats(time.UTC)
+	day := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	h.observe(day.Add(14*time.Hour), "hive.events.clicks", 120, true)
+	h.observe(day.Add(15*time.Hour), "hive.events.views", 40, false)
+	// A day without anything isn't written
+	if err := writeHourlyHistory(path, h.endedDays(day.Add(72*time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeHourlyHistory(path, h.endedDays(day.Add(96*time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var days []hourlyDay
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var d hourlyDay
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			t.Fatal(err)
+		}
+		days = append(days, d)
+	}
+	if len(days) != 1 {
+		t.Fatalf("got %v days in the history file, want 1", len(days))
+	}
+	d := days[0]
+	if d.Kind != HISTORY_KIND_HOURLY || d.Date != "2023-01-02" || d.PeakHour != 14 || d.Overall.Violations[14] != 1 {
+		t.Errorf("unexpected day %+v", d)
+	}
+	if len(d.TopTables) != 2 || d.TopTables[0].Table != "hive.events.clicks" || d.TopTables[1].Partitions[15] != 40 {
+		t.Errorf("unexpected top tables %+v", d.TopTables)
+	}
+	// The import skips the hourly records when looking for the queries it already has
+	ids := newHistoryIndex(dir)
+	defer ids.close()
+	if err := indexHistory(path, ids); err != nil || ids.count != 0 {
+		t.Errorf("got %v query IDs (%v) from a history of hourly records", ids.count, err)
+	}
+}
+
+func TestDashboardAndDigestPeakHour(t *testing.T) {
+	defer setupTest()()
+	if text := peakHourText(); text != "" {
+		t.Errorf("got %q before anything was seen", text)
+	}
+	hourly.observe(time.Date(2023, 1, 2, 14, 5, 0, 0, time.UTC), "hive.events.clicks", 120, true)
+	hourly.observe(time.Date(2023, 1, 2, 9, 5, 0, 0, time.UTC), "hive.events.clicks", 30, false)
+
+	if text := peakHourText(); text != "Peak abuse hour since startup: *14:00* UTC.\n" {
+		t.Errorf("got %q", text)
+	}
+	q := testQuery("q1", "alice", "SELECT * FROM events.clicks", 45)
+	if payload := digestPayload([]Alert{{Query: q, BadInputs: q.Inputs, TotalPartitions: 45}}); !strings.Contains(payload.Text, "*14:00*") {
+		t.Errorf("the digest doesn't name the peak hour:\n%v", payload.Text)
+	}
+
+	resp := httptest.NewRecorder()
+	dashboardHandler(resp, httptest.NewRequest("GET", "/dashboard", nil))
+	page := resp.Body.String()
+	for _, want := range []string{
+		"Peak abuse hour: 14:00",
+		`<td class="name">hive.events.clicks</td>`,
+		`style="background-color: rgba(204, 0, 0, 1.00)" title="120 partitions, 1 alerts">1</td>`,
+		`style="background-color: rgba(204, 0, 0, 0.25)" title="30 partitions, 0 alerts"></td>`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("the dashboard doesn't have %q:\n%v", want, page)
+		}
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/thecubed/prestowatcher/config"
+)
+
+/*
+	The import command evaluates archived query detail JSON against the current thresholds, the same way the
+	collector would have, and appends the results to a JSON lines history file. Nothing is alerted, killed or
+	emitted as a metric. Records are keyed on query ID, so running the import again (for example after it was
+	interrupted) only adds the queries that aren't in the history yet.
+
+	Memory stays bounded whatever the size of the history and the archive: the query IDs seen are kept in an
+	on-disk index next to the history file, removed once the import is done, and archive files are read one
+	JSON object at a time. An object that isn't a query is reported and skipped, the rest of its file is still
+	imported.
+*/
+
+const (
+	HISTORY_SOURCE_IMPORTED = "imported"
+
+	// Query IDs kept in memory before they're written out as a sorted index segment, and how many segments
+	// there may be before they're merged
+	IMPORT_INDEX_BATCH    = 1 << 18
+	IMPORT_INDEX_SEGMENTS = 8
+	// Failures listed at the end of an import, the rest are only counted
+	IMPORT_MAX_LISTED_FAILURES = 100
+)
+
+// One evaluated query in the history file
+type historyRecord struct {
+	QueryID    string          `json:"query_id"`
+	User       string          `json:"user"`
+	CreateTime string          `json:"create_time,omitempty"`
+	Type       string          `json:"query_type"`
+	Limit      int             `json:"limit"`
+	Inputs     []inputDecision `json:"inputs"`
+	Violation  bool            `json:"violation"`
+	OptedOut   bool            `json:"opted_out,omitempty"`
+	Source     string          `json:"source"`
+}
+
+type importStats struct {
+	Files      int
+	Imported   int
+	Duplicates int
+	Violations int
+	// Failures counts every failure, the first IMPORT_MAX_LISTED_FAILURES are kept to be listed
+	Failures int
+	Listed   []string
+}
+
+func (s *importStats) fail(format string, args ...interface{}) {
+	s.Failures++
+	if len(s.Listed) < IMPORT_MAX_LISTED_FAILURES {
+		s.Listed = append(s.Listed, fmt.Sprintf(format, args...))
+	}
+}
+
+// indexKey is a query ID hashed to a fixed size, so index segments can be binary searched in place
+type indexKey [16]byte
+
+func keyOf(queryID string) indexKey {
+	var k indexKey
+	sum := sha256.Sum256([]byte(queryID))
+	copy(k[:], sum[:])
+	return k
+}
+
+// historyIndex is the set of query IDs in the history file, kept on disk so memory doesn't grow with the
+// history or the archive. The latest IDs are kept in memory and written out as a sorted segment file once there
+// are IMPORT_INDEX_BATCH of them, and the segments are merged into one once there are more than
+// IMPORT_INDEX_SEGMENTS.
+type historyIndex struct {
+	dir string
+	// IDs kept in memory before they're written out, IMPORT_INDEX_BATCH
+	batch    int
+	recent   map[indexKey]bool
+	segments []*os.File
+	count    int
+}
+
+func newHistoryIndex(dir string) *historyIndex {
+	return &historyIndex{dir: dir, batch: IMPORT_INDEX_BATCH, recent: make(map[indexKey]bool)}
+}
+
+// has tells whether a query ID is in the index
+func (x *historyIndex) has(queryID string) (bool, error) {
+	k := keyOf(queryID)
+	if x.recent[k] {
+		return true, nil
+	}
+	for _, f := range x.segments {
+		found, err := segmentHas(f, k)
+		if found || err != nil {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+// segmentHas binary searches a segment file for a key
+func segmentHas(f *os.File, k indexKey) (bool, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	var searchErr error
+	var at indexKey
+	n := int(stat.Size() / int64(len(k)))
+	i := sort.Search(n, func(i int) bool {
+		if _, err := f.ReadAt(at[:], int64(i*len(k))); err != nil {
+			searchErr = err
+			return true
+		}
+		return bytes.Compare(at[:], k[:]) >= 0
+	})
+	if searchErr != nil || i == n {
+		return false, searchErr
+	}
+	// sort.Search doesn't necessarily look at i last
+	if _, err := f.ReadAt(at[:], int64(i*len(k))); err != nil {
+		return false, err
+	}
+	return at == k, nil
+}
+
+// add puts a query ID that isn't in the index yet into it
+func (x *historyIndex) add(queryID string) error {
+	x.recent[keyOf(queryID)] = true
+	x.count++
+	if len(x.recent) < x.batch {
+		return nil
+	}
+	return x.flush()
+}
+
+// flush writes the IDs kept in memory out as a segment
+func (x *historyIndex) flush() error {
+	keys := make([]indexKey, 0, len(x.recent))
+	for k := range x.recent {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i][:], keys[j][:]) < 0 })
+
+	f, err := ioutil.TempFile(x.dir, "segment")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, k := range keys {
+		w.Write(k[:])
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	x.segments = append(x.segments, f)
+	x.recent = make(map[indexKey]bool)
+	if len(x.segments) > IMPORT_INDEX_SEGMENTS {
+		return x.merge()
+	}
+	return nil
+}
+
+// merge replaces the segments by one, taking the smallest of their next keys until they're all read
+func (x *historyIndex) merge() error {
+	merged, err := ioutil.TempFile(x.dir, "segment")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(merged)
+	readers := make([]*bufio.Reader, len(x.segments))
+	heads := make([]*indexKey, len(x.segments))
+	next := func(i int) error {
+		var k indexKey
+		if _, err := io.ReadFull(readers[i], k[:]); err == io.EOF {
+			heads[i] = nil
+			return nil
+		} else if err != nil {
+			return err
+		}
+		heads[i] = &k
+		return nil
+	}
+	for i, f := range x.segments {
+		readers[i] = bufio.NewReader(io.NewSectionReader(f, 0, 1<<62))
+		if err := next(i); err != nil {
+			merged.Close()
+			return err
+		}
+	}
+	for {
+		smallest := -1
+		for i, h := range heads {
+			if h != nil && (smallest < 0 || bytes.Compare(h[:], heads[smallest][:]) < 0) {
+				smallest = i
+			}
+		}
+		if smallest < 0 {
+			break
+		}
+		w.Write(heads[smallest][:])
+		if err := next(smallest); err != nil {
+			merged.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		merged.Close()
+		return err
+	}
+	x.close()
+	x.segments = []*os.File{merged}
+	return nil
+}
+
+// close closes the segment files, they're removed along with the index directory
+func (x *historyIndex) close() {
+	for _, f := range x.segments {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	x.segments = nil
+}
+
+// indexHistory adds the query IDs already in the history file to the index, one record at a time. Other kinds
+// of records, like the daily hour-of-day histograms, have no query ID and are skipped.
+func indexHistory(path string, x *historyIndex) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var r struct {
+			QueryID string `json:"query_id"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &r) != nil || r.QueryID == "" {
+			continue
+		}
+		if found, err := x.has(r.QueryID); err != nil {
+			return err
+		} else if !found {
+			if err := x.add(r.QueryID); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// splitObjects calls each with every top level JSON object in r, skipping the brackets and commas of an array
+// around them, and returns how many bytes were outside of any object. Objects are only split on their braces,
+// so bad syntax inside one doesn't affect the ones after it. each mustn't keep the slice.
+func splitObjects(r *bufio.Reader, each func([]byte)) (stray int, err error) {
+	var obj []byte
+	var depth int
+	var inString, escaped bool
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			// A truncated last object
+			return stray + len(obj), nil
+		} else if err != nil {
+			return stray, err
+		}
+		if depth == 0 {
+			switch b {
+			case '{':
+				depth = 1
+				obj = append(obj[:0], b)
+			case ' ', '\t', '\r', '\n', ',', '[', ']':
+			default:
+				stray++
+			}
+			continue
+		}
+		obj = append(obj, b)
+		switch {
+		case escaped:
+			escaped = false
+		case inString && b == '\\':
+			escaped = true
+		case b == '"':
+			inString = !inString
+		case inString:
+		case b == '{':
+			depth++
+		case b == '}':
+			depth--
+			if depth == 0 {
+				each(obj)
+				obj = obj[:0]
+			}
+		}
+	}
+}
+
+// readArchive streams the queries in an archive file, which holds either an overview-shaped array or one or
+// more detail objects. Objects that aren't a query are passed to malformed and skipped.
+func readArchive(path string, each func(PrestoQuery), malformed func(err error)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var n int
+	stray, err := splitObjects(bufio.NewReader(r), func(obj []byte) {
+		n++
+		var q PrestoQuery
+		if err := json.Unmarshal(obj, &q); err != nil {
+			malformed(fmt.Errorf("object %v: %v", n, err))
+			return
+		}
+		each(q)
+	})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("no JSON objects found")
+	}
+	if stray > 0 {
+		malformed(fmt.Errorf("%v bytes outside of any JSON object, is the file truncated?", stray))
+	}
+	return nil
+}
+
+func importHistory(cmd config.ImportOptions) int {
+	dir, err := ioutil.TempDir(filepath.Dir(cmd.History), ".import-index")
+	if err != nil {
+		log.Errorf("Unable to create the history index next to [%v]: %v", cmd.History, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	ids := newHistoryIndex(dir)
+	defer ids.close()
+	if err := indexHistory(cmd.History, ids); err != nil {
+		log.Errorf("Unable to read history file [%v]: %v", cmd.History, err)
+		return 1
+	}
+	log.Infof("History file [%v] already has [%v] queries", cmd.History, ids.count)
+
+	out, err := os.OpenFile(cmd.History, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		log.Errorf("Unable to open history file [%v]: %v", cmd.History, err)
+		return 1
+	}
+	defer out.Close()
+
+	// An interrupted import may have left half a line behind, don't glue the next record onto it
+	if stat, err := out.Stat(); err == nil && stat.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := out.ReadAt(last, stat.Size()-1); err == nil && last[0] != '\n' {
+			out.Write([]byte("\n"))
+		}
+	}
+
+	w := bufio.NewWriter(out)
+	enc := json.NewEncoder(w)
+	var stats importStats
+
+	err = filepath.Walk(cmd.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			stats.fail("%v: %v", path, err)
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		stats.Files++
+		log.Debugf("Importing [%v]", path)
+
+		var indexErr error
+		err = readArchive(path, func(q PrestoQuery) {
+			if indexErr != nil {
+				return
+			}
+			if q.QueryID == "" {
+				stats.fail("%v: query without an ID", path)
+				return
+			}
+			found, err := ids.has(q.QueryID)
+			if err != nil {
+				indexErr = err
+				return
+			}
+			if found {
+				stats.Duplicates++
+				return
+			}
+
+			ev := evaluateQuery(q)
+			rec := historyRecord{
+				QueryID:    q.QueryID,
+				User:       q.Session.User,
+				CreateTime: q.QueryStats.CreateTime,
+				Type:       ev.Type,
+				Limit:      ev.Limit,
+				Violation:  len(ev.BadInputs) > 0,
+				OptedOut:   ev.OptedOut,
+				Source:     HISTORY_SOURCE_IMPORTED,
+			}
+			for idx, input := range ev.Inputs {
+				rec.Inputs = append(rec.Inputs, inputDecision{Table: tableName(input), Partitions: len(input.ConnectorInfo.PartitionIds), Limit: ev.Limits[idx].Max})
+			}
+			if err := enc.Encode(rec); err != nil {
+				stats.fail("%v: unable to write query [%v]: %v", path, q.QueryID, err)
+				return
+			}
+			indexErr = ids.add(q.QueryID)
+			stats.Imported++
+			if rec.Violation {
+				stats.Violations++
+			}
+		}, func(err error) {
+			stats.fail("%v: skipped %v", path, err)
+		})
+		if err != nil {
+			stats.fail("%v: %v", path, err)
+		}
+
+		// Flush after every file so an interrupted import loses at most the file it was working on
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		return indexErr
+	})
+	if err != nil {
+		log.Errorf("Import of [%v] failed: %v", cmd.Dir, err)
+		return 1
+	}
+
+	fmt.Printf("Read %v files: imported %v queries (%v over the limit), skipped %v already in the history, %v failures\n",
+		stats.Files, stats.Imported, stats.Violations, stats.Duplicates, stats.Failures)
+	for _, f := range stats.Listed {
+		fmt.Printf("  %v\n", f)
+	}
+	if stats.Failures > len(stats.Listed) {
+		fmt.Printf("  and %v more\n", stats.Failures-len(stats.Listed))
+	}
+	if stats.Failures > 0 {
+		return 2
+	}
+	return 0
+}
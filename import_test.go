@@ -0,0 +1,134 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thecubed/prestowatcher/config"
+)
+
+// tempDir is a fresh temp directory, removed by the returned func
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestHistoryIndex(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	x := newHistoryIndex(dir)
+	defer x.close()
+	// Small batches so the IDs go through many segments and merges
+	x.batch = 3
+
+	for i := 0; i < 100; i++ {
+		if err := x.add(fmt.Sprintf("q%v", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(x.segments) > IMPORT_INDEX_SEGMENTS || len(x.recent) >= x.batch {
+		t.Errorf("got %v segments and %v IDs in memory", len(x.segments), len(x.recent))
+	}
+	for i := 0; i < 110; i++ {
+		found, err := x.has(fmt.Sprintf("q%v", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != (i < 100) {
+			t.Errorf("q%v: got %v", i, found)
+		}
+	}
+}
+
+const archiveQueries = `{"queryId": "good-1", "session": {"user": "alice"}}
+{"queryId": 42}
+{"queryId": "bad-syntax", "session": {"user": "bob",,}}
+{"queryId": "good-2", "query": "SELECT '}' -- \"{\""}
+`
+
+func TestReadArchiveSkipsMalformedObjects(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	plain := filepath.Join(dir, "details.json")
+	array := filepath.Join(dir, "overview.json")
+	gzipped := filepath.Join(dir, "details.json.gz")
+	truncated := filepath.Join(dir, "truncated.json")
+	ioutil.WriteFile(plain, []byte(archiveQueries), 0644)
+	ioutil.WriteFile(array, []byte("[\n"+strings.Replace(strings.TrimSpace(archiveQueries), "\n", ",\n", -1)+"\n]\n"), 0644)
+	ioutil.WriteFile(truncated, []byte(archiveQueries+`{"queryId": "cut-`), 0644)
+	f, err := os.Create(gzipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	gz.Write([]byte(archiveQueries))
+	gz.Close()
+	f.Close()
+
+	for _, path := range []string{plain, array, gzipped, truncated} {
+		var ids []string
+		var skipped []string
+		err := readArchive(path, func(q PrestoQuery) {
+			ids = append(ids, q.QueryID)
+		}, func(err error) {
+			skipped = append(skipped, err.Error())
+		})
+		if err != nil {
+			t.Fatalf("%v: %v", path, err)
+		}
+		if fmt.Sprint(ids) != "[good-1 good-2]" {
+			t.Errorf("%v: got queries %v", path, ids)
+		}
+		want := 2
+		if path == truncated {
+			want = 3
+		}
+		if len(skipped) != want || !strings.HasPrefix(skipped[0], "object 2: ") || !strings.HasPrefix(skipped[1], "object 3: ") {
+			t.Errorf("%v: got %q skipped, want objects 2 and 3", path, skipped)
+		}
+	}
+}
+
+func TestImportHistory(t *testing.T) {
+	defer setupTest()()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	archive := filepath.Join(dir, "archive")
+	os.Mkdir(archive, 0755)
+	history := filepath.Join(dir, "history.jsonl")
+
+	ioutil.WriteFile(filepath.Join(archive, "a.json"), []byte(archiveQueries), 0644)
+	// The same queries archived twice
+	ioutil.WriteFile(filepath.Join(archive, "b.json"), []byte(archiveQueries), 0644)
+	// The history already has hourly records
+	ioutil.WriteFile(history, []byte(`{"kind":"hourly","date":"2023-01-02"}`+"\n"), 0644)
+
+	cmd := config.ImportOptions{Dir: archive, History: history}
+	if code := importHistory(cmd); code != 2 {
+		t.Errorf("got exit code %v with malformed objects, want 2", code)
+	}
+	x := newHistoryIndex(dir)
+	defer x.close()
+	if err := indexHistory(history, x); err != nil || x.count != 2 {
+		t.Errorf("got %v queries in the history (%v), want good-1 and good-2", x.count, err)
+	}
+
+	// Importing again adds nothing
+	importHistory(cmd)
+	data, _ := ioutil.ReadFile(history)
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Errorf("got %v lines in the history after a second import, want 3:\n%s", lines, data)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("the index directory was left behind: %v entries in %v", len(entries), dir)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/ashwanthkumar/slack-go-webhook"
+)
+
+/*
+	Presto sometimes lists the same table twice in a query's inputs, once per set of columns read. mergeInputs
+	folds those into one input per connector.schema.table with the union of their partitions, so a table is
+	never counted twice against its limit.
+
+	A federated query can also have dozens of bad inputs, more attachments than Slack accepts in one message.
+	Bad inputs are sorted worst first, and the Slack alert shows at most --slack-max-tables of them with a line
+	summing up the rest.
+*/
+
+// mergeInputs merges the inputs on the same table, keeping the order in which each table first appears
+func mergeInputs(inputs []PrestoInput) []PrestoInput {
+	var merged []PrestoInput
+	index := make(map[string]int)
+	for _, input := range inputs {
+		table := tableName(input)
+		i, seen := index[table]
+		if !seen {
+			index[table] = len(merged)
+			merged = append(merged, input)
+			continue
+		}
+		merged[i].ConnectorInfo.PartitionIds = unionPartitions(merged[i].ConnectorInfo.PartitionIds, input.ConnectorInfo.PartitionIds)
+		merged[i].ConnectorInfo.Truncated = merged[i].ConnectorInfo.Truncated || input.ConnectorInfo.Truncated
+	}
+	return merged
+}
+
+// unionPartitions adds the partitions of b that aren't in a already
+func unionPartitions(a []string, b []string) []string {
+	union := append([]string(nil), a...)
+	seen := make(map[string]bool, len(a))
+	for _, p := range a {
+		seen[p] = true
+	}
+	for _, p := range b {
+		if !seen[p] {
+			seen[p] = true
+			union = append(union, p)
+		}
+	}
+	return union
+}
+
+// sortByPartitions puts the inputs scanning the most partitions first
+func sortByPartitions(inputs []PrestoInput) {
+	sort.SliceStable(inputs, func(i, j int) bool {
+		return len(inputs[i].ConnectorInfo.PartitionIds) > len(inputs[j].ConnectorInfo.PartitionIds)
+	})
+}
+
+// capInputs splits the inputs into the first max to show and the rest
+func capInputs(inputs []PrestoInput, max int) (shown []PrestoInput, rest []PrestoInput) {
+	if len(inputs) <= max {
+		return inputs, nil
+	}
+	return inputs[:max], inputs[max:]
+}
+
+// moreTablesAttachment sums up the tables left out of an alert
+func moreTablesAttachment(rest []PrestoInput) slack.Attachment {
+	var partitions int
+	for _, i := range rest {
+		partitions += len(i.ConnectorInfo.PartitionIds)
+	}
+	tables := "tables"
+	if len(rest) == 1 {
+		tables = "table"
+	}
+	text := fmt.Sprintf("…and %v more %v totalling %v partitions", len(rest), tables, partitions)
+	return slack.Attachment{Fallback: &text, Text: &text}
+}
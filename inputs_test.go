@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// syntheticInput is an input on a hive table scanning partitions p0..p(n-1)
+func syntheticInput(schema string, table string, n int) PrestoInput {
+	input := PrestoInput{ConnectorID: "hive", Schema: schema, Table: table}
+	for i := 0; i < n; i++ {
+		input.ConnectorInfo.PartitionIds = append(input.ConnectorInfo.PartitionIds, fmt.Sprintf("p%v", i))
+	}
+	return input
+}
+
+// inputSummary is each input's table and partition count, in order
+func inputSummary(inputs []PrestoInput) []string {
+	var summary []string
+	for _, i := range inputs {
+		summary = append(summary, fmt.Sprintf("%v:%v", tableName(i), len(i.ConnectorInfo.PartitionIds)))
+	}
+	return summary
+}
+
+func TestMergeInputs(t *testing.T) {
+	clicks := syntheticInput("events", "clicks", 40)
+	// The same table read again for other columns, over partly the same partitions
+	clicksAgain := syntheticInput("events", "clicks", 60)
+	clicksAgain.ConnectorInfo.Truncated = true
+	views := syntheticInput("events", "views", 10)
+	// Same schema and table on another connector
+	mysqlClicks := syntheticInput("events", "clicks", 0)
+	mysqlClicks.ConnectorID = "mysql"
+
+	merged := mergeInputs([]PrestoInput{clicks, views, clicksAgain, mysqlClicks})
+	if got, want := inputSummary(merged), []string{"hive.events.clicks:60", "hive.events.views:10", "mysql.events.clicks:0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !merged[0].ConnectorInfo.Truncated {
+		t.Error("the merged input lost the truncated flag")
+	}
+	if len(clicks.ConnectorInfo.PartitionIds) != 40 {
+		t.Error("merging changed the original input")
+	}
+
+	if got := unionPartitions([]string{"a", "b"}, []string{"b", "c", "c"}); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("got union %v", got)
+	}
+}
+
+func TestCapInputs(t *testing.T) {
+	var inputs []PrestoInput
+	for i := 0; i < 30; i++ {
+		// 31, 32, ... 60 partitions, in ascending order so sorting has something to do
+		inputs = append(inputs, syntheticInput("events", fmt.Sprintf("t%02d", i), 31+i))
+	}
+	sortByPartitions(inputs)
+	if got := inputSummary(inputs[:3]); !reflect.DeepEqual(got, []string{"hive.events.t29:60", "hive.events.t28:59", "hive.events.t27:58"}) {
+		t.Errorf("got %v first, want the worst offenders", got)
+	}
+
+	shown, rest := capInputs(inputs, 10)
+	if len(shown) != 10 || len(rest) != 20 || tableName(shown[9]) != "hive.events.t20" {
+		t.Fatalf("got %v shown and %v left", inputSummary(shown), len(rest))
+	}
+	// The 20 smallest: 31 + ... + 50
+	if text := *moreTablesAttachment(rest).Text; text != "…and 20 more tables totalling 810 partitions" {
+		t.Errorf("got summary %q", text)
+	}
+	if text := *moreTablesAttachment(rest[:1]).Text; text != "…and 1 more table totalling 50 partitions" {
+		t.Errorf("got summary %q", text)
+	}
+
+	if shown, rest := capInputs(inputs[:10], 10); len(shown) != 10 || rest != nil {
+		t.Errorf("got %v shown and %v left at the cap", len(shown), len(rest))
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/thecubed/prestowatcher/config"
+)
+
+/*
+	The kafka event publisher's producer. Like the Redis lock, it speaks the few requests it needs directly
+	instead of pulling in a client library, which wouldn't build with this Go anyway: a Metadata request (v4) to
+	one of --kafka-brokers to find the leader of every partition of --kafka-topic, then a Produce request (v3,
+	Kafka 0.11 and later) with a one-record batch to the leader of the event's partition. The partition is picked
+	by hashing the query ID, so a query's events stay in order.
+
+	Produce waits for all in-sync replicas. When it fails, the producer forgets its connections and partition
+	leaders and tries once more with fresh metadata, which covers a leader moving to another broker. Only
+	plaintext listeners are supported, there's no TLS or SASL.
+
+	It's only ever used from the event publisher goroutine, so nothing here is locked.
+*/
+
+const (
+	KAFKA_DEFAULT_PORT = "9092"
+	KAFKA_TIMEOUT      = 10 * time.Second
+
+	KAFKA_API_PRODUCE  = 0
+	KAFKA_API_METADATA = 3
+
+	KAFKA_PRODUCE_VERSION  = 3
+	KAFKA_METADATA_VERSION = 4
+
+	// Wait for all in-sync replicas
+	KAFKA_ACKS_ALL = -1
+)
+
+// Names of the error codes a produce is likely to run into, see the Kafka protocol guide for the rest
+var kafkaErrorNames = map[int16]string{
+	2:  "CORRUPT_MESSAGE",
+	3:  "UNKNOWN_TOPIC_OR_PARTITION",
+	5:  "LEADER_NOT_AVAILABLE",
+	6:  "NOT_LEADER_OR_FOLLOWER",
+	7:  "REQUEST_TIMED_OUT",
+	10: "MESSAGE_TOO_LARGE",
+	19: "NOT_ENOUGH_REPLICAS",
+	20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	29: "TOPIC_AUTHORIZATION_FAILED",
+	35: "UNSUPPORTED_VERSION",
+}
+
+// kafkaError is an error code in a Kafka response
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	if name, ok := kafkaErrorNames[int16(e)]; ok {
+		return fmt.Sprintf("kafka error %d (%v)", int16(e), name)
+	}
+	return fmt.Sprintf("kafka error %d", int16(e))
+}
+
+type kafkaConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+type kafkaProducer struct {
+	// Bootstrap brokers as host:port
+	brokers []string
+	topic   string
+	// Leader of every partition of the topic as host:port, by partition, nil until the metadata is fetched
+	leaders     []string
+	conns       map[string]*kafkaConn
+	correlation int32
+}
+
+func newKafkaProducer(brokers []string, topic string) *kafkaProducer {
+	k := &kafkaProducer{topic: topic, conns: make(map[string]*kafkaConn)}
+	for _, b := range brokers {
+		if _, _, err := net.SplitHostPort(b); err != nil {
+			b = net.JoinHostPort(b, KAFKA_DEFAULT_PORT)
+		}
+		k.brokers = append(k.brokers, b)
+	}
+	return k
+}
+
+func newKafkaEventProducer() *kafkaProducer {
+	return newKafkaProducer(config.SplitList(cfg.KafkaBrokers), cfg.KafkaTopic)
+}
+
+// produce sends one record to the topic, on the partition its key hashes to
+func (k *kafkaProducer) produce(key []byte, value []byte) error {
+	err := k.tryProduce(key, value, time.Now())
+	if err != nil {
+		log.Debugf("Producing to Kafka topic [%v] failed, retrying with fresh metadata: %v", k.topic, err)
+		k.disconnect()
+		err = k.tryProduce(key, value, time.Now())
+	}
+	return err
+}
+
+func (k *kafkaProducer) tryProduce(key []byte, value []byte, now time.Time) error {
+	if k.leaders == nil {
+		if err := k.refreshMetadata(); err != nil {
+			return err
+		}
+	}
+	partition := kafkaPartition(key, len(k.leaders))
+	leader := k.leaders[partition]
+	if leader == "" {
+		return fmt.Errorf("partition [%v] of topic [%v] has no leader", partition, k.topic)
+	}
+
+	var body kafkaEncoder
+	body.nullableString(nil) // transactional ID
+	body.int16(KAFKA_ACKS_ALL)
+	body.int32(int32(KAFKA_TIMEOUT / time.Millisecond))
+	body.int32(1)
+	body.string(k.topic)
+	body.int32(1)
+	body.int32(partition)
+	body.bytes(kafkaRecordBatch(key, value, now))
+
+	resp, err := k.roundTrip(leader, KAFKA_API_PRODUCE, KAFKA_PRODUCE_VERSION, body.Bytes())
+	if err != nil {
+		return err
+	}
+	d := kafkaDecoder{b: resp}
+	for topics := d.int32(); topics > 0 && d.err == nil; topics-- {
+		d.string()
+		for partitions := d.int32(); partitions > 0 && d.err == nil; partitions-- {
+			d.int32()
+			code := d.int16()
+			d.int64() // base offset
+			d.int64() // log append time
+			if code != 0 && d.err == nil {
+				return kafkaError(code)
+			}
+		}
+	}
+	return d.err
+}
+
+// refreshMetadata asks the bootstrap brokers, one after the other, for the leaders of the topic's partitions
+func (k *kafkaProducer) refreshMetadata() error {
+	var body kafkaEncoder
+	body.int32(1)
+	body.string(k.topic)
+	body.bool(false) // don't create the topic
+
+	var err error
+	for _, broker := range k.brokers {
+		var resp []byte
+		if resp, err = k.roundTrip(broker, KAFKA_API_METADATA, KAFKA_METADATA_VERSION, body.Bytes()); err != nil {
+			continue
+		}
+		if err = k.parseMetadata(resp); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("unable to get the metadata of topic [%v]: %v", k.topic, err)
+}
+
+func (k *kafkaProducer) parseMetadata(resp []byte) error {
+	d := kafkaDecoder{b: resp}
+	d.int32() // throttle time
+	hosts := make(map[int32]string)
+	for brokers := d.int32(); brokers > 0 && d.err == nil; brokers-- {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.nullableString() // rack
+		hosts[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.nullableString() // cluster ID
+	d.int32()          // controller ID
+
+	var leaders []string
+	for topics := d.int32(); topics > 0 && d.err == nil; topics-- {
+		code := d.int16()
+		name := d.string()
+		d.bool() // internal
+		partitions := d.int32()
+		if name == k.topic && d.err == nil {
+			if code != 0 {
+				return kafkaError(code)
+			}
+			leaders = make([]string, partitions)
+		}
+		for ; partitions > 0 && d.err == nil; partitions-- {
+			d.int16() // partition error, a partition without a leader has an empty one below
+			index := d.int32()
+			leader := d.int32()
+			d.int32Array() // replicas
+			d.int32Array() // in-sync replicas
+			if name == k.topic && index >= 0 && int(index) < len(leaders) {
+				leaders[index] = hosts[leader]
+			}
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(leaders) == 0 {
+		return fmt.Errorf("the broker didn't return topic [%v]", k.topic)
+	}
+	k.leaders = leaders
+	return nil
+}
+
+// roundTrip sends a request to a broker and returns the response body after the correlation ID
+func (k *kafkaProducer) roundTrip(addr string, apiKey int16, version int16, body []byte) ([]byte, error) {
+	conn, ok := k.conns[addr]
+	if !ok {
+		c, err := net.DialTimeout("tcp", addr, KAFKA_TIMEOUT)
+		if err != nil {
+			return nil, err
+		}
+		conn = &kafkaConn{Conn: c, reader: bufio.NewReader(c)}
+		k.conns[addr] = conn
+	}
+	conn.SetDeadline(time.Now().Add(KAFKA_TIMEOUT))
+
+	k.correlation++
+	var req kafkaEncoder
+	req.int16(apiKey)
+	req.int16(version)
+	req.int32(k.correlation)
+	req.string(APP_NAME)
+	req.Write(body)
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(req.Len()))
+	if _, err := conn.Write(append(size[:], req.Bytes()...)); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(conn.reader, size[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(conn.reader, resp); err != nil {
+		return nil, err
+	}
+	if len(resp) < 4 || int32(binary.BigEndian.Uint32(resp)) != k.correlation {
+		return nil, errors.New("got a response to another request from the broker")
+	}
+	return resp[4:], nil
+}
+
+// disconnect closes every broker connection and forgets the partition leaders
+func (k *kafkaProducer) disconnect() {
+	for addr, conn := range k.conns {
+		conn.Close()
+		delete(k.conns, addr)
+	}
+	k.leaders = nil
+}
+
+// kafkaPartition picks a key's partition. It's FNV-1a rather than the Java client's murmur2, so it only keeps
+// our own events for a key together.
+func kafkaPartition(key []byte, partitions int) int32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return int32(h.Sum32() % uint32(partitions))
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaRecordBatch is a record batch (magic 2) holding a single record
+func kafkaRecordBatch(key []byte, value []byte, now time.Time) []byte {
+	var record kafkaEncoder
+	record.int8(0)   // attributes
+	record.varint(0) // timestamp delta
+	record.varint(0) // offset delta
+	record.varint(int64(len(key)))
+	record.Write(key)
+	record.varint(int64(len(value)))
+	record.Write(value)
+	record.varint(0) // headers
+
+	// Everything the CRC covers, from the attributes on
+	var tail kafkaEncoder
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+	tail.int16(0) // attributes: no compression, create time
+	tail.int32(0) // last offset delta
+	tail.int64(timestamp)
+	tail.int64(timestamp)
+	tail.int64(-1) // producer ID
+	tail.int16(-1) // producer epoch
+	tail.int32(-1) // base sequence
+	tail.int32(1)
+	tail.varint(int64(record.Len()))
+	tail.Write(record.Bytes())
+
+	var batch kafkaEncoder
+	batch.int64(0) // base offset
+	// Length of what follows: leader epoch, magic, CRC and the tail
+	batch.int32(int32(4 + 1 + 4 + tail.Len()))
+	batch.int32(-1) // partition leader epoch
+	batch.int8(2)
+	batch.int32(int32(crc32.Checksum(tail.Bytes(), crc32c)))
+	batch.Write(tail.Bytes())
+	return batch.Bytes()
+}
+
+// kafkaEncoder writes the big endian and zigzag varint encodings of the Kafka protocol
+type kafkaEncoder struct {
+	bytes.Buffer
+}
+
+func (e *kafkaEncoder) int8(v int8) {
+	e.WriteByte(byte(v))
+}
+
+func (e *kafkaEncoder) int16(v int16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(v))
+	e.Write(b[:])
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	e.Write(b[:])
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	e.Write(b[:])
+}
+
+func (e *kafkaEncoder) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func (e *kafkaEncoder) bool(v bool) {
+	if v {
+		e.int8(1)
+	} else {
+		e.int8(0)
+	}
+}
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.WriteString(s)
+}
+
+func (e *kafkaEncoder) nullableString(s *string) {
+	if s == nil {
+		e.int16(-1)
+		return
+	}
+	e.string(*s)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.Write(b)
+}
+
+// kafkaDecoder reads a Kafka response. The first read past the end sets err, and every read after it returns
+// zero values, so a response can be read through and checked once.
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = errors.New("truncated response from the broker")
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *kafkaDecoder) bool() bool {
+	b := d.next(1)
+	return b != nil && b[0] != 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) string() string {
+	return string(d.next(int(d.int16())))
+}
+
+func (d *kafkaDecoder) nullableString() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *kafkaDecoder) int32Array() {
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		d.int32()
+	}
+}
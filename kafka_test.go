@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeKafka is a cluster of brokers speaking just enough Metadata v4 and Produce v3 for kafkaProducer. Produced
+// record batches are checked and decoded as they arrive.
+type fakeKafka struct {
+	sync.Mutex
+	t         *testing.T
+	listeners []net.Listener
+	topic     string
+	// Which broker leads every partition, by partition
+	leaders []int
+	// Records produced, by partition
+	records map[int32][]fakeRecord
+	// Produce requests answered with NOT_LEADER_OR_FOLLOWER because they went to the wrong broker
+	misdirected int
+}
+
+type fakeRecord struct {
+	key   string
+	value string
+}
+
+func newFakeKafka(t *testing.T, brokers int, topic string, leaders ...int) *fakeKafka {
+	k := &fakeKafka{t: t, topic: topic, leaders: leaders, records: make(map[int32][]fakeRecord)}
+	for i := 0; i < brokers; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		k.listeners = append(k.listeners, listener)
+		go func(id int) {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go k.serve(id, conn)
+			}
+		}(i)
+	}
+	return k
+}
+
+func (k *fakeKafka) addr(broker int) string {
+	return k.listeners[broker].Addr().String()
+}
+
+func (k *fakeKafka) close() {
+	for _, l := range k.listeners {
+		l.Close()
+	}
+}
+
+func (k *fakeKafka) serve(broker int, conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(reader, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(reader, req); err != nil {
+			return
+		}
+		d := kafkaDecoder{b: req}
+		apiKey, version, correlation, client := d.int16(), d.int16(), d.int32(), d.string()
+		if client != APP_NAME {
+			k.t.Errorf("got client ID %q", client)
+		}
+
+		var resp kafkaEncoder
+		resp.int32(correlation)
+		switch {
+		case apiKey == KAFKA_API_METADATA && version == KAFKA_METADATA_VERSION:
+			k.metadata(&d, &resp)
+		case apiKey == KAFKA_API_PRODUCE && version == KAFKA_PRODUCE_VERSION:
+			k.produce(broker, &d, &resp)
+		default:
+			k.t.Errorf("got request %v version %v", apiKey, version)
+			return
+		}
+		if d.err != nil {
+			k.t.Errorf("unable to read request %v: %v", apiKey, d.err)
+			return
+		}
+		binary.BigEndian.PutUint32(size[:], uint32(resp.Len()))
+		conn.Write(append(size[:], resp.Bytes()...))
+	}
+}
+
+func (k *fakeKafka) metadata(d *kafkaDecoder, resp *kafkaEncoder) {
+	k.Lock()
+	defer k.Unlock()
+	topics := d.int32()
+	topic := d.string()
+	if topics != 1 || d.bool() {
+		k.t.Errorf("got a metadata request for %v topics, or one creating them", topics)
+	}
+
+	resp.int32(0) // throttle time
+	resp.int32(int32(len(k.listeners)))
+	for i := range k.listeners {
+		host, port, _ := net.SplitHostPort(k.addr(i))
+		p, _ := strconv.Atoi(port)
+		resp.int32(int32(i))
+		resp.string(host)
+		resp.int32(int32(p))
+		resp.nullableString(nil)
+	}
+	resp.nullableString(nil) // cluster ID
+	resp.int32(0)            // controller
+	resp.int32(1)
+	if topic != k.topic {
+		resp.int16(3) // UNKNOWN_TOPIC_OR_PARTITION
+		resp.string(topic)
+		resp.bool(false)
+		resp.int32(0)
+		return
+	}
+	resp.int16(0)
+	resp.string(topic)
+	resp.bool(false)
+	resp.int32(int32(len(k.leaders)))
+	for partition, leader := range k.leaders {
+		resp.int16(0)
+		resp.int32(int32(partition))
+		resp.int32(int32(leader))
+		resp.int32(1)
+		resp.int32(int32(leader))
+		resp.int32(1)
+		resp.int32(int32(leader))
+	}
+}
+
+func (k *fakeKafka) produce(broker int, d *kafkaDecoder, resp *kafkaEncoder) {
+	k.Lock()
+	defer k.Unlock()
+	d.nullableString() // transactional ID
+	if acks := d.int16(); acks != KAFKA_ACKS_ALL {
+		k.t.Errorf("got acks %v", acks)
+	}
+	d.int32() // timeout
+	if topics := d.int32(); topics != 1 {
+		k.t.Errorf("got %v topics in one produce", topics)
+	}
+	topic := d.string()
+	d.int32() // partitions
+	partition := d.int32()
+	batch := kafkaDecoder{b: d.next(int(d.int32()))}
+
+	code := int16(0)
+	if k.leaders[partition] != broker {
+		k.misdirected++
+		code = 6 // NOT_LEADER_OR_FOLLOWER
+	} else {
+		k.records[partition] = append(k.records[partition], k.recordBatch(&batch))
+	}
+	resp.int32(1)
+	resp.string(topic)
+	resp.int32(1)
+	resp.int32(partition)
+	resp.int16(code)
+	resp.int64(0)  // base offset
+	resp.int64(-1) // log append time
+	resp.int32(0)  // throttle time
+}
+
+// recordBatch checks the framing and CRC of a one-record batch and returns its record
+func (k *fakeKafka) recordBatch(d *kafkaDecoder) fakeRecord {
+	d.int64() // base offset
+	if length := int(d.int32()); length != len(d.b) {
+		k.t.Errorf("batch length %v, got %v bytes", length, len(d.b))
+	}
+	d.int32() // leader epoch
+	if magic := d.next(1); magic == nil || magic[0] != 2 {
+		k.t.Errorf("got magic %v", magic)
+	}
+	crc := uint32(d.int32())
+	if got := crc32.Checksum(d.b, crc32.MakeTable(crc32.Castagnoli)); got != crc {
+		k.t.Errorf("got CRC %x, the batch sums to %x", crc, got)
+	}
+	d.int16() // attributes
+	d.int32() // last offset delta
+	d.int64() // first timestamp
+	d.int64() // max timestamp
+	d.int64() // producer ID
+	d.int16() // producer epoch
+	d.int32() // base sequence
+	if n := d.int32(); n != 1 {
+		k.t.Errorf("got %v records in a batch", n)
+	}
+	varint := func() int64 {
+		v, n := binary.Varint(d.b)
+		d.b = d.b[n:]
+		return v
+	}
+	if length := int(varint()); length != len(d.b) {
+		k.t.Errorf("record length %v, got %v bytes", length, len(d.b))
+	}
+	d.next(1) // attributes
+	varint()  // timestamp delta
+	varint()  // offset delta
+	var r fakeRecord
+	r.key = string(d.next(int(varint())))
+	r.value = string(d.next(int(varint())))
+	if headers := varint(); headers != 0 || d.err != nil {
+		k.t.Errorf("got %v headers, %v", headers, d.err)
+	}
+	return r
+}
+
+func (k *fakeKafka) produced(partition int32) []fakeRecord {
+	k.Lock()
+	defer k.Unlock()
+	return append([]fakeRecord(nil), k.records[partition]...)
+}
+
+func TestKafkaProduce(t *testing.T) {
+	defer setupTest()()
+	kafka := newFakeKafka(t, 2, "prestowatcher.alerts", 0, 1, 1)
+	defer kafka.close()
+	// The second broker is only found through the metadata
+	producer := newKafkaProducer([]string{kafka.addr(0)}, "prestowatcher.alerts")
+	defer producer.disconnect()
+
+	for _, r := range []fakeRecord{{"q1", `{"n":1}`}, {"q2", `{"n":2}`}, {"q1", `{"n":3}`}} {
+		if err := producer.produce([]byte(r.key), []byte(r.value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var total int
+	for partition := int32(0); partition < 3; partition++ {
+		records := kafka.produced(partition)
+		total += len(records)
+		for _, r := range records {
+			if want := kafkaPartition([]byte(r.key), 3); want != partition {
+				t.Errorf("%v went to partition %v, want %v", r.key, partition, want)
+			}
+		}
+	}
+	if total != 3 {
+		t.Errorf("got %v records, want 3", total)
+	}
+	// A query's events stay in order
+	var q1 []string
+	for _, r := range kafka.produced(kafkaPartition([]byte("q1"), 3)) {
+		if r.key == "q1" {
+			q1 = append(q1, r.value)
+		}
+	}
+	if strings.Join(q1, " ") != `{"n":1} {"n":3}` {
+		t.Errorf("got q1 records %v", q1)
+	}
+}
+
+func TestKafkaLeaderMoves(t *testing.T) {
+	defer setupTest()()
+	kafka := newFakeKafka(t, 2, "prestowatcher.alerts", 0)
+	defer kafka.close()
+	producer := newKafkaProducer([]string{kafka.addr(0), kafka.addr(1)}, "prestowatcher.alerts")
+	defer producer.disconnect()
+	if err := producer.produce([]byte("q1"), []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	kafka.Lock()
+	kafka.leaders[0] = 1
+	kafka.Unlock()
+	if err := producer.produce([]byte("q1"), []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	kafka.Lock()
+	misdirected := kafka.misdirected
+	kafka.Unlock()
+	if records := kafka.produced(0); len(records) != 2 || records[1].value != "second" || misdirected != 1 {
+		t.Errorf("got records %v after %v misdirected produces, want the second one retried on the new leader", records, misdirected)
+	}
+}
+
+func TestKafkaErrors(t *testing.T) {
+	defer setupTest()()
+	kafka := newFakeKafka(t, 1, "prestowatcher.alerts", 0)
+	producer := newKafkaProducer([]string{kafka.addr(0)}, "prestowatcher.other")
+	if err := producer.produce([]byte("q1"), []byte("{}")); err == nil || !strings.Contains(err.Error(), "UNKNOWN_TOPIC_OR_PARTITION") {
+		t.Errorf("got %v for an unknown topic", err)
+	}
+	producer.disconnect()
+
+	producer = newKafkaProducer([]string{kafka.addr(0)}, "prestowatcher.alerts")
+	kafka.close()
+	if err := producer.produce([]byte("q1"), []byte("{}")); err == nil {
+		t.Error("producing to a broker that's gone succeeded")
+	}
+}
+
+func TestKafkaBrokerPort(t *testing.T) {
+	producer := newKafkaProducer([]string{"kafka-1", "kafka-2:9093", "10.0.0.1"}, "prestowatcher.alerts")
+	if got := strings.Join(producer.brokers, ","); got != "kafka-1:9092,kafka-2:9093,10.0.0.1:9092" {
+		t.Errorf("got brokers %v", got)
+	}
+}
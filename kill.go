@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strings"
+
+	"github.com/armon/go-metrics"
+	"github.com/thecubed/prestowatcher/config"
+	"github.com/thecubed/prestowatcher/prestoclient"
+)
+
+/*
+	Killing queries is the one destructive thing the watcher can do, so every kill goes through killQuery,
+	which checks the protection lists immediately before the DELETE is sent. Rule configuration can decide
+	*when* to kill, but it can never override a protection. In a dry run the DELETE is never sent and
+	killQuery returns ErrKillDryRun, so the would-be kill is logged and counted as a dry-run alert rather than
+	as a kill.
+
+	Kills are asked for in three ways: automatically by --kill-threshold, by people through the "Kill this
+	query" link partition alerts get with --kill-links, and through the admin API:
+
+		POST /kill/{queryID}    with X-Admin-Secret, ?by= names who asked
+
+	The kill link is signed like the acknowledge link, with --ack-secret over "kill/" and the query ID, so an
+	acknowledge token can't be used to kill. Whoever asked is told what happened, including the protection
+	that stopped the kill. When an automatic kill is refused, the alert says which protection the query matched.
+*/
+
+// Who asked for the kill
+const (
+	KILL_REQUESTER_AUTO  = "auto"
+	KILL_REQUESTER_SLACK = "slack"
+	KILL_REQUESTER_ADMIN = "admin"
+)
+
+// ErrKillDryRun is returned instead of killing a query in a dry run
+var ErrKillDryRun = errors.New("dry run, query not killed")
+
+// KillRefusedError is returned when a kill was refused because the query is protected
+type KillRefusedError struct {
+	Protection string
+	Value      string
+}
+
+func (e *KillRefusedError) Error() string {
+	return fmt.Sprintf("query is protected by %v [%v]", e.Protection, e.Value)
+}
+
+// killProtection returns the protection matching the query, if any
+func killProtection(query PrestoQuery) *KillRefusedError {
+	for _, u := range config.SplitList(cfg.ProtectedUsers) {
+		if strings.EqualFold(u, query.Session.User) {
+			return &KillRefusedError{Protection: "user", Value: u}
+		}
+	}
+	for _, src := range config.SplitList(cfg.ProtectedSources) {
+		if query.Session.Source != "" && strings.EqualFold(src, query.Session.Source) {
+			return &KillRefusedError{Protection: "source", Value: src}
+		}
+	}
+	if len(query.ResourceGroupID) > 0 {
+		group := strings.ToLower(strings.Join(query.ResourceGroupID, "."))
+		for _, rg := range config.SplitList(cfg.ProtectedResourceGroups) {
+			rg = strings.ToLower(rg)
+			if group == rg || strings.HasPrefix(group, rg+".") {
+				return &KillRefusedError{Protection: "resource group", Value: rg}
+			}
+		}
+	}
+	for _, tag := range config.SplitList(cfg.ProtectedTags) {
+		if strings.Contains(query.Query, tag) {
+			return &KillRefusedError{Protection: "tag", Value: tag}
+		}
+	}
+	return nil
+}
+
+// killQuery cancels a query in Presto, unless it's protected. The query must be the full detail version
+// so that the session and resource group are populated.
+func killQuery(ctx context.Context, c *cluster, query PrestoQuery, requester string) error {
+	if refusal := killProtection(query); refusal != nil {
+		log.Warningf("Refusing [%v] kill of query [%v] by user [%v]: %v", requester, query.QueryID, query.Session.User, refusal)
+		c.metrics.IncrCounterWithLabels(
+			metricKey("kill_refusals"),
+			1.0,
+			[]metrics.Label{
+				{
+					Name:  "protection",
+					Value: refusal.Protection,
+				},
+				{
+					Name:  "requester",
+					Value: requester,
+				},
+			},
+		)
+		return refusal
+	}
+
+	if cfg.DryRun {
+		log.Warningf("Dry run, not killing query [%v] by user [%v] on behalf of [%v]", query.QueryID, query.Session.User, requester)
+		return ErrKillDryRun
+	}
+
+	if err := c.client.KillQuery(ctx, query.QueryID); err != nil {
+		return fmt.Errorf("unable to kill query [%v]: %v", query.QueryID, explainPrestoError(err))
+	}
+
+	log.Warningf("Killed query [%v] by user [%v] on behalf of [%v]", query.QueryID, query.Session.User, requester)
+	return nil
+}
+
+// killToken is the token in a query's kill link
+func killToken(queryID string) string {
+	return signBody(cfg.AckSecret, []byte("kill/"+queryID))
+}
+
+// killURL is the link killing a query, empty when --kill-links is off
+func killURL(queryID string) string {
+	if !cfg.KillLinks {
+		return ""
+	}
+	return fmt.Sprintf("%v/kill/%v?token=%v", cfg.AckBaseURL, neturl.PathEscape(queryID), killToken(queryID))
+}
+
+// killHandler serves /kill/, the kill links when the request carries a token and the admin API otherwise
+func killHandler(resp http.ResponseWriter, request *http.Request) {
+	resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	id := strings.TrimPrefix(request.URL.Path, "/kill/")
+	token := request.URL.Query().Get("token")
+
+	if cfg.KillLinks && token != "" {
+		if strings.Contains(request.UserAgent(), "Slackbot") {
+			// Unfurling the link must not kill the query
+			fmt.Fprintln(resp, "Open this link to kill the query.")
+			return
+		}
+		if id == "" || !hmac.Equal([]byte(token), []byte(killToken(id))) {
+			http.Error(resp, "This kill link isn't valid, copy the whole link from the alert.", http.StatusForbidden)
+			return
+		}
+		requestKill(request.Context(), resp, id, KILL_REQUESTER_SLACK, request.URL.Query().Get("by"))
+		return
+	}
+
+	if cfg.AdminSecret == "" {
+		http.NotFound(resp, request)
+		return
+	}
+	if !adminAuthorized(resp, request) {
+		return
+	}
+	if request.Method != "POST" || id == "" {
+		http.Error(resp, "use POST /kill/{queryID}", http.StatusMethodNotAllowed)
+		return
+	}
+	requestKill(request.Context(), resp, id, KILL_REQUESTER_ADMIN, request.URL.Query().Get("by"))
+}
+
+// requestKill kills a running query someone asked to have killed, and tells them what happened
+func requestKill(ctx context.Context, resp http.ResponseWriter, id string, requester string, by string) {
+	by = strings.TrimSpace(by)
+	if len(by) > ACK_NOTE_MAX_LENGTH {
+		by = by[:ACK_NOTE_MAX_LENGTH]
+	}
+	if by == "" {
+		by = "someone"
+	}
+
+	for _, c := range clusters {
+		detail, err := getQuery(ctx, c, id)
+		if err == prestoclient.ErrQueryGone {
+			continue
+		}
+		if err != nil {
+			http.Error(resp, fmt.Sprintf("Unable to look up query %v: %v", id, err), http.StatusBadGateway)
+			return
+		}
+		query := detail[0]
+		if finalStates[query.State] {
+			http.Error(resp, fmt.Sprintf("Query %v has already completed with state %v, there's nothing left to kill.", id, query.State), http.StatusGone)
+			return
+		}
+
+		err = killQuery(ctx, c, query, requester)
+		if refusal, ok := err.(*KillRefusedError); ok {
+			http.Error(resp, fmt.Sprintf("Query %v won't be killed, the %v.", id, refusal), http.StatusForbidden)
+			return
+		}
+		if err == ErrKillDryRun {
+			fmt.Fprintf(resp, "Dry run, query %v by %v was not killed.\n", id, query.Session.User)
+			return
+		}
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusBadGateway)
+			return
+		}
+		c.metrics.IncrCounter(metricKey("killed_queries"), 1.0)
+		log.Warningf("%vQuery [%v] was killed on behalf of [%v] through [%v]", c.prefix(), id, by, requester)
+		notify(ctx, Alert{Cluster: c, Query: query, KillReason: fmt.Sprintf("%v asked for it through %v", by, killRequesterText(requester))})
+		fmt.Fprintf(resp, "Killed query %v by %v.\n", id, query.Session.User)
+		return
+	}
+	http.Error(resp, fmt.Sprintf("Query %v isn't running on any cluster we watch.", id), http.StatusNotFound)
+}
+
+// killRequesterText names where a kill was asked for, for the kill notice
+func killRequesterText(requester string) string {
+	switch requester {
+	case KILL_REQUESTER_SLACK:
+		return "the link in the Slack alert"
+	case KILL_REQUESTER_ADMIN:
+		return "the admin API"
+	}
+	return requester
+}
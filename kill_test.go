@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// protectedFixtures are queries matching each kind of kill protection
+func protectedFixtures() []PrestoQuery {
+	byUser := testQuery("by-user", "etl", "SELECT * FROM events.clicks", 500)
+	bySource := testQuery("by-source", "alice", "SELECT * FROM events.clicks", 500)
+	bySource.Session.Source = "airflow"
+	byGroup := testQuery("by-group", "alice", "SELECT * FROM events.clicks", 500)
+	byGroup.ResourceGroupID = []string{"global", "pipelines", "hourly"}
+	byTag := testQuery("by-tag", "alice", "-- keep-alive\nSELECT * FROM events.clicks", 500)
+	return []PrestoQuery{byUser, bySource, byGroup, byTag}
+}
+
+var protectionFor = map[string]string{
+	"by-user":   "user [etl]",
+	"by-source": "source [airflow]",
+	"by-group":  "resource group [global.pipelines]",
+	"by-tag":    "tag [keep-alive]",
+}
+
+// setupKillTest protects the fixtures and makes the fake Presto the only cluster
+func setupKillTest(queries ...PrestoQuery) (presto *fakePresto, c *cluster, notifier *recordingNotifier, restore func()) {
+	restoreConfig := setupTest()
+	cfg.ProtectedUsers = "etl"
+	cfg.ProtectedSources = "airflow"
+	cfg.ProtectedResourceGroups = "global.pipelines"
+	cfg.ProtectedTags = "keep-alive"
+	cfg.AckSecret, cfg.AckBaseURL = "ack-secret", "https://prestowatcher.example.com"
+	cfg.KillLinks = true
+	cfg.AdminSecret = "admin-secret"
+	startSlackTemplate()
+
+	presto = newFakePresto(queries...)
+	c, notifier = testCluster(presto)
+	saved := clusters
+	clusters = []*cluster{c}
+	return presto, c, notifier, func() {
+		clusters = saved
+		restoreConfig()
+	}
+}
+
+func TestAutoKillRefusedForProtectedQueries(t *testing.T) {
+	presto, c, notifier, restore := setupKillTest(protectedFixtures()...)
+	defer restore()
+	cfg.KillThreshold = 100
+
+	for _, q := range protectedFixtures() {
+		if err := checkQuery(context.Background(), c, PrestoQuery{QueryID: q.QueryID}, &cachedQuery{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(presto.killed) != 0 {
+		t.Fatalf("protected queries %v were killed", presto.killed)
+	}
+	alerts := notifier.sent()
+	if len(alerts) != len(protectionFor) {
+		t.Fatalf("got %v alerts, want one per protected query", len(alerts))
+	}
+	for _, a := range alerts {
+		want := "the query is protected by " + protectionFor[a.Query.QueryID]
+		if a.KillReason != "" || a.KillRefusal != want {
+			t.Errorf("%v: got kill reason %q and refusal %q, want refusal %q", a.Query.QueryID, a.KillReason, a.KillRefusal, want)
+		}
+		text, err := renderSlackText(a, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(text, "wasn't cancelled, "+want) {
+			t.Errorf("%v: the alert doesn't name the protection:\n%v", a.Query.QueryID, text)
+		}
+		if strings.Contains(text, "|Kill this query>") {
+			t.Errorf("%v: a protected query got a kill link:\n%v", a.Query.QueryID, text)
+		}
+	}
+}
+
+func TestAutoKillRefusedOnce(t *testing.T) {
+	presto, c, notifier, restore := setupKillTest(testQuery("q1", "etl", "SELECT * FROM events.clicks", 500))
+	defer restore()
+	cfg.KillThreshold = 100
+
+	// The query keeps growing past the kill threshold, the kill is only tried on the first check
+	entry := &cachedQuery{}
+	if err := checkQuery(context.Background(), c, PrestoQuery{QueryID: "q1"}, entry); err != nil {
+		t.Fatal(err)
+	}
+	presto.add(testQuery("q1", "etl", "SELECT * FROM events.clicks", 1500))
+	if err := checkQuery(context.Background(), c, PrestoQuery{QueryID: "q1"}, entry); err != nil {
+		t.Fatal(err)
+	}
+	if len(presto.killed) != 0 {
+		t.Fatalf("protected query was killed: %v", presto.killed)
+	}
+	sink := metricsSink.MetricSink.(*recordingSink)
+	if got := sink.count("kill_refusals"); got != 1 {
+		t.Errorf("got %v kill_refusals, want 1", got)
+	}
+	alerts := notifier.sent()
+	if len(alerts) != 2 || alerts[1].EscalatedFrom == 0 {
+		t.Fatalf("got alerts %+v, want the alert and its escalation", alerts)
+	}
+	want := "the query is protected by user [etl]"
+	for _, a := range alerts {
+		if a.KillRefusal != want {
+			t.Errorf("got kill refusal %q, want %q", a.KillRefusal, want)
+		}
+	}
+}
+
+func TestAutoKill(t *testing.T) {
+	presto, c, notifier, restore := setupKillTest(testQuery("q1", "alice", "SELECT * FROM events.clicks", 500))
+	defer restore()
+	cfg.KillThreshold = 100
+
+	if err := checkQuery(context.Background(), c, PrestoQuery{QueryID: "q1"}, &cachedQuery{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(presto.killed) != 1 || presto.killed[0] != "q1" {
+		t.Errorf("got kills %v, want q1", presto.killed)
+	}
+	if alerts := notifier.sent(); len(alerts) != 1 || alerts[0].KillReason == "" {
+		t.Errorf("got alerts %+v, want a kill notice", alerts)
+	}
+}
+
+// killRequest sends a request to killHandler
+func killRequest(method string, target string, header http.Header) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, nil)
+	for k, v := range header {
+		request.Header[k] = v
+	}
+	resp := httptest.NewRecorder()
+	killHandler(resp, request)
+	return resp
+}
+
+func TestSlackKillRefusedForProtectedQueries(t *testing.T) {
+	presto, _, notifier, restore := setupKillTest(protectedFixtures()...)
+	defer restore()
+
+	for _, q := range protectedFixtures() {
+		link := killURL(q.QueryID)
+		if !strings.HasPrefix(link, "https://prestowatcher.example.com/kill/"+q.QueryID+"?token=") {
+			t.Fatalf("unexpected kill link %v", link)
+		}
+		resp := killRequest("GET", strings.TrimPrefix(link, "https://prestowatcher.example.com")+"&by=bob", nil)
+		if resp.Code != http.StatusForbidden || !strings.Contains(resp.Body.String(), "protected by "+protectionFor[q.QueryID]) {
+			t.Errorf("%v: got %v %q, want a 403 naming the protection", q.QueryID, resp.Code, resp.Body.String())
+		}
+	}
+	if len(presto.killed) != 0 || len(notifier.sent()) != 0 {
+		t.Errorf("protected queries were killed: %v", presto.killed)
+	}
+}
+
+func TestSlackKill(t *testing.T) {
+	presto, _, notifier, restore := setupKillTest(testQuery("q1", "alice", "SELECT * FROM events.clicks", 500))
+	defer restore()
+
+	// The acknowledge token doesn't kill
+	if resp := killRequest("GET", "/kill/q1?token="+ackToken("q1"), nil); resp.Code != http.StatusForbidden {
+		t.Errorf("got %v for an acknowledge token, want 403", resp.Code)
+	}
+	// Neither does Slack unfurling the link
+	if resp := killRequest("GET", "/kill/q1?token="+killToken("q1"), http.Header{"User-Agent": {"Slackbot-LinkExpanding 1.0"}}); resp.Code != http.StatusOK || len(presto.killed) != 0 {
+		t.Errorf("unfurling answered %v and killed %v", resp.Code, presto.killed)
+	}
+
+	resp := killRequest("GET", "/kill/q1?token="+killToken("q1")+"&by=bob", nil)
+	if resp.Code != http.StatusOK || len(presto.killed) != 1 {
+		t.Fatalf("got %v %q and kills %v", resp.Code, resp.Body.String(), presto.killed)
+	}
+	if alerts := notifier.sent(); len(alerts) != 1 || alerts[0].KillReason != "bob asked for it through the link in the Slack alert" {
+		t.Errorf("got alerts %+v, want a kill notice", alerts)
+	}
+	if resp := killRequest("GET", "/kill/gone?token="+killToken("gone"), nil); resp.Code != http.StatusNotFound {
+		t.Errorf("got %v for an unknown query, want 404", resp.Code)
+	}
+}
+
+func TestAdminKillRefusedForProtectedQueries(t *testing.T) {
+	presto, _, _, restore := setupKillTest(protectedFixtures()...)
+	defer restore()
+	secret := http.Header{ADMIN_SECRET_HEADER: {"admin-secret"}}
+
+	for _, q := range protectedFixtures() {
+		resp := killRequest("POST", "/kill/"+q.QueryID, secret)
+		if resp.Code != http.StatusForbidden || !strings.Contains(resp.Body.String(), "protected by "+protectionFor[q.QueryID]) {
+			t.Errorf("%v: got %v %q, want a 403 naming the protection", q.QueryID, resp.Code, resp.Body.String())
+		}
+	}
+	if len(presto.killed) != 0 {
+		t.Errorf("protected queries were killed: %v", presto.killed)
+	}
+}
+
+func TestAdminKill(t *testing.T) {
+	presto, _, notifier, restore := setupKillTest(testQuery("q1", "alice", "SELECT * FROM events.clicks", 500))
+	defer restore()
+
+	if resp := killRequest("POST", "/kill/q1", http.Header{ADMIN_SECRET_HEADER: {"wrong"}}); resp.Code != http.StatusUnauthorized {
+		t.Errorf("got %v with the wrong secret, want 401", resp.Code)
+	}
+	if resp := killRequest("GET", "/kill/q1", http.Header{ADMIN_SECRET_HEADER: {"admin-secret"}}); resp.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got %v for a GET, want 405", resp.Code)
+	}
+	if len(presto.killed) != 0 {
+		t.Fatalf("killed %v without a valid request", presto.killed)
+	}
+
+	resp := killRequest("POST", "/kill/q1?by=carol", http.Header{ADMIN_SECRET_HEADER: {"admin-secret"}})
+	if resp.Code != http.StatusOK || len(presto.killed) != 1 {
+		t.Fatalf("got %v %q and kills %v", resp.Code, resp.Body.String(), presto.killed)
+	}
+	if alerts := notifier.sent(); len(alerts) != 1 || alerts[0].KillReason != "carol asked for it through the admin API" {
+		t.Errorf("got alerts %+v, want a kill notice", alerts)
+	}
+}
+
+func TestKillInDryRun(t *testing.T) {
+	presto, c, notifier, restore := setupKillTest(testQuery("q1", "alice", "SELECT * FROM events.clicks", 500))
+	defer restore()
+	cfg.DryRun = true
+	cfg.KillThreshold = 100
+
+	// The query is still running on the next check, the would-be kill is only reported once
+	entry := &cachedQuery{}
+	for i := 0; i < 2; i++ {
+		if err := checkQuery(context.Background(), c, PrestoQuery{QueryID: "q1"}, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(presto.killed) != 0 {
+		t.Errorf("killed %v in a dry run", presto.killed)
+	}
+	sink := metricsSink.MetricSink.(*recordingSink)
+	if sink.count("killed_queries") != 0 || sink.count("dry_run_alerts") != 1 {
+		t.Errorf("got %v killed_queries and %v dry_run_alerts, want 0 and 1", sink.count("killed_queries"), sink.count("dry_run_alerts"))
+	}
+	alerts := notifier.sent()
+	if len(alerts) != 1 {
+		t.Fatalf("got %v alerts, want the would-be kill notice", len(alerts))
+	}
+	if !alerts[0].DryRunKill || isFollowUp(alerts[0]) {
+		t.Errorf("got dry-run kill %v and follow-up %v, want a first alert about a dry-run kill", alerts[0].DryRunKill, isFollowUp(alerts[0]))
+	}
+	text, err := renderSlackText(alerts[0], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text, "*would have been cancelled by prestowatcher*") || strings.Contains(text, "was *cancelled") {
+		t.Errorf("the alert reads as a real kill:\n%v", text)
+	}
+	if got := status.report().Flagged; len(got) != 1 || got[0].Decision != DECISION_DRY_RUN_KILL {
+		t.Errorf("got /status entries %+v, want one dry-run-kill", got)
+	}
+	if got := auditAction(DECISION_DRY_RUN_KILL); got != AUDIT_ACTION_DRY_RUN {
+		t.Errorf("got audit action %q, want %q", got, AUDIT_ACTION_DRY_RUN)
+	}
+	if resp := killRequest("POST", "/kill/q1", http.Header{ADMIN_SECRET_HEADER: {"admin-secret"}}); resp.Code != http.StatusOK || !strings.HasPrefix(resp.Body.String(), "Dry run") {
+		t.Errorf("got %v %q for an admin kill in a dry run", resp.Code, resp.Body.String())
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+	Detection latency answers "how fast does the bot catch bad queries?": the time from a query's createTime to
+	its first alert, whichever kind that is. It's shown on that alert ("caught after 47s"), sampled in
+	presto.watcher.detection_latency_ms and summed up as min, average and max since startup on /status.
+
+	The coordinator's clock and ours can disagree, so a latency below zero is counted as zero and logged at debug
+	level instead of being reported.
+*/
+
+// Detection latency since startup, the milliseconds are for /status
+type latencyStats struct {
+	Count     int64 `json:"count"`
+	MinMillis int64 `json:"min_ms"`
+	AvgMillis int64 `json:"avg_ms"`
+	MaxMillis int64 `json:"max_ms"`
+	// Only for the average
+	total time.Duration
+}
+
+func (l *latencyStats) add(d time.Duration) {
+	ms := int64(d / time.Millisecond)
+	if l.Count == 0 || ms < l.MinMillis {
+		l.MinMillis = ms
+	}
+	if ms > l.MaxMillis {
+		l.MaxMillis = ms
+	}
+	l.Count++
+	l.total += d
+	l.AvgMillis = int64(l.total/time.Millisecond) / l.Count
+}
+
+// queryCreated parses the query's createTime, ok is false when Presto didn't give a readable one
+func queryCreated(query PrestoQuery) (created time.Time, ok bool) {
+	if query.QueryStats.CreateTime == "" {
+		return created, false
+	}
+	created, err := time.Parse(time.RFC3339Nano, query.QueryStats.CreateTime)
+	if err != nil {
+		log.Debugf("Query [%v] has an unreadable create time: %v", query.QueryID, err)
+		return created, false
+	}
+	return created, true
+}
+
+// detection records how long after its creation a query is being alerted on, the first time it is. It returns
+// the latency to show on the alert, 0 for later alerts or when the create time is unknown.
+func detection(c *cluster, query PrestoQuery, entry *cachedQuery, now time.Time) time.Duration {
+	if entry.Detected {
+		return 0
+	}
+	entry.Detected = true
+	created, ok := queryCreated(query)
+	if !ok {
+		return 0
+	}
+	latency := now.Sub(created)
+	if latency < 0 {
+		log.Debugf("Query [%v] was created [%v] after we alerted on it, the coordinator's clock must be ahead", query.QueryID, -latency)
+		latency = 0
+	}
+	c.metrics.AddSample(metricKey("detection_latency_ms"), float32(latency.Seconds()*1000))
+	status.detected(latency)
+	return latency
+}
+
+// caughtAfterText is the line saying how fast a query was caught, empty unless this is its first alert
+func caughtAfterText(alert Alert) string {
+	if alert.CaughtAfter <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("_Caught after %v._\n", formatDuration(alert.CaughtAfter))
+}
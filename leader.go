@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thecubed/prestowatcher/config"
+)
+
+/*
+	Leader election for running more than one replica. With --lock-backend=redis only the instance holding the
+	lock in --lock-key polls Presto, the others stay on standby and say so on /readyz. The leader renews the
+	lock after every successful poll and releases it on shutdown. If it dies, the lock expires after --lock-ttl
+	and the next standby to try takes over, so --lock-ttl has to be longer than --interval.
+
+	The lock only needs three Redis commands, which are spoken directly over RESP instead of pulling in a client
+	library. Without a lock backend, the default, none of this runs.
+*/
+
+const REDIS_TIMEOUT = 5 * time.Second
+
+// Renew the lock only if it's still ours
+const redisRenewScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+
+// Release the lock only if it's still ours
+const redisReleaseScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+
+type leaderLock interface {
+	// acquire takes the lock, or renews it if we already hold it, and tells whether we hold it now
+	acquire() (bool, error)
+	// renew extends the lock if we still hold it
+	renew() (bool, error)
+	release() error
+}
+
+type redisLock struct {
+	addr     string
+	password string
+	key      string
+	// Who we are, stored as the lock's value
+	id  string
+	ttl time.Duration
+}
+
+// do runs one command on a fresh connection. Replies are a string, an int64, or nil for a null bulk string.
+func (r *redisLock) do(args ...string) (interface{}, error) {
+	conn, err := net.DialTimeout("tcp", r.addr, REDIS_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(REDIS_TIMEOUT))
+	reader := bufio.NewReader(conn)
+
+	if r.password != "" {
+		if _, err := redisRoundTrip(conn, reader, "AUTH", r.password); err != nil {
+			return nil, err
+		}
+	}
+	return redisRoundTrip(conn, reader, args...)
+}
+
+func redisRoundTrip(w io.Writer, reader *bufio.Reader, args ...string) (interface{}, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return nil, err
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty reply from Redis")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("Redis error: %v", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	}
+	return nil, fmt.Errorf("unexpected reply from Redis: %q", line)
+}
+
+func (r *redisLock) ttlMillis() string {
+	return strconv.FormatInt(int64(r.ttl/time.Millisecond), 10)
+}
+
+func (r *redisLock) acquire() (bool, error) {
+	if held, err := r.renew(); err != nil || held {
+		return held, err
+	}
+	reply, err := r.do("SET", r.key, r.id, "NX", "PX", r.ttlMillis())
+	if err != nil {
+		return false, err
+	}
+	return reply == "OK", nil
+}
+
+func (r *redisLock) renew() (bool, error) {
+	reply, err := r.do("EVAL", redisRenewScript, "1", r.key, r.id, r.ttlMillis())
+	if err != nil {
+		return false, err
+	}
+	return reply == int64(1), nil
+}
+
+func (r *redisLock) release() error {
+	_, err := r.do("EVAL", redisReleaseScript, "1", r.key, r.id)
+	return err
+}
+
+type leaderElection struct {
+	lock leaderLock
+	ttl  time.Duration
+	// Held while taking or renewing the lock, every cluster's collector goes through here
+	mu sync.Mutex
+	// Until when we know we hold the lock
+	heldUntil time.Time
+	// 1 while another instance is the leader, read by /readyz
+	standby int32
+}
+
+// nil without a lock backend
+var election *leaderElection
+
+// startElection sets up the lock backend, if one was configured
+func startElection() {
+	if cfg.LockBackend != config.LOCK_BACKEND_REDIS {
+		return
+	}
+	host, _ := os.Hostname()
+	lock := &redisLock{
+		addr:     cfg.LockRedisAddr,
+		password: cfg.LockRedisPassword,
+		key:      cfg.LockKey,
+		id:       fmt.Sprintf("%v-%v", host, os.Getpid()),
+		ttl:      cfg.LockTTL,
+	}
+	// Standby until the first poll finds out otherwise
+	election = &leaderElection{lock: lock, ttl: cfg.LockTTL, standby: 1}
+	log.Infof("Using Redis at [%v] for leader election as [%v], lock [%v]", lock.addr, lock.id, lock.key)
+}
+
+// lead tells whether this instance should poll now, taking the lock if it's free
+func (e *leaderElection) lead() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if time.Now().Before(e.heldUntil) {
+		return true
+	}
+	// Redis starts the TTL a little after we ask, so counting from before the request errs on the safe side
+	asked := time.Now()
+	held, err := e.lock.acquire()
+	if err != nil {
+		log.Errorf("Unable to take the leader lock, staying on standby: %v", err)
+		held = false
+	}
+	if !held {
+		if atomic.SwapInt32(&e.standby, 1) == 0 {
+			log.Warning("Lost the leader lock, going on standby")
+		}
+		return false
+	}
+	e.heldUntil = asked.Add(e.ttl)
+	if atomic.SwapInt32(&e.standby, 0) == 1 {
+		log.Info("Took the leader lock, polling Presto")
+	}
+	return true
+}
+
+// renewed extends the lock after a successful poll
+func (e *leaderElection) renewed() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	asked := time.Now()
+	held, err := e.lock.renew()
+	switch {
+	case err != nil:
+		// The lock is still good until heldUntil, the next poll tries again
+		log.Warningf("Unable to renew the leader lock: %v", err)
+	case held:
+		e.heldUntil = asked.Add(e.ttl)
+	default:
+		e.heldUntil = time.Time{}
+	}
+}
+
+// stop gives up the lock so a standby can take over right away
+func (e *leaderElection) stop() {
+	if err := e.lock.release(); err != nil {
+		log.Warningf("Unable to release the leader lock: %v", err)
+	}
+}
+
+// onStandby tells whether another instance is doing the polling
+func onStandby() bool {
+	return election != nil && atomic.LoadInt32(&election.standby) == 1
+}
+
+// collect runs one poll of a cluster, unless another instance holds the leader lock. One lock covers all the
+// clusters, the leader polls them all.
+func collect(c *cluster) {
+	if election == nil {
+		c.pollFinished(doCollect(c))
+		return
+	}
+	if !election.lead() {
+		return
+	}
+	ok := doCollect(c)
+	c.pollFinished(ok)
+	if ok {
+		election.renewed()
+	}
+}
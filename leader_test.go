@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis speaks just enough RESP for redisLock: AUTH, SET NX PX and the renew and release scripts
+type fakeRedis struct {
+	sync.Mutex
+	listener net.Listener
+	password string
+	values   map[string]string
+	expires  map[string]time.Time
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{listener: listener, password: password, values: make(map[string]string), expires: make(map[string]time.Time)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authed := r.password == ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			reader.ReadString('\n')
+			arg, _ := reader.ReadString('\n')
+			args[i] = strings.TrimSuffix(arg, "\r\n")
+		}
+		if args[0] == "AUTH" {
+			authed = args[1] == r.password
+			if !authed {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			fmt.Fprint(conn, "+OK\r\n")
+			continue
+		}
+		if !authed {
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		fmt.Fprint(conn, r.command(args))
+	}
+}
+
+// command runs one command and returns its RESP reply
+func (r *fakeRedis) command(args []string) string {
+	r.Lock()
+	defer r.Unlock()
+	key := ""
+	if len(args) > 1 {
+		key = args[1]
+	}
+	if at, ok := r.expires[key]; ok && !time.Now().Before(at) {
+		delete(r.values, key)
+		delete(r.expires, key)
+	}
+	switch {
+	case args[0] == "SET" && len(args) == 6 && args[3] == "NX" && args[4] == "PX":
+		if _, taken := r.values[key]; taken {
+			return "$-1\r\n"
+		}
+		ms, _ := strconv.Atoi(args[5])
+		r.values[key], r.expires[key] = args[2], time.Now().Add(time.Duration(ms)*time.Millisecond)
+		return "+OK\r\n"
+	case args[0] == "EVAL" && args[1] == redisRenewScript:
+		key = args[3]
+		if r.values[key] != args[4] {
+			return ":0\r\n"
+		}
+		ms, _ := strconv.Atoi(args[5])
+		r.expires[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	case args[0] == "EVAL" && args[1] == redisReleaseScript:
+		key = args[3]
+		if r.values[key] != args[4] {
+			return ":0\r\n"
+		}
+		delete(r.values, key)
+		delete(r.expires, key)
+		return ":1\r\n"
+	}
+	return fmt.Sprintf("-ERR unknown command '%v'\r\n", args[0])
+}
+
+func (r *fakeRedis) lock(id string, ttl time.Duration) *redisLock {
+	return &redisLock{addr: r.listener.Addr().String(), password: r.password, key: "prestowatcher-leader", id: id, ttl: ttl}
+}
+
+func TestRedisLock(t *testing.T) {
+	redis := newFakeRedis(t, "secret")
+	defer redis.listener.Close()
+	a, b := redis.lock("a", 200*time.Millisecond), redis.lock("b", 200*time.Millisecond)
+
+	if held, err := a.acquire(); !held || err != nil {
+		t.Fatalf("a got %v, %v taking a free lock", held, err)
+	}
+	if held, err := b.acquire(); held || err != nil {
+		t.Fatalf("b got %v, %v taking a's lock", held, err)
+	}
+	// Acquiring a lock we hold renews it
+	if held, err := a.acquire(); !held || err != nil {
+		t.Errorf("a got %v, %v taking its own lock again", held, err)
+	}
+	if held, err := b.renew(); held || err != nil {
+		t.Errorf("b got %v, %v renewing a's lock", held, err)
+	}
+	if err := b.release(); err != nil {
+		t.Fatal(err)
+	}
+	if held, _ := a.renew(); !held {
+		t.Error("b released a's lock")
+	}
+
+	// The lock expires if a stops renewing it
+	time.Sleep(250 * time.Millisecond)
+	if held, err := b.acquire(); !held || err != nil {
+		t.Fatalf("b got %v, %v taking an expired lock", held, err)
+	}
+	if err := b.release(); err != nil {
+		t.Fatal(err)
+	}
+	if held, err := a.acquire(); !held || err != nil {
+		t.Errorf("a got %v, %v taking a released lock", held, err)
+	}
+
+	wrong := redis.lock("c", time.Second)
+	wrong.password = "guess"
+	if _, err := wrong.acquire(); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("got %v with the wrong password", err)
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	defer setupTest()()
+	redis := newFakeRedis(t, "")
+	defer redis.listener.Close()
+	const ttl = 200 * time.Millisecond
+	leader := &leaderElection{lock: redis.lock("leader", ttl), ttl: ttl, standby: 1}
+	standby := &leaderElection{lock: redis.lock("standby", ttl), ttl: ttl, standby: 1}
+
+	presto := newFakePresto(testQuery("q1", "alice", "SELECT * FROM events.clicks", 45))
+	c, notifier := testCluster(presto)
+	saved := election
+	defer func() { election = saved }()
+
+	election = leader
+	collect(c)
+	election = standby
+	collect(c)
+	if len(notifier.sent()) != 1 {
+		t.Fatalf("got %v alerts from two replicas, want 1", len(notifier.sent()))
+	}
+	if !onStandby() {
+		t.Error("the replica without the lock isn't on standby")
+	}
+	resp := httptest.NewRecorder()
+	readyzHandler(resp, httptest.NewRequest("GET", "/readyz", nil))
+	if resp.Code != 200 || !strings.Contains(resp.Body.String(), `"standby":true`) {
+		t.Errorf("got /readyz %v %v on standby", resp.Code, resp.Body.String())
+	}
+
+	// The standby takes over within a TTL of the leader dying
+	time.Sleep(ttl + 50*time.Millisecond)
+	if !standby.lead() || onStandby() {
+		t.Error("the standby didn't take over an expired lock")
+	}
+	election = leader
+	if leader.lead() {
+		t.Error("the old leader still thinks it leads")
+	}
+
+	// A graceful shutdown hands the lock over right away
+	standby.stop()
+	if !leader.lead() {
+		t.Error("the lock wasn't released on shutdown")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/thecubed/prestowatcher/prestoclient"
+)
+
+/*
+	Every message that links to a query builds its links here, so alerts, escalations, kill notices,
+	follow-ups, user load alerts, the digest and the webhook and PagerDuty payloads all agree on which UI
+	hostnames to use.
+*/
+
+func queryURL(c *cluster, base string, queryID string) string {
+	if c != nil && c.flavor == prestoclient.FLAVOR_TRINO {
+		return fmt.Sprintf("%v/ui/query/%v", base, queryID)
+	}
+	return fmt.Sprintf("%v/ui/query.html?%v", base, queryID)
+}
+
+// primaryUIBase is the UI base URL used for the main link, the cluster's own URL without --ui-url
+func primaryUIBase(c *cluster) string {
+	if len(cfg.UILinks) == 0 {
+		if c == nil {
+			return cfg.Clusters[0].URL
+		}
+		return c.url
+	}
+	return cfg.UILinks[0].Base
+}
+
+// primaryQueryURL is the main link to a query
+func primaryQueryURL(c *cluster, queryID string) string {
+	return queryURL(c, primaryUIBase(c), queryID)
+}
+
+// slackQueryLink is the main link to a query, in Slack link syntax
+func slackQueryLink(c *cluster, queryID string) string {
+	return fmt.Sprintf("<%v>", primaryQueryURL(c, queryID))
+}
+
+// slackAlternateLinks is a line with the other UI links and the bare query ID, for people who can only reach
+// the UI some other way. Empty when there's only one UI URL.
+func slackAlternateLinks(c *cluster, queryID string) string {
+	if len(cfg.UILinks) < 2 {
+		return ""
+	}
+	var links []string
+	for _, l := range cfg.UILinks[1:] {
+		links = append(links, fmt.Sprintf("<%v|%v>", queryURL(c, l.Base, queryID), l.Label))
+	}
+	return fmt.Sprintf("Alternate links: %v (query ID `%v`)\n", strings.Join(links, ", "), queryID)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/thecubed/prestowatcher/config"
+	"github.com/thecubed/prestowatcher/prestoclient"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// Every URL in a message, Slack link labels and JSON quoting cut off
+var urlPattern = regexp.MustCompile(`https?://[^\s<>|"\\]+`)
+
+// messageURLs renders an alert as every kind of message that links to the query, returning the URLs in each
+func messageURLs(t *testing.T, c *cluster) map[string][]string {
+	var posted []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	q := testQuery("20230102_101112_00042_abcde", "alice", "SELECT * FROM events.clicks", 45)
+	alert := Alert{Cluster: c, Query: q, BadInputs: q.Inputs, TotalPartitions: 45, Severity: config.SEVERITY_WARNING}
+	queued, fullScan, final, userLoad := alert, alert, alert, alert
+	queued.QueuedFor = 10 * time.Minute
+	fullScan.FullScans = q.Inputs
+	final.FinalState = "FINISHED"
+	userLoad.UserQueries = []userQuery{{QueryID: q.QueryID, Partitions: 45}, {QueryID: "20230102_101112_00043_abcde", Partitions: 30}}
+	userLoad.Breaches = []string{"they're running 2 queries"}
+
+	urls := make(map[string][]string)
+	add := func(message string, v interface{}) {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls[message] = urlPattern.FindAllString(string(b), -1)
+	}
+	for message, a := range map[string]Alert{"alert": alert, "queued": queued, "full-scan": fullScan, "final": final, "user-load": userLoad} {
+		payload, err := slackPayload(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		add(message, payload)
+	}
+	add("digest", digestPayload([]Alert{alert}))
+	if err := (&webhookNotifier{url: server.URL}).Notify(alert); err != nil {
+		t.Fatal(err)
+	}
+	add("webhook", json.RawMessage(posted))
+	if err := (&pagerDutyNotifier{url: server.URL}).Notify(alert); err != nil {
+		t.Fatal(err)
+	}
+	add("pagerduty", json.RawMessage(posted))
+	return urls
+}
+
+func TestMessageLinks(t *testing.T) {
+	defer setupTest()()
+	startSlackTemplate()
+
+	var out bytes.Buffer
+	for _, tc := range []struct {
+		name    string
+		cluster *cluster
+		uiLinks []config.UILink
+	}{
+		{"presto", &cluster{url: "http://presto.example.com:8080", flavor: prestoclient.FLAVOR_PRESTO}, nil},
+		{"trino-named", &cluster{name: "adhoc", url: "http://adhoc.example.com:8080", flavor: prestoclient.FLAVOR_TRINO}, nil},
+		{"ui-urls", &cluster{url: "http://presto.example.com:8080", flavor: prestoclient.FLAVOR_PRESTO}, []config.UILink{
+			{Label: "vpn", Base: "https://presto.vpn.example.com"},
+			{Label: "public", Base: "https://presto.example.com"},
+			{Label: "tunnel", Base: "http://localhost:8080"},
+		}},
+	} {
+		cfg.UILinks = tc.uiLinks
+		urls := messageURLs(t, tc.cluster)
+		for _, message := range []string{"alert", "queued", "full-scan", "final", "user-load", "digest", "webhook", "pagerduty"} {
+			for _, u := range urls[message] {
+				fmt.Fprintf(&out, "%v %v: %v\n", tc.name, message, u)
+			}
+		}
+	}
+
+	golden := filepath.Join("testdata", "links.golden")
+	if *updateGolden {
+		if err := ioutil.WriteFile(golden, out.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("the message links changed, got\n%v\nwant\n%v\n(go test -run TestMessageLinks -update rewrites %v)", out.String(), string(want), golden)
+	}
+}
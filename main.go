@@ -1,26 +1,26 @@
 package main
 
 import (
-	"github.com/jessevdk/go-flags"
-	"github.com/op/go-logging"
-	"github.com/ashwanthkumar/slack-go-webhook"
-	"os"
+	"context"
 	"fmt"
-	"time"
+	"github.com/armon/go-metrics"
+	"github.com/op/go-logging"
+	"github.com/thecubed/prestowatcher/config"
+	"github.com/thecubed/prestowatcher/prestoclient"
 	"net/http"
-	"strconv"
-	"bytes"
-	"encoding/json"
-	"github.com/bluele/gcache"
+	"os"
+	"os/signal"
 	"strings"
-	"github.com/armon/go-metrics/datadog"
-	"github.com/armon/go-metrics"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 /*
 	This simple application's purpose in life is to ping Presto on an interval and check if any queries
 	exceed a given partition limit and if so, ping a Slack channel to notify the users about the problem.
- */
+*/
 
 const APP_NAME = "prestowatcher"
 const APP_VERSION = "0.0.1"
@@ -30,302 +30,789 @@ var format = logging.MustStringFormatter(
 	`%{color}%{level:-7s}: %{time} %{shortfile} %{longfunc} %{id:03x}%{color:reset} %{message}`,
 )
 
-var opts struct {
-	Verbose bool `short:"v" long:"verbose" description:"Enable DEBUG logging"`
-	DoVersion bool `short:"V" long:"version" description:"Print version and exit"`
-	PrestoURL string `short:"u" long:"url" description:"presto URL (including scheme and port)" default:"" env:"PRESTO_URL"`
-	PrestoConnector string `short:"c" long:"connector" description:"presto connector name for partitioned tables" default:"hive" env:"PRESTO_CONNECTOR"`
-	MaxPartitions string `short:"m" long:"maxpart" description:"Alert when Presto queries scan more than X partitions" default:"30" env:"MAX_PARTITIONS"`
-	UpdateInterval string `short:"i" long:"interval" description:"Update interval in seconds" default:"20" env:"UPDATE_INTERVAL"`
-	SlackURL string `short:"s" long:"slack" description:"Slack Webhook URL" default:"" env:"SLACK_URL"`
-	HealthHTTPPort string `short:"p" long:"port" description:"Health check HTTP server port" default:"8080" env:"PORT"`
-	StatsdHost string `long:"statsd" description:"StatsD ( host:port )" default:"127.0.0.1" env:"STATSD_HOST"`
+var cfg config.Config
 
-}
+// The Presto API types live in prestoclient
+type PrestoQuery = prestoclient.Query
+type PrestoInput = prestoclient.Input
+type ConnectorInfo = prestoclient.ConnectorInfo
 
-// This struct is used twice - once for the low-detail version on the overview page of all queries, and again in the full-detail version
-// we simply parse the query again to get the additional detail we need.
-type PrestoQuery struct {
-	Query string `json:"query"`
-	QueryID string `json:"queryId"`
-	State string `json:"state"`
-	Session struct {
-		User string `json:"user"`
-	} `json:"session"`
-	Inputs []PrestoInput `json:"inputs"`
-}
-type PrestoInput struct {
-	ConnectorID string `json:"connectorId"`
-	Schema string `json:"schema"`
-	Table string `json:"table"`
-	ConnectorInfo ConnectorInfo `json:"connectorInfo"`
-}
-type ConnectorInfo struct {
-	PartitionIds []string `json:"partitionIds"`
-	Truncated bool `json:"truncated"`
-}
+const (
+	QUERY_TYPE_READ  = "read"
+	QUERY_TYPE_WRITE = "write"
+)
 
-type ModeQueryInfo struct {
-	User string `json:"user"`
-	URL string `json:"url"`
-	Scheduled bool `json:"scheduled"`
+// Statements that write to a table. CREATE only counts because a CTAS is the only CREATE that has inputs to check.
+var writeStatements = []string{"INSERT", "CREATE", "DELETE", "UPDATE", "MERGE"}
+
+// How much a flagged query's partition count has to grow before we send an escalation
+const ESCALATION_FACTOR = 2
+
+// What we remember about a query between checks
+type cachedQuery struct {
+	// When we last fetched the query detail
+	LastChecked time.Time
+	// Partition counts per connector.schema.table at the last check
+	Partitions map[string]int
+	// Total partitions of the bad inputs when we first alerted, 0 if we never alerted
+	AlertedPartitions int
+	// Whether the escalation message has gone out
+	Escalated bool
+	// Whether we've counted this query's alert as suppressed by the opt-out tag
+	Suppressed bool
+	// Whether we've alerted on the bytes scanned and runtime limits
+	BytesAlerted   bool
+	RuntimeAlerted bool
+	// Whether we've alerted on the splits and physical input size limits
+	SplitsAlerted    bool
+	InputSizeAlerted bool
+	// When we first saw the query in QUEUED, zero if we never did
+	QueuedSince time.Time
+	// Whether we've alerted on it being queued too long
+	QueueAlerted bool
+	// Whether we've alerted on it scanning a partitioned table without a partition filter
+	FullScanAlerted bool
+	// Whether its suppressed alert went into the audit log
+	AuditedSuppressed bool
+	// Whether its detection latency has been recorded, which happens on its first alert
+	Detected bool
+	// With --watch-failures, whether we're waiting to see it finish or fail, and when it was first alerted on
+	AwaitingOutcome bool
+	FlaggedAt       time.Time
+	// Whether it was already running for longer than --startup-grace when we started, so it's never checked
+	PreExisting bool
+	// Whether its truncated partition lists have been counted, which happens once per query
+	TruncationCounted bool
+	// Whether its would-be kill was reported in a dry run, which happens once per query
+	KillNotified bool
+	// Why its automatic kill was refused, a protected query is only tried once
+	KillRefusal string
+	// Where its first Slack alert was posted through the API, for follow-ups to reply to
+	SlackThread slackThread
+	// Whether someone acknowledged its alert, which stops escalations and follow-ups, who and when
+	Acknowledged bool
+	AckedBy      string
+	AckedAt      time.Time
 }
 
-// Metrics sink
-var metricsSink *datadog.DogStatsdSink
-// Internal stat to track last time we polled Presto
-var lastUpdate int64
-// Converted version of the UpdateInterval
-var delay time.Duration
-// Maximum partitions
-var maxParts int
-// We need to store the queries we've seen before so we don't spam Slack. Maybe that'd be a good thing?
-var queryCache gcache.Cache
-
 func healthCheckHandler(resp http.ResponseWriter, request *http.Request) {
-	if time.Now().Unix() - lastUpdate > 3*int64(delay) {
+	stale := 0
+	var since int64
+	var perCluster string
+	for _, c := range clusters {
+		s := c.secondsSinceLastPoll()
+		if pollOverdue(s) {
+			stale++
+		}
+		if s > since {
+			since = s
+		}
+		if c.name != "" {
+			perCluster += fmt.Sprintf("\n%vpolled last: [%v]", c.prefix(), s)
+		}
+	}
+	if stale > cfg.MaxStaleClusters && !onStandby() {
 		resp.WriteHeader(500)
 	}
 	resp.Write(
-		[]byte(fmt.Sprintf("Hi Mom!\nPolled last: [%v]", time.Now().Unix() - lastUpdate)),
+		[]byte(fmt.Sprintf("Hi Mom!\nPolled last: [%v]", since) + perCluster),
 	)
 	log.Debug("Received health check")
 }
 
-func pingSlack(badInputs []PrestoInput, query PrestoQuery) {
-	var attachments []slack.Attachment
+// partitionCountText renders the partition count of an input, flagging it as a lower bound when Presto truncated the list
+func partitionCountText(input PrestoInput) string {
+	if input.ConnectorInfo.Truncated {
+		return fmt.Sprintf("%v+ (truncated)", len(input.ConnectorInfo.PartitionIds))
+	}
+	return fmt.Sprintf("%v", len(input.ConnectorInfo.PartitionIds))
+}
 
-	var totalPartitions int
-	for _, i := range badInputs {
-		ptnCount := len(i.ConnectorInfo.PartitionIds)
-		totalPartitions += ptnCount
-		attachment := slack.Attachment{}
-		var color = "warning"
-		attachment.Color = &color
-		attachment.AddField(slack.Field{Title: "Schema", Value: fmt.Sprintf("%v.%v.%v", i.ConnectorID, i.Schema, i.Table), Short: true})
-		attachment.AddField(slack.Field{Title: "Partitions", Value: fmt.Sprintf("%v", ptnCount), Short: true})
-		attachments = append(attachments, attachment)
-	}
-
-	if query.Session.User == "mode" {
-		var mqi ModeQueryInfo
-		var color = "439FE0"
-		lines := strings.Split(query.Query, "\n")
-		modeTag := lines[len(lines)-1][3:]
-		json.Unmarshal([]byte(modeTag), &mqi)
-		queryInfo := slack.Attachment{}
-		queryInfo.Color = &color
-		queryInfo.AddField(slack.Field{Title: "Mode Username", Value: mqi.User, Short: true})
-		queryInfo.AddField(slack.Field{Title: "Scheduled?", Value: fmt.Sprintf("%v", mqi.Scheduled), Short: true})
-		queryInfo.AddField(slack.Field{Title: "URL", Value: mqi.URL})
-		attachments = append(attachments, queryInfo)
-	}
-
-	payload := slack.Payload {
-		Text: fmt.Sprintf(":bomb: :bomb: :bomb:\nPresto query <%v/ui/query.html?%v> is searching through more than *%v* partitions total! :sql_bandit:\n", opts.PrestoURL, query.QueryID, totalPartitions) +
-			"Make sure your query has a filter for `date` and not `received_at`!\n" +
-			"\n\n*If you want to disable this alert for your query*, add `-- sqlbandit:off` somewhere in your query.",
-		Username: "SQLBandit",
-		Attachments: attachments,
-	}
-	err := slack.Send(opts.SlackURL, "", payload)
-	if len(err) > 0 {
-		log.Errorf("Error sending message to Slack: %s\n", err)
+// queryType classifies a query as a read or a write. Presto tells us through updateType on the detail payload,
+// but it's only set once the query has been analyzed, so fall back to looking at the SQL itself.
+func queryType(query PrestoQuery) string {
+	if query.UpdateType != "" {
+		return QUERY_TYPE_WRITE
 	}
+
+	sql := strings.TrimSpace(query.Query)
+	for {
+		if strings.HasPrefix(sql, "--") {
+			if idx := strings.Index(sql, "\n"); idx >= 0 {
+				sql = strings.TrimSpace(sql[idx+1:])
+				continue
+			}
+			sql = ""
+		} else if strings.HasPrefix(sql, "/*") {
+			if idx := strings.Index(sql, "*/"); idx >= 0 {
+				sql = strings.TrimSpace(sql[idx+2:])
+				continue
+			}
+			sql = ""
+		}
+		break
+	}
+
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return QUERY_TYPE_READ
+	}
+	keyword := strings.ToUpper(strings.TrimLeft(fields[0], "("))
+	for _, w := range writeStatements {
+		if keyword == w {
+			return QUERY_TYPE_WRITE
+		}
+	}
+	return QUERY_TYPE_READ
 }
 
-func checkQuery(queryStats PrestoQuery) error {
+// partitionLimit returns the partition threshold that applies to the given query type
+func partitionLimit(qType string) int {
+	if qType == QUERY_TYPE_WRITE {
+		return cfg.MaxWritePartitions
+	}
+	return cfg.MaxPartitions
+}
+
+// tableName is the fully qualified connector.schema.table name of an input
+func tableName(input PrestoInput) string {
+	return fmt.Sprintf("%s.%s.%s", input.ConnectorID, input.Schema, input.Table)
+}
+
+// resourceGroupName returns the query's resource group as a dotted path like global.adhoc, empty if it has none
+func resourceGroupName(query PrestoQuery) string {
+	return strings.Join(query.ResourceGroupID, ".")
+}
+
+// labelValue stands in for a missing session field in metric labels, so every series has the same labels
+func labelValue(value string) string {
+	if value == "" {
+		return "none"
+	}
+	return value
+}
+
+// overLimit tells whether an input scans more partitions than the limit allows
+func overLimit(input PrestoInput, limit int) bool {
+	// A truncated list only tells us the lower bound, so the real scan could be anything. Treat it as over the limit.
+	return len(input.ConnectorInfo.PartitionIds) > limit || input.ConnectorInfo.Truncated
+}
+
+// The outcome of checking a query's inputs against the thresholds
+type evaluation struct {
+	Type string
+	// Default limit for the query type
+	Limit int
+	// Inputs on the connectors we check
+	Inputs []PrestoInput
+	// The limit that applied to each of the Inputs
+	Limits []appliedLimit
+	// Inputs that are over the limit
+	BadInputs []PrestoInput
+	// Inputs on partitioned tables without any partition filter
+	FullScans []PrestoInput
+	OptedOut  bool
+	// The query carries the opt-out tag but is over --optout-max-partitions, so it's alerted on anyway
+	OptOutIgnored bool
+	// Bytes scanned and runtime so far, 0 when Presto didn't say
+	ScannedBytes int64
+	Runtime      time.Duration
+	// Splits and physical input bytes so far, 0 when Presto didn't say
+	Splits     int64
+	InputBytes int64
+	// Severity tier of the worst of the BadInputs, empty when there are none
+	Severity string
+}
+
+// evaluateQuery checks a query's inputs against the thresholds. It has no side effects, so it can also be used
+// for queries that have long finished.
+func evaluateQuery(query PrestoQuery) evaluation {
+	// Writes legitimately touch a lot of partitions, so they get their own threshold
+	ev := evaluation{Type: queryType(query)}
+	ev.Limit = partitionLimit(ev.Type)
+	ev.ScannedBytes, ev.Runtime = queryResources(query)
+	ev.Splits, ev.InputBytes = queryScale(query)
+
+	// Let us disable the slack alert per-query. This doesn't exempt the query from the kill threshold.
+	ev.OptedOut = strings.Contains(query.Query, cfg.OptOutTag)
+
+	for idx, input := range mergeInputs(query.Inputs) {
+		if !cfg.Connectors[input.ConnectorID] {
+			// not a hive input... skip it, but keep checking the others
+			log.Debugf("Query [%q] input index [%v] connector [%v] not in [%v], skipping check of this input index!", query.QueryID, idx, input.ConnectorID, cfg.PrestoConnector)
+			continue
+		}
+		limit := rules.limitFor(input, ev.Type)
+		ev.Inputs = append(ev.Inputs, input)
+		ev.Limits = append(ev.Limits, limit)
+		if overLimit(input, limit.Max) {
+			ev.BadInputs = append(ev.BadInputs, input)
+		}
+		if fullScan(input) {
+			ev.FullScans = append(ev.FullScans, input)
+		}
+	}
+
+	// The opt-out can't be used to hide a truly huge scan
+	if ev.OptedOut && cfg.OptOutMaxPartitions > 0 {
+		var total int
+		for _, i := range ev.BadInputs {
+			total += len(i.ConnectorInfo.PartitionIds)
+		}
+		if total > cfg.OptOutMaxPartitions {
+			ev.OptedOut, ev.OptOutIgnored = false, true
+		}
+	}
+
+	// Worst first, so the alerts that can't show them all show the ones that matter
+	sortByPartitions(ev.BadInputs)
+	ev.Severity = worstSeverity(ev.BadInputs, ev.Type)
+	return ev
+}
+
+// checkQuery fetches the query detail and alerts if it's over the limit. entry is what we remembered from
+// previous checks and is updated in place.
+func checkQuery(ctx context.Context, c *cluster, queryStats PrestoQuery, entry *cachedQuery) error {
 	// How many partitions does this query have?
 	log.Debugf("Checking query [%v] for issues...", queryStats.QueryID)
-	queryWrap, err := getQuery(queryStats.QueryID)
+	ctx, span := startSpan(ctx, "check query")
+	span.setAttribute("query.id", queryStats.QueryID)
+	defer span.end()
+	queryWrap, err := getQuery(ctx, c, queryStats.QueryID)
 	if err != nil {
+		if err != prestoclient.ErrQueryGone {
+			span.setError(err)
+		}
 		return err
 	}
 	// Yeah, silly i know, but whatever.
 	query := queryWrap[0]
-
-	// Let us disable the slack alert per-query
-	if strings.Contains(query.Query, "sqlbandit:off") {
-		return nil
-	}
-
-	shouldPingSlack := false
-
-	var badInputs []PrestoInput
+	entry.LastChecked = time.Now()
+	previous := entry.Partitions
+	entry.Partitions = make(map[string]int)
+
+	ev := evaluateQuery(query)
+	qType, limit, badInputs := ev.Type, ev.Limit, ev.BadInputs
+	log.Debugf("Query [%v] is a [%v] query, default partition limit is [%v]", queryStats.QueryID, qType, limit)
+
+	// Whatever we end up deciding goes into the decision journal
+	decision := queryDecision{QueryID: queryStats.QueryID, User: query.Session.User, Type: qType, Limit: limit, Severity: ev.Severity, Decision: DECISION_OK}
+	defer func() {
+		partitions := 0
+		for _, input := range decision.Inputs {
+			partitions += input.Partitions
+		}
+		_, alerted := flaggedDecision(decision.Decision, len(ev.BadInputs) > 0)
+		span.setAttribute("user", decision.User)
+		span.setAttribute("partitions", partitions)
+		span.setAttribute("decision", decision.Decision)
+		span.setAttribute("alerted", alerted)
+
+		journal.record(c, decision)
+		status.record(decision, len(ev.BadInputs) > 0, entry.LastChecked)
+		// Alerts are audited every time one goes out, suppressed ones once per query
+		if flagged, alerted := flaggedDecision(decision.Decision, len(ev.BadInputs) > 0); flagged && (alerted || !entry.AuditedSuppressed) {
+			entry.AuditedSuppressed = entry.AuditedSuppressed || !alerted
+			record := newAuditRecord(query, decision, entry.LastChecked)
+			audit.record(record)
+			events.publish(c, record)
+		}
+		if len(ev.BadInputs) > 0 {
+			atomic.AddInt64(&c.flaggedThisCycle, 1)
+		}
+		if _, alerted := flaggedDecision(decision.Decision, len(ev.BadInputs) > 0); alerted {
+			awaitOutcome(entry, entry.LastChecked)
+		}
+	}()
 
 	//log.Debugf("Query: %+v", query)
-	for idx, input := range query.Inputs {
+	// Presto keeps truncating the list on every re-check, so it's only counted the first time
+	var truncated bool
+	for idx, input := range ev.Inputs {
 		log.Debugf("Checking query [%q] input index [%v] partition counts...", queryStats.QueryID, idx)
-		if input.ConnectorID != opts.PrestoConnector {
-			// not a hive query... bail, bail, bail!
-			log.Debugf("Query [%q] input index [%v] connector [%v] != [%v], aborting check of this input index!", queryStats.QueryID, idx, input.ConnectorID, opts.PrestoConnector)
-			return nil
-		}
 		log.Debugf("Partitions: %v", input.ConnectorInfo.PartitionIds)
-
-		// emit partition names to datadog
-		for _, ptn := range input.ConnectorInfo.PartitionIds {
-			log.Debugf("Emit StatsD message for table: [%v.%v.%v] Partition: [%v]", input.ConnectorID, input.Schema, input.Table, ptn)
-			metricsSink.IncrCounterWithLabels(
-				[]string{"presto", "watcher", "queried_partitions",},
+		table := tableName(input)
+		inputLimit := ev.Limits[idx]
+		decision.Inputs = append(decision.Inputs, inputDecision{Table: table, Partitions: len(input.ConnectorInfo.PartitionIds), Limit: inputLimit.Max})
+		entry.Partitions[table] = len(input.ConnectorInfo.PartitionIds)
+		// Only count what's new since the last check so re-checks don't inflate the histogram
+		hourly.observe(entry.LastChecked, table, len(input.ConnectorInfo.PartitionIds)-previous[table], false)
+
+		emitPartitionMetrics(c, table, qType, input.ConnectorInfo.PartitionIds)
+
+		if input.ConnectorInfo.Truncated && !entry.TruncationCounted {
+			truncated = true
+			log.Warningf("Query [%v] Input [%v] Source [%v] partition list was truncated by Presto at [%v]", queryStats.QueryID, idx, table, len(input.ConnectorInfo.PartitionIds))
+			c.metrics.IncrCounterWithLabels(
+				metricKey("truncated_partition_lists"),
 				1.0,
 				[]metrics.Label{
 					{
-						Name: "table",
-						Value: fmt.Sprintf("%s.%s.%s", input.ConnectorID, input.Schema, input.Table),
+						Name:  "table",
+						Value: table,
+					},
+				},
+			)
+		}
+
+		if overLimit(input, inputLimit.Max) {
+			log.Warningf("Query [%v] Input [%v] Source [%v] is searching [%v] partitions! Limit for this [%v] query is [%v]", queryStats.QueryID, idx, table, len(input.ConnectorInfo.PartitionIds), qType, inputLimit)
+			c.metrics.IncrCounterWithLabels(
+				metricKey("query_partition_counts"),
+				float32(len(input.ConnectorInfo.PartitionIds)),
+				[]metrics.Label{
+					{
+						Name:  "table",
+						Value: table,
+					},
+					{
+						Name:  "query_type",
+						Value: qType,
 					},
 					{
-						Name: "partition",
-						Value: ptn,
+						Name:  "source",
+						Value: labelValue(query.Session.Source),
+					},
+					{
+						Name:  "resource_group",
+						Value: labelValue(resourceGroupName(query)),
+					},
+					{
+						Name:  "severity",
+						Value: ev.Severity,
 					},
 				},
 			)
 		}
+	}
 
-		if len(input.ConnectorInfo.PartitionIds) > maxParts {
-			shouldPingSlack = true
-			badInputs = append(badInputs, input)
-			log.Warningf("Query [%v] Input [%v] Source [%v.%v.%v] is searching [%v] partitions!", queryStats.QueryID, idx, input.ConnectorID, input.Schema, input.Table, len(input.ConnectorInfo.PartitionIds))
-			metricsSink.IncrCounterWithLabels(
-				[]string{"presto", "watcher", "query_partition_counts"},
-				float32(len(input.ConnectorInfo.PartitionIds)),
+	entry.TruncationCounted = entry.TruncationCounted || truncated
+
+	// The kill threshold is checked even for opted out queries, only the no-kill tag skips it
+	var killRefusal string
+	if cfg.KillThreshold > 0 && !strings.Contains(query.Query, cfg.NoKillTag) {
+		var queryPartitions int
+		for _, p := range entry.Partitions {
+			queryPartitions += p
+		}
+		if queryPartitions > cfg.KillThreshold && entry.KillNotified {
+			decision.Decision = DECISION_ALREADY_ALERTED
+			log.Debugf("Query [%v] would have been killed on an earlier check, not reporting it again", queryStats.QueryID)
+			return nil
+		}
+		if queryPartitions > cfg.KillThreshold && entry.KillRefusal != "" {
+			// Still protected, the refusal was logged and counted on an earlier check
+			killRefusal = entry.KillRefusal
+		} else if queryPartitions > cfg.KillThreshold {
+			reason := fmt.Sprintf("it was searching through %v partitions, over the kill threshold of %v", queryPartitions, cfg.KillThreshold)
+			err := killQuery(ctx, c, query, KILL_REQUESTER_AUTO)
+			switch {
+			case err == ErrKillDryRun:
+				// notify counts it in dry_run_alerts, nothing was killed
+				decision.Decision = DECISION_DRY_RUN_KILL
+				entry.KillNotified = true
+			case err != nil:
+				// Still let people know about the query through the normal warning, with why it wasn't killed
+				log.Errorf("Unable to kill query [%v]: %v", queryStats.QueryID, err)
+				if refusal, ok := err.(*KillRefusedError); ok {
+					killRefusal = fmt.Sprintf("the %v", refusal)
+					entry.KillRefusal = killRefusal
+				}
+			default:
+				decision.Decision = DECISION_KILLED
+				c.metrics.IncrCounter(metricKey("killed_queries"), 1.0)
+			}
+			if err == nil || err == ErrKillDryRun {
+				notify(ctx, Alert{Cluster: c, Query: query, CaughtAfter: detection(c, query, entry, time.Now()), BadInputs: badInputs, TotalPartitions: queryPartitions, Severity: ev.Severity, KillReason: reason, DryRunKill: err == ErrKillDryRun, Thread: &entry.SlackThread})
+				return nil
+			}
+		}
+	}
+
+	// Filtered users and schemas are measured above, but never alerted on
+	if !userAlertable(query.Session.User) || !sourceAlertable(query.Session.Source) {
+		decision.Decision = DECISION_IGNORED
+		return nil
+	}
+	if len(badInputs) > 0 {
+		if badInputs = alertableInputs(badInputs); len(badInputs) == 0 {
+			decision.Decision = DECISION_IGNORED
+			return nil
+		}
+	}
+
+	if ev.OptedOut {
+		decision.Decision = DECISION_OPTOUT
+		if len(badInputs) > 0 {
+			countSuppressed(c, query, entry, badInputs, fmt.Sprintf("it carries the opt-out tag [%v]", cfg.OptOutTag))
+		}
+		return nil
+	}
+	if ev.OptOutIgnored {
+		log.Infof("Query [%v] by user [%v] carries the opt-out tag but is over [%v] partitions, alerting anyway", queryStats.QueryID, query.Session.User, cfg.OptOutMaxPartitions)
+	}
+
+	// Suppressions added through the admin API
+	if len(badInputs) > 0 {
+		var suppressed []PrestoInput
+		if badInputs, suppressed = suppressions.filter(query.Session.User, badInputs); len(suppressed) > 0 {
+			countSuppressed(c, query, entry, suppressed, "of a suppression")
+			if len(badInputs) == 0 {
+				decision.Decision = DECISION_SUPPRESSED
+				return nil
+			}
+		}
+	}
+
+	// Scanning a partitioned table without a partition filter gets its own alert, once per query
+	fullScans, _ := suppressions.filter(query.Session.User, alertableInputs(ev.FullScans))
+	if len(fullScans) > 0 && !entry.FullScanAlerted {
+		entry.FullScanAlerted = true
+		decision.Decision = DECISION_ALERTED
+		log.Warningf("Query [%v] by user [%v] has no partition filter on [%v]", queryStats.QueryID, query.Session.User, tableNames(fullScans))
+		for _, i := range fullScans {
+			c.metrics.IncrCounterWithLabels(
+				metricKey("full_scans"),
+				1.0,
 				[]metrics.Label{
 					{
-						Name: "table",
-						Value: fmt.Sprintf("%s.%s.%s", input.ConnectorID, input.Schema, input.Table),
+						Name:  "table",
+						Value: tableName(i),
 					},
 				},
 			)
 		}
+		notify(ctx, Alert{Cluster: c, Query: query, CaughtAfter: detection(c, query, entry, time.Now()), FullScans: fullScans, Thread: &entry.SlackThread})
 	}
 
-	if shouldPingSlack {
-		pingSlack(badInputs, query)
+	// Bytes, runtime, splits and input size only grow, so they're checked on every re-check
+	breaches := resourceBreaches(ev, entry)
+	if len(badInputs) == 0 {
+		if len(breaches) > 0 && entry.Acknowledged {
+			decision.Decision = DECISION_ALREADY_ALERTED
+			log.Debugf("Query [%v] is over its resource limits, but was acknowledged by [%v]", queryStats.QueryID, entry.AckedBy)
+		} else if len(breaches) > 0 {
+			decision.Decision = DECISION_ALERTED
+			log.Warningf("Query [%v] is over its resource limits: %v", queryStats.QueryID, breachText(breaches))
+			notify(ctx, Alert{Cluster: c, Query: query, CaughtAfter: detection(c, query, entry, time.Now()), Breaches: breaches, ScannedBytes: ev.ScannedBytes, Runtime: ev.Runtime, Thread: &entry.SlackThread})
+		}
+		return nil
+	}
+
+	var totalPartitions int
+	for _, i := range badInputs {
+		totalPartitions += len(i.ConnectorInfo.PartitionIds)
+	}
+	// Suppressed and filtered inputs don't count towards the tier of the alert
+	severity := worstSeverity(badInputs, qType)
+
+	// Only alert the first time a query crosses the threshold, and escalate once if it keeps growing
+	switch {
+	case entry.AlertedPartitions == 0:
+		decision.Decision = DECISION_ALERTED
+		entry.AlertedPartitions = totalPartitions
+		for _, i := range badInputs {
+			hourly.observe(entry.LastChecked, tableName(i), 0, true)
+		}
+		notify(ctx, Alert{Cluster: c, Query: query, CaughtAfter: detection(c, query, entry, time.Now()), BadInputs: badInputs, TotalPartitions: totalPartitions, Severity: severity, OptOutIgnored: ev.OptOutIgnored, KillRefusal: killRefusal, Breaches: breaches, ScannedBytes: ev.ScannedBytes, Runtime: ev.Runtime, RepeatCount: repeatOffense(query, entry.LastChecked), Thread: &entry.SlackThread})
+	case entry.Acknowledged:
+		decision.Decision = DECISION_ALREADY_ALERTED
+		log.Debugf("Query [%v] was acknowledged by [%v], not escalating at [%v] partitions", queryStats.QueryID, entry.AckedBy, totalPartitions)
+	case !entry.Escalated && totalPartitions > ESCALATION_FACTOR*entry.AlertedPartitions:
+		decision.Decision = DECISION_ESCALATED
+		entry.Escalated = true
+		notify(ctx, Alert{Cluster: c, Query: query, CaughtAfter: detection(c, query, entry, time.Now()), BadInputs: badInputs, TotalPartitions: totalPartitions, Severity: severity, EscalatedFrom: entry.AlertedPartitions, OptOutIgnored: ev.OptOutIgnored, KillRefusal: killRefusal, Breaches: breaches, ScannedBytes: ev.ScannedBytes, Runtime: ev.Runtime, Thread: &entry.SlackThread})
+	case len(breaches) > 0:
+		decision.Decision = DECISION_ALERTED
+		log.Warningf("Query [%v] is over its resource limits: %v", queryStats.QueryID, breachText(breaches))
+		notify(ctx, Alert{Cluster: c, Query: query, CaughtAfter: detection(c, query, entry, time.Now()), BadInputs: badInputs, TotalPartitions: totalPartitions, Severity: severity, OptOutIgnored: ev.OptOutIgnored, Breaches: breaches, ScannedBytes: ev.ScannedBytes, Runtime: ev.Runtime, Thread: &entry.SlackThread})
+	default:
+		decision.Decision = DECISION_ALREADY_ALERTED
+		log.Debugf("Query [%v] was already alerted on at [%v] partitions, now at [%v]", queryStats.QueryID, entry.AlertedPartitions, totalPartitions)
 	}
 	return nil
 }
 
-func getQuery(queryId string) ([]PrestoQuery, error) {
-	var req *http.Request
-	if queryId == "" {
-		// Get all running query IDs
-		req, _ = http.NewRequest("GET", fmt.Sprintf("%v/v1/query?state=running", opts.PrestoURL), nil)
-	} else {
-		// Get all specific query IDs
-		req, _ = http.NewRequest("GET", fmt.Sprintf("%v/v1/query/%v", opts.PrestoURL, queryId), nil)
+// countSuppressed counts a query's suppressed alert in suppressed_alerts by user and table, once per query
+func countSuppressed(c *cluster, query PrestoQuery, entry *cachedQuery, inputs []PrestoInput, why string) {
+	if entry.Suppressed {
+		return
 	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-
-	// Was there an error with the collection?
-	if err !=nil || resp.Body==nil {
-		log.Errorf("Error with request to Presto server for query overview: %+v", err)
-		return nil, err
+	entry.Suppressed = true
+	log.Infof("Suppressed alert for query [%v] by user [%v], because %v", query.QueryID, query.Session.User, why)
+	for _, i := range inputs {
+		c.metrics.IncrCounterWithLabels(
+			metricKey("suppressed_alerts"),
+			1.0,
+			[]metrics.Label{
+				{
+					Name:  "user",
+					Value: query.Session.User,
+				},
+				{
+					Name:  "table",
+					Value: tableName(i),
+				},
+			},
+		)
 	}
+}
 
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(resp.Body)
-
+func getQuery(ctx context.Context, c *cluster, queryId string) ([]PrestoQuery, error) {
 	if queryId == "" {
-		var queries []PrestoQuery
-		json.Unmarshal(buf.Bytes(), &queries)
-		log.Debug("Received overview data from Presto!")
-		return queries, nil
-	} else {
-		var query PrestoQuery
-		json.Unmarshal(buf.Bytes(), &query)
-		log.Debug("Received query data from Presto!")
-		return []PrestoQuery{query}, nil
+		// Get all running query IDs
+		return getQueriesInState(ctx, c, "running")
+	}
+	// Get all specific query IDs
+	var query PrestoQuery
+	err := retry(RETRY_TARGET_PRESTO, "query "+queryId, func() (err error) {
+		query, err = c.client.GetQuery(ctx, queryId)
+		return err
+	})
+	if err != nil {
+		return nil, explainPrestoError(err)
 	}
+	log.Debug("Received query data from Presto!")
+	return []PrestoQuery{query}, nil
+}
 
+// getQueriesInState returns the overview of all queries in a state, e.g. running or queued
+func getQueriesInState(ctx context.Context, c *cluster, state string) ([]PrestoQuery, error) {
+	var queries []PrestoQuery
+	err := retry(RETRY_TARGET_PRESTO, state+" queries", func() (err error) {
+		queries, err = c.client.ListQueries(ctx, state)
+		return err
+	})
+	if err != nil {
+		return nil, explainPrestoError(err)
+	}
+	log.Debugf("Received [%v] overview data from Presto!", state)
+	return queries, nil
 }
 
-func doCollect() bool {
+func doCollect(c *cluster) bool {
+	started := time.Now()
+	atomic.StoreInt64(&c.flaggedThisCycle, 0)
+	ctx, span := startSpan(context.Background(), "poll")
+	span.setAttribute("cluster", c.displayName())
+	defer span.end()
+
+	// Re-publish the config info gauges every cycle so reloads show up
+	emitConfigInfo(c)
 
 	// Get all queries
-	queries, err := getQuery("")
+	queries, err := getQuery(ctx, c, "")
 	if err != nil {
-		log.Errorf("Got error while collecting queries. We'll retry again in [%v] seconds", opts.UpdateInterval)
+		span.setError(err)
+		log.Errorf("%vGot error while collecting queries: %v. We'll retry again in [%v]", c.prefix(), err, cfg.UpdateInterval)
 		return false
 	}
+	if !c.warmedUp {
+		warmStart(c, queries, time.Now())
+		c.warmedUp = true
+	}
 
+	// Check the running queries on --concurrency workers, fetching query details from Presto is the slow part
+	work := make(chan PrestoQuery)
+	var wg sync.WaitGroup
+	var running, failed int64
+	runningIDs := make(map[string]bool)
+	for i := 0; i < cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for query := range work {
+				if collectQuery(ctx, c, query) != nil {
+					atomic.AddInt64(&failed, 1)
+				}
+			}
+		}()
+	}
 	for _, query := range queries {
 		if query.State == "RUNNING" {
-			log.Debugf("Found RUNNING query with id: [%+v]", query.QueryID)
-			t, err := queryCache.GetIFPresent(query.QueryID)
-			if err == gcache.KeyNotFoundError {
-				log.Debugf("Query with id: [%v] not found in cache! [%v]", query.QueryID, err)
-				// This is a new query we haven't seen before - check it!
-
-				if e := checkQuery(query); e != nil {
-					log.Errorf("Received error checking query [%v]. Error was [%v]", query.QueryID, e)
-					return false
+			running++
+			runningIDs[query.QueryID] = true
+			work <- query
+		}
+	}
+	close(work)
+	wg.Wait()
+	span.setAttribute("queries.running", running)
+	span.setAttribute("queries.failed", failed)
+	if failed > 0 {
+		log.Warningf("%vUnable to check [%v] of [%v] running queries this cycle", c.prefix(), failed, running)
+	}
+
+	completions.check(ctx, c, runningIDs)
+	checkUserLoad(ctx, c, queries, time.Now())
+
+	// Queued queries are only fetched when something needs them
+	queued := -1
+	if cfg.MaxQueueTime > 0 || cfg.ClusterMetrics {
+		if q, err := getQueriesInState(ctx, c, "queued"); err != nil {
+			log.Errorf("%vGot error while collecting queued queries: %v", c.prefix(), err)
+			c.metrics.IncrCounter(metricKey("check_errors"), 1.0)
+		} else {
+			queued = 0
+			for _, query := range q {
+				if query.State == "QUEUED" {
+					queued++
 				}
-				queryCache.Set(query.QueryID, time.Now())
-			} else {
-				log.Debugf("Query with id: [%v] was found in cache. Was cached at [%v], ignoring. [%v]", query.QueryID, t, err)
 			}
-
+			if cfg.MaxQueueTime > 0 {
+				checkQueued(ctx, c, q, time.Now())
+			}
 		}
 	}
 
+	if cfg.WatchFailures {
+		checkOutcomes(ctx, c, time.Now())
+	}
+
+	status.pollDone(len(queries), time.Now())
+	journal.flushCycle(c, time.Now())
+	if err := c.cache.Save(); err != nil {
+		log.Errorf("Unable to save query cache [%v]: %v", c.cacheFile, err)
+	}
+	if err := offenders.save(); err != nil {
+		log.Errorf("Unable to save repeat offender file [%v]: %v", cfg.RepeatOffenderFile, err)
+	}
+	took := time.Since(started)
+	atomic.StoreInt64(&lastPollMillis, int64(took/time.Millisecond))
+	if cfg.ClusterMetrics {
+		emitClusterMetrics(c, running, queued, atomic.LoadInt64(&c.flaggedThisCycle), took)
+	}
 	return true
 }
 
-func startCollector() {
-	var e error
-	metricsSink, e = datadog.NewDogStatsdSink(opts.StatsdHost, "")
-	if e != nil || metricsSink==nil {
-		log.Fatalf("Unable to start statsd sink. Addr: [%v], Error: [%v]", opts.StatsdHost, e.Error())
-		os.Exit(-1)
+// collectQuery checks a running query unless it was checked recently, and remembers it in the cache. It's called
+// from several workers at once. An error means the query couldn't be checked and will be tried again next poll.
+func collectQuery(ctx context.Context, c *cluster, query PrestoQuery) error {
+	log.Debugf("Found RUNNING query with id: [%+v]", query.QueryID)
+	entry := &cachedQuery{}
+	cached, found := c.cache.Get(query.QueryID)
+	if found {
+		c.metrics.IncrCounter(metricKey("cache_hits"), 1.0)
+	} else {
+		c.metrics.IncrCounter(metricKey("cache_misses"), 1.0)
+	}
+	if !found {
+		log.Debugf("Query with id: [%v] not found in cache!", query.QueryID)
+		// This is a new query we haven't seen before - check it!
+	} else if cached.PreExisting {
+		log.Debugf("Query with id: [%v] was running before we started, ignoring.", query.QueryID)
+		journal.record(c, queryDecision{QueryID: query.QueryID, User: query.Session.User, Decision: DECISION_CACHED})
+		return nil
+	} else if time.Since(cached.LastChecked) >= cfg.RecheckInterval.Duration {
+		// Presto fills in partitions as planning goes on, so look at running queries again every so often
+		log.Debugf("Query with id: [%v] was last checked at [%v], re-checking", query.QueryID, cached.LastChecked)
+		*entry = cached
+	} else {
+		log.Debugf("Query with id: [%v] was found in cache. Was checked at [%v], ignoring.", query.QueryID, cached.LastChecked)
+		journal.record(c, queryDecision{QueryID: query.QueryID, User: query.Session.User, Decision: DECISION_CACHED})
+		return nil
 	}
 
-	ticker := time.NewTicker(delay * time.Second)
+	atomic.AddInt64(&queriesCheckedTotal, 1)
+	if e := checkQuery(ctx, c, query, entry); e == prestoclient.ErrQueryGone {
+		log.Debugf("Query [%v] finished before we could check it, skipping", query.QueryID)
+		return nil
+	} else if e != nil {
+		// Don't let one bad query blind us to the rest, and leave it out of the cache so it's retried
+		log.Errorf("Received error checking query [%v]. Error was [%v]", query.QueryID, e)
+		c.metrics.IncrCounter(metricKey("check_errors"), 1.0)
+		journal.record(c, queryDecision{QueryID: query.QueryID, User: query.Session.User, Decision: DECISION_ERROR})
+		return e
+	}
+	// An acknowledgement that came in while the query was being checked wins
+	if current, found := c.cache.Get(query.QueryID); found && current.Acknowledged && !entry.Acknowledged {
+		entry.Acknowledged, entry.AckedBy, entry.AckedAt = true, current.AckedBy, current.AckedAt
+		entry.AwaitingOutcome = false
+	}
+	c.cache.Set(query.QueryID, *entry)
+	return nil
+}
+
+// startCollector polls a cluster on every tick until stop is called. stop lets an in-flight poll finish, waiting
+// at most grace for it, and reports whether it did.
+func startCollector(c *cluster) (stop func(grace time.Duration) bool) {
 	quit := make(chan struct{})
+	done := make(chan struct{})
 
-	lastUpdate = time.Now().Unix()
+	atomic.StoreInt64(&c.lastUpdate, time.Now().Unix())
 
 	go func() {
-		log.Debug("Starting collector thread")
-		// initial run
-		if doCollect() {
-			lastUpdate = time.Now().Unix()
-		}
+		defer close(done)
+		log.Debugf("%vStarting collector thread", c.prefix())
 		for {
+			// One collection at a time: the next one waits for this one, and ticks it ran over are skipped
+			started := time.Now()
+			cfgLock.RLock()
+			collect(c)
+			cfgLock.RUnlock()
+			took := time.Since(started)
+			c.metrics.AddSample(metricKey("collect_duration_ms"), float32(took.Seconds()*1000))
+
+			wait, skipped := nextTick(took, cfg.UpdateInterval.Duration)
+			if skipped > 0 {
+				log.Warningf("%vCollection took [%v], longer than the interval of [%v]. Skipping [%v] ticks", c.prefix(), took, cfg.UpdateInterval, skipped)
+				c.metrics.IncrCounter(metricKey("skipped_ticks"), float32(skipped))
+			}
+
+			timer := time.NewTimer(wait)
 			select {
-			case <- ticker.C:
-				// do work on timer tick
+			case <-timer.C:
 				log.Debug("Timer Tick!")
-				if doCollect() {
-					lastUpdate = time.Now().Unix()
-				}
 
 				// quit signal
-			case <- quit:
-				ticker.Stop()
-				log.Info("Received stop signal. Exiting")
-				break
+			case <-quit:
+				timer.Stop()
+				log.Infof("%vReceived stop signal. Exiting", c.prefix())
+				return
 			}
 		}
 	}()
+
+	return func(grace time.Duration) bool {
+		close(quit)
+		select {
+		case <-done:
+			return true
+		case <-time.After(grace):
+			return false
+		}
+	}
+}
+
+// nextTick is how long to wait after a collection that took took, so collections keep to the interval's grid, and
+// how many ticks were skipped because it ran over
+func nextTick(took time.Duration, interval time.Duration) (wait time.Duration, skipped int64) {
+	skipped = int64(took / interval)
+	return interval - took%interval, skipped
 }
 
 func main() {
-	// Parse arguments
-	_, err := flags.Parse(&opts)
-	// From https://www.snip2code.com/Snippet/605806/go-flags-suggested--h-documentation
-	if err != nil {
-		typ := err.(*flags.Error).Type
-		if typ == flags.ErrHelp {
+	// Parse and validate arguments
+	var err error
+	cfg, err = config.Load(os.Args[1:], os.Getenv)
+	switch e := err.(type) {
+	case nil:
+	case *config.UsageError:
+		fmt.Println(e)
+		if e.Help {
 			os.Exit(0)
-		} else {
-			fmt.Println(err)
-			os.Exit(1)
 		}
+		os.Exit(1)
+	case *config.ValidationError:
+		fmt.Println(e)
+		os.Exit(2)
+	default:
+		fmt.Println(e)
+		os.Exit(1)
 	}
 
 	// Print version number if requested from command line
-	if opts.DoVersion == true {
+	if cfg.DoVersion == true {
 		fmt.Printf("%s %s at your service.\n", APP_NAME, APP_VERSION)
 		os.Exit(10)
 	}
@@ -336,60 +823,134 @@ func main() {
 	logging.SetBackend(backend_formatter)
 
 	// Enable debug logging
-	if opts.Verbose == true {
+	if cfg.Verbose == true {
 		logging.SetLevel(logging.DEBUG, "")
 	} else {
 		logging.SetLevel(logging.INFO, "")
 	}
 
-	log.Debugf("Commandline options: %+v", opts)
+	for _, w := range cfg.Warnings {
+		log.Warning(w)
+	}
+	log.Debugf("Commandline options: %+v", cfg.Options)
+	if cfg.DryRun {
+		log.Warning("Dry run: alerts are logged instead of sent, and no query will be killed")
+	}
 
-	// can we continue?
-	if opts.PrestoURL == "" || opts.SlackURL == "" {
-		log.Fatal("Missing options. Try again!")
+	// Load per-table limits
+	startRules(cfg.RulesReloadInterval.Duration)
+	startUserMap(cfg.RulesReloadInterval.Duration)
+	startPartitionedTables()
+	startSlackRoutes()
+	startOffenders()
+
+	switch cfg.Command {
+	case config.COMMAND_REPLAY_DECISION:
+		os.Exit(replayDecision(cfg.ReplayDecision, os.Stdout))
+	case config.COMMAND_IMPORT:
+		os.Exit(importHistory(cfg.Import))
 	}
 
-	// instanciate our cache
-	queryCache = gcache.New(100).
-		LFU().
-		Expiration(time.Hour).
-		EvictedFunc(func(key, value interface{}) {
-			log.Debugf("Evicted query [%+v] from cache", key)
-		}).
-		Build()
+	// Pick up threshold changes in the config file on SIGHUP
+	startConfigReload()
 
-	// Convert interval string from ENV / opts to integer
-	if interval, err := strconv.Atoi(opts.UpdateInterval) ; err == nil {
-		delay = time.Duration(interval)
-		log.Debugf("Update interval: %v seconds", interval)
-	} else {
-		log.Fatalf("Unable to convert Update Interval '%s' to integer. Error was: %s", opts.UpdateInterval, err)
-	}
+	// Set up where alerts go
+	startSlackTemplate()
+	notifiers = buildNotifiers(cfg.NotifierNames)
+	startDigest()
 
-	// Convert health check port string from ENV / opts to integer
-	port, err := strconv.Atoi(opts.HealthHTTPPort) ;
-	if err != nil {
-		log.Fatalf("Unable to convert Health Check HTTP Port '%s' to integer. Error was: %s", opts.HealthHTTPPort, err)
-	}
+	// Set up a client and a cache for every cluster
+	startClusters(notifiers)
 
-	// Convert max partitions string from ENV / opts to integer
-	if maxPartsTmp, err := strconv.Atoi(opts.MaxPartitions) ; err == nil {
-		maxParts = maxPartsTmp
-	} else {
-		log.Fatalf("Unable to convert max partitions '%s' to integer. Error was: %s", opts.MaxPartitions, err)
+	// Make sure Presto and the notifiers are reachable before we settle in
+	runSelfTest()
+
+	log.Debugf("Update interval: [%v], recheck interval: [%v]", cfg.UpdateInterval, cfg.RecheckInterval)
+	if cfg.KillThreshold > 0 {
+		log.Infof("Killing queries that scan more than [%v] partitions", cfg.KillThreshold)
+		if cfg.KillThreshold <= cfg.MaxPartitions {
+			log.Warningf("Kill threshold [%v] is not above the alert threshold [%v]", cfg.KillThreshold, cfg.MaxPartitions)
+		}
 	}
 
+	hourly = newHourlyStats(cfg.DisplayLocation)
+	startHourlyHistory()
+	status = newStatusTracker(cfg.StatusSize)
+
 	hostname, _ := os.Hostname()
 	log.Infof("Starting %s version: %s on host %s", APP_NAME, APP_VERSION, hostname)
 
+	startJournal()
+	startAudit()
+	startEvents()
+	startTracing()
+
+	// Health check, reports and metrics all share one server
+	mux := http.NewServeMux()
+	startMetrics(mux)
+	startDebugHTTP(mux)
+
 	//START COLLECTOR HERE!
-	startCollector()
+	startElection()
+	stopCollectors := startCollectors()
 
 	// Start the health check handler
-	http.HandleFunc("/", healthCheckHandler)
-	http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	mux.HandleFunc("/", healthCheckHandler)
+	mux.HandleFunc("/hourly", hourlyHandler)
+	mux.HandleFunc("/dashboard", dashboardHandler)
+	mux.HandleFunc("/status", statusHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	if cfg.AckSecret != "" {
+		mux.HandleFunc("/ack/", ackHandler)
+	}
+	if cfg.KillLinks || cfg.AdminSecret != "" {
+		mux.HandleFunc("/kill/", killHandler)
+	}
+	if cfg.AdminSecret != "" {
+		mux.HandleFunc("/suppressions", suppressionsHandler)
+		mux.HandleFunc("/suppressions/", suppressionsHandler)
+	}
+	server := &http.Server{Addr: fmt.Sprintf(":%d", cfg.HealthHTTPPort), Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Health check server failed: %v", err)
+		}
+	}()
 
 	log.Info("Running, collecting queries from Presto!.")
 
+	// Wait for Kubernetes (or a human) to tell us to stop
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	shutdown(sig, server, stopCollectors)
+
+	log.Info("Bye!")
+	os.Exit(0)
 }
 
+// shutdown waits for a signal on sig, then stops the collectors and the server and flushes everything still
+// buffered, all within --shutdown-grace
+func shutdown(sig <-chan os.Signal, server *http.Server, stopCollectors func(grace time.Duration) bool) {
+	log.Infof("Received [%v], shutting down", <-sig)
+
+	// The poll and the HTTP server share one grace period
+	deadline := time.Now().Add(cfg.ShutdownGrace)
+	if !stopCollectors(cfg.ShutdownGrace) {
+		log.Warningf("Poll still running after [%v], not waiting for it", cfg.ShutdownGrace)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warningf("Unable to shut down the health check server cleanly: %v", err)
+	}
+	cancel()
+	if election != nil {
+		election.stop()
+	}
+	saveCaches()
+	flushDigest()
+	audit.close(time.Until(deadline))
+	events.close(time.Until(deadline))
+	tracing.close(time.Until(deadline))
+	stopMetrics()
+}
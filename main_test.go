@@ -0,0 +1,564 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/thecubed/prestowatcher/config"
+	"github.com/thecubed/prestowatcher/prestoclient"
+)
+
+// fakePresto stands in for a coordinator, serving canned query details
+type fakePresto struct {
+	sync.Mutex
+	running []PrestoQuery
+	details map[string]PrestoQuery
+	// How long every detail fetch takes
+	delay  time.Duration
+	err    error
+	killed []string
+	// Overview fetches of running queries, one per poll
+	polls int
+}
+
+func newFakePresto(queries ...PrestoQuery) *fakePresto {
+	p := &fakePresto{details: make(map[string]PrestoQuery)}
+	for _, q := range queries {
+		p.add(q)
+	}
+	return p
+}
+
+// add makes a query RUNNING, the overview being the detail without its inputs
+func (p *fakePresto) add(q PrestoQuery) {
+	p.Lock()
+	defer p.Unlock()
+	p.details[q.QueryID] = q
+	overview := q
+	overview.Inputs = nil
+	p.running = append(p.running, overview)
+}
+
+func (p *fakePresto) ListQueries(ctx context.Context, state string) ([]PrestoQuery, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.err != nil {
+		return nil, p.err
+	}
+	if state == "running" {
+		p.polls++
+	}
+	var queries []PrestoQuery
+	for _, q := range p.running {
+		if state == "running" && q.State == "RUNNING" || state == "queued" && q.State == "QUEUED" {
+			queries = append(queries, q)
+		}
+	}
+	return queries, nil
+}
+
+func (p *fakePresto) GetQuery(ctx context.Context, id string) (PrestoQuery, error) {
+	time.Sleep(p.delay)
+	p.Lock()
+	defer p.Unlock()
+	q, ok := p.details[id]
+	if !ok {
+		return PrestoQuery{}, prestoclient.ErrQueryGone
+	}
+	return q, nil
+}
+
+func (p *fakePresto) KillQuery(ctx context.Context, id string) error {
+	p.Lock()
+	defer p.Unlock()
+	p.killed = append(p.killed, id)
+	return nil
+}
+
+func (p *fakePresto) Version(ctx context.Context) (string, error) {
+	return "0.215", nil
+}
+
+// recordingNotifier keeps every alert it's given
+type recordingNotifier struct {
+	sync.Mutex
+	alerts []Alert
+}
+
+func (n *recordingNotifier) Name() string { return "recording" }
+
+func (n *recordingNotifier) Notify(alert Alert) error {
+	n.Lock()
+	defer n.Unlock()
+	n.alerts = append(n.alerts, alert)
+	return nil
+}
+
+func (n *recordingNotifier) sent() []Alert {
+	n.Lock()
+	defer n.Unlock()
+	return append([]Alert(nil), n.alerts...)
+}
+
+// mapQueryCache is a queryCacheStore without expiry or eviction
+type mapQueryCache struct {
+	sync.Mutex
+	entries map[string]cachedQuery
+}
+
+func (m *mapQueryCache) Get(queryID string) (cachedQuery, bool) {
+	m.Lock()
+	defer m.Unlock()
+	e, ok := m.entries[queryID]
+	return e, ok
+}
+
+func (m *mapQueryCache) Set(queryID string, entry cachedQuery) {
+	m.Lock()
+	defer m.Unlock()
+	m.entries[queryID] = entry
+}
+
+func (m *mapQueryCache) Save() error { return nil }
+
+func (m *mapQueryCache) Len() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.entries)
+}
+
+// recordingSink keeps every counter increment and gauge
+type recordingSink struct {
+	metrics.BlackholeSink
+	sync.Mutex
+	counters []recordedCounter
+	gauges   []recordedCounter
+}
+
+type recordedCounter struct {
+	Key    string
+	Value  float32
+	Labels []metrics.Label
+}
+
+func (s *recordingSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.Lock()
+	defer s.Unlock()
+	s.gauges = append(s.gauges, recordedCounter{Key: fmt.Sprint(key), Value: val, Labels: labels})
+}
+
+// gauge returns every value set on a gauge, whatever its labels
+func (s *recordingSink) gauge(name string) []recordedCounter {
+	s.Lock()
+	defer s.Unlock()
+	var set []recordedCounter
+	for _, g := range s.gauges {
+		if g.Key == fmt.Sprint(metricKey(name)) {
+			set = append(set, g)
+		}
+	}
+	return set
+}
+
+func (s *recordingSink) IncrCounter(key []string, val float32) {
+	s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *recordingSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.Lock()
+	defer s.Unlock()
+	s.counters = append(s.counters, recordedCounter{Key: fmt.Sprint(key), Value: val, Labels: labels})
+}
+
+// count sums the increments of a counter, whatever its labels
+func (s *recordingSink) count(name string) float32 {
+	s.Lock()
+	defer s.Unlock()
+	var total float32
+	for _, c := range s.counters {
+		if c.Key == fmt.Sprint(metricKey(name)) {
+			total += c.Value
+		}
+	}
+	return total
+}
+
+// setupTest resets the configuration and global state to the defaults checks depend on. The returned func
+// restores the configuration and metrics sink.
+func setupTest() (restore func()) {
+	saved, savedSink := cfg, metricsSink
+	cfg = config.Config{}
+	cfg.MaxPartitions = 30
+	cfg.MaxWritePartitions = 90
+	cfg.Connectors = map[string]bool{"hive": true}
+	cfg.PrestoConnector = "hive"
+	cfg.OptOutTag = "sqlbandit:off"
+	cfg.NoKillTag = "sqlbandit:nokill"
+	cfg.Concurrency = 2
+	cfg.RetryAttempts = 1
+	cfg.RecheckInterval.Duration = time.Minute
+	cfg.UpdateInterval.Duration = 20 * time.Second
+	cfg.CacheTTL = time.Hour
+	cfg.CriticalMultiplier, cfg.EmergencyMultiplier = 5, 20
+	cfg.MentionSeverity = config.SEVERITY_WARNING
+	cfg.MetricsPrefixKey = []string{"presto", "watcher"}
+	cfg.DisplayLocation = time.UTC
+	cfg.Clusters = []config.Cluster{{URL: "http://presto.example.com:8080"}}
+	metricsSink = newMetricsWrapper(&recordingSink{}, nil)
+	rules = &ruleSet{}
+	status = newStatusTracker(10)
+	hourly = newHourlyStats(time.UTC)
+	completions = &completionTracker{alerts: make(map[string]Alert)}
+	suppressions = &suppressionList{rules: make(map[string]suppression)}
+	offenders = &offenderTracker{alerts: make(map[string][]time.Time)}
+	return func() {
+		cfg, metricsSink = saved, savedSink
+	}
+}
+
+// testCluster is an unnamed cluster talking to client and alerting to a recordingNotifier
+func testCluster(client prestoAPI) (*cluster, *recordingNotifier) {
+	n := &recordingNotifier{}
+	c := &cluster{
+		client:        client,
+		notifier:      n,
+		cache:         &mapQueryCache{entries: make(map[string]cachedQuery)},
+		metrics:       &clusterSink{},
+		userAlertedAt: make(map[string]time.Time),
+		warmedUp:      true,
+	}
+	return c, n
+}
+
+// testQuery is a RUNNING query reading partitions of hive.events.clicks
+func testQuery(id string, user string, sql string, partitions int) PrestoQuery {
+	var q PrestoQuery
+	q.QueryID, q.State, q.Query = id, "RUNNING", sql
+	q.Session.User = user
+	input := PrestoInput{ConnectorID: "hive", Schema: "events", Table: "clicks"}
+	for i := 0; i < partitions; i++ {
+		input.ConnectorInfo.PartitionIds = append(input.ConnectorInfo.PartitionIds, fmt.Sprintf("ds=2023-01-%02d/hr=%02d", i/24+1, i%24))
+	}
+	q.Inputs = []PrestoInput{input}
+	return q
+}
+
+func TestCheckQueryAlertsOverTheLimit(t *testing.T) {
+	defer setupTest()()
+	presto := newFakePresto(testQuery("q1", "alice", "SELECT * FROM events.clicks", 45))
+	c, notifier := testCluster(presto)
+
+	entry := &cachedQuery{}
+	if err := checkQuery(context.Background(), c, PrestoQuery{QueryID: "q1"}, entry); err != nil {
+		t.Fatal(err)
+	}
+	alerts := notifier.sent()
+	if len(alerts) != 1 {
+		t.Fatalf("got %v alerts, want 1", len(alerts))
+	}
+	if alerts[0].TotalPartitions != 45 || alerts[0].Severity != config.SEVERITY_WARNING || alerts[0].Cluster != c {
+		t.Errorf("unexpected alert %+v", alerts[0])
+	}
+	if entry.AlertedPartitions != 45 || entry.Partitions["hive.events.clicks"] != 45 {
+		t.Errorf("unexpected cache entry %+v", entry)
+	}
+
+	// The same query on a re-check isn't alerted on again
+	if err := checkQuery(context.Background(), c, PrestoQuery{QueryID: "q1"}, entry); err != nil {
+		t.Fatal(err)
+	}
+	if len(notifier.sent()) != 1 {
+		t.Errorf("got %v alerts after a re-check, want 1", len(notifier.sent()))
+	}
+}
+
+func TestCheckQueryUnderTheLimit(t *testing.T) {
+	defer setupTest()()
+	c, notifier := testCluster(newFakePresto(testQuery("q1", "alice", "SELECT * FROM events.clicks", 30)))
+
+	if err := checkQuery(context.Background(), c, PrestoQuery{QueryID: "q1"}, &cachedQuery{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(notifier.sent()) != 0 {
+		t.Errorf("got %v alerts for a query at the limit", len(notifier.sent()))
+	}
+}
+
+func TestCheckQueryGone(t *testing.T) {
+	defer setupTest()()
+	c, _ := testCluster(newFakePresto())
+
+	if err := checkQuery(context.Background(), c, PrestoQuery{QueryID: "finished"}, &cachedQuery{}); err != prestoclient.ErrQueryGone {
+		t.Errorf("got %v for a finished query, want ErrQueryGone", err)
+	}
+}
+
+func TestDoCollect(t *testing.T) {
+	defer setupTest()()
+	presto := newFakePresto(
+		testQuery("bad", "alice", "SELECT * FROM events.clicks", 100),
+		testQuery("fine", "bob", "SELECT * FROM events.clicks WHERE ds = '2023-01-01'", 1),
+	)
+	c, notifier := testCluster(presto)
+
+	if !doCollect(c) {
+		t.Fatal("the poll failed")
+	}
+	if alerts := notifier.sent(); len(alerts) != 1 || alerts[0].Query.QueryID != "bad" {
+		t.Errorf("got alerts %+v, want one for query bad", alerts)
+	}
+	for _, id := range []string{"bad", "fine"} {
+		if _, found := c.cache.Get(id); !found {
+			t.Errorf("query %v wasn't cached", id)
+		}
+	}
+
+	// A second poll finds both in the cache
+	if !doCollect(c) {
+		t.Fatal("the second poll failed")
+	}
+	if len(notifier.sent()) != 1 {
+		t.Errorf("got %v alerts after the second poll, want 1", len(notifier.sent()))
+	}
+
+	presto.err = fmt.Errorf("connection refused")
+	if doCollect(c) {
+		t.Error("the poll succeeded without the overview")
+	}
+}
+
+func TestCheckQueryWriteThreshold(t *testing.T) {
+	defer setupTest()()
+	// An INSERT reading a couple of days of clicks to write one partition per hour of the target table: over
+	// --maxpart, but only --maxpart-write applies to it
+	insert := testQuery("insert", "etl", "INSERT INTO events.hourly SELECT * FROM events.clicks WHERE ds >= '2023-01-01'", 60)
+	insert.UpdateType = "INSERT"
+	big := testQuery("big-insert", "etl", "INSERT INTO events.hourly SELECT * FROM events.clicks", 100)
+	big.UpdateType = "INSERT"
+	c, notifier := testCluster(newFakePresto(insert, big))
+
+	decisions := make(map[string]*cachedQuery)
+	for _, id := range []string{"insert", "big-insert"} {
+		decisions[id] = &cachedQuery{}
+		if err := checkQuery(context.Background(), c, PrestoQuery{QueryID: id}, decisions[id]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alerts := notifier.sent()
+	if len(alerts) != 1 || alerts[0].Query.QueryID != "big-insert" {
+		t.Fatalf("got alerts %+v, want one for big-insert", alerts)
+	}
+	if qType := queryType(alerts[0].Query); qType != QUERY_TYPE_WRITE {
+		t.Errorf("got query type %v, want %v", qType, QUERY_TYPE_WRITE)
+	}
+	if limit := rules.limitFor(alerts[0].BadInputs[0], QUERY_TYPE_WRITE); limit.Max != cfg.MaxWritePartitions {
+		t.Errorf("got limit %v, want --maxpart-write %v", limit.Max, cfg.MaxWritePartitions)
+	}
+	if decisions["insert"].AlertedPartitions != 0 {
+		t.Errorf("the INSERT under --maxpart-write was alerted on at %v partitions", decisions["insert"].AlertedPartitions)
+	}
+}
+
+func TestShutdownOnSignal(t *testing.T) {
+	defer setupTest()()
+	for _, tc := range []struct {
+		name  string
+		delay time.Duration
+		// Whether the in-flight poll gets to alert before shutdown returns
+		finished bool
+	}{
+		{"a poll within the grace period", 100 * time.Millisecond, true},
+		{"a poll longer than the grace period", time.Second, false},
+	} {
+		cfg.ShutdownGrace = 500 * time.Millisecond
+		presto := newFakePresto(testQuery("q1", "alice", "SELECT * FROM events.clicks", 45))
+		presto.delay = tc.delay
+		c, notifier := testCluster(presto)
+		saved := clusters
+		clusters = []*cluster{c}
+
+		stop := startCollectors()
+		// Gives up after grace like stop does, but keeps waiting in the background so the abandoned poll can be
+		// waited for below
+		var stopped sync.WaitGroup
+		stopped.Add(1)
+		stopWithin := func(grace time.Duration) bool {
+			finished := make(chan struct{})
+			go func() {
+				defer stopped.Done()
+				stop(time.Minute)
+				close(finished)
+			}()
+			select {
+			case <-finished:
+				return true
+			case <-time.After(grace):
+				return false
+			}
+		}
+		// Let the first poll get as far as fetching the query detail
+		time.Sleep(20 * time.Millisecond)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM)
+		if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+			t.Fatal(err)
+		}
+		started := time.Now()
+		shutdown(sig, &http.Server{}, stopWithin)
+		took := time.Since(started)
+		signal.Stop(sig)
+
+		if took > cfg.ShutdownGrace+100*time.Millisecond {
+			t.Errorf("%v: shutting down took %v, longer than the grace period", tc.name, took)
+		}
+		if finished := len(notifier.sent()) == 1; finished != tc.finished {
+			t.Errorf("%v: got the poll finished %v, want %v", tc.name, finished, tc.finished)
+		}
+		// Don't leave the abandoned poll running into the next test
+		stopped.Wait()
+		clusters = saved
+	}
+}
+
+// collectSlowCluster polls a cluster of n running queries whose details each take delay to fetch, and returns how
+// long the poll took
+func collectSlowCluster(t testing.TB, n int, delay time.Duration) time.Duration {
+	presto := newFakePresto()
+	for i := 0; i < n; i++ {
+		presto.add(testQuery(fmt.Sprintf("q%v", i), "alice", "SELECT * FROM events.clicks", 10))
+	}
+	presto.delay = delay
+	c, _ := testCluster(presto)
+	started := time.Now()
+	if !doCollect(c) {
+		t.Fatal("the poll failed")
+	}
+	for i := 0; i < n; i++ {
+		if _, found := c.cache.Get(fmt.Sprintf("q%v", i)); !found {
+			t.Fatalf("query q%v wasn't checked", i)
+		}
+	}
+	return time.Since(started)
+}
+
+func TestDoCollectConcurrency(t *testing.T) {
+	defer setupTest()()
+	const queries, delay = 20, 25 * time.Millisecond
+
+	cfg.Concurrency = 1
+	serial := collectSlowCluster(t, queries, delay)
+	cfg.Concurrency = 10
+	parallel := collectSlowCluster(t, queries, delay)
+
+	if serial < queries*delay {
+		t.Errorf("a serial poll took %v, less than the %v the fetches take one after another", serial, queries*delay)
+	}
+	// Two rounds of ten fetches, with plenty of room for a slow machine
+	if parallel > serial/3 {
+		t.Errorf("a poll with 10 workers took %v, not much faster than %v with one", parallel, serial)
+	}
+}
+
+func BenchmarkDoCollect(b *testing.B) {
+	defer setupTest()()
+	for _, concurrency := range []int{1, 5, 20} {
+		b.Run(fmt.Sprintf("concurrency=%v", concurrency), func(b *testing.B) {
+			cfg.Concurrency = concurrency
+			for i := 0; i < b.N; i++ {
+				collectSlowCluster(b, 40, 5*time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestScaleLimitsAlertOnce(t *testing.T) {
+	defer setupTest()()
+	cfg.MaxSplits = 10000
+	cfg.MaxInputBytes = 500 << 30
+	// Unpartitioned, so the partition count doesn't catch it
+	q := testQuery("q1", "alice", "SELECT * FROM events.lookup", 0)
+	q.QueryStats.TotalSplits = 5000
+	q.QueryStats.PhysicalInputDataSize = "100GB"
+	presto := newFakePresto(q)
+	c, notifier := testCluster(presto)
+
+	entry := &cachedQuery{}
+	check := func(splits int64, size prestoclient.DataSize) {
+		q.QueryStats.TotalSplits, q.QueryStats.PhysicalInputDataSize = splits, size
+		presto.add(q)
+		if err := checkQuery(context.Background(), c, PrestoQuery{QueryID: "q1"}, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(5000, "100GB")
+	if len(notifier.sent()) != 0 {
+		t.Fatalf("got %v alerts under both limits", len(notifier.sent()))
+	}
+	// Splits grow on a re-check
+	check(20000, "100GB")
+	check(30000, "200GB")
+	if alerts := notifier.sent(); len(alerts) != 1 || breachText(alerts[0].Breaches) != "it has 20000 splits, over the limit of 10000" {
+		t.Fatalf("got alerts %+v, want one for the splits", alerts)
+	}
+	// Then the input size, as raw bytes from a newer coordinator
+	check(40000, "644245094400")
+	check(50000, "700GB")
+	alerts := notifier.sent()
+	if len(alerts) != 2 || breachText(alerts[1].Breaches) != "it has read 600.0 GiB of physical input, over the limit of 500.0 GiB" {
+		t.Errorf("got alerts %+v, want a second one for the input size only", alerts)
+	}
+}
+
+func TestNextTick(t *testing.T) {
+	for _, tc := range []struct {
+		took    time.Duration
+		wait    time.Duration
+		skipped int64
+	}{
+		{5 * time.Second, 15 * time.Second, 0},
+		{0, 20 * time.Second, 0},
+		{20 * time.Second, 20 * time.Second, 1},
+		{45 * time.Second, 15 * time.Second, 2},
+		{61 * time.Second, 19 * time.Second, 3},
+	} {
+		wait, skipped := nextTick(tc.took, 20*time.Second)
+		if wait != tc.wait || skipped != tc.skipped {
+			t.Errorf("nextTick(%v) = %v, %v, want %v, %v", tc.took, wait, skipped, tc.wait, tc.skipped)
+		}
+	}
+}
+
+func TestSlowPollsSkipTicks(t *testing.T) {
+	defer setupTest()()
+	cfg.UpdateInterval.Duration = 40 * time.Millisecond
+	// Every poll re-checks the query, taking 100ms: two and a half intervals
+	cfg.RecheckInterval.Duration = time.Nanosecond
+	presto := newFakePresto(testQuery("q1", "alice", "SELECT * FROM events.clicks", 10))
+	presto.delay = 100 * time.Millisecond
+	c, _ := testCluster(presto)
+
+	stop := startCollector(c)
+	time.Sleep(450 * time.Millisecond)
+	if !stop(time.Second) {
+		t.Fatal("the collector didn't stop")
+	}
+
+	// Stacked ticks would start a poll every 100ms, one at a time they start every 120ms
+	presto.Lock()
+	polls := presto.polls
+	presto.Unlock()
+	if polls < 2 || polls > 4 {
+		t.Errorf("got %v polls in 450ms, want one every three intervals", polls)
+	}
+	if skipped := metricsSink.MetricSink.(*recordingSink).count("skipped_ticks"); int(skipped) < 2*polls {
+		t.Errorf("got %v skipped ticks over %v polls, want at least 2 each", skipped, polls)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/armon/go-metrics/datadog"
+	"github.com/armon/go-metrics/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/thecubed/prestowatcher/config"
+)
+
+/*
+	Metrics go to DogStatsD, plain StatsD, Prometheus or nowhere, depending on --metrics. All of them are a
+	go-metrics MetricSink, so the rest of the watcher emits the same way regardless. The Prometheus sink registers
+	with the default registry, which is served at /metrics on the health check server.
+
+	Plain StatsD has no tags, so the statsd sink folds label values into the metric name, e.g.
+	presto.watcher.queried_partitions.hive.events.clicks.select, or with --statsd-labels=drop leaves them out.
+	Every metric name is built by metricKey, which puts --metrics-prefix in front of it.
+
+	Metrics are best-effort: if the sink can't be created the watcher logs a warning and carries on with the
+	no-op sink, still polling Presto and sending alerts. Everything emits through metricsWrapper, which holds
+	whichever sink is in use.
+*/
+
+const STATSD_DEFAULT_PORT = "8125"
+
+// Metrics sink everything emits through, a no-op until startMetrics has run
+var metricsSink = newMetricsWrapper(&metrics.BlackholeSink{}, nil)
+
+// metricsWrapper is the sink the watcher emits through. It holds the configured sink, or the no-op sink when
+// that couldn't be created, so emitting never has to check whether metrics are working.
+type metricsWrapper struct {
+	metrics.MetricSink
+	// Whether the configured sink failed to start and metrics are being dropped
+	degraded bool
+}
+
+// newMetricsWrapper wraps a sink as its constructor returned it. A constructor error or a nil sink gives the
+// no-op sink instead.
+func newMetricsWrapper(sink metrics.MetricSink, err error) *metricsWrapper {
+	if err != nil || sink == nil || reflect.ValueOf(sink).IsNil() {
+		return &metricsWrapper{MetricSink: &metrics.BlackholeSink{}, degraded: true}
+	}
+	return &metricsWrapper{MetricSink: sink}
+}
+
+// metricKey is the full key of a metric, --metrics-prefix followed by its name
+func metricKey(name string) []string {
+	return append(append([]string(nil), cfg.MetricsPrefixKey...), name)
+}
+
+// unlabelledSink is the plain StatsD sink with --statsd-labels=drop, it emits every metric under its bare name
+type unlabelledSink struct {
+	*metrics.StatsdSink
+}
+
+func (s *unlabelledSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.SetGauge(key, val)
+}
+
+func (s *unlabelledSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.IncrCounter(key, val)
+}
+
+func (s *unlabelledSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.AddSample(key, val)
+}
+
+// statsdAddr adds the default StatsD port to --statsd if it has none
+func statsdAddr() string {
+	if _, _, err := net.SplitHostPort(cfg.StatsdHost); err != nil {
+		return net.JoinHostPort(cfg.StatsdHost, STATSD_DEFAULT_PORT)
+	}
+	return cfg.StatsdHost
+}
+
+// startMetrics creates the configured metrics sink and registers its HTTP endpoint, if it has one, on mux
+func startMetrics(mux *http.ServeMux) {
+	switch cfg.Metrics {
+	case config.METRICS_DOGSTATSD:
+		sink, e := datadog.NewDogStatsdSink(cfg.StatsdHost, "")
+		if metricsSink = newMetricsWrapper(sink, e); metricsSink.degraded {
+			log.Warningf("Unable to start statsd sink, continuing without metrics. Addr: [%v], Error: [%v]", cfg.StatsdHost, e)
+			return
+		}
+		log.Infof("Sending metrics to DogStatsD at [%v]", cfg.StatsdHost)
+	case config.METRICS_STATSD:
+		addr := statsdAddr()
+		sink, e := metrics.NewStatsdSink(addr)
+		if metricsSink = newMetricsWrapper(sink, e); metricsSink.degraded {
+			log.Warningf("Unable to start statsd sink, continuing without metrics. Addr: [%v], Error: [%v]", addr, e)
+			return
+		}
+		if cfg.StatsdLabels == config.STATSD_LABELS_DROP {
+			metricsSink = newMetricsWrapper(&unlabelledSink{sink}, nil)
+		}
+		log.Infof("Sending metrics to StatsD at [%v], labels: [%v]", addr, cfg.StatsdLabels)
+	case config.METRICS_PROMETHEUS:
+		sink, e := prometheus.NewPrometheusSink()
+		if metricsSink = newMetricsWrapper(sink, e); metricsSink.degraded {
+			log.Warningf("Unable to start prometheus sink, continuing without metrics. Error: [%v]", e)
+			return
+		}
+		mux.Handle("/metrics", promhttp.Handler())
+		log.Infof("Serving Prometheus metrics at /metrics on port [%v]", cfg.HealthHTTPPort)
+	case config.METRICS_NONE:
+		log.Info("Metrics are disabled")
+	}
+}
+
+// recordPoll counts successful and failed polls of a cluster
+func recordPoll(c *cluster, ok bool) {
+	if ok {
+		c.metrics.IncrCounter(metricKey("poll_successes"), 1.0)
+	} else {
+		c.metrics.IncrCounter(metricKey("poll_failures"), 1.0)
+	}
+}
+
+// emitPartitionMetrics counts the partitions a check found on a table. Per-partition counters are opt-in and
+// sampled, a query can scan thousands of partitions and every name is another custom metric.
+func emitPartitionMetrics(c *cluster, table string, qType string, partitions []string) {
+	if len(partitions) == 0 {
+		return
+	}
+	c.metrics.IncrCounterWithLabels(
+		metricKey("queried_partitions"),
+		float32(len(partitions)),
+		[]metrics.Label{
+			{Name: "table", Value: table},
+			{Name: "query_type", Value: qType},
+		},
+	)
+	if !cfg.PartitionMetrics {
+		return
+	}
+	for _, ptn := range samplePartitions(partitions, cfg.PartitionMetricsSample) {
+		c.metrics.IncrCounterWithLabels(
+			metricKey("queried_partition_names"),
+			1.0,
+			[]metrics.Label{
+				{Name: "table", Value: table},
+				{Name: "partition", Value: ptn},
+				{Name: "query_type", Value: qType},
+			},
+		)
+	}
+}
+
+// samplePartitions picks n partitions spread evenly over the list, all of them when n is 0 or the list is short
+func samplePartitions(partitions []string, n int) []string {
+	if n == 0 || len(partitions) <= n {
+		return partitions
+	}
+	sample := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		sample = append(sample, partitions[i*len(partitions)/n])
+	}
+	return sample
+}
+
+// emitClusterMetrics publishes the cluster gauges for a poll, queued is -1 when it couldn't be fetched
+func emitClusterMetrics(c *cluster, running int64, queued int, flagged int64, took time.Duration) {
+	c.metrics.SetGauge(metricKey("running_queries"), float32(running))
+	if queued >= 0 {
+		c.metrics.SetGauge(metricKey("queued_queries"), float32(queued))
+	}
+	c.metrics.SetGauge(metricKey("flagged_queries"), float32(flagged))
+	c.metrics.AddSample(metricKey("poll_duration_ms"), float32(took.Seconds()*1000))
+}
+
+// stopMetrics flushes anything the sink still has buffered
+func stopMetrics() {
+	if s, ok := metricsSink.MetricSink.(interface {
+		Shutdown()
+	}); ok {
+		s.Shutdown()
+	}
+}
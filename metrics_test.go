@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/armon/go-metrics"
+	"github.com/armon/go-metrics/datadog"
+)
+
+func TestMetricsWrapper(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		sink     metrics.MetricSink
+		err      error
+		degraded bool
+	}{
+		{"a sink", &recordingSink{}, nil, false},
+		{"an error", &recordingSink{}, errors.New("lookup statsd: no such host"), true},
+		{"no sink", nil, nil, true},
+		// What NewDogStatsdSink returns for a host that doesn't resolve
+		{"a nil sink and an error", (*datadog.DogStatsdSink)(nil), errors.New("lookup statsd: no such host"), true},
+	} {
+		w := newMetricsWrapper(tc.sink, tc.err)
+		if w.degraded != tc.degraded {
+			t.Errorf("%v: got degraded %v, want %v", tc.name, w.degraded, tc.degraded)
+		}
+		if _, blackhole := w.MetricSink.(*metrics.BlackholeSink); blackhole != tc.degraded {
+			t.Errorf("%v: got sink %T", tc.name, w.MetricSink)
+		}
+	}
+}
+
+// collectWithMetrics runs a poll over a query above the limit and one below it, emitting through metricsSink
+func collectWithMetrics(t *testing.T) {
+	presto := newFakePresto(
+		testQuery("bad", "alice", "SELECT * FROM events.clicks", 100),
+		testQuery("fine", "bob", "SELECT * FROM events.clicks WHERE ds = '2023-01-01'", 1),
+	)
+	c, notifier := testCluster(presto)
+	if !doCollect(c) {
+		t.Fatal("the poll failed")
+	}
+	if alerts := notifier.sent(); len(alerts) != 1 || alerts[0].Query.QueryID != "bad" {
+		t.Errorf("got alerts %+v, want one for query bad", alerts)
+	}
+}
+
+func TestMetricsEmitted(t *testing.T) {
+	defer setupTest()()
+	sink := &recordingSink{}
+	metricsSink = newMetricsWrapper(sink, nil)
+
+	collectWithMetrics(t)
+	if got := sink.count("queried_partitions"); got != 101 {
+		t.Errorf("got %v queried_partitions, want 101", got)
+	}
+	if got := sink.count("cache_misses"); got != 2 {
+		t.Errorf("got %v cache_misses, want 2", got)
+	}
+}
+
+func TestMetricsDegraded(t *testing.T) {
+	defer setupTest()()
+	metricsSink = newMetricsWrapper((*datadog.DogStatsdSink)(nil), errors.New("lookup statsd: no such host"))
+
+	// Polling and alerting carry on with nothing to emit to
+	collectWithMetrics(t)
+	stopMetrics()
+}
+
+func TestPartitionMetrics(t *testing.T) {
+	defer setupTest()()
+	c, _ := testCluster(newFakePresto())
+	partitions := testQuery("q1", "alice", "SELECT * FROM events.clicks", 2000).Inputs[0].ConnectorInfo.PartitionIds
+
+	for _, tc := range []struct {
+		name    string
+		enabled bool
+		sample  int
+		names   int
+	}{
+		{"off", false, 20, 0},
+		{"sampled", true, 20, 20},
+		{"every partition", true, 0, 2000},
+	} {
+		sink := &recordingSink{}
+		metricsSink = newMetricsWrapper(sink, nil)
+		cfg.PartitionMetrics, cfg.PartitionMetricsSample = tc.enabled, tc.sample
+
+		emitPartitionMetrics(c, "hive.events.clicks", QUERY_TYPE_READ, partitions)
+		var aggregates []recordedCounter
+		for _, r := range sink.counters {
+			if r.Key == fmt.Sprint(metricKey("queried_partitions")) {
+				aggregates = append(aggregates, r)
+			}
+		}
+		// One call for the table however many partitions it has
+		if len(aggregates) != 1 || aggregates[0].Value != 2000 {
+			t.Errorf("%v: got queried_partitions %+v, want a single 2000", tc.name, aggregates)
+		}
+		if got := sink.count("queried_partition_names"); int(got) != tc.names {
+			t.Errorf("%v: got %v queried_partition_names, want %v", tc.name, got, tc.names)
+		}
+		if len(sink.counters) != 1+tc.names {
+			t.Errorf("%v: got %v counter calls, want %v", tc.name, len(sink.counters), 1+tc.names)
+		}
+	}
+}
+
+func TestSamplePartitions(t *testing.T) {
+	partitions := []string{"p0", "p1", "p2", "p3", "p4", "p5", "p6", "p7", "p8", "p9"}
+	for _, tc := range []struct {
+		n    int
+		want []string
+	}{
+		{0, partitions},
+		{10, partitions},
+		{20, partitions},
+		{5, []string{"p0", "p2", "p4", "p6", "p8"}},
+		{3, []string{"p0", "p3", "p6"}},
+		{1, []string{"p0"}},
+	} {
+		if got := samplePartitions(partitions, tc.n); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("samplePartitions(%v) = %v, want %v", tc.n, got, tc.want)
+		}
+	}
+}
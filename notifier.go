@@ -0,0 +1,629 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/ashwanthkumar/slack-go-webhook"
+	"github.com/thecubed/prestowatcher/config"
+)
+
+/*
+	Alerts fan out to every configured notifier. A failing notifier is logged and counted, and doesn't stop the
+	others from being tried.
+*/
+
+// Alert is everything a notifier needs to tell people about a query
+type Alert struct {
+	// The cluster the query runs on
+	Cluster   *cluster
+	Query     PrestoQuery
+	BadInputs []PrestoInput
+	// Partitions the alert is about in total
+	TotalPartitions int
+	// Severity tier of the worst of the BadInputs, empty for alerts without any
+	Severity string
+	// Partition total at the first alert when this is an escalation, 0 otherwise
+	EscalatedFrom int
+	// Why prestowatcher cancelled the query, empty if it didn't
+	KillReason string
+	// The kill in KillReason only happened in a dry run, the query is still running
+	DryRunKill bool
+	// The protection that kept a query over --kill-threshold from being killed, e.g. "query is protected by
+	// user [etl]", empty unless a kill was refused
+	KillRefusal string
+	// The query carries the opt-out tag, but is too big for it to count
+	OptOutIgnored bool
+	// Bytes scanned and runtime limits the query went over, as sentences
+	Breaches []string
+	// Bytes scanned and runtime so far, 0 when unknown
+	ScannedBytes int64
+	Runtime      time.Duration
+	// How long the query has been queued, when the alert is about a query stuck in QUEUED
+	QueuedFor time.Duration
+	// Inputs on partitioned tables without any partition filter, when the alert is about a full scan
+	FullScans []PrestoInput
+	// Alerts for the same user and query within --repeat-offender-window when it's a repeat offender, 0 otherwise
+	RepeatCount int
+	// FINISHED, FAILED or CANCELED when this is the follow-up to an earlier alert, Query is then the final detail
+	FinalState string
+	// Why a FAILED query failed, when the follow-up comes from --watch-failures
+	FailureReason string
+	// The user's RUNNING queries, largest first, when the alert is about their combined load. Query is then the
+	// largest of them.
+	UserQueries []userQuery
+	// How long after it was created the query was caught, only set on its first alert
+	CaughtAfter time.Duration
+	// Where the query's first Slack alert went, nil when the alert isn't about a cached query. The Slack
+	// notifier fills it in when it posts a first alert through the API, and replies to it for follow-ups.
+	Thread *slackThread
+}
+
+type Notifier interface {
+	// Name identifies the notifier in logs and metrics
+	Name() string
+	Notify(alert Alert) error
+}
+
+// Every configured notifier, the one clusters alert through
+var notifiers fanOut
+
+// Shared client for the notifiers we talk HTTP to ourselves
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+func buildNotifiers(names []string) fanOut {
+	var built fanOut
+	for _, name := range names {
+		switch name {
+		case config.NOTIFIER_SLACK:
+			if cfg.DigestInterval.Duration > 0 {
+				digest = &digestNotifier{slack: newSlackNotifier()}
+				built = append(built, digest)
+			} else {
+				built = append(built, newSlackNotifier())
+			}
+		case config.NOTIFIER_WEBHOOK:
+			built = append(built, &webhookNotifier{url: cfg.WebhookURL})
+		case config.NOTIFIER_PAGERDUTY:
+			built = append(built, &pagerDutyNotifier{url: cfg.PagerDutyURL, routingKey: cfg.PagerDutyRoutingKey, minPartitions: cfg.PagerDutyMinPartitions})
+		}
+	}
+	return built
+}
+
+// notify sends an alert through its cluster's notifier, traced under the span in ctx
+func notify(ctx context.Context, alert Alert) {
+	if alert.FinalState == "" && len(alert.UserQueries) == 0 {
+		completions.track(alert)
+	}
+	atomic.AddInt64(&alertsSentTotal, 1)
+	if cfg.DryRun {
+		metricsSink.IncrCounter(metricKey("dry_run_alerts"), 1.0)
+	}
+	var to Notifier = notifiers
+	if alert.Cluster != nil && alert.Cluster.notifier != nil {
+		to = alert.Cluster.notifier
+	}
+	_, span := startSpan(ctx, "notify")
+	span.setAttribute("notifier", to.Name())
+	span.setAttribute("query.id", alert.Query.QueryID)
+	defer span.end()
+	if err := to.Notify(alert); err != nil {
+		span.setError(err)
+		log.Errorf("Error sending alert for query [%v] to [%v]: %v", alert.Query.QueryID, to.Name(), err)
+	}
+}
+
+// fanOut sends an alert to every notifier in it. A failing notifier is logged and counted, and doesn't stop the
+// others from being tried.
+type fanOut []Notifier
+
+func (f fanOut) Name() string {
+	return "all"
+}
+
+func (f fanOut) Notify(alert Alert) error {
+	for _, n := range f {
+		if err := n.Notify(alert); err != nil {
+			log.Errorf("Error sending alert for query [%v] to [%v]: %v", alert.Query.QueryID, n.Name(), err)
+			metricsSink.IncrCounterWithLabels(
+				metricKey("notify_errors"),
+				1.0,
+				[]metrics.Label{
+					{
+						Name:  "backend",
+						Value: n.Name(),
+					},
+				},
+			)
+		}
+	}
+	return nil
+}
+
+// PagerDuty routing keys are as good as a password, don't put them in the dry run log
+var routingKeyPattern = regexp.MustCompile(`"routing_key":"[^"]*"`)
+
+// postJSON POSTs a JSON body and treats anything but a 2xx as an error. In a dry run it only logs the body.
+func postJSON(url string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	if cfg.DryRun {
+		// Webhook URLs carry their secret in the path, so only the host is logged
+		host := url
+		if u, err := neturl.Parse(url); err == nil {
+			host = u.Host
+		}
+		log.Infof("Dry run, not sending to [%v]: %s", host, routingKeyPattern.ReplaceAll(b, []byte(`"routing_key":"<redacted>"`)))
+		return nil
+	}
+	req, err := newNotifyRequest(url, b)
+	if err != nil {
+		return err
+	}
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := ioutil.ReadAll(resp.Body)
+		return &httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(snippet), RetryAfter: retryAfter(resp)}
+	}
+	return nil
+}
+
+// Slack incoming webhook, the original alert format, or the Web API with --slack-token
+type slackNotifier struct {
+	// Empty when posting through the API
+	url   string
+	token string
+
+	// Queries are checked in parallel, but messages go out one at a time so we don't burst the webhook
+	sendLock sync.Mutex
+}
+
+func newSlackNotifier() *slackNotifier {
+	if cfg.SlackToken != "" {
+		return &slackNotifier{token: cfg.SlackToken}
+	}
+	return &slackNotifier{url: cfg.SlackURL}
+}
+
+func (n *slackNotifier) Name() string { return config.NOTIFIER_SLACK }
+
+func (n *slackNotifier) Notify(alert Alert) error {
+	var failed error
+	if isFollowUp(alert) && alert.Thread != nil && alert.Thread.TS != "" {
+		// Follow-ups on a query whose first alert went through the API are replies in its thread
+		payload, err := slackPayload(alert)
+		if err != nil {
+			return err
+		}
+		payload.Channel = alert.Thread.Channel
+		_, failed = n.post("", payload, alert.Thread.TS)
+	} else {
+		failed = n.notifyRoutes(alert)
+	}
+	if failed != nil {
+		return failed
+	}
+
+	// The copy is a courtesy, the channel alert already went out
+	if alert.QueuedFor == 0 && len(alert.FullScans) == 0 && alert.FinalState == "" {
+		n.sendCopy(alert)
+	}
+	return nil
+}
+
+// notifyRoutes posts a new message for every route of the alert, a failed one doesn't stop the others
+func (n *slackNotifier) notifyRoutes(alert Alert) error {
+	var failed error
+	routed := routeAlert(alert)
+	if alert.RepeatCount > 0 && cfg.RepeatOffenderWebhook != "" {
+		routed = []routedAlert{{Alert: alert, Route: SlackRoute{Webhook: cfg.RepeatOffenderWebhook}}}
+	}
+	// The tier's webhook wins, an emergency matters more than who ran it
+	if hook := severityWebhook(alert.Severity); hook != "" {
+		routed = []routedAlert{{Alert: alert, Route: SlackRoute{Webhook: hook}}}
+	}
+	for _, r := range routed {
+		payload, err := slackPayload(r.Alert)
+		if err != nil {
+			return err
+		}
+		url := n.url
+		if r.Route.Webhook != "" {
+			url = r.Route.Webhook
+		}
+		payload.Channel = r.Route.Channel
+		thread, err := n.post(url, payload, "")
+		if err != nil {
+			if failed == nil {
+				failed = err
+			}
+			continue
+		}
+		// The first message that went through the API becomes the query's thread
+		if alert.Thread != nil && alert.Thread.TS == "" && thread.TS != "" {
+			*alert.Thread = thread
+		}
+	}
+	return failed
+}
+
+// slackPayload builds the message for an alert, starting with the cluster name when there are several
+func slackPayload(alert Alert) (slack.Payload, error) {
+	payload, err := alertPayload(alert)
+	if err != nil {
+		return payload, err
+	}
+	payload.Text = alert.Cluster.prefix() + payload.Text
+	return payload, nil
+}
+
+func alertPayload(alert Alert) (slack.Payload, error) {
+	if alert.FinalState != "" {
+		return finalPayload(alert), nil
+	}
+	if len(alert.UserQueries) > 0 {
+		return userLoadPayload(alert), nil
+	}
+	if alert.QueuedFor > 0 {
+		return queuedPayload(alert), nil
+	}
+	if len(alert.FullScans) > 0 {
+		return fullScanPayload(alert), nil
+	}
+
+	var attachments []slack.Attachment
+	query := alert.Query
+	qType := queryType(query)
+
+	shown, rest := capInputs(alert.BadInputs, cfg.SlackMaxTables)
+	for _, i := range shown {
+		attachment := slack.Attachment{}
+		var color = severityColor(alert.Severity)
+		if alert.KillReason != "" {
+			color = "danger"
+		} else if alert.RepeatCount > 0 && severityRank(alert.Severity) == 0 {
+			color = REPEAT_OFFENDER_COLOR
+		}
+		attachment.Color = &color
+		attachment.AddField(slack.Field{Title: "Schema", Value: tableName(i), Short: true})
+		attachment.AddField(slack.Field{Title: "Partitions", Value: partitionCountText(i), Short: true})
+		attachment.AddField(slack.Field{Title: "Query Type", Value: qType, Short: true})
+		attachment.AddField(slack.Field{Title: "Limit", Value: rules.limitFor(i, qType).String(), Short: true})
+		if ranges, ok := partitionRanges(i.ConnectorInfo.PartitionIds); ok {
+			attachment.AddField(slack.Field{Title: "Scanning", Value: ranges[0].rangeText()})
+		}
+		attachments = append(attachments, attachment)
+	}
+	if len(rest) > 0 {
+		attachments = append(attachments, moreTablesAttachment(rest))
+	}
+
+	// Who ran it when the user is a shared service account, fields Presto didn't get are left out
+	session := slack.Attachment{}
+	if query.Session.Source != "" {
+		session.AddField(slack.Field{Title: "Source", Value: query.Session.Source, Short: true})
+	}
+	if rg := resourceGroupName(query); rg != "" {
+		session.AddField(slack.Field{Title: "Resource Group", Value: rg, Short: true})
+	}
+	if query.Session.ClientInfo != "" {
+		session.AddField(slack.Field{Title: "Client Info", Value: query.Session.ClientInfo})
+	}
+	if len(session.Fields) > 0 {
+		attachments = append(attachments, session)
+	}
+
+	if snippet, ok := querySnippetAttachment(query); ok {
+		attachments = append(attachments, snippet)
+	}
+
+	tag, tagged := extractBITag(query)
+	if tagged {
+		var color = tag.Color
+		queryInfo := slack.Attachment{}
+		queryInfo.Color = &color
+		for _, f := range tag.Fields {
+			queryInfo.AddField(f)
+		}
+		attachments = append(attachments, queryInfo)
+	}
+
+	if len(alert.Breaches) > 0 {
+		var color = "warning"
+		resources := slack.Attachment{}
+		resources.Color = &color
+		resources.AddField(slack.Field{Title: "Scanned", Value: formatBytes(alert.ScannedBytes), Short: true})
+		resources.AddField(slack.Field{Title: "Runtime", Value: formatDuration(alert.Runtime), Short: true})
+		if cfg.MaxSplits > 0 || cfg.MaxInputBytes > 0 {
+			splits, input := queryScale(query)
+			resources.AddField(slack.Field{Title: "Splits", Value: fmt.Sprintf("%v", splits), Short: true})
+			resources.AddField(slack.Field{Title: "Physical Input", Value: formatBytes(input), Short: true})
+		}
+		attachments = append(attachments, resources)
+	}
+
+	// Make it personal if we know who ran the query
+	mapping, _ := users.lookup(query.Session.User, tag.User)
+	if !severityMentions(alert.Severity) {
+		mapping.SlackID = ""
+	}
+	text, err := renderSlackText(alert, mapping.SlackID)
+	if err != nil {
+		return slack.Payload{}, err
+	}
+	if alert.RepeatCount > 0 {
+		text = fmt.Sprintf(":rotating_light: *Repeat offender*, flagged %v times in the last %v\n", alert.RepeatCount, windowText()) + text
+	}
+
+	return slack.Payload{
+		Text:        text,
+		Attachments: attachments,
+	}, nil
+}
+
+// sendCopy sends a copy of the whole alert to the user who ran the query, if the user map says where to
+func (n *slackNotifier) sendCopy(alert Alert) {
+	query := alert.Query
+	tag, _ := extractBITag(query)
+	mapping, mapped := users.lookup(query.Session.User, tag.User)
+	if !mapped || (mapping.DMWebhook == "" && mapping.DMChannel == "") {
+		return
+	}
+	payload, err := slackPayload(alert)
+	if err != nil {
+		log.Errorf("Unable to build a copy of the alert for query [%v]: %v", query.QueryID, err)
+		return
+	}
+	url := n.url
+	if mapping.DMWebhook != "" {
+		url = mapping.DMWebhook
+	} else {
+		payload.Channel = mapping.DMChannel
+	}
+	if err := n.send(url, payload); err != nil {
+		log.Errorf("Unable to send a copy of the alert for query [%v] to user [%v]: %v", query.QueryID, query.Session.User, err)
+	}
+}
+
+// queuedPayload tells the channel about a query stuck in the queue
+func queuedPayload(alert Alert) slack.Payload {
+	query := alert.Query
+	user := query.Session.User
+	if mapping, ok := users.lookup(query.Session.User); ok {
+		user = fmt.Sprintf("<@%v>", mapping.SlackID)
+	}
+	payload := slack.Payload{
+		Text: fmt.Sprintf(":hourglass_flowing_sand: Presto query %v by %v has been *queued for %v*, over the limit of %v. "+
+			"Something may be starving its resource group.\n", slackQueryLink(alert.Cluster, query.QueryID), user, formatDuration(alert.QueuedFor), formatDuration(cfg.MaxQueueTime)) +
+			slackAlternateLinks(alert.Cluster, query.QueryID) + ackLine(query.QueryID),
+	}
+	if snippet, ok := querySnippetAttachment(query); ok {
+		payload.Attachments = append(payload.Attachments, snippet)
+	}
+	return payload
+}
+
+// fullScanPayload tells the channel about a query that doesn't filter a partitioned table's partitions at all
+func fullScanPayload(alert Alert) slack.Payload {
+	query := alert.Query
+	user := query.Session.User
+	if mapping, ok := users.lookup(query.Session.User); ok {
+		user = fmt.Sprintf("<@%v>", mapping.SlackID)
+	}
+	payload := slack.Payload{
+		Text: fmt.Sprintf(":rotating_light: Presto query %v by %v has *no partition filter detected* on %v, so it's scanning every partition. "+
+			"Make sure your queries filter on the partition columns of the tables they read!\n", slackQueryLink(alert.Cluster, query.QueryID), user, tableNames(alert.FullScans)) +
+			slackAlternateLinks(alert.Cluster, query.QueryID) + caughtAfterText(alert) + ackLine(query.QueryID),
+	}
+	if snippet, ok := querySnippetAttachment(query); ok {
+		payload.Attachments = append(payload.Attachments, snippet)
+	}
+	return payload
+}
+
+// finalPayload follows up on an alerted query that has completed
+func finalPayload(alert Alert) slack.Payload {
+	query := alert.Query
+	emoji := ":white_check_mark:"
+	if alert.FinalState != "FINISHED" {
+		emoji = ":x:"
+	}
+	text := fmt.Sprintf("%v Presto query %v by %v that we alerted on is *%v* after %v, having scanned %v and %v partitions.",
+		emoji, slackQueryLink(alert.Cluster, query.QueryID), query.Session.User, alert.FinalState, formatDuration(alert.Runtime), formatBytes(alert.ScannedBytes), finalPartitions(query))
+	if alert.FailureReason != "" {
+		text += fmt.Sprintf("\nIt failed with `%v`", slackEscaper.Replace(alert.FailureReason))
+	}
+	if alternate := slackAlternateLinks(alert.Cluster, query.QueryID); alternate != "" {
+		text += "\n" + strings.TrimSuffix(alternate, "\n")
+	}
+	return slack.Payload{Text: text}
+}
+
+// send posts a payload with the configured bot name, icon and channel filled in
+func (n *slackNotifier) send(url string, payload slack.Payload) error {
+	_, err := n.post(url, payload, "")
+	return err
+}
+
+// post sends a payload to a webhook URL, or through the API when url is empty, replying in the thread threadTS
+// if it's set. It returns where the message went when it was sent through the API.
+func (n *slackNotifier) post(url string, payload slack.Payload, threadTS string) (slackThread, error) {
+	payload.Username = cfg.SlackUsername
+	payload.IconEmoji = cfg.SlackIconEmoji
+	if payload.Channel == "" {
+		payload.Channel = cfg.SlackChannel
+	}
+	n.sendLock.Lock()
+	defer n.sendLock.Unlock()
+	var thread slackThread
+	err := retry(RETRY_TARGET_SLACK, "message", func() (err error) {
+		if url != "" {
+			return postJSON(url, payload)
+		}
+		thread, err = postSlackAPI(n.token, slackAPIMessage{Payload: payload, ThreadTS: threadTS})
+		return err
+	})
+	return thread, err
+}
+
+// Generic JSON webhook
+type webhookNotifier struct {
+	url string
+}
+
+type webhookInput struct {
+	Table      string `json:"table"`
+	Partitions int    `json:"partitions"`
+	Truncated  bool   `json:"truncated"`
+	Limit      int    `json:"limit"`
+}
+
+type webhookAlert struct {
+	Cluster         string         `json:"cluster,omitempty"`
+	QueryID         string         `json:"query_id"`
+	User            string         `json:"user"`
+	QueryType       string         `json:"query_type"`
+	Severity        string         `json:"severity,omitempty"`
+	URL             string         `json:"url"`
+	TotalPartitions int            `json:"total_partitions"`
+	EscalatedFrom   int            `json:"escalated_from,omitempty"`
+	Killed          bool           `json:"killed"`
+	DryRunKill      bool           `json:"dry_run_kill,omitempty"`
+	KillReason      string         `json:"kill_reason,omitempty"`
+	KillRefusal     string         `json:"kill_refusal,omitempty"`
+	Breaches        []string       `json:"breaches,omitempty"`
+	ScannedBytes    int64          `json:"scanned_bytes,omitempty"`
+	RuntimeSeconds  float64        `json:"runtime_seconds,omitempty"`
+	QueuedSeconds   float64        `json:"queued_seconds,omitempty"`
+	FullScans       []string       `json:"full_scans,omitempty"`
+	RepeatCount     int            `json:"repeat_count,omitempty"`
+	Inputs          []webhookInput `json:"inputs"`
+}
+
+func (n *webhookNotifier) Name() string { return config.NOTIFIER_WEBHOOK }
+
+func (n *webhookNotifier) Notify(alert Alert) error {
+	// Follow-ups and user load alerts are Slack only
+	if alert.FinalState != "" || len(alert.UserQueries) > 0 {
+		return nil
+	}
+	qType := queryType(alert.Query)
+	body := webhookAlert{
+		Cluster:         alert.Cluster.displayName(),
+		QueryID:         alert.Query.QueryID,
+		User:            alert.Query.Session.User,
+		QueryType:       qType,
+		Severity:        alert.Severity,
+		URL:             primaryQueryURL(alert.Cluster, alert.Query.QueryID),
+		TotalPartitions: alert.TotalPartitions,
+		EscalatedFrom:   alert.EscalatedFrom,
+		Killed:          alert.KillReason != "" && !alert.DryRunKill,
+		DryRunKill:      alert.DryRunKill,
+		KillReason:      alert.KillReason,
+		KillRefusal:     alert.KillRefusal,
+		Breaches:        alert.Breaches,
+		ScannedBytes:    alert.ScannedBytes,
+		RuntimeSeconds:  alert.Runtime.Seconds(),
+		QueuedSeconds:   alert.QueuedFor.Seconds(),
+		RepeatCount:     alert.RepeatCount,
+	}
+	for _, i := range alert.BadInputs {
+		body.Inputs = append(body.Inputs, webhookInput{
+			Table:      tableName(i),
+			Partitions: len(i.ConnectorInfo.PartitionIds),
+			Truncated:  i.ConnectorInfo.Truncated,
+			Limit:      rules.limitFor(i, qType).Max,
+		})
+	}
+	for _, i := range alert.FullScans {
+		body.FullScans = append(body.FullScans, tableName(i))
+	}
+	return postJSON(n.url, body)
+}
+
+// PagerDuty Events API v2
+type pagerDutyNotifier struct {
+	url           string
+	routingKey    string
+	minPartitions int
+}
+
+func (n *pagerDutyNotifier) Name() string { return config.NOTIFIER_PAGERDUTY }
+
+func (n *pagerDutyNotifier) Notify(alert Alert) error {
+	if alert.FinalState != "" || len(alert.UserQueries) > 0 {
+		return nil
+	}
+	if alert.TotalPartitions < n.minPartitions && len(alert.Breaches) == 0 && alert.QueuedFor == 0 && len(alert.FullScans) == 0 {
+		log.Debugf("Not paging for query [%v], [%v] partitions is under [%v]", alert.Query.QueryID, alert.TotalPartitions, n.minPartitions)
+		return nil
+	}
+
+	// PagerDuty's own severities, a critical tier is an error and an emergency is critical
+	severity := "warning"
+	switch alert.Severity {
+	case config.SEVERITY_EMERGENCY:
+		severity = "critical"
+	case config.SEVERITY_CRITICAL:
+		severity = "error"
+	}
+	summary := fmt.Sprintf("Presto query %v by %v is scanning %v partitions", alert.Query.QueryID, alert.Query.Session.User, alert.TotalPartitions)
+	if alert.QueuedFor > 0 {
+		summary = fmt.Sprintf("Presto query %v by %v has been queued for %v", alert.Query.QueryID, alert.Query.Session.User, formatDuration(alert.QueuedFor))
+	} else if len(alert.FullScans) > 0 {
+		summary = fmt.Sprintf("Presto query %v by %v has no partition filter on %v", alert.Query.QueryID, alert.Query.Session.User, tableNames(alert.FullScans))
+	} else if len(alert.BadInputs) == 0 && len(alert.Breaches) > 0 {
+		summary = fmt.Sprintf("Presto query %v by %v is over its limits because %v", alert.Query.QueryID, alert.Query.Session.User, breachText(alert.Breaches))
+	}
+	if alert.KillReason != "" {
+		severity = "critical"
+		summary = fmt.Sprintf("Presto query %v by %v was cancelled by prestowatcher because %v", alert.Query.QueryID, alert.Query.Session.User, alert.KillReason)
+		if alert.DryRunKill {
+			summary = fmt.Sprintf("Presto query %v by %v would have been cancelled by prestowatcher because %v", alert.Query.QueryID, alert.Query.Session.User, alert.KillReason)
+		}
+	}
+	tables := make(map[string]int)
+	for _, i := range alert.BadInputs {
+		tables[tableName(i)] = len(i.ConnectorInfo.PartitionIds)
+	}
+
+	event := map[string]interface{}{
+		"routing_key":  n.routingKey,
+		"event_action": "trigger",
+		// One incident per query, escalations and kills update it
+		"dedup_key": alert.Query.QueryID,
+		"payload": map[string]interface{}{
+			"summary":  summary,
+			"source":   APP_NAME,
+			"severity": severity,
+			"custom_details": map[string]interface{}{
+				"user":             alert.Query.Session.User,
+				"query_type":       queryType(alert.Query),
+				"total_partitions": alert.TotalPartitions,
+				"tables":           tables,
+				"breaches":         alert.Breaches,
+			},
+		},
+		"links": []map[string]string{
+			{"href": primaryQueryURL(alert.Cluster, alert.Query.QueryID), "text": "Presto UI"},
+		},
+	}
+	return postJSON(n.url, event)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+/*
+	Every alert request, to a Slack webhook or the Slack API, the generic webhook or PagerDuty, is built here so
+	the receiving end can check where it came from. --notify-header adds static headers, like the auth header an
+	internal relay in front of Slack wants. They only go to the webhook URLs we were given, --slack, the tier and
+	route webhooks and --webhook-url, since that's where a relay sits: Slack's API and PagerDuty have no business
+	seeing the relay's credentials. With --notify-hmac-secret every body is signed with HMAC-SHA256 and the hex
+	digest goes in NOTIFY_SIGNATURE_HEADER, which the receiver recomputes over the raw body it got.
+*/
+
+const NOTIFY_SIGNATURE_HEADER = "X-Prestowatcher-Signature"
+
+// newNotifyRequest builds a POST of a JSON body with the signature, and the --notify-header headers when it goes
+// to a relay
+func newNotifyRequest(url string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if relayURL(url) {
+		for _, h := range cfg.NotifyHeaderList {
+			req.Header.Set(h.Name, h.Value)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if cfg.NotifyHMACSecret != "" {
+		req.Header.Set(NOTIFY_SIGNATURE_HEADER, signBody(cfg.NotifyHMACSecret, body))
+	}
+	return req, nil
+}
+
+// relayURL tells whether url is one of the webhook URLs we were given
+func relayURL(url string) bool {
+	if url == "" {
+		return false
+	}
+	for _, u := range []string{cfg.SlackURL, cfg.CriticalWebhook, cfg.EmergencyWebhook, cfg.RepeatOffenderWebhook, cfg.WebhookURL} {
+		if url == u {
+			return true
+		}
+	}
+	for _, r := range slackRoutes {
+		if url == r.Webhook {
+			return true
+		}
+	}
+	return users.hasDMWebhook(url)
+}
+
+// signBody is the hex HMAC-SHA256 of body keyed with secret
+func signBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
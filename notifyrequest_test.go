@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/thecubed/prestowatcher/config"
+)
+
+func TestSignBody(t *testing.T) {
+	for _, tc := range []struct {
+		secret string
+		body   string
+		want   string
+	}{
+		// RFC 4231 test case 2
+		{"Jefe", "what do ya want for nothing?", "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+		{"key", "The quick brown fox jumps over the lazy dog", "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"},
+		{"", "", "b613679a0814d9ec772f95d778c35fc5ff1697c493715653c6c712144292c5ad"},
+	} {
+		if got := signBody(tc.secret, []byte(tc.body)); got != tc.want {
+			t.Errorf("signBody(%q, %q) = %v, want %v", tc.secret, tc.body, got, tc.want)
+		}
+	}
+}
+
+func TestNotifyRequestHeaders(t *testing.T) {
+	defer setupTest()()
+	cfg.SlackURL = "https://relay.example.com/slack/T000/B000/XXXX"
+	cfg.WebhookURL = "https://alerts.example.com/hook"
+	cfg.RepeatOffenderWebhook = "https://relay.example.com/slack/repeat"
+	cfg.NotifyHeaderList = []config.Header{{Name: "X-Relay-Auth", Value: "relay-credential"}}
+	cfg.NotifyHMACSecret = "Jefe"
+	saved := slackRoutes
+	slackRoutes = []SlackRoute{{Match: "hive.finance.*", Webhook: "https://relay.example.com/slack/finance"}}
+	defer func() { slackRoutes = saved }()
+	savedUsers := users
+	users = &userMap{users: map[string]UserMapping{"alice": {SlackID: "U123", DMWebhook: "https://relay.example.com/slack/alice"}}}
+	defer func() { users = savedUsers }()
+
+	body := []byte("what do ya want for nothing?")
+	for _, tc := range []struct {
+		url     string
+		headers bool
+	}{
+		{cfg.SlackURL, true},
+		{cfg.WebhookURL, true},
+		{"https://relay.example.com/slack/finance", true},
+		{cfg.RepeatOffenderWebhook, true},
+		{"https://relay.example.com/slack/alice", true},
+		{SLACK_API_URL, false},
+		{"https://events.pagerduty.com/v2/enqueue", false},
+		{"https://relay.example.com/slack/T000/B000/OTHER", false},
+	} {
+		req, err := newNotifyRequest(tc.url, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := req.Header.Get("X-Relay-Auth") != ""; got != tc.headers {
+			t.Errorf("%v: got the relay header %v, want %v", tc.url, got, tc.headers)
+		}
+		if got := req.Header.Get(NOTIFY_SIGNATURE_HEADER); got != "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843" {
+			t.Errorf("%v: got signature %q", tc.url, got)
+		}
+		if sent, _ := ioutil.ReadAll(req.Body); string(sent) != string(body) {
+			t.Errorf("%v: got body %q", tc.url, sent)
+		}
+	}
+}
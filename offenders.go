@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Repeat offenders: the scheduled report that goes over the limit every morning. Each first alert on a query
+	is counted against the user and a fingerprint of the SQL, and once the same pair has been alerted on
+	--repeat-offender-count times within --repeat-offender-window, the alert says so and, with
+	--repeat-offender-webhook, goes to that webhook instead of the usual channels.
+
+	The fingerprint ignores comments, literals and whitespace, so tomorrow's run of the same report with a new
+	date and a new BI tool run ID still matches. With --repeat-offender-file the counts survive restarts.
+*/
+
+// Attachment color of repeat offender alerts
+const REPEAT_OFFENDER_COLOR = "#7b1fa2"
+
+var (
+	numberLiteralPattern = regexp.MustCompile(`\b[0-9]+(\.[0-9]+)?\b`)
+	inListPattern        = regexp.MustCompile(`\(\s*\?(\s*,\s*\?)*\s*\)`)
+	whitespacePattern    = regexp.MustCompile(`\s+`)
+)
+
+// queryFingerprint hashes a query's SQL with comments dropped and string and number literals replaced by ?
+func queryFingerprint(sql string) string {
+	var b strings.Builder
+	for i := 0; i < len(sql); i++ {
+		switch {
+		case sql[i] == '\'':
+			// A doubled quote is an escaped quote inside the literal
+			i++
+			for i < len(sql) && (sql[i] != '\'' || strings.HasPrefix(sql[i:], "''")) {
+				if sql[i] == '\'' {
+					i++
+				}
+				i++
+			}
+			b.WriteByte('?')
+		case sql[i] == '"':
+			// Quoted identifiers are part of the query's shape
+			end := strings.IndexByte(sql[i+1:], '"')
+			if end < 0 {
+				b.WriteString(sql[i:])
+				i = len(sql)
+				break
+			}
+			b.WriteString(sql[i : i+end+2])
+			i += end + 1
+		case strings.HasPrefix(sql[i:], "--"):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				end = len(sql) - i
+			}
+			b.WriteByte(' ')
+			i += end
+		case strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				end = len(sql) - i - 2
+			}
+			b.WriteByte(' ')
+			i += end + 3
+		default:
+			b.WriteByte(sql[i])
+		}
+	}
+
+	normalized := numberLiteralPattern.ReplaceAllString(b.String(), "?")
+	normalized = inListPattern.ReplaceAllString(normalized, "(?)")
+	normalized = strings.TrimSpace(whitespacePattern.ReplaceAllString(strings.ToLower(normalized), " "))
+	sum := sha1.Sum([]byte(normalized))
+	return hex.EncodeToString(sum[:8])
+}
+
+type offenderTracker struct {
+	sync.Mutex
+	// Optional file the alert times are kept in
+	path string
+	// Alert times within the window by user and fingerprint
+	alerts map[string][]time.Time
+	dirty  bool
+}
+
+var offenders = &offenderTracker{alerts: make(map[string][]time.Time)}
+
+// record counts an alert for the user and fingerprint and returns how many there were within the window
+func (t *offenderTracker) record(user string, fingerprint string, now time.Time) int {
+	t.Lock()
+	defer t.Unlock()
+	key := user + "|" + fingerprint
+	t.alerts[key] = append(t.recent(t.alerts[key], now), now)
+	t.dirty = true
+	return len(t.alerts[key])
+}
+
+// recent drops the times that have fallen out of the window
+func (t *offenderTracker) recent(times []time.Time, now time.Time) []time.Time {
+	cutoff := now.Add(-cfg.RepeatOffenderWindow.Duration)
+	var kept []time.Time
+	for _, at := range times {
+		if at.After(cutoff) {
+			kept = append(kept, at)
+		}
+	}
+	return kept
+}
+
+// save writes the alert times to the file, if there is one and anything changed
+func (t *offenderTracker) save() error {
+	t.Lock()
+	defer t.Unlock()
+	if t.path == "" || !t.dirty {
+		return nil
+	}
+	now := time.Now()
+	for key, times := range t.alerts {
+		if t.alerts[key] = t.recent(times, now); len(t.alerts[key]) == 0 {
+			delete(t.alerts, key)
+		}
+	}
+	data, err := json.Marshal(t.alerts)
+	if err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, t.path); err != nil {
+		return err
+	}
+	t.dirty = false
+	return nil
+}
+
+// startOffenders reads --repeat-offender-file, if one was given
+func startOffenders() {
+	if cfg.RepeatOffenderCount == 0 || cfg.RepeatOffenderFile == "" {
+		return
+	}
+	offenders.path = cfg.RepeatOffenderFile
+	data, err := ioutil.ReadFile(offenders.path)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Fatalf("Unable to read repeat offender file [%v]: %v", offenders.path, err)
+	}
+	if err := json.Unmarshal(data, &offenders.alerts); err != nil {
+		log.Fatalf("Unable to parse repeat offender file [%v]: %v", offenders.path, err)
+	}
+	log.Infof("Restored alert counts for [%v] queries from [%v]", len(offenders.alerts), offenders.path)
+}
+
+// repeatOffense counts a first alert and returns the number of alerts within the window when that makes the
+// query a repeat offender, 0 otherwise
+func repeatOffense(query PrestoQuery, now time.Time) int {
+	if cfg.RepeatOffenderCount == 0 {
+		return 0
+	}
+	count := offenders.record(query.Session.User, queryFingerprint(query.Query), now)
+	if count < cfg.RepeatOffenderCount {
+		return 0
+	}
+	log.Warningf("Query [%v] by user [%v] is a repeat offender, flagged [%v] times in the last [%v]", query.QueryID, query.Session.User, count, cfg.RepeatOffenderWindow)
+	return count
+}
+
+// windowText renders the repeat offender window for messages, in days when it's whole days
+func windowText() string {
+	w := cfg.RepeatOffenderWindow.Duration
+	if w >= 24*time.Hour && w%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%v days", int(w/(24*time.Hour)))
+	}
+	return formatDuration(w)
+}
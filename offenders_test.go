@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueryFingerprint(t *testing.T) {
+	report := queryFingerprint("-- Mode run 1a2b3c\nSELECT ds, count(*) FROM events.clicks WHERE ds >= '2023-01-01' AND ds < '2023-01-02' GROUP BY 1")
+	for _, sql := range []string{
+		"-- Mode run 4d5e6f\nSELECT ds, count(*) FROM events.clicks WHERE ds >= '2023-06-14' AND ds < '2023-06-15' GROUP BY 1",
+		"select ds,   count(*)\nfrom events.clicks\nwhere ds >= '2024-02-29' and ds < '2024-03-01'\ngroup by 1",
+		"/* {\"user\":\"alice\"} */ SELECT ds, count(*) FROM events.clicks WHERE ds >= '2023-01-01' AND ds < '2023-01-02' GROUP BY 1",
+		"SELECT ds, count(*) FROM events.clicks WHERE ds >= 'it''s' AND ds < '' GROUP BY 7",
+	} {
+		if got := queryFingerprint(sql); got != report {
+			t.Errorf("%q: got fingerprint %v, want the report's %v", sql, got, report)
+		}
+	}
+
+	for _, sql := range []string{
+		"SELECT ds, count(*) FROM events.views WHERE ds >= '2023-01-01' AND ds < '2023-01-02' GROUP BY 1",
+		"SELECT ds, count(*) FROM events.clicks WHERE ds >= '2023-01-01' GROUP BY 1",
+		"SELECT \"ds\", count(*) FROM events.clicks WHERE ds >= '2023-01-01' AND ds < '2023-01-02' GROUP BY 1",
+	} {
+		if got := queryFingerprint(sql); got == report {
+			t.Errorf("%q: a different query got the report's fingerprint", sql)
+		}
+	}
+
+	// IN lists of any length collapse too
+	if queryFingerprint("SELECT * FROM t WHERE id IN (1, 2, 3)") != queryFingerprint("SELECT * FROM t WHERE id IN (42)") {
+		t.Error("IN lists of different lengths got different fingerprints")
+	}
+}
+
+func TestOffenderTracker(t *testing.T) {
+	defer setupTest()()
+	cfg.RepeatOffenderWindow.Duration = 14 * 24 * time.Hour
+	start := time.Date(2023, 1, 1, 6, 0, 0, 0, time.UTC)
+	fingerprint := queryFingerprint("SELECT * FROM events.clicks WHERE ds = '2023-01-01'")
+
+	for day := 0; day < 7; day++ {
+		if got := offenders.record("alice", fingerprint, start.AddDate(0, 0, day)); got != day+1 {
+			t.Fatalf("day %v: got count %v, want %v", day, got, day+1)
+		}
+	}
+	if got := offenders.record("bob", fingerprint, start.AddDate(0, 0, 7)); got != 1 {
+		t.Errorf("another user's alert got count %v, want 1", got)
+	}
+	// Two weeks after the first alert it has fallen out of the window
+	if got := offenders.record("alice", fingerprint, start.AddDate(0, 0, 14)); got != 7 {
+		t.Errorf("got count %v at the end of the window, want 7", got)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Which partition columns a table has, and which values a query is scanning, read from the partition IDs Presto
+	returns. Hive partition IDs look like "date=2023-01-02" or "ds=2023-01-02/hr=03", so the alert can say what
+	the table is partitioned by, which column to filter on, and the range being scanned:
+
+		`events.clicks` is partitioned by `ds`, `hr`, add a filter on `ds`. It's scanning `ds` from 2021-01-01
+		to 2023-06-01 (882 days).
+
+	Values are compared as numbers when they all are, and days are counted when they're dates. An input whose
+	partition IDs aren't all key=value pairs with the same keys gets no hint, the alert just shows the count.
+*/
+
+// Date formats partition values are recognized in, to count the days in a range
+var partitionDateLayouts = []string{"2006-01-02", "20060102"}
+
+// The values of one partition column a query is scanning
+type partitionKeyRange struct {
+	Key string
+	Min string
+	Max string
+	// Days from Min to Max inclusive, 0 when they aren't dates
+	Days int
+}
+
+type partitionKeyValue struct {
+	Key   string
+	Value string
+}
+
+// parsePartitionID splits a partition ID like "ds=2023-01-02/hr=03" into its keys and values
+func parsePartitionID(id string) ([]partitionKeyValue, bool) {
+	var kvs []partitionKeyValue
+	for _, part := range strings.Split(id, "/") {
+		eq := strings.Index(part, "=")
+		if eq <= 0 {
+			return nil, false
+		}
+		kvs = append(kvs, partitionKeyValue{Key: part[:eq], Value: part[eq+1:]})
+	}
+	return kvs, true
+}
+
+// partitionRanges returns the partition columns of the partition IDs and the range scanned on each, ok is
+// false when the IDs aren't all key=value pairs with the same keys
+func partitionRanges(ids []string) (ranges []partitionKeyRange, ok bool) {
+	var values [][]string
+	for n, id := range ids {
+		kvs, ok := parsePartitionID(id)
+		if !ok {
+			return nil, false
+		}
+		if n == 0 {
+			ranges = make([]partitionKeyRange, len(kvs))
+			values = make([][]string, len(kvs))
+			for i, kv := range kvs {
+				ranges[i].Key = kv.Key
+			}
+		}
+		if len(kvs) != len(ranges) {
+			return nil, false
+		}
+		for i, kv := range kvs {
+			if kv.Key != ranges[i].Key {
+				return nil, false
+			}
+			values[i] = append(values[i], kv.Value)
+		}
+	}
+	for i := range ranges {
+		ranges[i].Min, ranges[i].Max = valueRange(values[i])
+		ranges[i].Days = daysBetween(ranges[i].Min, ranges[i].Max)
+	}
+	return ranges, len(ranges) > 0
+}
+
+// valueRange returns the smallest and largest value, as numbers if they all are and as strings otherwise
+func valueRange(values []string) (min string, max string) {
+	less := func(a, b string) bool { return a < b }
+	numeric := true
+	for _, v := range values {
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			numeric = false
+			break
+		}
+	}
+	if numeric {
+		less = func(a, b string) bool {
+			x, _ := strconv.ParseFloat(a, 64)
+			y, _ := strconv.ParseFloat(b, 64)
+			return x < y
+		}
+	}
+	min, max = values[0], values[0]
+	for _, v := range values[1:] {
+		if less(v, min) {
+			min = v
+		}
+		if less(max, v) {
+			max = v
+		}
+	}
+	return min, max
+}
+
+// daysBetween counts the days from min to max inclusive, 0 when they aren't both dates in the same format
+func daysBetween(min string, max string) int {
+	for _, layout := range partitionDateLayouts {
+		from, err := time.Parse(layout, min)
+		if err != nil {
+			continue
+		}
+		to, err := time.Parse(layout, max)
+		if err != nil {
+			continue
+		}
+		return int(to.Sub(from).Hours()/24) + 1
+	}
+	return 0
+}
+
+// rangeText describes a scanned range, e.g. "`ds` from 2021-01-01 to 2023-06-01 (882 days)"
+func (r partitionKeyRange) rangeText() string {
+	text := fmt.Sprintf("`%v` from %v to %v", r.Key, r.Min, r.Max)
+	if r.Min == r.Max {
+		text = fmt.Sprintf("`%v` %v", r.Key, r.Min)
+	}
+	if r.Days > 1 {
+		text += fmt.Sprintf(" (%v days)", r.Days)
+	}
+	return text
+}
+
+// partitionHint tells the user which column to filter an input on, empty when its partition IDs can't be read
+func partitionHint(input PrestoInput) string {
+	ranges, ok := partitionRanges(input.ConnectorInfo.PartitionIds)
+	if !ok {
+		return ""
+	}
+	var keys []string
+	for _, r := range ranges {
+		keys = append(keys, "`"+r.Key+"`")
+	}
+	return fmt.Sprintf("`%v` is partitioned by %v, add a filter on `%v`. It's scanning %v.",
+		tableName(input), strings.Join(keys, ", "), ranges[0].Key, ranges[0].rangeText())
+}
+
+// partitionHints is the advice for all the inputs of an alert, one line per table, or a general reminder when
+// none of their partition IDs can be read
+func partitionHints(inputs []PrestoInput) string {
+	var hints []string
+	for _, i := range inputs {
+		if hint := partitionHint(i); hint != "" {
+			hints = append(hints, hint)
+		}
+	}
+	if len(hints) == 0 {
+		return "Make sure your query filters on the partition columns of the tables it reads!"
+	}
+	return strings.Join(hints, "\n")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPartitionRanges(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ids  []string
+		want []partitionKeyRange
+	}{
+		{"single key", []string{"date=2023-01-03", "date=2023-01-01", "date=2023-01-02"}, []partitionKeyRange{
+			{Key: "date", Min: "2023-01-01", Max: "2023-01-03", Days: 3},
+		}},
+		{"a year of days", []string{"ds=2021-01-01", "ds=2023-06-01"}, []partitionKeyRange{
+			{Key: "ds", Min: "2021-01-01", Max: "2023-06-01", Days: 882},
+		}},
+		{"compact dates", []string{"dt=20230228", "dt=20230301"}, []partitionKeyRange{
+			{Key: "dt", Min: "20230228", Max: "20230301", Days: 2},
+		}},
+		{"multi key", []string{"ds=2023-01-02/hr=03", "ds=2023-01-01/hr=23", "ds=2023-01-02/hr=9"}, []partitionKeyRange{
+			{Key: "ds", Min: "2023-01-01", Max: "2023-01-02", Days: 2},
+			// Compared as numbers, "9" is less than "23"
+			{Key: "hr", Min: "03", Max: "23"},
+		}},
+		{"strings", []string{"region=us-east/ds=2023-01-01", "region=eu-west/ds=2023-01-01"}, []partitionKeyRange{
+			{Key: "region", Min: "eu-west", Max: "us-east"},
+			{Key: "ds", Min: "2023-01-01", Max: "2023-01-01", Days: 1},
+		}},
+		{"one partition", []string{"event_date=2023-06-01"}, []partitionKeyRange{
+			{Key: "event_date", Min: "2023-06-01", Max: "2023-06-01", Days: 1},
+		}},
+		{"empty value", []string{"ds=", "ds=2023-01-01"}, []partitionKeyRange{
+			{Key: "ds", Min: "", Max: "2023-01-01"},
+		}},
+		{"opaque ids", []string{"2023-01-01", "2023-01-02"}, nil},
+		{"no key", []string{"=2023-01-01"}, nil},
+		{"mixed keys", []string{"ds=2023-01-01", "dt=2023-01-02"}, nil},
+		{"mixed depth", []string{"ds=2023-01-01/hr=01", "ds=2023-01-01"}, nil},
+		{"some opaque", []string{"ds=2023-01-01", "<bucket 3>"}, nil},
+		{"none", nil, nil},
+	} {
+		got, ok := partitionRanges(tc.ids)
+		if ok != (tc.want != nil) || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: got %+v, %v, want %+v", tc.name, got, ok, tc.want)
+		}
+	}
+}
+
+func TestPartitionHints(t *testing.T) {
+	clicks := PrestoInput{ConnectorID: "hive", Schema: "events", Table: "clicks"}
+	clicks.ConnectorInfo.PartitionIds = []string{"ds=2021-01-01/hr=00", "ds=2023-06-01/hr=23"}
+	opaque := PrestoInput{ConnectorID: "hive", Schema: "events", Table: "buckets"}
+	opaque.ConnectorInfo.PartitionIds = []string{"<bucket 1>", "<bucket 2>"}
+	single := PrestoInput{ConnectorID: "hive", Schema: "events", Table: "views"}
+	single.ConnectorInfo.PartitionIds = []string{"date=2023-01-01"}
+
+	for _, tc := range []struct {
+		inputs []PrestoInput
+		want   string
+	}{
+		{[]PrestoInput{clicks}, "`hive.events.clicks` is partitioned by `ds`, `hr`, add a filter on `ds`. It's scanning `ds` from 2021-01-01 to 2023-06-01 (882 days)."},
+		{[]PrestoInput{single}, "`hive.events.views` is partitioned by `date`, add a filter on `date`. It's scanning `date` 2023-01-01."},
+		// Unreadable partition IDs fall back to the count-only alert
+		{[]PrestoInput{opaque}, "Make sure your query filters on the partition columns of the tables it reads!"},
+		{[]PrestoInput{opaque, single}, "`hive.events.views` is partitioned by `date`, add a filter on `date`. It's scanning `date` 2023-01-01."},
+	} {
+		if got := partitionHints(tc.inputs); got != tc.want {
+			t.Errorf("got hint %q, want %q", got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/thecubed/prestowatcher/config"
+	"github.com/thecubed/prestowatcher/prestoclient"
+)
+
+/*
+	Everything that talks to Presto goes through the presto client, so TLS settings, credentials and the
+	user header are applied the same way to polls and kills. Every cluster has its own client. The flavor
+	(Presto or Trino) is decided once at startup, from --flavor or by asking the coordinator.
+
+	Clusters only see the client through prestoAPI, so the checks can be run against a fake Presto.
+*/
+
+// prestoAPI is the part of the Presto client the watcher uses
+type prestoAPI interface {
+	ListQueries(ctx context.Context, state string) ([]PrestoQuery, error)
+	GetQuery(ctx context.Context, id string) (PrestoQuery, error)
+	KillQuery(ctx context.Context, id string) error
+	Version(ctx context.Context) (string, error)
+}
+
+// newPrestoClient builds the client for a cluster from the command line options
+func newPrestoClient(cluster config.Cluster) *prestoclient.Client {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.PrestoInsecureSkipVerify}
+	if cfg.PrestoCACert != "" {
+		pem, err := ioutil.ReadFile(cfg.PrestoCACert)
+		if err != nil {
+			log.Fatalf("Unable to read Presto CA certificate [%v]: %v", cfg.PrestoCACert, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates found in Presto CA certificate [%v]", cfg.PrestoCACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.PrestoInsecureSkipVerify {
+		log.Warning("Not verifying the Presto TLS certificate")
+	}
+
+	presto := prestoclient.New(cluster.URL, &http.Client{
+		Timeout: cfg.PrestoTimeout,
+		Transport: &tracingTransport{
+			name: "presto",
+			base: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+	})
+	presto.Flavor = cfg.Flavor
+	if cfg.Flavor == config.FLAVOR_AUTO {
+		flavor, version, err := presto.DetectFlavor(context.Background())
+		if err != nil {
+			log.Warningf("Unable to detect the flavor of coordinator [%v], assuming [%v]: %v", cluster.URL, prestoclient.FLAVOR_PRESTO, explainPrestoError(err))
+			flavor = prestoclient.FLAVOR_PRESTO
+		} else {
+			log.Infof("Coordinator [%v] is version [%v], using the [%v] flavor", cluster.URL, version, flavor)
+		}
+		presto.Flavor = flavor
+	}
+	presto.User = cfg.PrestoUser
+	if presto.User == "" {
+		presto.User = APP_NAME
+	}
+	presto.Password = cfg.PrestoPassword
+	presto.Token = cfg.PrestoToken
+	return presto
+}
+
+// explainPrestoError adds which options to look at to a 401 from Presto
+func explainPrestoError(err error) error {
+	authErr, ok := err.(*prestoclient.AuthError)
+	if !ok {
+		return err
+	}
+	if !authErr.HasCredentials {
+		return fmt.Errorf("%v, set --presto-user and --presto-password or --presto-token", authErr)
+	}
+	return fmt.Errorf("%v, check --presto-password or --presto-token", authErr)
+}
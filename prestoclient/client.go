@@ -0,0 +1,160 @@
+// Package prestoclient talks to the Presto coordinator's query API.
+//
+// It knows nothing about thresholds or alerting, so the watcher's decision logic can be pointed at any base
+// URL, including a test server.
+package prestoclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// The query is no longer known to Presto, usually because it finished between the overview and the detail fetch
+var ErrQueryGone = errors.New("query is gone")
+
+// AuthError is a 401 from Presto
+type AuthError struct {
+	User string
+	// Whether we sent credentials at all
+	HasCredentials bool
+}
+
+func (e *AuthError) Error() string {
+	if !e.HasCredentials {
+		return "Presto requires authentication (401)"
+	}
+	return fmt.Sprintf("Presto rejected our credentials (401) for user [%v]", e.User)
+}
+
+// StatusError is any other non-2xx response from Presto
+type StatusError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Presto returned [%v] for [%v %v]: %s", e.Status, e.Method, e.Path, e.Body)
+}
+
+type Client struct {
+	// Presto URL including scheme and port, without a trailing slash
+	BaseURL string
+	HTTP    *http.Client
+	// FLAVOR_PRESTO or FLAVOR_TRINO, Presto when empty
+	Flavor string
+	// Sent as X-Presto-User (or X-Trino-User) and used for basic auth
+	User     string
+	Password string
+	// Bearer token, used instead of basic auth when set
+	Token string
+}
+
+func New(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/"), HTTP: httpClient}
+}
+
+// newRequest builds a request carrying ctx, so cancelling it or tracing it reaches the HTTP client
+func (c *Client) newRequest(ctx context.Context, method string, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(c.userHeader(), c.User)
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	} else if c.Password != "" {
+		req.SetBasicAuth(c.User, c.Password)
+	}
+	return req, nil
+}
+
+// do sends a request and checks the response status, returning the body of a successful response
+func (c *Client) do(ctx context.Context, method string, path string) ([]byte, error) {
+	req, err := c.newRequest(ctx, method, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response from Presto: %v", err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrQueryGone
+	case resp.StatusCode == http.StatusUnauthorized:
+		return nil, &AuthError{User: c.User, HasCredentials: c.Token != "" || c.Password != ""}
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, &StatusError{Method: method, Path: path, StatusCode: resp.StatusCode, Status: resp.Status, Body: snippet(body)}
+	}
+	return body, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, v interface{}) error {
+	body, err := c.do(ctx, "GET", path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("unable to parse response from Presto for [%v]: %v: %s", path, err, snippet(body))
+	}
+	return nil
+}
+
+// ListQueries returns the overview of all queries in a state, e.g. running or queued
+func (c *Client) ListQueries(ctx context.Context, state string) ([]Query, error) {
+	var queries []Query
+	if err := c.getJSON(ctx, "/v1/query?state="+state, &queries); err != nil {
+		return nil, err
+	}
+	for i := range queries {
+		queries[i].normalize()
+	}
+	return queries, nil
+}
+
+func (c *Client) ListRunningQueries(ctx context.Context) ([]Query, error) {
+	return c.ListQueries(ctx, "running")
+}
+
+// GetQuery returns the full detail of a query, including its inputs
+func (c *Client) GetQuery(ctx context.Context, id string) (Query, error) {
+	var query Query
+	err := c.getJSON(ctx, "/v1/query/"+id, &query)
+	query.normalize()
+	return query, err
+}
+
+// KillQuery cancels a query
+func (c *Client) KillQuery(ctx context.Context, id string) error {
+	_, err := c.do(ctx, "DELETE", "/v1/query/"+id)
+	return err
+}
+
+// snippet returns the start of a response body for error messages
+func snippet(body []byte) string {
+	const max = 200
+	if len(body) > max {
+		return string(body[:max]) + "..."
+	}
+	return string(body)
+}
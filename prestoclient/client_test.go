@@ -0,0 +1,186 @@
+package prestoclient
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// fixtureServer serves the recorded coordinator responses in testdata, keyed by request path and query
+func fixtureServer(t *testing.T, routes map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fixture, ok := routes[r.Method+" "+r.URL.RequestURI()]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		body, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+		if err != nil {
+			t.Fatalf("reading fixture %v: %v", fixture, err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+}
+
+func TestListRunningQueries(t *testing.T) {
+	server := fixtureServer(t, map[string]string{"GET /v1/query?state=running": "overview.json"})
+	defer server.Close()
+
+	queries, err := New(server.URL, nil).ListRunningQueries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 2 {
+		t.Fatalf("got %v queries, want 2", len(queries))
+	}
+	q := queries[0]
+	if q.QueryID != "20230102_101112_00042_abcde" || q.State != "RUNNING" || q.Session.User != "mode" || q.Session.Source != "mode" {
+		t.Errorf("unexpected overview query %+v", q)
+	}
+	if len(q.ResourceGroupID) != 2 || q.ResourceGroupID[1] != "adhoc" {
+		t.Errorf("got resource group %v, want [global adhoc]", q.ResourceGroupID)
+	}
+	if q.QueryStats.CreateTime != "2023-01-02T10:11:12.345Z" || q.QueryStats.ElapsedTime != "1.45m" || q.QueryStats.TotalDrivers != 1830 {
+		t.Errorf("unexpected query stats %+v", q.QueryStats)
+	}
+	if len(q.Inputs) != 0 {
+		t.Errorf("the overview has no inputs, got %v", q.Inputs)
+	}
+	if queries[1].State != "QUEUED" {
+		t.Errorf("got state %v for the second query, want QUEUED", queries[1].State)
+	}
+}
+
+func TestGetQueryTruncatedPartitions(t *testing.T) {
+	server := fixtureServer(t, map[string]string{"GET /v1/query/20230102_101112_00042_abcde": "query_truncated.json"})
+	defer server.Close()
+
+	q, err := New(server.URL, nil).GetQuery(context.Background(), "20230102_101112_00042_abcde")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Inputs) != 2 {
+		t.Fatalf("got %v inputs, want 2", len(q.Inputs))
+	}
+	hive := q.Inputs[0]
+	if hive.ConnectorID != "hive" || hive.Schema != "events" || hive.Table != "clicks" {
+		t.Errorf("unexpected input %+v", hive)
+	}
+	if !hive.ConnectorInfo.Truncated || len(hive.ConnectorInfo.PartitionIds) != 5 || hive.ConnectorInfo.PartitionIds[4] != "ds=2023-01-01" {
+		t.Errorf("unexpected connector info %+v", hive.ConnectorInfo)
+	}
+	// Newer coordinators only send catalogName
+	if q.Inputs[1].ConnectorID != "mysql" {
+		t.Errorf("got connector %q for the catalogName input, want mysql", q.Inputs[1].ConnectorID)
+	}
+	if q.QueryStats.TotalSplits != 1830 || q.QueryStats.PhysicalInputDataSize != "3.2GB" {
+		t.Errorf("unexpected query stats %+v", q.QueryStats)
+	}
+	if q.UpdateType != "" {
+		t.Errorf("got update type %q for a SELECT", q.UpdateType)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/query/gone":
+			http.NotFound(w, r)
+		case "/v1/query/auth":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"message":"Server is shutting down"}`))
+		}
+	}))
+	defer server.Close()
+	client := New(server.URL, nil)
+
+	_, err := client.ListRunningQueries(context.Background())
+	statusErr, ok := err.(*StatusError)
+	if !ok {
+		t.Fatalf("got %#v for a 500, want a *StatusError", err)
+	}
+	if statusErr.StatusCode != 500 || statusErr.Method != "GET" || statusErr.Path != "/v1/query?state=running" || statusErr.Body != `{"message":"Server is shutting down"}` {
+		t.Errorf("unexpected status error %+v", statusErr)
+	}
+
+	if _, err := client.GetQuery(context.Background(), "gone"); err != ErrQueryGone {
+		t.Errorf("got %v for a 404, want ErrQueryGone", err)
+	}
+
+	client.User = "watcher"
+	client.Password = "secret"
+	_, err = client.GetQuery(context.Background(), "auth")
+	if authErr, ok := err.(*AuthError); !ok || !authErr.HasCredentials || authErr.User != "watcher" {
+		t.Errorf("got %#v for a 401, want an *AuthError with credentials", err)
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("got a request for %v with a cancelled context", r.URL)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := New(server.URL, nil).GetQuery(ctx, "q1"); err == nil {
+		t.Error("the request went through with a cancelled context")
+	}
+}
+
+func TestRequestHeaders(t *testing.T) {
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		flavor string
+		token  string
+		header string
+		auth   string
+	}{
+		{FLAVOR_PRESTO, "", "X-Presto-User", "Basic d2F0Y2hlcjpzZWNyZXQ="},
+		{FLAVOR_TRINO, "", "X-Trino-User", "Basic d2F0Y2hlcjpzZWNyZXQ="},
+		{FLAVOR_PRESTO, "tok", "X-Presto-User", "Bearer tok"},
+	} {
+		client := New(server.URL+"/", nil)
+		client.Flavor, client.User, client.Password, client.Token = tc.flavor, "watcher", "secret", tc.token
+		if _, err := client.ListRunningQueries(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got.Header.Get(tc.header) != "watcher" || got.Header.Get("Authorization") != tc.auth {
+			t.Errorf("%v: got headers %v", tc.flavor, got.Header)
+		}
+	}
+}
+
+func TestDataSize(t *testing.T) {
+	for _, tc := range []struct {
+		json string
+		want DataSize
+	}{
+		{`"1.25GB"`, "1.25GB"},
+		{`123456789`, "123456789"},
+		{`1.5e9`, "1.5e9"},
+		{`""`, ""},
+	} {
+		var d DataSize
+		if err := json.Unmarshal([]byte(tc.json), &d); err != nil || d != tc.want {
+			t.Errorf("unmarshalling %v got %q, %v, want %q", tc.json, d, err, tc.want)
+		}
+	}
+	var d DataSize
+	if err := json.Unmarshal([]byte(`{"bytes":1}`), &d); err == nil {
+		t.Errorf("unmarshalling an object got %q", d)
+	}
+}
@@ -0,0 +1,62 @@
+package prestoclient
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// Coordinator flavors. Trino (formerly PrestoSQL, renamed in version 351) uses X-Trino-User and its own UI paths.
+const (
+	FLAVOR_PRESTO = "presto"
+	FLAVOR_TRINO  = "trino"
+)
+
+// The first Trino release, older PrestoSQL releases still speak the Presto protocol
+const TRINO_FIRST_VERSION = 351
+
+type serverInfo struct {
+	NodeVersion struct {
+		Version string `json:"version"`
+	} `json:"nodeVersion"`
+}
+
+// userHeader is the header that names the user for the client's flavor
+func (c *Client) userHeader() string {
+	if c.Flavor == FLAVOR_TRINO {
+		return "X-Trino-User"
+	}
+	return "X-Presto-User"
+}
+
+// DetectFlavor asks the coordinator for its version. PrestoDB versions look like 0.2xx, PrestoSQL and Trino
+// versions are plain numbers, with the Trino protocol from TRINO_FIRST_VERSION on.
+func (c *Client) DetectFlavor(ctx context.Context) (flavor string, version string, err error) {
+	version, err = c.Version(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	major, err := strconv.Atoi(strings.SplitN(version, "-", 2)[0])
+	if err == nil && major >= TRINO_FIRST_VERSION {
+		return FLAVOR_TRINO, version, nil
+	}
+	return FLAVOR_PRESTO, version, nil
+}
+
+// normalize fills in fields that newer coordinators name differently
+func (q *Query) normalize() {
+	for i := range q.Inputs {
+		if q.Inputs[i].ConnectorID == "" {
+			q.Inputs[i].ConnectorID = q.Inputs[i].CatalogName
+		}
+	}
+}
+
+// Version asks the coordinator's /v1/info for its version, e.g. "0.215" or "351"
+func (c *Client) Version(ctx context.Context) (string, error) {
+	var info serverInfo
+	if err := c.getJSON(ctx, "/v1/info", &info); err != nil {
+		return "", err
+	}
+	return info.NodeVersion.Version, nil
+}
@@ -0,0 +1,78 @@
+package prestoclient
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// Query is used twice - once for the low-detail version on the overview page of all queries, and again in the
+// full-detail version. We simply parse the query again to get the additional detail we need.
+type Query struct {
+	Query      string `json:"query"`
+	QueryID    string `json:"queryId"`
+	State      string `json:"state"`
+	UpdateType string `json:"updateType"`
+	Session    struct {
+		User   string `json:"user"`
+		Source string `json:"source"`
+		// Free-form, set by clients like Airflow or the JDBC driver
+		ClientInfo string `json:"clientInfo"`
+	} `json:"session"`
+	ResourceGroupID []string `json:"resourceGroupId"`
+	QueryStats      struct {
+		CreateTime             string   `json:"createTime"`
+		ElapsedTime            string   `json:"elapsedTime"`
+		RawInputDataSize       string   `json:"rawInputDataSize"`
+		ProcessedInputDataSize string   `json:"processedInputDataSize"`
+		PhysicalInputDataSize  DataSize `json:"physicalInputDataSize"`
+		TotalDrivers           int64    `json:"totalDrivers"`
+		// Not every version reports splits, totalDrivers is the closest thing then
+		TotalSplits int64 `json:"totalSplits"`
+	} `json:"queryStats"`
+	Inputs []Input `json:"inputs"`
+	// Why a FAILED query failed, empty otherwise. failureInfo is only in the full-detail version.
+	ErrorType string `json:"errorType"`
+	ErrorCode struct {
+		Code int    `json:"code"`
+		Name string `json:"name"`
+		Type string `json:"type"`
+	} `json:"errorCode"`
+	FailureInfo struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"failureInfo"`
+}
+
+type Input struct {
+	ConnectorID string `json:"connectorId"`
+	// Trino calls the connector ID catalogName, normalize copies it into ConnectorID
+	CatalogName   string        `json:"catalogName"`
+	Schema        string        `json:"schema"`
+	Table         string        `json:"table"`
+	ConnectorInfo ConnectorInfo `json:"connectorInfo"`
+}
+
+type ConnectorInfo struct {
+	PartitionIds []string `json:"partitionIds"`
+	Truncated    bool     `json:"truncated"`
+}
+
+// DataSize is a size as Presto reports it, either formatted like "1.25GB" or a plain number of bytes
+type DataSize string
+
+func (d *DataSize) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*d = DataSize(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	if _, err := strconv.ParseFloat(string(n), 64); err != nil {
+		return err
+	}
+	*d = DataSize(n)
+	return nil
+}
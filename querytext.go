@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ashwanthkumar/slack-go-webhook"
+)
+
+/*
+	The start of the query's SQL, shown in Slack alerts as a code block. By the time someone clicks through to the
+	Presto UI the query is often gone, and the SQL is what tells them which of their reports it was.
+
+	The snippet is cut to --query-text-length characters on a rune boundary, with an ellipsis and the full length
+	appended. --query-text-compact drops the comment lines and collapses whitespace first, so more of the query
+	fits. Runs of backticks are broken up so the SQL can't end the code block early, and &, < and > are escaped
+	as Slack requires. --no-query-text leaves the SQL out entirely.
+*/
+
+// Breaks up backtick runs so Slack doesn't read them as the end of the code block
+const ZERO_WIDTH_SPACE = "\u200b"
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "`", "`"+ZERO_WIDTH_SPACE)
+
+// compactSQL drops the lines that are only a -- comment and collapses all whitespace to single spaces
+func compactSQL(sql string) string {
+	var lines []string
+	for _, line := range strings.Split(sql, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(strings.Fields(strings.Join(lines, "\n")), " ")
+}
+
+// truncateSQL cuts the SQL to max runes, noting how long it was when it had to be cut
+func truncateSQL(sql string, max int) string {
+	total := utf8.RuneCountInString(sql)
+	if total <= max {
+		return sql
+	}
+	n := 0
+	for i := range sql {
+		if n == max {
+			return fmt.Sprintf("%v… (%v characters)", sql[:i], total)
+		}
+		n++
+	}
+	return sql
+}
+
+// querySnippet is the SQL as shown in Slack, empty with --no-query-text or when there's no SQL
+func querySnippet(sql string) string {
+	if cfg.NoQueryText {
+		return ""
+	}
+	if cfg.QueryTextCompact {
+		sql = compactSQL(sql)
+	}
+	sql = strings.TrimSpace(sql)
+	if sql == "" {
+		return ""
+	}
+	return truncateSQL(sql, cfg.QueryTextLength)
+}
+
+// querySnippetAttachment shows the query's SQL in a code block, ok is false when there's nothing to show
+func querySnippetAttachment(query PrestoQuery) (attachment slack.Attachment, ok bool) {
+	snippet := querySnippet(query.Query)
+	if snippet == "" {
+		return attachment, false
+	}
+	text := "```" + slackEscaper.Replace(snippet) + "```"
+	markdown := []string{"text"}
+	attachment.Fallback = &snippet
+	attachment.Text = &text
+	attachment.MarkdownIn = &markdown
+	return attachment, true
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+/*
+	Queries stuck in QUEUED, usually because something else is starving their resource group. We remember when
+	each queued query was first seen in the query cache and alert once when it has waited longer than
+	--max-queue-time.
+*/
+
+// checkQueued alerts on the queued queries that have waited too long
+func checkQueued(ctx context.Context, c *cluster, queued []PrestoQuery, now time.Time) {
+	for _, query := range queued {
+		if query.State != "QUEUED" {
+			continue
+		}
+		entry, _ := c.cache.Get(query.QueryID)
+		if entry.QueuedSince.IsZero() {
+			entry.QueuedSince = now
+		}
+		waited := now.Sub(entry.QueuedSince)
+		if waited > cfg.MaxQueueTime && !entry.QueueAlerted {
+			entry.QueueAlerted = true
+			log.Warningf("%vQuery [%v] by user [%v] has been queued for [%v]", c.prefix(), query.QueryID, query.Session.User, formatDuration(waited))
+			c.metrics.IncrCounter(metricKey("queued_alerts"), 1.0)
+			notify(ctx, Alert{Cluster: c, Query: query, QueuedFor: waited})
+			record := newAuditRecord(query, queryDecision{QueryID: query.QueryID, User: query.Session.User, Decision: DECISION_ALERTED}, now)
+			audit.record(record)
+			events.publish(c, record)
+		}
+		c.cache.Set(query.QueryID, entry)
+	}
+}
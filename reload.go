@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/thecubed/prestowatcher/config"
+)
+
+/*
+	With --config, the file is re-read on SIGHUP through the same parsing as at startup, with the file as the
+	only source, and the thresholds in config.Reloadable it changed are applied. Options a flag or an env var
+	overrode at startup keep their value, and a file that doesn't validate is ignored. Everything else needs a
+	restart.
+
+	The collectors hold cfgLock for reading while they poll, so a reload only happens between polls.
+*/
+
+var cfgLock sync.RWMutex
+
+// startConfigReload reloads --config on SIGHUP
+func startConfigReload() {
+	if cfg.ConfigFile == "" {
+		return
+	}
+	loaded, err := config.LoadFile(cfg.ConfigFile)
+	if err != nil {
+		log.Errorf("Config file [%v] can't be reloaded: %v", cfg.ConfigFile, err)
+		return
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Infof("Received SIGHUP, reloading config file [%v]", cfg.ConfigFile)
+			loaded = reloadConfig(loaded)
+		}
+	}()
+}
+
+// reloadConfig applies what changed in the config file since it was loaded, returning the file as it is now
+func reloadConfig(loaded config.Config) config.Config {
+	now, err := config.LoadFile(cfg.ConfigFile)
+	if err != nil {
+		log.Errorf("Unable to reload config file, keeping the current options: %v", err)
+		return loaded
+	}
+	cfgLock.Lock()
+	changed, err := config.Reload(&cfg, loaded, now)
+	cfgLock.Unlock()
+	if err != nil {
+		log.Errorf("Unable to reload config file [%v], keeping the current options: %v", cfg.ConfigFile, err)
+		return loaded
+	}
+	if len(changed) == 0 {
+		log.Infof("No reloadable options changed in config file [%v]", cfg.ConfigFile)
+	} else {
+		log.Infof("Reloaded [%v] from config file [%v]", strings.Join(changed, ", "), cfg.ConfigFile)
+	}
+	return now
+}
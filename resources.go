@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thecubed/prestowatcher/config"
+)
+
+/*
+	Bytes scanned and runtime limits, for the queries that hit one giant partition or run for hours. Presto's
+	query detail reports both as human-readable strings (e.g. "1.25GB" and "3.20h"), which are parsed here.
+	Splits and physical input size catch huge scans of unpartitioned tables, which the partition count misses;
+	depending on the version the input size is a formatted string or a plain number of bytes.
+	Each limit alerts at most once per query, but is checked on every re-check since they all only grow.
+*/
+
+var prestoDurationPattern = regexp.MustCompile(`^\s*([0-9.]+)\s*([a-z]+)\s*$`)
+
+var prestoDurationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+}
+
+// parsePrestoDuration parses an airlift Duration as found in Presto's JSON, e.g. "1.50m"
+func parsePrestoDuration(s string) (time.Duration, error) {
+	m := prestoDurationPattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid duration '%v'", s)
+	}
+	unit, ok := prestoDurationUnits[m[2]]
+	if !ok {
+		return 0, fmt.Errorf("unknown duration unit in '%v'", s)
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(v * float64(unit)), nil
+}
+
+// queryResources returns how much a query has scanned and how long it has been running, zero when unknown
+func queryResources(query PrestoQuery) (scanned int64, runtime time.Duration) {
+	size := query.QueryStats.RawInputDataSize
+	if size == "" {
+		size = query.QueryStats.ProcessedInputDataSize
+	}
+	if size != "" {
+		if b, err := config.ParseDataSize(size); err == nil {
+			scanned = b
+		} else {
+			log.Debugf("Query [%v] has an unreadable input data size: %v", query.QueryID, err)
+		}
+	}
+	if query.QueryStats.ElapsedTime != "" {
+		if d, err := parsePrestoDuration(query.QueryStats.ElapsedTime); err == nil {
+			runtime = d
+		} else {
+			log.Debugf("Query [%v] has an unreadable elapsed time: %v", query.QueryID, err)
+		}
+	}
+	return scanned, runtime
+}
+
+// queryScale returns how many splits a query has and how much physical input it has read, zero when unknown
+func queryScale(query PrestoQuery) (splits int64, input int64) {
+	splits = query.QueryStats.TotalSplits
+	if splits == 0 {
+		splits = query.QueryStats.TotalDrivers
+	}
+	if size := string(query.QueryStats.PhysicalInputDataSize); size != "" {
+		if b, err := config.ParseDataSize(size); err == nil {
+			input = b
+		} else {
+			log.Debugf("Query [%v] has an unreadable physical input data size: %v", query.QueryID, err)
+		}
+	}
+	return splits, input
+}
+
+// formatBytes renders a byte count for humans
+func formatBytes(b int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	v := float64(b)
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", b)
+	}
+	return fmt.Sprintf("%.1f %v", v, units[i])
+}
+
+// formatDuration renders a runtime for humans
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Second).String()
+}
+
+// resourceBreaches returns the bytes scanned, runtime, splits and input size limits the query newly went over,
+// marking them as alerted in entry
+func resourceBreaches(ev evaluation, entry *cachedQuery) []string {
+	var breaches []string
+	if cfg.MaxBytes > 0 && ev.ScannedBytes > cfg.MaxBytes && !entry.BytesAlerted {
+		entry.BytesAlerted = true
+		breaches = append(breaches, fmt.Sprintf("it has scanned %v, over the limit of %v", formatBytes(ev.ScannedBytes), formatBytes(cfg.MaxBytes)))
+	}
+	if cfg.MaxRuntime > 0 && ev.Runtime > cfg.MaxRuntime && !entry.RuntimeAlerted {
+		entry.RuntimeAlerted = true
+		breaches = append(breaches, fmt.Sprintf("it has been running for %v, over the limit of %v", formatDuration(ev.Runtime), formatDuration(cfg.MaxRuntime)))
+	}
+	if cfg.MaxSplits > 0 && ev.Splits > cfg.MaxSplits && !entry.SplitsAlerted {
+		entry.SplitsAlerted = true
+		breaches = append(breaches, fmt.Sprintf("it has %v splits, over the limit of %v", ev.Splits, cfg.MaxSplits))
+	}
+	if cfg.MaxInputBytes > 0 && ev.InputBytes > cfg.MaxInputBytes && !entry.InputSizeAlerted {
+		entry.InputSizeAlerted = true
+		breaches = append(breaches, fmt.Sprintf("it has read %v of physical input, over the limit of %v", formatBytes(ev.InputBytes), formatBytes(cfg.MaxInputBytes)))
+	}
+	return breaches
+}
+
+// breachText joins breaches into a sentence
+func breachText(breaches []string) string {
+	return strings.Join(breaches, " and ")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/thecubed/prestowatcher/prestoclient"
+)
+
+/*
+	Presto and Slack requests are retried up to --retry-attempts times with exponential backoff and jitter, but
+	only when another try might help: network errors, 429s and 5xxs. A 404 or 401 from Presto, or a bad
+	response body, fails straight away. When a notifier endpoint sends Retry-After, that's the wait instead.
+
+	Each retried call gives up early rather than sleep past a third of --interval, so a query check that
+	fetches the query and then alerts on it stays below the poll interval even when both calls retry.
+*/
+
+const (
+	RETRY_TARGET_PRESTO = "presto"
+	RETRY_TARGET_SLACK  = "slack"
+
+	// Wait before the second attempt, doubled for every one after it
+	RETRY_BASE_DELAY = 500 * time.Millisecond
+)
+
+func init() {
+	// Otherwise every replica jitters the same way
+	rand.Seed(time.Now().UnixNano())
+}
+
+// httpStatusError is a non-2xx response from a notifier endpoint
+type httpStatusError struct {
+	StatusCode int
+	Status     string
+	Body       string
+	// How long the endpoint asked us to wait before trying again, 0 if it didn't say
+	RetryAfter time.Duration
+}
+
+func (e *httpStatusError) Error() string {
+	return "got [" + e.Status + "] " + e.Body
+}
+
+// retry calls fn until it succeeds, fails with an error that isn't worth retrying, or runs out of attempts or time
+func retry(target string, what string, fn func() error) error {
+	deadline := time.Now().Add(cfg.UpdateInterval.Duration / 3)
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= cfg.RetryAttempts || !retryable(err) {
+			return err
+		}
+		wait := backoff(attempt)
+		if e, ok := err.(*httpStatusError); ok && e.RetryAfter > 0 {
+			wait = e.RetryAfter
+		}
+		if time.Now().Add(wait).After(deadline) {
+			log.Debugf("Not retrying [%v] %v after attempt [%v], the next one would be too late: %v", target, what, attempt, err)
+			return err
+		}
+		log.Debugf("Retrying [%v] %v in [%v] after attempt [%v] of [%v] failed: %v", target, what, wait, attempt, cfg.RetryAttempts, err)
+		metricsSink.IncrCounterWithLabels(
+			metricKey("retries"),
+			1.0,
+			[]metrics.Label{
+				{
+					Name:  "target",
+					Value: target,
+				},
+			},
+		)
+		time.Sleep(wait)
+	}
+}
+
+// backoff is the wait after a failed attempt: the base delay doubled per attempt, with the upper half jittered
+func backoff(attempt int) time.Duration {
+	d := RETRY_BASE_DELAY << uint(attempt-1)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryable is true for errors another attempt might get past
+func retryable(err error) bool {
+	switch e := err.(type) {
+	case *prestoclient.StatusError:
+		return retryableStatus(e.StatusCode)
+	case *httpStatusError:
+		return retryableStatus(e.StatusCode)
+	case net.Error:
+		// Includes the *url.Error the HTTP client returns for timeouts and refused connections
+		return true
+	}
+	return false
+}
+
+// retryAfter reads the Retry-After header of a response, in seconds as Slack sends it
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/thecubed/prestowatcher/config"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+	Per-table partition limits from a YAML (or JSON) rules file, e.g.
+
+		rules:
+		  - table: hive.events.*
+		    max_partitions: 90
+		  - table: hive.hourly.*
+		    query_type: read
+		    max_partitions: 24
+
+	Rules are matched against connector.schema.table in file order and the first match wins. Tables that match
+	no rule fall back to --maxpart / --maxpart-write. The file is re-read on SIGHUP and whenever it changes.
+
+	The file can also set the severity tier multipliers, overriding --critical-multiplier and
+	--emergency-multiplier:
+
+		severity:
+		  critical_multiplier: 5
+		  emergency_multiplier: 20
+*/
+
+type Rule struct {
+	// Glob pattern matched against connector.schema.table
+	Table string `yaml:"table" json:"table"`
+	// Only match queries of this type (read or write), any type when empty
+	QueryType     string `yaml:"query_type" json:"query_type"`
+	MaxPartitions int    `yaml:"max_partitions" json:"max_partitions"`
+}
+
+// Severity tier multipliers, 0 leaves the command line value in effect
+type SeverityMultipliers struct {
+	Critical  float64 `yaml:"critical_multiplier" json:"critical_multiplier"`
+	Emergency float64 `yaml:"emergency_multiplier" json:"emergency_multiplier"`
+}
+
+type RulesFile struct {
+	Rules    []Rule              `yaml:"rules" json:"rules"`
+	Severity SeverityMultipliers `yaml:"severity" json:"severity"`
+}
+
+// The partition limit that applies to an input and where it came from
+type appliedLimit struct {
+	Max int
+	// The rule pattern that set the limit, empty for the global default
+	Rule string
+}
+
+func (l appliedLimit) String() string {
+	if l.Rule == "" {
+		return fmt.Sprintf("%v (default)", l.Max)
+	}
+	return fmt.Sprintf("%v (rule %v)", l.Max, l.Rule)
+}
+
+type ruleSet struct {
+	sync.RWMutex
+	path        string
+	modTime     time.Time
+	rules       []Rule
+	severity    SeverityMultipliers
+	fingerprint string
+}
+
+var rules = &ruleSet{}
+
+func parseRules(data []byte) (RulesFile, error) {
+	var f RulesFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return f, err
+	}
+	for i, r := range f.Rules {
+		if r.Table == "" {
+			return f, fmt.Errorf("rule %v has no table pattern", i+1)
+		}
+		if _, err := path.Match(r.Table, ""); err != nil {
+			return f, fmt.Errorf("rule %v has a bad table pattern '%v': %v", i+1, r.Table, err)
+		}
+		if r.QueryType != "" && r.QueryType != QUERY_TYPE_READ && r.QueryType != QUERY_TYPE_WRITE {
+			return f, fmt.Errorf("rule %v has unknown query type '%v'", i+1, r.QueryType)
+		}
+		if r.MaxPartitions <= 0 {
+			return f, fmt.Errorf("rule %v for '%v' needs a positive max_partitions", i+1, r.Table)
+		}
+	}
+	if f.Severity.Critical < 0 || f.Severity.Emergency < 0 {
+		return f, fmt.Errorf("severity multipliers must not be negative")
+	}
+	if f.Severity.Critical > 0 || f.Severity.Emergency > 0 {
+		critical, emergency := effectiveMultipliers(f.Severity)
+		if err := config.CheckSeverityMultipliers(critical, emergency); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+// load (re)reads the rules file. On error the previous rules stay in effect.
+func (rs *ruleSet) load() error {
+	stat, err := os.Stat(rs.path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(rs.path)
+	if err != nil {
+		return err
+	}
+	parsed, err := parseRules(data)
+	if err != nil {
+		return err
+	}
+	sum := sha1.Sum(data)
+
+	rs.Lock()
+	defer rs.Unlock()
+	rs.rules = parsed.Rules
+	rs.severity = parsed.Severity
+	rs.modTime = stat.ModTime()
+	rs.fingerprint = hex.EncodeToString(sum[:6])
+	log.Infof("Loaded [%v] partition rules from [%v]", len(parsed.Rules), rs.path)
+	return nil
+}
+
+// reloadIfChanged re-reads the rules file if its modification time changed
+func (rs *ruleSet) reloadIfChanged() {
+	stat, err := os.Stat(rs.path)
+	if err != nil {
+		log.Errorf("Unable to check rules file [%v]: %v", rs.path, err)
+		return
+	}
+	rs.RLock()
+	changed := !stat.ModTime().Equal(rs.modTime)
+	rs.RUnlock()
+	if changed {
+		if err := rs.load(); err != nil {
+			log.Errorf("Unable to reload rules file [%v], keeping the previous rules: %v", rs.path, err)
+		}
+	}
+}
+
+// limitFor returns the partition limit for an input of a query of the given type
+func (rs *ruleSet) limitFor(input PrestoInput, qType string) appliedLimit {
+	table := tableName(input)
+	rs.RLock()
+	defer rs.RUnlock()
+	for _, r := range rs.rules {
+		if r.QueryType != "" && r.QueryType != qType {
+			continue
+		}
+		if ok, _ := path.Match(r.Table, table); ok {
+			return appliedLimit{Max: r.MaxPartitions, Rule: r.Table}
+		}
+	}
+	return appliedLimit{Max: partitionLimit(qType)}
+}
+
+// multipliers returns the critical and emergency tier multipliers in effect
+func (rs *ruleSet) multipliers() (critical float64, emergency float64) {
+	rs.RLock()
+	defer rs.RUnlock()
+	return effectiveMultipliers(rs.severity)
+}
+
+// effectiveMultipliers fills in the multipliers a rules file doesn't set from the command line
+func effectiveMultipliers(m SeverityMultipliers) (critical float64, emergency float64) {
+	critical, emergency = cfg.CriticalMultiplier, cfg.EmergencyMultiplier
+	if m.Critical > 0 {
+		critical = m.Critical
+	}
+	if m.Emergency > 0 {
+		emergency = m.Emergency
+	}
+	return critical, emergency
+}
+
+// Fingerprint of the rules in effect, empty when there is no rules file
+func (rs *ruleSet) Fingerprint() string {
+	rs.RLock()
+	defer rs.RUnlock()
+	return rs.fingerprint
+}
+
+// startRules loads the rules file, if any, and reloads it on SIGHUP or when it changes on disk
+func startRules(reloadInterval time.Duration) {
+	if cfg.RulesFile == "" {
+		return
+	}
+	rules.path = cfg.RulesFile
+	if err := rules.load(); err != nil {
+		log.Fatalf("Unable to load rules file [%v]: %v", cfg.RulesFile, err)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(reloadInterval)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				log.Info("Received SIGHUP, reloading rules")
+				if err := rules.load(); err != nil {
+					log.Errorf("Unable to reload rules file [%v], keeping the previous rules: %v", rules.path, err)
+				}
+			case <-ticker.C:
+				rules.reloadIfChanged()
+			}
+		}
+	}()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	neturl "net/url"
+	"os"
+	"strings"
+
+	"github.com/ashwanthkumar/slack-go-webhook"
+	"github.com/thecubed/prestowatcher/config"
+)
+
+/*
+	The startup self-test, so a typo'd URL crash-loops with a message saying what's wrong instead of turning into
+	errors buried in the logs. Before polling starts every cluster's /v1/info is asked for its version and its
+	running queries are listed, which proves the URL, the credentials and the JSON all work. The notifier URLs
+	are checked to be absolute http(s) URLs, and a Slack webhook to have its full path with the token. With
+	--selftest-slack a short startup message goes to Slack as well, which proves the webhook or token works.
+
+	The first failed check stops the watcher with SELFTEST_EXIT_CODE, naming the check and the cluster.
+	--skip-selftest skips all of it.
+*/
+
+const SELFTEST_EXIT_CODE = 3
+
+// The Slack host whose webhook URLs we know the shape of, /services/T.../B.../token
+const SLACK_WEBHOOK_HOST = "hooks.slack.com"
+
+type selfTestError struct {
+	Check string
+	Err   error
+}
+
+func (e *selfTestError) Error() string {
+	return fmt.Sprintf("self-test [%v] failed: %v", e.Check, e.Err)
+}
+
+// runSelfTest runs the startup checks and exits if one fails
+func runSelfTest() {
+	if cfg.SkipSelfTest {
+		log.Info("Skipping the startup self-test")
+		return
+	}
+	if err := selfTest(); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(SELFTEST_EXIT_CODE)
+	}
+	log.Info("Startup self-test passed")
+}
+
+func selfTest() error {
+	if err := checkNotifierURLs(); err != nil {
+		return err
+	}
+	for _, c := range clusters {
+		var version string
+		err := retry(RETRY_TARGET_PRESTO, "server info", func() (err error) {
+			version, err = c.client.Version(context.Background())
+			return err
+		})
+		if err != nil {
+			return &selfTestError{Check: "presto-info", Err: fmt.Errorf("%vunable to get /v1/info from [%v]: %v", c.prefix(), c.url, explainPrestoError(err))}
+		}
+		log.Infof("%vPresto at [%v] is version [%v]", c.prefix(), c.url, version)
+
+		var queries []PrestoQuery
+		err = retry(RETRY_TARGET_PRESTO, "running queries", func() (err error) {
+			queries, err = c.client.ListQueries(context.Background(), "running")
+			return err
+		})
+		if err != nil {
+			return &selfTestError{Check: "presto-queries", Err: fmt.Errorf("%vunable to list the running queries on [%v]: %v", c.prefix(), c.url, explainPrestoError(err))}
+		}
+		log.Infof("%vPresto at [%v] has [%v] running queries", c.prefix(), c.url, len(queries))
+	}
+	if cfg.SelfTestSlack {
+		if err := postStartupMessage(); err != nil {
+			return &selfTestError{Check: "slack-message", Err: err}
+		}
+	}
+	return nil
+}
+
+// checkNotifierURLs catches notifier URLs that can't work, like a Slack webhook missing its token
+func checkNotifierURLs() error {
+	for _, name := range cfg.NotifierNames {
+		var check, url string
+		switch name {
+		case config.NOTIFIER_SLACK:
+			check, url = "slack-url", cfg.SlackURL
+		case config.NOTIFIER_WEBHOOK:
+			check, url = "webhook-url", cfg.WebhookURL
+		case config.NOTIFIER_PAGERDUTY:
+			check, url = "pagerduty-url", cfg.PagerDutyURL
+		}
+		if url == "" {
+			continue
+		}
+		if err := checkURL(url); err != nil {
+			return &selfTestError{Check: check, Err: err}
+		}
+	}
+	return nil
+}
+
+// checkURL checks that a URL is absolute http(s), and that a Slack webhook URL has all of its path. Only the host
+// ends up in the error, since the path of a webhook URL is its secret.
+func checkURL(url string) error {
+	u, err := neturl.Parse(url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("not an absolute http(s) URL")
+	}
+	if u.Host == SLACK_WEBHOOK_HOST {
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if len(parts) != 4 || parts[0] != "services" || parts[3] == "" {
+			return fmt.Errorf("URL for [%v] is not a whole Slack webhook URL like https://%v/services/T000/B000/XXXX", u.Host, SLACK_WEBHOOK_HOST)
+		}
+	}
+	return nil
+}
+
+// postStartupMessage tells Slack the watcher has started
+func postStartupMessage() error {
+	host, _ := os.Hostname()
+	var names []string
+	for _, c := range clusters {
+		if c.name != "" {
+			names = append(names, c.name)
+		} else {
+			names = append(names, c.url)
+		}
+	}
+	n := newSlackNotifier()
+	payload := slack.Payload{Text: fmt.Sprintf("%v %v started on host %v watching %v", APP_NAME, APP_VERSION, host, strings.Join(names, ", "))}
+	if err := n.send(n.url, payload); err != nil {
+		return fmt.Errorf("unable to post the startup message: %v", err)
+	}
+	return nil
+}
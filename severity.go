@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/thecubed/prestowatcher/config"
+)
+
+/*
+	Severity tiers, so a query scanning 3,100 partitions doesn't look like one scanning 31. A partition alert's
+	tier comes from its worst input, the one furthest over its limit:
+
+		warning    over the limit
+		critical   at --critical-multiplier times the limit or more (default 5)
+		emergency  at --emergency-multiplier times the limit or more (default 20)
+
+	The rules file can override both multipliers. The tier picks the attachment color and the emoji of the
+	alert, whether the user is @mentioned (--mention-severity), and with --critical-webhook or
+	--emergency-webhook the Slack webhook the alert goes to, emergencies going to the critical one when only
+	that is set. It's also a label on query_partition_counts and recorded in the audit log and on /status.
+*/
+
+// Darker than Slack's "danger", for the alerts that can't wait
+const EMERGENCY_COLOR = "#7f0000"
+
+// severityFor is the tier of an input scanning partitions against its limit
+func severityFor(partitions int, limit int) string {
+	critical, emergency := rules.multipliers()
+	ratio := float64(partitions) / float64(limit)
+	switch {
+	case ratio >= emergency:
+		return config.SEVERITY_EMERGENCY
+	case ratio >= critical:
+		return config.SEVERITY_CRITICAL
+	}
+	return config.SEVERITY_WARNING
+}
+
+// worstSeverity is the tier of the worst of a query's inputs that are over their limit, empty when there are none
+func worstSeverity(inputs []PrestoInput, qType string) string {
+	var worst string
+	for _, i := range inputs {
+		s := severityFor(len(i.ConnectorInfo.PartitionIds), rules.limitFor(i, qType).Max)
+		if worst == "" || severityRank(s) > severityRank(worst) {
+			worst = s
+		}
+	}
+	return worst
+}
+
+// severityRank orders the tiers, alerts without one rank as warnings
+func severityRank(severity string) int {
+	switch severity {
+	case config.SEVERITY_EMERGENCY:
+		return 2
+	case config.SEVERITY_CRITICAL:
+		return 1
+	}
+	return 0
+}
+
+func severityColor(severity string) string {
+	switch severity {
+	case config.SEVERITY_EMERGENCY:
+		return EMERGENCY_COLOR
+	case config.SEVERITY_CRITICAL:
+		return "danger"
+	}
+	return "warning"
+}
+
+func severityEmoji(severity string) string {
+	switch severity {
+	case config.SEVERITY_EMERGENCY:
+		return ":rotating_light:"
+	case config.SEVERITY_CRITICAL:
+		return ":fire:"
+	}
+	return ":bomb:"
+}
+
+// severityWebhook is the Slack webhook for alerts of a tier, empty to use the usual channels
+func severityWebhook(severity string) string {
+	switch severity {
+	case config.SEVERITY_EMERGENCY:
+		if cfg.EmergencyWebhook != "" {
+			return cfg.EmergencyWebhook
+		}
+		return cfg.CriticalWebhook
+	case config.SEVERITY_CRITICAL:
+		return cfg.CriticalWebhook
+	}
+	return ""
+}
+
+// severityMentions tells whether alerts of a tier @mention the user who ran the query
+func severityMentions(severity string) bool {
+	return severityRank(severity) >= severityRank(cfg.MentionSeverity)
+}
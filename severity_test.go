@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/thecubed/prestowatcher/config"
+)
+
+func TestSeverityFor(t *testing.T) {
+	defer setupTest()()
+	for _, tc := range []struct {
+		partitions  int
+		multipliers SeverityMultipliers
+		want        string
+	}{
+		// 5x and 20x a limit of 30
+		{31, SeverityMultipliers{}, config.SEVERITY_WARNING},
+		{149, SeverityMultipliers{}, config.SEVERITY_WARNING},
+		{150, SeverityMultipliers{}, config.SEVERITY_CRITICAL},
+		{599, SeverityMultipliers{}, config.SEVERITY_CRITICAL},
+		{600, SeverityMultipliers{}, config.SEVERITY_EMERGENCY},
+		{3100, SeverityMultipliers{}, config.SEVERITY_EMERGENCY},
+		// The rules file overrides either multiplier
+		{59, SeverityMultipliers{Critical: 2}, config.SEVERITY_WARNING},
+		{60, SeverityMultipliers{Critical: 2}, config.SEVERITY_CRITICAL},
+		{599, SeverityMultipliers{Critical: 2}, config.SEVERITY_CRITICAL},
+		{299, SeverityMultipliers{Emergency: 10}, config.SEVERITY_CRITICAL},
+		{300, SeverityMultipliers{Emergency: 10}, config.SEVERITY_EMERGENCY},
+		// Fractional multipliers
+		{44, SeverityMultipliers{Critical: 1.5, Emergency: 2.5}, config.SEVERITY_WARNING},
+		{45, SeverityMultipliers{Critical: 1.5, Emergency: 2.5}, config.SEVERITY_CRITICAL},
+		{75, SeverityMultipliers{Critical: 1.5, Emergency: 2.5}, config.SEVERITY_EMERGENCY},
+	} {
+		rules.severity = tc.multipliers
+		if got := severityFor(tc.partitions, 30); got != tc.want {
+			t.Errorf("%v partitions with %+v: got %v, want %v", tc.partitions, tc.multipliers, got, tc.want)
+		}
+	}
+}
+
+func TestWorstSeverity(t *testing.T) {
+	defer setupTest()()
+	inputs := []PrestoInput{syntheticInput("events", "a", 40), syntheticInput("events", "b", 600), syntheticInput("events", "c", 200)}
+	if got := worstSeverity(inputs, QUERY_TYPE_READ); got != config.SEVERITY_EMERGENCY {
+		t.Errorf("got %v, want the worst input's emergency", got)
+	}
+	if got := worstSeverity(inputs[:1], QUERY_TYPE_READ); got != config.SEVERITY_WARNING {
+		t.Errorf("got %v for one input just over", got)
+	}
+	if got := worstSeverity(nil, QUERY_TYPE_READ); got != "" {
+		t.Errorf("got %v without inputs", got)
+	}
+	// The same partitions are only critical against --maxpart-write
+	if got := worstSeverity(inputs[1:2], QUERY_TYPE_WRITE); got != config.SEVERITY_CRITICAL {
+		t.Errorf("got %v for a write, want critical", got)
+	}
+}
+
+func TestSeverityRouting(t *testing.T) {
+	defer setupTest()()
+	cfg.CriticalWebhook = "https://hooks.slack.com/services/critical"
+	cfg.MentionSeverity = config.SEVERITY_CRITICAL
+	for _, tc := range []struct {
+		severity string
+		webhook  string
+		mention  bool
+	}{
+		{config.SEVERITY_WARNING, "", false},
+		{config.SEVERITY_CRITICAL, cfg.CriticalWebhook, true},
+		// Emergencies go to the critical webhook without one of their own
+		{config.SEVERITY_EMERGENCY, cfg.CriticalWebhook, true},
+	} {
+		if got := severityWebhook(tc.severity); got != tc.webhook {
+			t.Errorf("%v: got webhook %q, want %q", tc.severity, got, tc.webhook)
+		}
+		if got := severityMentions(tc.severity); got != tc.mention {
+			t.Errorf("%v: got mention %v, want %v", tc.severity, got, tc.mention)
+		}
+	}
+	cfg.EmergencyWebhook = "https://hooks.slack.com/services/emergency"
+	if got := severityWebhook(config.SEVERITY_EMERGENCY); got != cfg.EmergencyWebhook {
+		t.Errorf("got emergency webhook %q", got)
+	}
+}
+
+func TestSeverityRecorded(t *testing.T) {
+	defer setupTest()()
+	c, notifier := testCluster(newFakePresto(testQuery("q1", "alice", "SELECT * FROM events.clicks", 600)))
+	if err := checkQuery(context.Background(), c, PrestoQuery{QueryID: "q1"}, &cachedQuery{}); err != nil {
+		t.Fatal(err)
+	}
+	if alerts := notifier.sent(); len(alerts) != 1 || alerts[0].Severity != config.SEVERITY_EMERGENCY {
+		t.Fatalf("got alerts %+v, want an emergency", alerts)
+	}
+	var labelled bool
+	for _, r := range metricsSink.MetricSink.(*recordingSink).counters {
+		for _, l := range r.Labels {
+			labelled = labelled || l.Name == "severity" && l.Value == config.SEVERITY_EMERGENCY
+		}
+	}
+	if !labelled {
+		t.Error("query_partition_counts has no severity label")
+	}
+	if got := status.report().Flagged; len(got) != 1 || got[0].Severity != config.SEVERITY_EMERGENCY {
+		t.Errorf("got /status entries %+v, want the emergency", got)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/ashwanthkumar/slack-go-webhook"
+)
+
+/*
+	The Slack Web API transport. With --slack-token the Slack notifier posts through chat.postMessage as a bot
+	instead of the incoming webhook, to --slack-channel or the channel a route or user map names. Route and DM
+	webhooks are still posted to as webhooks.
+
+	Unlike a webhook, the API tells us where the message went, so the first alert on a query remembers its
+	channel and ts in the query cache, and follow-ups on it (escalations, kills, completion notices) are posted
+	as replies in its thread. A 429 is retried after the Retry-After Slack asks for, and API errors like
+	channel_not_found are logged with Slack's error code.
+*/
+
+const SLACK_API_URL = "https://slack.com/api/chat.postMessage"
+
+// Where a query's first Slack alert was posted, empty when it went to a webhook
+type slackThread struct {
+	Channel string
+	TS      string
+}
+
+type slackAPIMessage struct {
+	slack.Payload
+	ThreadTS string `json:"thread_ts,omitempty"`
+}
+
+type slackAPIResponse struct {
+	OK      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Channel string `json:"channel"`
+	TS      string `json:"ts"`
+}
+
+// slackAPIError is Slack refusing a message, Code is Slack's error code like channel_not_found
+type slackAPIError struct {
+	Code string
+}
+
+func (e *slackAPIError) Error() string {
+	return "Slack API error [" + e.Code + "]"
+}
+
+// isFollowUp tells whether an alert is about a query we've alerted on before, and belongs in its thread. A
+// dry-run kill is the first alert on its query.
+func isFollowUp(alert Alert) bool {
+	return alert.EscalatedFrom > 0 || (alert.KillReason != "" && !alert.DryRunKill) || alert.FinalState != ""
+}
+
+// postSlackAPI posts a message with chat.postMessage and returns where it went. In a dry run it only logs it.
+func postSlackAPI(token string, msg slackAPIMessage) (slackThread, error) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return slackThread{}, err
+	}
+	if cfg.DryRun {
+		log.Infof("Dry run, not sending to [slack.com] channel [%v]: %s", msg.Channel, b)
+		return slackThread{}, nil
+	}
+	req, err := newNotifyRequest(SLACK_API_URL, b)
+	if err != nil {
+		return slackThread{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return slackThread{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		snippet, _ := ioutil.ReadAll(resp.Body)
+		return slackThread{}, &httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: string(snippet), RetryAfter: retryAfter(resp)}
+	}
+
+	var r slackAPIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return slackThread{}, err
+	}
+	if !r.OK {
+		log.Errorf("Slack refused the message to channel [%v] with error code [%v]", msg.Channel, r.Error)
+		return slackThread{}, &slackAPIError{Code: r.Error}
+	}
+	return slackThread{Channel: r.Channel, TS: r.TS}, nil
+}
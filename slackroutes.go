@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+	Routes Slack alerts to the channels of the teams that own the tables, e.g.
+
+		routes:
+		  - match: core
+		    webhook: https://hooks.slack.com/services/...
+		  - match: mkt.*
+		    channel: "#marketing-data"
+
+	match is a case-insensitive glob on the schema, or on schema.table when it contains a dot. The first route
+	that matches an input wins, inputs no route matches go to --slack and --slack-channel. A route can set a
+	webhook, a channel override for --slack, or both. When a query's inputs belong to several routes, each
+	destination gets one alert with only its own inputs.
+
+	The file is read at startup and any error in it stops the watcher, so a typo can't silently drop a route.
+	Digests are not routed.
+*/
+
+type SlackRoute struct {
+	Match   string `yaml:"match" json:"match"`
+	Webhook string `yaml:"webhook" json:"webhook"`
+	Channel string `yaml:"channel" json:"channel"`
+}
+
+type SlackRoutesFile struct {
+	Routes []SlackRoute `yaml:"routes" json:"routes"`
+}
+
+// Routes from --slack-routes-file, read-only after startup
+var slackRoutes []SlackRoute
+
+// An alert narrowed down to the inputs of one route
+type routedAlert struct {
+	Alert Alert
+	Route SlackRoute
+}
+
+func parseSlackRoutes(data []byte) ([]SlackRoute, error) {
+	var f SlackRoutesFile
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, err
+	}
+	for idx, r := range f.Routes {
+		if r.Match == "" {
+			return nil, fmt.Errorf("route %v has no match", idx)
+		}
+		if _, err := path.Match(r.Match, ""); err != nil {
+			return nil, fmt.Errorf("route %v has an invalid match '%v': %v", idx, r.Match, err)
+		}
+		if r.Webhook == "" && r.Channel == "" {
+			return nil, fmt.Errorf("route %v ('%v') needs a webhook or a channel", idx, r.Match)
+		}
+	}
+	return f.Routes, nil
+}
+
+// startSlackRoutes reads --slack-routes-file, if one was given
+func startSlackRoutes() {
+	if cfg.SlackRoutesFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(cfg.SlackRoutesFile)
+	if err != nil {
+		log.Fatalf("Unable to read Slack routes file [%v]: %v", cfg.SlackRoutesFile, err)
+	}
+	if slackRoutes, err = parseSlackRoutes(data); err != nil {
+		log.Fatalf("Unable to parse Slack routes file [%v]: %v", cfg.SlackRoutesFile, err)
+	}
+	log.Infof("Loaded [%v] Slack routes from [%v]", len(slackRoutes), cfg.SlackRoutesFile)
+}
+
+// routeFor returns the route of the first pattern matching the input, the zero (default) route if none does
+func routeFor(input PrestoInput) SlackRoute {
+	for _, r := range slackRoutes {
+		name := input.Schema
+		if strings.Contains(r.Match, ".") {
+			name = input.Schema + "." + input.Table
+		}
+		if ok, _ := path.Match(strings.ToLower(r.Match), strings.ToLower(name)); ok {
+			return r
+		}
+	}
+	return SlackRoute{}
+}
+
+// routeAlert splits an alert by the routes of its inputs, one alert per distinct webhook and channel. Alerts
+// without inputs, like queue alerts, go to the default route.
+func routeAlert(alert Alert) []routedAlert {
+	if len(slackRoutes) == 0 || len(alert.BadInputs)+len(alert.FullScans) == 0 {
+		return []routedAlert{{Alert: alert}}
+	}
+
+	var routed []routedAlert
+	index := make(map[SlackRoute]int)
+	add := func(input PrestoInput, fullScan bool) {
+		r := routeFor(input)
+		// Only the destination counts, two patterns for the same channel share an alert
+		r.Match = ""
+		idx, ok := index[r]
+		if !ok {
+			a := alert
+			a.BadInputs, a.FullScans = nil, nil
+			routed = append(routed, routedAlert{Alert: a, Route: r})
+			idx = len(routed) - 1
+			index[r] = idx
+		}
+		if fullScan {
+			routed[idx].Alert.FullScans = append(routed[idx].Alert.FullScans, input)
+		} else {
+			routed[idx].Alert.BadInputs = append(routed[idx].Alert.BadInputs, input)
+		}
+	}
+	for _, i := range alert.BadInputs {
+		add(i, false)
+	}
+	for _, i := range alert.FullScans {
+		add(i, true)
+	}
+
+	if len(routed) > 1 {
+		// Each owner hears about the partitions of their own tables
+		for idx := range routed {
+			var total int
+			for _, i := range routed[idx].Alert.BadInputs {
+				total += len(i.ConnectorInfo.PartitionIds)
+			}
+			routed[idx].Alert.TotalPartitions = total
+		}
+	}
+	return routed
+}
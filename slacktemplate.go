@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+/*
+	The Slack alert text is a Go text/template, so teams can give their own guidance. The built-in default is
+	the original message. Templates get a slackTemplateData; the per-table attachments, Mode details and
+	resource usage are added outside the template.
+*/
+
+const DEFAULT_SLACK_TEMPLATE = `{{if .Mention}}{{.Mention}} {{end -}}
+{{if .KillReason -}}
+:skull: :skull: :skull:
+Presto query {{.QueryLink}} {{if .DryRunKill}}*would have been cancelled by prestowatcher*{{else}}was *cancelled by prestowatcher*{{end}} because {{.KillReason}}. :sql_bandit:
+{{else if not .Tables -}}
+:hourglass: :bomb: :bomb:
+Presto query {{.QueryLink}} is over its limits because {{.Breaches}}! :sql_bandit:
+{{else if .EscalatedFrom -}}
+:chart_with_upwards_trend: :bomb: :bomb:
+Presto query {{.QueryLink}} is now searching through *{{.TotalPartitions}}* partitions total, up from *{{.EscalatedFrom}}* when we first warned about it! :sql_bandit:
+{{else -}}
+{{.SeverityEmoji}} {{.SeverityEmoji}} {{.SeverityEmoji}}
+Presto query {{.QueryLink}} is searching through more than *{{.TotalPartitions}}* partitions total! :sql_bandit:
+{{if .Breaches}}On top of that, {{.Breaches}}.
+{{end}}{{if .KillRefusal}}It's over the kill threshold but wasn't cancelled, {{.KillRefusal}}.
+{{end}}{{end -}}
+{{.AlternateLinks -}}
+{{if .CaughtAfter}}_Caught after {{.CaughtAfter}}._
+{{end -}}
+{{.PartitionHint}}
+{{if .AckURL}}<{{.AckURL}}|Acknowledge this alert> to stop escalations and follow-ups on this query.
+{{end}}{{if .KillURL}}<{{.KillURL}}|Kill this query> if it shouldn't be running.
+{{end}}
+{{if .KillReason -}}
+*If this query really needs to scan that much*, add ` + "`-- {{.NoKillTag}}`" + ` somewhere in your query.
+{{- else if .OptOutIgnored -}}
+` + "`{{.OptOutTag}}`" + ` is ignored for queries over *{{.OptOutMaxPartitions}}* partitions.
+{{- else -}}
+*If you want to disable this alert for your query*, add ` + "`-- {{.OptOutTag}}`" + ` somewhere in your query.
+{{- end}}`
+
+type slackTemplateTable struct {
+	Name string
+	// Partition count, e.g. "42" or "1000+ (truncated)"
+	Partitions string
+	// The limit that applied and where it came from
+	Limit string
+	// Partition columns read from the partition IDs, e.g. "ds, hr", empty when they can't be read
+	PartitionKeys string
+	// Which column to filter on and the range scanned, empty when the partition IDs can't be read
+	Hint string
+}
+
+type slackTemplateData struct {
+	QueryID  string
+	QueryURL string
+	// QueryURL in Slack link syntax
+	QueryLink string
+	// Line with the other UI links, empty with a single UI URL
+	AlternateLinks string
+	User           string
+	// <@ID> when the user is in the user map, empty otherwise
+	Mention   string
+	QueryType string
+	// warning, critical or emergency, empty for alerts that aren't about partitions
+	Severity string
+	// The emoji of the severity tier, :bomb: for warnings
+	SeverityEmoji   string
+	TotalPartitions int
+	// Default partition limit for the query type
+	MaxPartitions int
+	// Inputs over their limit
+	Tables        []slackTemplateTable
+	EscalatedFrom int
+	KillReason    string
+	// KillReason is about a kill that only happened in a dry run
+	DryRunKill bool
+	// Bytes scanned and runtime limits that were breached, as one sentence
+	Breaches            string
+	OptOutTag           string
+	NoKillTag           string
+	OptOutIgnored       bool
+	OptOutMaxPartitions int
+	// How long after its creation the query was caught, e.g. "47s", empty unless this is its first alert
+	CaughtAfter string
+	// The Hint of every table, one per line, or a general reminder to filter on partition columns
+	PartitionHint string
+	// Link acknowledging the alert, empty when --ack-secret isn't set and on kill notices
+	AckURL string
+	// Link killing the query, only on partition alerts with --kill-links
+	KillURL string
+	// The protection that kept the query from being killed, empty unless it was over --kill-threshold
+	KillRefusal string
+}
+
+var slackTemplate *template.Template
+
+// startSlackTemplate sets up the alert template, the default one unless --slack-template(-file) was given
+func startSlackTemplate() {
+	if cfg.SlackMessageTemplate != nil {
+		slackTemplate = cfg.SlackMessageTemplate
+		return
+	}
+	slackTemplate = template.Must(template.New("slack").Parse(DEFAULT_SLACK_TEMPLATE))
+}
+
+// renderSlackText renders the alert text, mention is the Slack user ID to @mention or empty
+func renderSlackText(alert Alert, mention string) (string, error) {
+	query := alert.Query
+	qType := queryType(query)
+	data := slackTemplateData{
+		QueryID:             query.QueryID,
+		QueryURL:            primaryQueryURL(alert.Cluster, query.QueryID),
+		QueryLink:           slackQueryLink(alert.Cluster, query.QueryID),
+		AlternateLinks:      slackAlternateLinks(alert.Cluster, query.QueryID),
+		User:                query.Session.User,
+		QueryType:           qType,
+		Severity:            alert.Severity,
+		SeverityEmoji:       severityEmoji(alert.Severity),
+		TotalPartitions:     alert.TotalPartitions,
+		MaxPartitions:       partitionLimit(qType),
+		EscalatedFrom:       alert.EscalatedFrom,
+		KillReason:          alert.KillReason,
+		DryRunKill:          alert.DryRunKill,
+		Breaches:            breachText(alert.Breaches),
+		OptOutTag:           cfg.OptOutTag,
+		NoKillTag:           cfg.NoKillTag,
+		OptOutIgnored:       alert.OptOutIgnored,
+		OptOutMaxPartitions: cfg.OptOutMaxPartitions,
+		PartitionHint:       partitionHints(alert.BadInputs),
+	}
+	if alert.KillReason == "" {
+		data.AckURL = ackURL(query.QueryID)
+	}
+	if alert.KillReason == "" && alert.KillRefusal == "" && len(alert.BadInputs) > 0 {
+		data.KillURL = killURL(query.QueryID)
+	}
+	data.KillRefusal = alert.KillRefusal
+	if alert.CaughtAfter > 0 {
+		data.CaughtAfter = formatDuration(alert.CaughtAfter)
+	}
+	if mention != "" {
+		data.Mention = fmt.Sprintf("<@%v>", mention)
+	}
+	for _, i := range alert.BadInputs {
+		var keys []string
+		if ranges, ok := partitionRanges(i.ConnectorInfo.PartitionIds); ok {
+			for _, r := range ranges {
+				keys = append(keys, r.Key)
+			}
+		}
+		data.Tables = append(data.Tables, slackTemplateTable{
+			Name:          tableName(i),
+			Partitions:    partitionCountText(i),
+			Limit:         rules.limitFor(i, qType).String(),
+			PartitionKeys: strings.Join(keys, ", "),
+			Hint:          partitionHint(i),
+		})
+	}
+
+	var text bytes.Buffer
+	if err := slackTemplate.Execute(&text, data); err != nil {
+		return "", fmt.Errorf("unable to render Slack template: %v", err)
+	}
+	return strings.TrimSpace(text.String()), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ashwanthkumar/slack-go-webhook"
+	"github.com/thecubed/prestowatcher/config"
+)
+
+/*
+	Warm starts. A restart mid-day would otherwise check every running query for the "first" time, re-alerting on
+	the long-running ones the previous instance already alerted on and counting hours-old queries in the metrics
+	as if they were new. With --startup-grace the first poll of each cluster remembers the running queries that
+	have been running for longer than the grace period as pre-existing instead of checking them, and they're left
+	alone for as long as they stay in the cache. Queries younger than the grace period, and those already in a
+	--cache-file, are checked as usual.
+
+	How many were skipped is logged, counted in presto.watcher.startup_skipped_queries and, with the slack
+	notifier, posted to Slack once.
+*/
+
+// queryAge is how long a query has been running, from its elapsed time or else its create time. ok is false
+// when Presto gave neither.
+func queryAge(query PrestoQuery, now time.Time) (age time.Duration, ok bool) {
+	if query.QueryStats.ElapsedTime != "" {
+		if d, err := parsePrestoDuration(query.QueryStats.ElapsedTime); err == nil {
+			return d, true
+		}
+	}
+	if created, ok := queryCreated(query); ok {
+		return now.Sub(created), true
+	}
+	return 0, false
+}
+
+// preExisting tells whether a query was already running for longer than the grace period
+func preExisting(query PrestoQuery, grace time.Duration, now time.Time) bool {
+	age, ok := queryAge(query, now)
+	return ok && age > grace
+}
+
+// warmStart marks the running queries the previous instance must have checked as pre-existing, on a cluster's
+// first poll
+func warmStart(c *cluster, queries []PrestoQuery, now time.Time) {
+	if cfg.StartupGrace.Duration <= 0 {
+		return
+	}
+	var skipped int
+	for _, query := range queries {
+		if query.State != "RUNNING" || !preExisting(query, cfg.StartupGrace.Duration, now) {
+			continue
+		}
+		if _, found := c.cache.Get(query.QueryID); found {
+			continue
+		}
+		c.cache.Set(query.QueryID, cachedQuery{LastChecked: now, PreExisting: true})
+		skipped++
+	}
+	if skipped == 0 {
+		return
+	}
+	log.Infof("%vSkipped [%v] pre-existing queries on startup, running for longer than [%v]", c.prefix(), skipped, cfg.StartupGrace)
+	c.metrics.IncrCounter(metricKey("startup_skipped_queries"), float32(skipped))
+	for _, name := range cfg.NotifierNames {
+		if name != config.NOTIFIER_SLACK {
+			continue
+		}
+		n := newSlackNotifier()
+		text := fmt.Sprintf("%v%v started and skipped %v pre-existing queries that were running for over %v.", c.prefix(), APP_NAME, skipped, cfg.StartupGrace)
+		if err := n.send(n.url, slack.Payload{Text: text}); err != nil {
+			log.Errorf("%vUnable to post the startup notice to Slack: %v", c.prefix(), err)
+		}
+	}
+}
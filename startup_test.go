@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePrestoDuration(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want time.Duration
+	}{
+		{"1.50m", 90 * time.Second},
+		{"3.20h", 192 * time.Minute},
+		{"250.00ms", 250 * time.Millisecond},
+		{" 2d ", 48 * time.Hour},
+		{"0.00ns", 0},
+	} {
+		if got, err := parsePrestoDuration(tc.s); err != nil || got != tc.want {
+			t.Errorf("parsePrestoDuration(%q) = %v, %v, want %v", tc.s, got, err, tc.want)
+		}
+	}
+	for _, s := range []string{"", "1.5", "2 weeks", "m"} {
+		if _, err := parsePrestoDuration(s); err == nil {
+			t.Errorf("parsePrestoDuration(%q) succeeded", s)
+		}
+	}
+}
+
+func TestPreExisting(t *testing.T) {
+	now := time.Date(2023, 1, 2, 12, 0, 0, 0, time.UTC)
+	const grace = 10 * time.Minute
+	for _, tc := range []struct {
+		name    string
+		elapsed string
+		created string
+		want    bool
+	}{
+		{"elapsed at the grace period", "10.00m", "", false},
+		{"elapsed just over", "10.01m", "", true},
+		{"elapsed just under", "9.99m", "", false},
+		{"created at the grace period", "", "2023-01-02T11:50:00.000Z", false},
+		{"created just before", "", "2023-01-02T11:49:59.999Z", true},
+		{"created just after", "", "2023-01-02T11:50:00.001Z", false},
+		{"elapsed wins over created", "1.00m", "2023-01-02T08:00:00.000Z", false},
+		{"unreadable elapsed falls back to created", "soon", "2023-01-02T08:00:00.000Z", true},
+		{"neither", "", "", false},
+	} {
+		var q PrestoQuery
+		q.QueryStats.ElapsedTime, q.QueryStats.CreateTime = tc.elapsed, tc.created
+		if got := preExisting(q, grace, now); got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestWarmStart(t *testing.T) {
+	defer setupTest()()
+	cfg.StartupGrace.Duration = 10 * time.Minute
+	old := testQuery("old", "alice", "SELECT * FROM events.clicks", 45)
+	old.QueryStats.ElapsedTime = "2.00h"
+	young := testQuery("young", "bob", "SELECT * FROM events.clicks", 45)
+	young.QueryStats.ElapsedTime = "9.00m"
+	// Checked before the restart, it's in the --cache-file
+	cached := testQuery("cached", "carol", "SELECT * FROM events.clicks", 45)
+	cached.QueryStats.ElapsedTime = "3.00h"
+	c, notifier := testCluster(newFakePresto(old, young, cached))
+	c.warmedUp = false
+	c.cache.Set("cached", cachedQuery{LastChecked: time.Now(), AlertedPartitions: 45})
+
+	if !doCollect(c) {
+		t.Fatal("the poll failed")
+	}
+	if alerts := notifier.sent(); len(alerts) != 1 || alerts[0].Query.QueryID != "young" {
+		t.Errorf("got alerts %+v, want one for the young query only", alerts)
+	}
+	if entry, _ := c.cache.Get("old"); !entry.PreExisting {
+		t.Errorf("the old query wasn't remembered as pre-existing: %+v", entry)
+	}
+	if entry, _ := c.cache.Get("cached"); entry.PreExisting || entry.AlertedPartitions != 45 {
+		t.Errorf("the cached query's entry was replaced: %+v", entry)
+	}
+	if got := metricsSink.MetricSink.(*recordingSink).count("startup_skipped_queries"); got != 1 {
+		t.Errorf("got %v startup_skipped_queries, want 1", got)
+	}
+
+	// Only the first poll skips anything
+	late := testQuery("late", "dave", "SELECT * FROM events.clicks", 45)
+	late.QueryStats.ElapsedTime = "5.00h"
+	c.client.(*fakePresto).add(late)
+	if !doCollect(c) {
+		t.Fatal("the second poll failed")
+	}
+	if alerts := notifier.sent(); len(alerts) != 2 || alerts[1].Query.QueryID != "late" {
+		t.Errorf("got alerts %+v, want the old query found after startup alerted on", alerts)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+	/status answers "why did the bot ping me?" with the last --status-size flagged queries and what was done
+	about each, along with when the last successful poll was and how fast queries have been caught. The collector writes it, the handler only copies
+	it out under the mutex, so a slow client never holds up a poll.
+*/
+
+type flaggedQuery struct {
+	Time    time.Time       `json:"time"`
+	QueryID string          `json:"query_id"`
+	User    string          `json:"user"`
+	Inputs  []inputDecision `json:"inputs"`
+	// Severity tier of the worst input, empty when none was over its limit
+	Severity string `json:"severity,omitempty"`
+	// What was decided, one of the DECISION_* values
+	Decision string `json:"decision"`
+	// Whether an alert (or kill notice) went out
+	Alerted bool `json:"alerted"`
+	// Who acknowledged the alert, with the note they left, empty until someone does
+	AcknowledgedBy string `json:"acknowledged_by,omitempty"`
+}
+
+type statusTracker struct {
+	sync.Mutex
+	lastPoll time.Time
+	seen     int
+	// Ring buffer of flagged queries, next is where the next one goes
+	flagged []flaggedQuery
+	next    int
+	full    bool
+	// From query creation to first alert, since startup
+	detection latencyStats
+}
+
+var status *statusTracker
+
+func newStatusTracker(size int) *statusTracker {
+	return &statusTracker{flagged: make([]flaggedQuery, size)}
+}
+
+// flaggedDecision tells whether a decision is worth showing on /status, and whether it sent an alert
+func flaggedDecision(decision string, overLimit bool) (flagged bool, alerted bool) {
+	switch decision {
+	case DECISION_ALERTED, DECISION_ESCALATED, DECISION_KILLED, DECISION_DRY_RUN_KILL:
+		return true, true
+	case DECISION_OPTOUT, DECISION_IGNORED, DECISION_SUPPRESSED:
+		return overLimit, false
+	}
+	return false, false
+}
+
+// record adds a query decision if it's a flagged one we haven't got yet
+func (s *statusTracker) record(d queryDecision, overLimit bool, now time.Time) {
+	flagged, alerted := flaggedDecision(d.Decision, overLimit)
+	if s == nil || !flagged {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	// Re-checks keep suppressing the same query, it only needs to show up once
+	for _, f := range s.flagged {
+		if f.QueryID == d.QueryID && f.Decision == d.Decision {
+			return
+		}
+	}
+	s.flagged[s.next] = flaggedQuery{Time: now, QueryID: d.QueryID, User: d.User, Inputs: d.Inputs, Severity: d.Severity, Decision: d.Decision, Alerted: alerted}
+	s.next = (s.next + 1) % len(s.flagged)
+	if s.next == 0 {
+		s.full = true
+	}
+}
+
+// acknowledged marks a flagged query's entries as acknowledged by someone
+func (s *statusTracker) acknowledged(queryID string, by string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	for i := range s.flagged {
+		if s.flagged[i].QueryID == queryID {
+			s.flagged[i].AcknowledgedBy = by
+		}
+	}
+}
+
+// pollDone records a successful poll that saw this many queries
+func (s *statusTracker) pollDone(seen int, now time.Time) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.lastPoll = now
+	s.seen = seen
+}
+
+// detected adds a query's detection latency
+func (s *statusTracker) detected(latency time.Duration) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.detection.add(latency)
+}
+
+type statusReport struct {
+	LastPoll         time.Time      `json:"last_successful_poll"`
+	QueriesSeen      int            `json:"queries_seen_last_cycle"`
+	DetectionLatency latencyStats   `json:"detection_latency"`
+	Flagged          []flaggedQuery `json:"recent_flagged_queries"`
+}
+
+// report returns the current status, most recent flagged query first
+func (s *statusTracker) report() statusReport {
+	s.Lock()
+	defer s.Unlock()
+
+	r := statusReport{LastPoll: s.lastPoll, QueriesSeen: s.seen, DetectionLatency: s.detection, Flagged: []flaggedQuery{}}
+	count := s.next
+	if s.full {
+		count = len(s.flagged)
+	}
+	for i := 1; i <= count; i++ {
+		idx := (s.next - i + len(s.flagged)) % len(s.flagged)
+		r.Flagged = append(r.Flagged, s.flagged[idx])
+	}
+	return r
+}
+
+func statusHandler(resp http.ResponseWriter, request *http.Request) {
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(status.report())
+}
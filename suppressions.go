@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Temporary suppressions, added at runtime through the admin API to silence a user or a table during an
+	incident without a redeploy:
+
+		POST   /suppressions       {"user": "mode", "table": "hive.events.clicks", "ttl": "1h"}
+		GET    /suppressions
+		DELETE /suppressions/{id}
+
+	user and table are case-insensitive globs, table against connector.schema.table, and a rule needs at least
+	one of them. Suppressed inputs are measured and counted in suppressed_alerts like opted out ones, but not
+	alerted on. Rules only live in memory and are dropped once they expire.
+
+	The API is only served when --admin-secret is set, and every request has to carry it in X-Admin-Secret.
+*/
+
+const ADMIN_SECRET_HEADER = "X-Admin-Secret"
+
+type suppression struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user,omitempty"`
+	Table   string    `json:"table,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// matches tells whether the rule covers an input of a query by user
+func (s suppression) matches(user string, input PrestoInput) bool {
+	return s.covers(user, tableName(input))
+}
+
+// covers tells whether the rule covers a table, as connector.schema.table, read by user
+func (s suppression) covers(user string, table string) bool {
+	if s.User != "" {
+		if ok, _ := path.Match(strings.ToLower(s.User), strings.ToLower(user)); !ok {
+			return false
+		}
+	}
+	if s.Table != "" {
+		if ok, _ := path.Match(strings.ToLower(s.Table), strings.ToLower(table)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+type suppressionList struct {
+	sync.Mutex
+	rules  map[string]suppression
+	lastID int
+}
+
+var suppressions = &suppressionList{rules: make(map[string]suppression)}
+
+// expire drops the rules that have run out, the lock must be held
+func (l *suppressionList) expire(now time.Time) {
+	for id, s := range l.rules {
+		if !s.Expires.After(now) {
+			log.Infof("Suppression [%v] for user [%v] table [%v] expired", id, s.User, s.Table)
+			delete(l.rules, id)
+		}
+	}
+}
+
+func (l *suppressionList) add(user string, table string, ttl time.Duration) suppression {
+	l.Lock()
+	defer l.Unlock()
+	l.lastID++
+	s := suppression{ID: strconv.Itoa(l.lastID), User: user, Table: table, Expires: time.Now().Add(ttl)}
+	l.rules[s.ID] = s
+	return s
+}
+
+func (l *suppressionList) remove(id string) bool {
+	l.Lock()
+	defer l.Unlock()
+	_, ok := l.rules[id]
+	delete(l.rules, id)
+	return ok
+}
+
+// active returns the rules that haven't expired, oldest first
+func (l *suppressionList) active() []suppression {
+	l.Lock()
+	defer l.Unlock()
+	l.expire(time.Now())
+	list := make([]suppression, 0, len(l.rules))
+	for _, s := range l.rules {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Expires.Before(list[j].Expires) })
+	return list
+}
+
+// filter splits a query's inputs into the ones still to alert on and the suppressed ones
+func (l *suppressionList) filter(user string, inputs []PrestoInput) (kept []PrestoInput, suppressed []PrestoInput) {
+	rules := l.active()
+	for _, i := range inputs {
+		matched := false
+		for _, s := range rules {
+			if s.matches(user, i) {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			suppressed = append(suppressed, i)
+		} else {
+			kept = append(kept, i)
+		}
+	}
+	return kept, suppressed
+}
+
+type suppressionRequest struct {
+	User  string `json:"user"`
+	Table string `json:"table"`
+	TTL   string `json:"ttl"`
+}
+
+// adminAuthorized checks the shared secret, answering 401 when it's wrong
+func adminAuthorized(resp http.ResponseWriter, request *http.Request) bool {
+	given := request.Header.Get(ADMIN_SECRET_HEADER)
+	if subtle.ConstantTimeCompare([]byte(given), []byte(cfg.AdminSecret)) != 1 {
+		http.Error(resp, "missing or wrong "+ADMIN_SECRET_HEADER, http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func suppressionsHandler(resp http.ResponseWriter, request *http.Request) {
+	if !adminAuthorized(resp, request) {
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case request.URL.Path == "/suppressions" && request.Method == "GET":
+		json.NewEncoder(resp).Encode(suppressions.active())
+
+	case request.URL.Path == "/suppressions" && request.Method == "POST":
+		var req suppressionRequest
+		if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+			http.Error(resp, fmt.Sprintf("invalid JSON: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.User == "" && req.Table == "" {
+			http.Error(resp, "a suppression needs a user, a table or both", http.StatusBadRequest)
+			return
+		}
+		for _, pattern := range []string{req.User, req.Table} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				http.Error(resp, fmt.Sprintf("invalid pattern '%v': %v", pattern, err), http.StatusBadRequest)
+				return
+			}
+		}
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			http.Error(resp, fmt.Sprintf("invalid ttl '%v', expected a positive duration like 1h", req.TTL), http.StatusBadRequest)
+			return
+		}
+		s := suppressions.add(req.User, req.Table, ttl)
+		log.Warningf("Added suppression [%v] for user [%v] table [%v] until [%v] from [%v]", s.ID, s.User, s.Table, s.Expires, request.RemoteAddr)
+		resp.WriteHeader(http.StatusCreated)
+		json.NewEncoder(resp).Encode(s)
+
+	case strings.HasPrefix(request.URL.Path, "/suppressions/") && request.Method == "DELETE":
+		id := strings.TrimPrefix(request.URL.Path, "/suppressions/")
+		if !suppressions.remove(id) {
+			http.Error(resp, fmt.Sprintf("no suppression [%v]", id), http.StatusNotFound)
+			return
+		}
+		log.Warningf("Removed suppression [%v] from [%v]", id, request.RemoteAddr)
+		resp.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(resp, "use GET or POST /suppressions, or DELETE /suppressions/{id}", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ashwanthkumar/slack-go-webhook"
+)
+
+/*
+	BI tools tag the SQL they send with a JSON comment saying who ran it and from where. Each tool gets a
+	tagExtractor; extractBITag tries them against every comment in the query, line and block comments alike, so
+	the tag doesn't have to be on the last line and trailing blank lines or semicolons don't matter.
+*/
+
+// What a BI tool's tag told us about a query
+type biTag struct {
+	Tool string
+	// The tool's username, used for @mentions
+	User   string
+	Color  string
+	Fields []slack.Field
+}
+
+type tagExtractor struct {
+	Tool string
+	// extract looks for the tool's tag in one comment
+	extract func(query PrestoQuery, comment string) (biTag, bool)
+}
+
+var tagExtractors = []tagExtractor{
+	{Tool: "Mode", extract: extractModeTag},
+	{Tool: "Looker", extract: extractLookerTag},
+}
+
+// Mode appends a JSON comment like {"user":"alice","url":"https://modeanalytics.com/...","scheduled":false}
+type ModeQueryInfo struct {
+	User      string `json:"user"`
+	URL       string `json:"url"`
+	Scheduled bool   `json:"scheduled"`
+}
+
+func extractModeTag(query PrestoQuery, comment string) (biTag, bool) {
+	if query.Session.User != "mode" {
+		return biTag{}, false
+	}
+	var mqi ModeQueryInfo
+	if !decodeJSONObject(comment, &mqi) || (mqi.User == "" && mqi.URL == "") {
+		return biTag{}, false
+	}
+	return biTag{
+		Tool:  "Mode",
+		User:  mqi.User,
+		Color: "439FE0",
+		Fields: []slack.Field{
+			{Title: "Mode Username", Value: mqi.User, Short: true},
+			{Title: "Scheduled?", Value: fmt.Sprintf("%v", mqi.Scheduled), Short: true},
+			{Title: "URL", Value: mqi.URL},
+		},
+	}, true
+}
+
+// Looker prefixes its SQL with -- Looker Query Context '{"user_id":42,"history_slug":"...","instance_slug":"..."}'
+type LookerQueryContext struct {
+	UserID       json.Number `json:"user_id"`
+	HistorySlug  string      `json:"history_slug"`
+	InstanceSlug string      `json:"instance_slug"`
+}
+
+func extractLookerTag(query PrestoQuery, comment string) (biTag, bool) {
+	if !strings.HasPrefix(strings.TrimSpace(comment), "Looker Query Context") {
+		return biTag{}, false
+	}
+	var lqc LookerQueryContext
+	if !decodeJSONObject(comment, &lqc) {
+		return biTag{}, false
+	}
+	return biTag{
+		Tool:  "Looker",
+		User:  lqc.UserID.String(),
+		Color: "64518A",
+		Fields: []slack.Field{
+			{Title: "Looker User ID", Value: lqc.UserID.String(), Short: true},
+			{Title: "History", Value: lqc.HistorySlug, Short: true},
+			{Title: "Instance", Value: lqc.InstanceSlug, Short: true},
+		},
+	}, true
+}
+
+// extractBITag returns the tag of the first BI tool that tagged the query
+func extractBITag(query PrestoQuery) (biTag, bool) {
+	comments := sqlComments(query.Query)
+	for _, e := range tagExtractors {
+		// Tags usually sit at the end, so look there first
+		for i := len(comments) - 1; i >= 0; i-- {
+			if tag, ok := e.extract(query, comments[i]); ok {
+				return tag, true
+			}
+		}
+	}
+	log.Debugf("No BI tool tag found in query [%v] by user [%v]", query.QueryID, query.Session.User)
+	return biTag{}, false
+}
+
+// decodeJSONObject decodes the outermost {...} in s into v
+func decodeJSONObject(s string, v interface{}) bool {
+	start, end := strings.Index(s, "{"), strings.LastIndex(s, "}")
+	if start < 0 || end < start {
+		return false
+	}
+	return json.Unmarshal([]byte(s[start:end+1]), v) == nil
+}
+
+// sqlComments returns the text of every -- and /* */ comment in a SQL statement, skipping string literals and
+// quoted identifiers
+func sqlComments(sql string) []string {
+	var comments []string
+	for i := 0; i < len(sql); i++ {
+		switch {
+		case sql[i] == '\'' || sql[i] == '"':
+			// Quotes are escaped by doubling them, which this handles as two adjacent literals
+			quote := sql[i]
+			i++
+			for i < len(sql) && sql[i] != quote {
+				i++
+			}
+		case strings.HasPrefix(sql[i:], "--"):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				end = len(sql) - i
+			}
+			comments = append(comments, sql[i+2:i+end])
+			i += end
+		case strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				comments = append(comments, sql[i+2:])
+				return comments
+			}
+			comments = append(comments, sql[i+2:i+2+end])
+			i += end + 3
+		}
+	}
+	return comments
+}
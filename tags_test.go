@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExtractBITag(t *testing.T) {
+	const modeTag = `{"user":"alice","email":"alice@example.com","url":"https://modeanalytics.com/acme/reports/1a2b3c/runs/4d5e6f","scheduled":true}`
+	for _, tc := range []struct {
+		name  string
+		user  string
+		sql   string
+		tool  string
+		who   string
+		field string
+	}{
+		{"mode on the last line", "mode", "SELECT count(*) FROM events.clicks\n-- " + modeTag, "Mode", "alice", "true"},
+		{"mode then a blank line", "mode", "SELECT count(*) FROM events.clicks\n-- " + modeTag + "\n\n", "Mode", "alice", "true"},
+		{"mode then a semicolon", "mode", "SELECT count(*) FROM events.clicks\n--" + modeTag + "\n;", "Mode", "alice", "true"},
+		{"mode in a block comment", "mode", "/* " + modeTag + " */\nSELECT count(*) FROM events.clicks", "Mode", "alice", "true"},
+		{"mode indented with tabs", "mode", "SELECT 1\n\t--\t " + modeTag + "\t", "Mode", "alice", "true"},
+		{"mode after other comments", "mode", "-- daily rollup\nSELECT 1 -- cheap\n-- " + modeTag + "\n-- end", "Mode", "alice", "true"},
+		{"mode tag from another user", "alice", "SELECT 1\n-- " + modeTag, "", "", ""},
+		{"mode tag in a string literal", "mode", "SELECT '-- " + modeTag + "' AS tag", "", "", ""},
+		{"mode with broken json", "mode", "SELECT 1\n-- {\"user\":\"alice\",", "", "", ""},
+		{"an empty comment", "mode", "SELECT 1\n--", "", "", ""},
+		{"no comments", "mode", "SELECT 1;", "", "", ""},
+		{"an unterminated block comment", "mode", "SELECT 1 /* " + modeTag, "Mode", "alice", "true"},
+		{
+			"looker context", "looker",
+			"-- Looker Query Context '{\"user_id\":42,\"history_slug\":\"0ab1c2\",\"instance_slug\":\"d3e4f5\"}'\nSELECT ds, count(*) FROM events.clicks GROUP BY 1",
+			"Looker", "42", "0ab1c2",
+		},
+		{"looker without the marker", "looker", "-- '{\"user_id\":42}'\nSELECT 1", "", "", ""},
+	} {
+		var q PrestoQuery
+		q.Query, q.Session.User = tc.sql, tc.user
+		tag, found := extractBITag(q)
+		if found != (tc.tool != "") {
+			t.Errorf("%v: got found %v", tc.name, found)
+			continue
+		}
+		if !found {
+			continue
+		}
+		if tag.Tool != tc.tool || tag.User != tc.who || len(tag.Fields) < 2 || tag.Fields[1].Value != tc.field {
+			t.Errorf("%v: got tag %+v", tc.name, tag)
+		}
+	}
+}
+
+func TestSQLComments(t *testing.T) {
+	for _, tc := range []struct {
+		sql  string
+		want []string
+	}{
+		{"SELECT 1", nil},
+		{"SELECT 1 -- one\n-- two", []string{" one", " two"}},
+		{"SELECT /* a */ 1 /* b */", []string{" a ", " b "}},
+		{"SELECT '--not', \"/*col*/\" FROM t -- yes", []string{" yes"}},
+		{"SELECT 'it''s' -- quote", []string{" quote"}},
+		{"SELECT 1 /* open", []string{" open"}},
+	} {
+		if got := sqlComments(tc.sql); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("sqlComments(%q) = %q, want %q", tc.sql, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Tracing of polls for --otlp-endpoint. Every poll of a cluster is a trace: a root span for the poll, a child
+	span for every query checked with its ID, user, partition count and whether it was alerted on, and one for
+	every alert sent. The Presto client's HTTP transport adds a client span for every request under whichever of
+	those is current, so the overview fetch and every detail fetch show up with their retries, and passes the
+	trace on to the coordinator in a W3C traceparent header.
+
+	Spans are exported as OTLP/HTTP JSON to --otlp-endpoint/v1/traces, which any OpenTelemetry collector takes.
+	The OpenTelemetry Go SDK needs a much newer Go than this builds with, and the few fields we send don't need
+	it. Like the event publisher, finished spans go to an exporter goroutine through a buffered channel so a slow
+	collector never holds up a poll. It sends a batch every TRACE_EXPORT_INTERVAL, or sooner when
+	TRACE_BATCH_SIZE spans are waiting. Spans that don't fit in the buffer are dropped and counted in
+	presto.watcher.trace_spans_dropped, failed exports are logged and counted in presto.watcher.trace_export_errors.
+
+	--trace-sample-ratio decides whether a trace is recorded when its root span starts, and every span under it
+	follows that decision. Without --otlp-endpoint no spans are made at all, a nil span does nothing.
+*/
+
+const (
+	TRACE_BUFFER          = 4096
+	TRACE_BATCH_SIZE      = 512
+	TRACE_EXPORT_INTERVAL = 5 * time.Second
+
+	SPAN_KIND_INTERNAL = 1
+	SPAN_KIND_CLIENT   = 3
+
+	SPAN_STATUS_ERROR = 2
+)
+
+// The body of an OTLP/HTTP JSON export request, only the parts we fill in
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId,omitempty"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	// Nanosecond timestamps are 64 bit integers, which OTLP JSON sends as strings
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key string `json:"key"`
+	// One of stringValue, intValue or boolValue
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// attribute builds a span attribute, anything but a bool or an integer is sent as a string
+func attribute(key string, value interface{}) otlpAttribute {
+	switch v := value.(type) {
+	case bool:
+		return otlpAttribute{Key: key, Value: map[string]interface{}{"boolValue": v}}
+	case int:
+		return otlpAttribute{Key: key, Value: map[string]interface{}{"intValue": strconv.Itoa(v)}}
+	case int64:
+		return otlpAttribute{Key: key, Value: map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}}
+	}
+	return otlpAttribute{Key: key, Value: map[string]interface{}{"stringValue": fmt.Sprint(value)}}
+}
+
+// span is one timed operation in a trace. A nil span is one that isn't recorded, its methods do nothing.
+type span struct {
+	tracer  *tracer
+	trace   [16]byte
+	id      [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	started time.Time
+
+	lock       sync.Mutex
+	attributes []otlpAttribute
+	failure    string
+	ended      bool
+}
+
+type spanKey struct{}
+
+// startSpan starts a span under the one in ctx, or the root span of a new trace, and returns a context carrying
+// it. The span is nil when tracing is off or the trace isn't sampled.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	t := tracing
+	if t == nil {
+		return ctx, nil
+	}
+	parent, traced := ctx.Value(spanKey{}).(*span)
+	if traced && parent == nil {
+		// Nothing under a trace that wasn't sampled is recorded either
+		return ctx, nil
+	}
+	s := &span{tracer: t, name: name, kind: SPAN_KIND_INTERNAL, started: time.Now()}
+	if parent != nil {
+		s.trace, s.parent = parent.trace, parent.id
+	} else if rand.Float64() >= t.ratio {
+		return context.WithValue(ctx, spanKey{}, (*span)(nil)), nil
+	} else {
+		rand.Read(s.trace[:])
+	}
+	rand.Read(s.id[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *span) setAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attributes = append(s.attributes, attribute(key, value))
+}
+
+// setError marks the span as failed
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failure = err.Error()
+}
+
+// traceparent is the W3C trace context header for requests made under the span
+func (s *span) traceparent() string {
+	return "00-" + hex.EncodeToString(s.trace[:]) + "-" + hex.EncodeToString(s.id[:]) + "-01"
+}
+
+// end finishes the span and queues it for export, ending it again does nothing
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	ended := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ended {
+		return
+	}
+	s.ended = true
+	exported := otlpSpan{
+		TraceID:           hex.EncodeToString(s.trace[:]),
+		SpanID:            hex.EncodeToString(s.id[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.started.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(ended.UnixNano(), 10),
+		Attributes:        s.attributes,
+	}
+	if s.parent != [8]byte{} {
+		exported.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	if s.failure != "" {
+		exported.Status = &otlpStatus{Code: SPAN_STATUS_ERROR, Message: s.failure}
+	}
+	s.tracer.export(exported)
+}
+
+// tracer exports finished spans to an OTLP/HTTP collector
+type tracer struct {
+	// The collector's traces endpoint
+	url string
+	// Fraction of traces recorded, from 0 to 1
+	ratio   float64
+	spans   chan otlpSpan
+	dropped int64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// nil means disabled
+var tracing *tracer
+
+func newTracer(url string, ratio float64) *tracer {
+	return &tracer{
+		url:   url,
+		ratio: ratio,
+		spans: make(chan otlpSpan, TRACE_BUFFER),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// startTracing starts exporting spans to --otlp-endpoint, if it's set
+func startTracing() {
+	if cfg.OtlpEndpoint == "" {
+		return
+	}
+	tracing = newTracer(cfg.OtlpEndpoint+"/v1/traces", cfg.TraceSampleRatio)
+	go tracing.run(TRACE_EXPORT_INTERVAL)
+	log.Infof("Sending traces of [%v] of polls to [%v]", cfg.TraceSampleRatio, cfg.OtlpEndpoint)
+}
+
+// export queues a finished span, dropping it if the exporter is that far behind
+func (t *tracer) export(s otlpSpan) {
+	select {
+	case t.spans <- s:
+	default:
+		n := atomic.AddInt64(&t.dropped, 1)
+		metricsSink.IncrCounter(metricKey("trace_spans_dropped"), 1.0)
+		log.Debugf("Dropped span [%v], the buffer is full ([%v] dropped so far)", s.Name, n)
+	}
+}
+
+// send posts a batch of spans to the collector
+func (t *tracer) send(batch []otlpSpan) error {
+	b, err := json.Marshal(otlpExport{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{attribute("service.name", APP_NAME), attribute("service.version", APP_VERSION)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: APP_NAME, Version: APP_VERSION}, Spans: batch}},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", t.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%v: %s", resp.Status, snippet)
+	}
+	return nil
+}
+
+func (t *tracer) flush(batch []otlpSpan) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := t.send(batch); err != nil {
+		metricsSink.IncrCounter(metricKey("trace_export_errors"), 1.0)
+		log.Errorf("Unable to export [%v] spans to [%v]: %v", len(batch), t.url, err)
+	}
+}
+
+// run exports the queued spans in batches, every interval or whenever a batch is full
+func (t *tracer) run(interval time.Duration) {
+	defer close(t.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var batch []otlpSpan
+	for {
+		select {
+		case s := <-t.spans:
+			if batch = append(batch, s); len(batch) < TRACE_BATCH_SIZE {
+				continue
+			}
+		case <-ticker.C:
+		case <-t.stop:
+			// Export whatever is still queued
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					t.flush(batch)
+					return
+				}
+			}
+		}
+		t.flush(batch)
+		batch = nil
+	}
+}
+
+// close exports the queued spans, waiting at most the given time
+func (t *tracer) close(wait time.Duration) {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	select {
+	case <-t.done:
+	case <-time.After(wait):
+		log.Warningf("Trace exporter still sending after [%v], not waiting for it", wait)
+	}
+}
+
+// tracingTransport adds a client span for every request made under a recorded trace, and passes the trace on in
+// a traceparent header
+type tracingTransport struct {
+	// Names the spans, e.g. "presto GET"
+	name string
+	base http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, s := startSpan(req.Context(), t.name+" "+req.Method)
+	if s == nil {
+		return t.base.RoundTrip(req)
+	}
+	defer s.end()
+	s.kind = SPAN_KIND_CLIENT
+	s.setAttribute("http.method", req.Method)
+	s.setAttribute("http.url", req.URL.Scheme+"://"+req.URL.Host+req.URL.Path)
+
+	// A RoundTripper mustn't change the request it's given
+	traced := req.WithContext(ctx)
+	traced.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		traced.Header[k] = v
+	}
+	traced.Header.Set("traceparent", s.traceparent())
+	resp, err := t.base.RoundTrip(traced)
+	if err != nil {
+		s.setError(err)
+		return nil, err
+	}
+	s.setAttribute("http.status_code", resp.StatusCode)
+	if resp.StatusCode >= 400 {
+		s.setError(errors.New(resp.Status))
+	}
+	return resp, nil
+}
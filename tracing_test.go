@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thecubed/prestowatcher/prestoclient"
+)
+
+// traceCollector is an OTLP/HTTP endpoint that keeps the spans it's sent
+type traceCollector struct {
+	sync.Mutex
+	spans  []otlpSpan
+	server *httptest.Server
+}
+
+func newTraceCollector() *traceCollector {
+	tc := &traceCollector{}
+	tc.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var export otlpExport
+		if r.URL.Path != "/v1/traces" || json.NewDecoder(r.Body).Decode(&export) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		tc.Lock()
+		defer tc.Unlock()
+		for _, rs := range export.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				tc.spans = append(tc.spans, ss.Spans...)
+			}
+		}
+	}))
+	return tc
+}
+
+// start traces to the collector, stop exports what's queued and turns tracing off again
+func (tc *traceCollector) start(ratio float64) (stop func()) {
+	tracing = newTracer(tc.server.URL+"/v1/traces", ratio)
+	go tracing.run(time.Hour)
+	return func() {
+		tracing.close(5 * time.Second)
+		tracing = nil
+	}
+}
+
+func (tc *traceCollector) named(name string) []otlpSpan {
+	tc.Lock()
+	defer tc.Unlock()
+	var named []otlpSpan
+	for _, s := range tc.spans {
+		if s.Name == name {
+			named = append(named, s)
+		}
+	}
+	return named
+}
+
+// spanAttribute is the value of a span's attribute as it was sent, nil if it's missing
+func spanAttribute(s otlpSpan, key string) interface{} {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			for _, v := range a.Value {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+func TestTracePoll(t *testing.T) {
+	defer setupTest()()
+	collector := newTraceCollector()
+	defer collector.server.Close()
+	stop := collector.start(1)
+	c, _ := testCluster(newFakePresto(
+		testQuery("q1", "alice", "SELECT * FROM events.clicks", 45),
+		testQuery("q2", "bob", "SELECT * FROM events.clicks", 3),
+	))
+	if !doCollect(c) {
+		t.Fatal("the poll failed")
+	}
+	stop()
+
+	polls := collector.named("poll")
+	if len(polls) != 1 || polls[0].ParentSpanID != "" || polls[0].Status != nil {
+		t.Fatalf("got poll spans %+v, want one root", polls)
+	}
+	poll := polls[0]
+	if got := spanAttribute(poll, "queries.running"); got != "2" {
+		t.Errorf("got queries.running %v", got)
+	}
+	checks := make(map[string]otlpSpan)
+	for _, s := range collector.named("check query") {
+		if s.TraceID != poll.TraceID || s.ParentSpanID != poll.SpanID {
+			t.Errorf("check span %+v isn't under the poll", s)
+		}
+		checks[spanAttribute(s, "query.id").(string)] = s
+	}
+	for _, tc := range []struct {
+		id         string
+		user       string
+		partitions string
+		alerted    bool
+	}{
+		{"q1", "alice", "45", true},
+		{"q2", "bob", "3", false},
+	} {
+		s, ok := checks[tc.id]
+		if !ok {
+			t.Errorf("no check span for %v", tc.id)
+			continue
+		}
+		if spanAttribute(s, "user") != tc.user || spanAttribute(s, "partitions") != tc.partitions || spanAttribute(s, "alerted") != tc.alerted {
+			t.Errorf("%v: got attributes %+v", tc.id, s.Attributes)
+		}
+	}
+	notifies := collector.named("notify")
+	if len(notifies) != 1 || notifies[0].ParentSpanID != checks["q1"].SpanID || spanAttribute(notifies[0], "notifier") != "recording" {
+		t.Errorf("got notify spans %+v, want one under q1's check", notifies)
+	}
+}
+
+func TestTracingTransport(t *testing.T) {
+	defer setupTest()()
+	var traceparent string
+	presto := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.Write([]byte(`{"queryId":"q1","state":"RUNNING"}`))
+	}))
+	defer presto.Close()
+	client := prestoclient.New(presto.URL, &http.Client{Transport: &tracingTransport{name: "presto", base: http.DefaultTransport}})
+
+	// Tracing is off
+	if _, err := client.GetQuery(context.Background(), "q1"); err != nil {
+		t.Fatal(err)
+	}
+	if traceparent != "" {
+		t.Errorf("got traceparent %v without tracing", traceparent)
+	}
+
+	collector := newTraceCollector()
+	defer collector.server.Close()
+	stop := collector.start(1)
+	ctx, root := startSpan(context.Background(), "poll")
+	if _, err := client.GetQuery(ctx, "q1"); err != nil {
+		t.Fatal(err)
+	}
+	root.end()
+	stop()
+
+	requests := collector.named("presto GET")
+	if len(requests) != 1 {
+		t.Fatalf("got request spans %+v", requests)
+	}
+	s := requests[0]
+	if s.Kind != SPAN_KIND_CLIENT || s.ParentSpanID != collector.named("poll")[0].SpanID || spanAttribute(s, "http.status_code") != "200" || spanAttribute(s, "http.url") != presto.URL+"/v1/query/q1" {
+		t.Errorf("unexpected request span %+v", s)
+	}
+	if want := "00-" + s.TraceID + "-" + s.SpanID + "-01"; traceparent != want {
+		t.Errorf("got traceparent %v, want %v", traceparent, want)
+	}
+}
+
+func TestTraceSampling(t *testing.T) {
+	defer setupTest()()
+	collector := newTraceCollector()
+	defer collector.server.Close()
+	stop := collector.start(0)
+
+	ctx, root := startSpan(context.Background(), "poll")
+	if root != nil {
+		t.Fatal("a trace was recorded with a sample ratio of 0")
+	}
+	// Calling a nil span is fine
+	root.setAttribute("cluster", "default")
+	root.end()
+
+	// Whether a trace is recorded is decided once, at its root
+	tracing.ratio = 1
+	if _, child := startSpan(ctx, "check query"); child != nil {
+		t.Error("a span under a trace that wasn't sampled was recorded")
+	}
+	_, sampled := startSpan(context.Background(), "poll")
+	if sampled == nil {
+		t.Fatal("a trace wasn't recorded with a sample ratio of 1")
+	}
+	sampled.end()
+	stop()
+	if len(collector.spans) != 1 {
+		t.Errorf("got spans %+v, want only the sampled root", collector.spans)
+	}
+}
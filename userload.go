@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ashwanthkumar/slack-go-webhook"
+)
+
+/*
+	A user's combined load. Fifteen medium queries fired at once hurt the cluster as much as one huge one, and
+	never trip the per-query limits. After every poll the RUNNING queries are added up per session user, and a
+	user whose queries together scan more than --max-user-partitions or --max-user-bytes-scanned, or who runs
+	more than --max-user-queries at once, gets a single alert listing them.
+
+	Partition counts are the ones from each query's last check, so they lag by up to --recheck-interval. The
+	same user is alerted on at most once per --user-alert-cooldown while their batch runs. Only Slack gets these
+	alerts, the other notifiers are about single queries.
+*/
+
+// One of the queries in a user load alert
+type userQuery struct {
+	QueryID      string
+	Partitions   int
+	ScannedBytes int64
+}
+
+// userLoadEnabled tells whether any of the per-user limits is set
+func userLoadEnabled() bool {
+	return cfg.MaxUserPartitions > 0 || cfg.MaxUserQueries > 0 || cfg.MaxUserBytes > 0
+}
+
+// checkUserLoad alerts on the users whose RUNNING queries are over the per-user limits together
+func checkUserLoad(ctx context.Context, c *cluster, queries []PrestoQuery, now time.Time) {
+	if !userLoadEnabled() {
+		return
+	}
+	for user, at := range c.userAlertedAt {
+		if now.Sub(at) >= cfg.UserAlertCooldown.Duration {
+			delete(c.userAlertedAt, user)
+		}
+	}
+
+	byUser := make(map[string][]userQuery)
+	largest := make(map[string]PrestoQuery)
+	for _, query := range queries {
+		user := query.Session.User
+		if query.State != "RUNNING" || !userAlertable(user) || !sourceAlertable(query.Session.Source) {
+			continue
+		}
+		q := userQuery{QueryID: query.QueryID}
+		if entry, found := c.cache.Get(query.QueryID); found {
+			for _, p := range entry.Partitions {
+				q.Partitions += p
+			}
+		}
+		q.ScannedBytes, _ = queryResources(query)
+		if len(byUser[user]) == 0 || q.Partitions > largestPartitions(byUser[user]) {
+			largest[user] = query
+		}
+		byUser[user] = append(byUser[user], q)
+	}
+
+	for user, list := range byUser {
+		if _, cooling := c.userAlertedAt[user]; cooling {
+			continue
+		}
+		var partitions int
+		var scanned int64
+		for _, q := range list {
+			partitions += q.Partitions
+			scanned += q.ScannedBytes
+		}
+		breaches := userBreaches(len(list), partitions, scanned)
+		if len(breaches) == 0 {
+			continue
+		}
+
+		c.userAlertedAt[user] = now
+		sort.Slice(list, func(i, j int) bool { return list[i].Partitions > list[j].Partitions })
+		log.Warningf("%vUser [%v] is over the per-user limits with [%v] running queries: %v", c.prefix(), user, len(list), breachText(breaches))
+		c.metrics.IncrCounter(metricKey("user_load_alerts"), 1.0)
+		notify(ctx, Alert{Cluster: c, Query: largest[user], UserQueries: list, TotalPartitions: partitions, ScannedBytes: scanned, Breaches: breaches})
+	}
+}
+
+func largestPartitions(list []userQuery) int {
+	max := 0
+	for _, q := range list {
+		if q.Partitions > max {
+			max = q.Partitions
+		}
+	}
+	return max
+}
+
+// userBreaches describes the per-user limits a user's running queries are over together
+func userBreaches(running int, partitions int, scanned int64) []string {
+	var breaches []string
+	if cfg.MaxUserQueries > 0 && running > cfg.MaxUserQueries {
+		breaches = append(breaches, fmt.Sprintf("they have %v queries running, over the limit of %v", running, cfg.MaxUserQueries))
+	}
+	if cfg.MaxUserPartitions > 0 && partitions > cfg.MaxUserPartitions {
+		breaches = append(breaches, fmt.Sprintf("their queries are searching %v partitions together, over the limit of %v", partitions, cfg.MaxUserPartitions))
+	}
+	if cfg.MaxUserBytes > 0 && scanned > cfg.MaxUserBytes {
+		breaches = append(breaches, fmt.Sprintf("their queries have scanned %v together, over the limit of %v", formatBytes(scanned), formatBytes(cfg.MaxUserBytes)))
+	}
+	return breaches
+}
+
+// userLoadPayload tells the channel about a user whose queries are too much together
+func userLoadPayload(alert Alert) slack.Payload {
+	user := alert.Query.Session.User
+	if mapping, ok := users.lookup(user); ok {
+		user = fmt.Sprintf("<@%v>", mapping.SlackID)
+	}
+	var lines []string
+	for _, q := range alert.UserQueries {
+		line := fmt.Sprintf("• <%v|%v>: %v partitions", primaryQueryURL(alert.Cluster, q.QueryID), q.QueryID, q.Partitions)
+		if q.ScannedBytes > 0 {
+			line += ", " + formatBytes(q.ScannedBytes) + " scanned"
+		}
+		lines = append(lines, line)
+	}
+	return slack.Payload{
+		Text: fmt.Sprintf(":busts_in_silhouette: %v has *%v Presto queries running* that are too much for the cluster together, because %v. "+
+			"Consider running them one after the other.\n", user, len(alert.UserQueries), breachText(alert.Breaches)) +
+			strings.Join(lines, "\n"),
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+	Maps Presto session users (and Mode usernames) to Slack users so alerts can @mention whoever ran the query,
+	e.g.
+
+		users:
+		  alice:
+		    slack_id: U12345
+		  bob:
+		    slack_id: U67890
+		    dm_channel: "@bob"
+		  etl:
+		    slack_id: U24680
+		    dm_webhook: https://hooks.slack.com/services/...
+
+	Usernames are matched case-insensitively. dm_webhook or dm_channel also send a copy of the alert there.
+	The file is re-read on SIGHUP and whenever it changes.
+*/
+
+type UserMapping struct {
+	SlackID string `yaml:"slack_id" json:"slack_id"`
+	// Channel override to send a copy of the alert to through the main Slack webhook, e.g. @bob
+	DMChannel string `yaml:"dm_channel" json:"dm_channel"`
+	// Separate webhook to send a copy of the alert to
+	DMWebhook string `yaml:"dm_webhook" json:"dm_webhook"`
+}
+
+type UserMapFile struct {
+	Users map[string]UserMapping `yaml:"users" json:"users"`
+}
+
+type userMap struct {
+	sync.RWMutex
+	path    string
+	modTime time.Time
+	users   map[string]UserMapping
+}
+
+var users = &userMap{}
+
+func parseUserMap(data []byte) (map[string]UserMapping, error) {
+	var f UserMapFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	parsed := make(map[string]UserMapping)
+	for name, m := range f.Users {
+		if m.SlackID == "" {
+			return nil, fmt.Errorf("user '%v' has no slack_id", name)
+		}
+		parsed[strings.ToLower(name)] = m
+	}
+	return parsed, nil
+}
+
+// load (re)reads the user map file. On error the previous map stays in effect.
+func (um *userMap) load() error {
+	stat, err := os.Stat(um.path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(um.path)
+	if err != nil {
+		return err
+	}
+	parsed, err := parseUserMap(data)
+	if err != nil {
+		return err
+	}
+
+	um.Lock()
+	defer um.Unlock()
+	um.users = parsed
+	um.modTime = stat.ModTime()
+	log.Infof("Loaded [%v] Slack user mappings from [%v]", len(parsed), um.path)
+	return nil
+}
+
+// reloadIfChanged re-reads the user map file if its modification time changed
+func (um *userMap) reloadIfChanged() {
+	stat, err := os.Stat(um.path)
+	if err != nil {
+		log.Errorf("Unable to check user map file [%v]: %v", um.path, err)
+		return
+	}
+	um.RLock()
+	changed := !stat.ModTime().Equal(um.modTime)
+	um.RUnlock()
+	if changed {
+		if err := um.load(); err != nil {
+			log.Errorf("Unable to reload user map file [%v], keeping the previous map: %v", um.path, err)
+		}
+	}
+}
+
+// lookup returns the mapping for the first of names that has one
+func (um *userMap) lookup(names ...string) (UserMapping, bool) {
+	um.RLock()
+	defer um.RUnlock()
+	for _, name := range names {
+		if m, ok := um.users[strings.ToLower(name)]; ok && name != "" {
+			return m, true
+		}
+	}
+	return UserMapping{}, false
+}
+
+// hasDMWebhook tells whether url is the dm_webhook of a mapped user
+func (um *userMap) hasDMWebhook(url string) bool {
+	um.RLock()
+	defer um.RUnlock()
+	for _, m := range um.users {
+		if m.DMWebhook != "" && m.DMWebhook == url {
+			return true
+		}
+	}
+	return false
+}
+
+// startUserMap loads the user map file, if any, and reloads it on SIGHUP or when it changes on disk
+func startUserMap(reloadInterval time.Duration) {
+	if cfg.UserMapFile == "" {
+		return
+	}
+	users.path = cfg.UserMapFile
+	if err := users.load(); err != nil {
+		log.Fatalf("Unable to load user map file [%v]: %v", cfg.UserMapFile, err)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(reloadInterval)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				log.Info("Received SIGHUP, reloading user map")
+				if err := users.load(); err != nil {
+					log.Errorf("Unable to reload user map file [%v], keeping the previous map: %v", users.path, err)
+				}
+			case <-ticker.C:
+				users.reloadIfChanged()
+			}
+		}
+	}()
+}